@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/api"
+)
+
+const ctlUsage = `Usage: p-torrent ctl [--url <url>] [--token <token>] <command>
+
+Commands:
+  list                             list the torrents
+  info <hash>                      show a torrent
+  add [--paused] <torrent>...      add .torrent files
+  pause|resume|recheck <hash>      control a torrent
+  remove [--delete] <hash>         remove a torrent, with --delete its data too
+  files <hash>                     list the files of a torrent
+  priority <hash> <index> <prio>   set a file priority (skip, low, normal, high)
+  limit [<hash>] <down> <up>       set the global or torrent rates in bytes/s
+  peers <hash>                     list the connected peers
+  trackers <hash>                  list the trackers
+  stats                            show session statistics
+
+Torrents are given by their info hash or a unique prefix of it.`
+
+// runCtl controls a running p-torrent over its API.
+func runCtl(args []string, config *Config) error {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, ctlUsage) }
+	base_url := flags.String("url", "http://"+config.APIAddress, "address of the API")
+	token := flags.String("token", config.APIToken, "API token, also read from P_TORRENT_TOKEN")
+	flags.Parse(args)
+
+	if env_token := os.Getenv("P_TORRENT_TOKEN"); *token == "" {
+		*token = env_token
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return nil
+	}
+
+	c := api.NewClient(*base_url, *token)
+	command, args := flags.Arg(0), flags.Args()[1:]
+
+	need := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s needs %d arguments, see p-torrent ctl --help", command, n)
+		}
+		return nil
+	}
+
+	switch command {
+	case "list":
+		torrents, err := c.Torrents()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-12s %-11s %7s %14s %5s  %s\n", "HASH", "STATE", "DONE", "SIZE", "PEERS", "NAME")
+		for _, t := range torrents {
+			fmt.Printf("%-12s %-11s %6.1f%% %14d %5d  %s\n", t.InfoHash[:12], t.State, t.Progress*100, t.Wanted, t.Peers, t.Name)
+		}
+
+	case "info":
+		if err := need(1); err != nil {
+			return err
+		}
+		t, err := c.Torrent(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Name:       %s\n", t.Name)
+		fmt.Printf("Info hash:  %s\n", t.InfoHash)
+		fmt.Printf("State:      %s\n", t.State)
+		fmt.Printf("Progress:   %.1f%% (%d of %d bytes, %d in total)\n", t.Progress*100, t.Done, t.Wanted, t.Size)
+		fmt.Printf("Downloaded: %d\n", t.Downloaded)
+		fmt.Printf("Uploaded:   %d\n", t.Uploaded)
+		fmt.Printf("Peers:      %d\n", t.Peers)
+		fmt.Printf("Directory:  %s\n", t.Dir)
+		fmt.Printf("Rates:      %d down, %d up\n", t.Rates.Download, t.Rates.Upload)
+		fmt.Printf("Speed:      %.0f down, %.0f up\n", t.DownloadRate, t.UploadRate)
+
+	case "add":
+		add_flags := flag.NewFlagSet("add", flag.ExitOnError)
+		paused := add_flags.Bool("paused", false, "add without starting")
+		add_flags.Parse(args)
+
+		for _, name := range add_flags.Args() {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return fmt.Errorf("failed to add %s: %s", name, err)
+			}
+			t, err := c.Add(data, *paused)
+			if err != nil {
+				return fmt.Errorf("failed to add %s: %s", name, err)
+			}
+			fmt.Printf("Added %s %s\n", t.InfoHash[:12], t.Name)
+		}
+
+	case "pause", "resume", "recheck":
+		if err := need(1); err != nil {
+			return err
+		}
+		control := map[string]func(string) error{"pause": c.Pause, "resume": c.Resume, "recheck": c.Recheck}
+		return control[command](args[0])
+
+	case "remove":
+		remove_flags := flag.NewFlagSet("remove", flag.ExitOnError)
+		delete_data := remove_flags.Bool("delete", false, "delete the downloaded data")
+		remove_flags.Parse(args)
+		if remove_flags.NArg() != 1 {
+			return fmt.Errorf("remove needs 1 argument")
+		}
+		return c.Remove(remove_flags.Arg(0), *delete_data)
+
+	case "files":
+		if err := need(1); err != nil {
+			return err
+		}
+		files, err := c.Files(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%5s %-8s %7s %14s  %s\n", "INDEX", "PRIORITY", "DONE", "SIZE", "PATH")
+		for _, f := range files {
+			done := 100.0
+			if f.Length > 0 {
+				done = float64(f.Done) * 100 / float64(f.Length)
+			}
+			fmt.Printf("%5d %-8s %6.1f%% %14d  %s\n", f.Index, f.Priority, done, f.Length, f.Path)
+		}
+
+	case "priority":
+		if err := need(3); err != nil {
+			return err
+		}
+		index, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid file index %q", args[1])
+		}
+		return c.SetFilePriority(args[0], index, args[2])
+
+	case "limit":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf("limit needs 2 or 3 arguments")
+		}
+		download, err := strconv.Atoi(args[len(args)-2])
+		if err != nil {
+			return fmt.Errorf("invalid rate %q", args[len(args)-2])
+		}
+		upload, err := strconv.Atoi(args[len(args)-1])
+		if err != nil {
+			return fmt.Errorf("invalid rate %q", args[len(args)-1])
+		}
+
+		rates := api.Rates{Download: download, Upload: upload}
+		if len(args) == 2 {
+			return c.SetGlobalRates(rates)
+		}
+		return c.SetRates(args[0], rates)
+
+	case "peers":
+		if err := need(1); err != nil {
+			return err
+		}
+		peers, err := c.Peers(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-40s %-6s %10s %10s  %s\n", "ADDRESS", "FLAGS", "DOWN", "UP", "CLIENT")
+		for _, p := range peers {
+			fmt.Printf("%-40s %-6s %10.0f %10.0f  %s\n", p.Address, peerFlags(p), p.DownloadRate, p.UploadRate, p.Client)
+		}
+
+	case "trackers":
+		if err := need(1); err != nil {
+			return err
+		}
+		trackers, err := c.Trackers(args[0])
+		if err != nil {
+			return err
+		}
+		for _, tracker := range trackers {
+			fmt.Printf("%4d  %s\n", tracker.Tier, tracker.URL)
+		}
+
+	case "stats":
+		stats, err := c.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Torrents:   %d\n", stats.Torrents)
+		states := []string{}
+		for state := range stats.States {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		for _, state := range states {
+			fmt.Printf("  %-10s %d\n", state+":", stats.States[state])
+		}
+		fmt.Printf("Peers:      %d\n", stats.Peers)
+		fmt.Printf("Downloaded: %d\n", stats.Downloaded)
+		fmt.Printf("Uploaded:   %d\n", stats.Uploaded)
+		fmt.Printf("Rates:      %d down, %d up\n", stats.Rates.Download, stats.Rates.Upload)
+		fmt.Printf("Speed:      %.0f down, %.0f up\n", stats.DownloadRate, stats.UploadRate)
+
+	default:
+		return fmt.Errorf("unknown command %q, see p-torrent ctl --help", command)
+	}
+	return nil
+}
+
+// peerFlags abbreviates the state of a peer: I incoming, E encrypted, U uTP,
+// C choked by the peer, i interested in our pieces.
+func peerFlags(p api.Peer) string {
+	flags := ""
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{{p.Incoming, "I"}, {p.Encrypted, "E"}, {p.UTP, "U"}, {p.Choked, "C"}, {p.Interested, "i"}} {
+		if f.set {
+			flags += f.name
+		}
+	}
+	return flags
+}
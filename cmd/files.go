@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/rs/zerolog"
+)
+
+// runFiles lists the files of a torrent with the indices --files accepts.
+func runFiles(file_name string, logger *zerolog.Logger) {
+	torrent_file, err := torrent.NewTorrent(file_name)
+	if err != nil {
+		logger.Error().Msgf("Failed to create a torrent with error: %s", err)
+		return
+	}
+
+	fmt.Printf("%s\n\n", torrent_file.Info.Name)
+	fmt.Printf("%5s %14s  %s\n", "INDEX", "SIZE", "PATH")
+	for i, file := range torrent_file.Files() {
+		fmt.Printf("%5d %14d  %s\n", i, file.Length, strings.Join(file.Path, "/"))
+	}
+}
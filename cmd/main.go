@@ -1,21 +1,82 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/DarkPhoenix42/p-torrent/pkg/api"
 	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/connmgr"
+	"github.com/DarkPhoenix42/p-torrent/pkg/dht"
+	"github.com/DarkPhoenix42/p-torrent/pkg/lsd"
+	"github.com/DarkPhoenix42/p-torrent/pkg/mse"
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/schedule"
 	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/DarkPhoenix42/p-torrent/pkg/transmission"
+	"github.com/DarkPhoenix42/p-torrent/pkg/tui"
+	"github.com/DarkPhoenix42/p-torrent/pkg/webui"
 	"github.com/rs/zerolog"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	LogLevel string `yaml:"log_level"`
-	MaxPeers int    `yaml:"max_peers"`
+	LogLevel           string `yaml:"log_level"`
+	MaxPeers           int    `yaml:"max_peers"`
+	MaxPeersPerTorrent int    `yaml:"max_peers_per_torrent"`
+	MaxHalfOpen        int    `yaml:"max_half_open"`
+	AnnounceToAllTiers bool   `yaml:"announce_to_all_tiers"`
+	ListenPort         int    `yaml:"listen_port"`
+	UTPEnabled         bool   `yaml:"utp_enabled"`
+
+	DHTEnabled        bool     `yaml:"dht_enabled"`
+	DHTPort           int      `yaml:"dht_port"`
+	DHTBootstrapNodes []string `yaml:"dht_bootstrap_nodes"`
+	DHTStateFile      string   `yaml:"dht_state_file"`
+
+	LSDEnabled bool `yaml:"lsd_enabled"`
+
+	Encryption string `yaml:"encryption"`
+
+	DownloadRate        int `yaml:"download_rate"`
+	UploadRate          int `yaml:"upload_rate"`
+	TorrentDownloadRate int `yaml:"torrent_download_rate"`
+	TorrentUploadRate   int `yaml:"torrent_upload_rate"`
+	PeerDownloadRate    int `yaml:"peer_download_rate"`
+	PeerUploadRate      int `yaml:"peer_upload_rate"`
+
+	Sequential    bool   `yaml:"sequential"`
+	Readahead     int    `yaml:"readahead"`
+	StreamAddress string `yaml:"stream_address"`
+
+	DownloadDir string `yaml:"download_dir"`
+	StateDir    string `yaml:"state_dir"`
+
+	APIAddress string `yaml:"api_address"`
+	APIToken   string `yaml:"api_token"`
+	WebUI      bool   `yaml:"web_ui"`
+
+	RPCAddress  string `yaml:"rpc_address"`
+	RPCUsername string `yaml:"rpc_username"`
+	RPCPassword string `yaml:"rpc_password"`
+
+	MetricsAddress string `yaml:"metrics_address"`
+
+	UploadSlots    int                   `yaml:"upload_slots"`
+	ActiveTorrents int                   `yaml:"active_torrents"`
+	ActiveSeeds    int                   `yaml:"active_seeds"`
+	Schedule       []schedule.RuleConfig `yaml:"schedule"`
 }
 
+const configFile = "../config.yaml"
+
 func loadConfig(filename string) (*Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -32,7 +93,7 @@ func loadConfig(filename string) (*Config, error) {
 }
 
 func main() {
-	config, err := loadConfig("../config.yaml")
+	config, err := loadConfig(configFile)
 
 	if err != nil {
 		fmt.Println("Config file not found!")
@@ -49,14 +110,298 @@ func main() {
 		zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.DateTime},
 	).Level(log_level).With().Timestamp().Caller().Logger()
 
-	file_name := os.Args[1]
-	torrent_file, err := torrent.NewTorrent(file_name)
+	if len(os.Args) < 2 && config.StateDir == "" {
+		fmt.Println("Usage: p-torrent [--files <selection>] [--sequential] [--daemon] [--tui] <torrent>... | p-torrent scrape <torrent> | p-torrent files <torrent> | p-torrent ctl <command>")
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		err := runCtl(os.Args[2:], config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "scrape" {
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: p-torrent scrape <torrent>")
+			return
+		}
+		runScrape(os.Args[2], &logger)
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "files" {
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: p-torrent files <torrent>")
+			return
+		}
+		runFiles(os.Args[2], &logger)
+		return
+	}
+
+	flags := flag.NewFlagSet("p-torrent", flag.ExitOnError)
+	selection := flags.String("files", "", "download only these files, by index or glob, comma separated (e.g. 0,2,*.mkv)")
+	sequential := flags.Bool("sequential", false, "download pieces in order, for watching while downloading")
+	daemon := flags.Bool("daemon", false, "keep running until interrupted, to be controlled over the API")
+	tui_mode := flags.Bool("tui", false, "show an interactive terminal UI, or a plain progress line if the output is not a terminal")
+	flags.Parse(os.Args[1:])
+	if flags.NArg() < 1 && config.StateDir == "" && !*daemon {
+		fmt.Println("Usage: p-torrent [--files <selection>] [--sequential] [--daemon] [--tui] <torrent>...")
+		return
+	}
+	if *selection != "" && flags.NArg() > 1 {
+		fmt.Println("--files needs exactly one torrent")
+		return
+	}
 
+	// The UI owns stdout, so logs and peer diagnostics have to go elsewhere.
+	var log_buffer *tui.LogBuffer
+	if *tui_mode {
+		peer.Output = os.Stderr
+		if tui.IsTerminal() {
+			log_buffer = tui.NewLogBuffer(tui.LogLines)
+			logger = logger.Output(zerolog.ConsoleWriter{Out: log_buffer, NoColor: true, TimeFormat: time.TimeOnly})
+			peer.Output = log_buffer
+		}
+	}
+
+	session := client.NewSession(&logger)
+	session.AnnounceToAllTiers = config.AnnounceToAllTiers
+	session.UTPEnabled = config.UTPEnabled
+	session.Connections = connmgr.NewLimits(config.MaxPeers, config.MaxHalfOpen)
+	session.GlobalRates.SetRates(config.DownloadRate, config.UploadRate)
+	session.SetUploadSlots(config.UploadSlots)
+	session.SetActiveSeeds(config.ActiveSeeds)
+	if config.DownloadDir != "" {
+		session.DownloadDir = config.DownloadDir
+	}
+
+	session.Encryption, err = mse.ParseMode(config.Encryption)
 	if err != nil {
-		logger.Error().Msgf("Failed to create a torrent with error: %s", err)
+		logger.Error().Msgf("Invalid config: %s", err)
 		return
 	}
+	if config.ListenPort != 0 {
+		session.Port = config.ListenPort
+	}
 
-	torrent_client := client.NewClient(torrent_file, &logger)
-	torrent_client.StartDownload()
-}
\ No newline at end of file
+	if config.DHTEnabled {
+		node, err := dht.New(dht.Config{
+			Address:        ":" + strconv.Itoa(config.DHTPort),
+			BootstrapNodes: config.DHTBootstrapNodes,
+			StateFile:      config.DHTStateFile,
+			Logger:         &logger,
+		})
+		if err != nil {
+			logger.Error().Msgf("Failed to start the DHT: %s", err)
+		} else {
+			node.Start()
+			defer node.Close()
+			session.DHT = node
+		}
+	}
+
+	if config.LSDEnabled {
+		service := lsd.New(session.Port, &logger)
+		err := service.Listen()
+		if err != nil {
+			logger.Warn().Msgf("Local service discovery disabled: %s", err)
+		} else {
+			service.Start()
+			defer service.Close()
+			session.LSD = service
+		}
+	}
+
+	err = session.Listen()
+	if err != nil {
+		logger.Warn().Msgf("Incoming connections disabled: %s", err)
+	}
+	defer session.Close()
+
+	scheduler, err := startScheduler(config, session, &logger)
+	if err != nil {
+		logger.Error().Msgf("Invalid config: %s", err)
+		return
+	}
+	defer scheduler.Close()
+
+	if config.StateDir != "" {
+		session.StateDir = config.StateDir
+		err = session.Load()
+		if err != nil {
+			logger.Error().Msgf("Failed to load the saved torrents: %s", err)
+		}
+		for _, torrent_client := range session.Torrents() {
+			configureTorrent(torrent_client, config)
+		}
+	}
+
+	for _, file_name := range flags.Args() {
+		torrent_file, err := torrent.NewTorrent(file_name)
+		if err != nil {
+			logger.Error().Msgf("Failed to create a torrent from %s with error: %s", file_name, err)
+			continue
+		}
+
+		torrent_client := session.Get(torrent_file.InfoHash)
+		if torrent_client != nil {
+			logger.Info().Msgf("%s was restored from the saved session", file_name)
+			if *selection == "" {
+				session.Resume(torrent_file.InfoHash)
+				continue
+			}
+			// Pause it while the selection changes.
+			session.Pause(torrent_file.InfoHash)
+		} else {
+			torrent_client, err = session.Add(torrent_file, true)
+			if err != nil {
+				logger.Error().Msgf("Failed to add %s: %s", file_name, err)
+				continue
+			}
+			configureTorrent(torrent_client, config)
+			torrent_client.SetSequential(config.Sequential || *sequential)
+		}
+
+		if *selection != "" {
+			err = torrent_client.SelectFiles(*selection)
+			if err != nil {
+				logger.Error().Msgf("Invalid file selection: %s", err)
+				return
+			}
+		}
+		session.Resume(torrent_file.InfoHash)
+	}
+
+	if config.StreamAddress != "" {
+		listener, err := net.Listen("tcp", config.StreamAddress)
+		if err != nil {
+			logger.Error().Msgf("Failed to start the stream server: %s", err)
+		} else {
+			logger.Info().Msgf("Streaming files on http://%s/", listener.Addr())
+			go http.Serve(listener, session.Handler())
+			defer listener.Close()
+		}
+	}
+
+	if config.APIAddress != "" {
+		err := startAPI(config, session, &logger)
+		if err != nil {
+			logger.Error().Msgf("Failed to start the API: %s", err)
+			return
+		}
+	}
+
+	if config.RPCAddress != "" {
+		err := startRPC(config, session, &logger)
+		if err != nil {
+			logger.Error().Msgf("Failed to start Transmission RPC: %s", err)
+			return
+		}
+	}
+
+	if config.MetricsAddress != "" {
+		listener, err := net.Listen("tcp", config.MetricsAddress)
+		if err != nil {
+			logger.Error().Msgf("Failed to start the metrics server: %s", err)
+		} else {
+			logger.Info().Msgf("Serving metrics on http://%s/metrics", listener.Addr())
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", session.MetricsHandler())
+			go http.Serve(listener, mux)
+			defer listener.Close()
+		}
+	}
+
+	// Closing the session on a signal saves the torrents before exiting.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	shutdown := make(chan struct{})
+	go func() {
+		<-signals
+		logger.Info().Msg("Shutting down")
+		session.Close()
+		close(shutdown)
+	}()
+
+	finished := make(chan struct{})
+	go func() {
+		if *daemon {
+			<-shutdown
+		} else {
+			session.Wait()
+		}
+		close(finished)
+	}()
+
+	if *tui_mode {
+		tui.New(session, log_buffer).Run(finished)
+	} else {
+		<-finished
+	}
+}
+
+// startAPI serves the control API, which needs a token, and the web
+// interface on top of it.
+func startAPI(config *Config, session *client.Session, logger *zerolog.Logger) error {
+	if config.APIToken == "" {
+		return fmt.Errorf("api_token must be set")
+	}
+
+	listener, err := net.Listen("tcp", config.APIAddress)
+	if err != nil {
+		return err
+	}
+
+	server := api.NewServer(session, config.APIToken, logger)
+	server.Configure = func(torrent_client *client.Client) {
+		configureTorrent(torrent_client, config)
+		torrent_client.SetSequential(config.Sequential)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", server.Handler())
+	if config.WebUI {
+		mux.Handle("/", webui.Handler())
+		logger.Info().Msgf("Serving the web interface on http://%s/", listener.Addr())
+	}
+
+	logger.Info().Msgf("Serving the API on http://%s/api/", listener.Addr())
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// startRPC serves the Transmission RPC protocol for existing tools.
+func startRPC(config *Config, session *client.Session, logger *zerolog.Logger) error {
+	listener, err := net.Listen("tcp", config.RPCAddress)
+	if err != nil {
+		return err
+	}
+
+	server := transmission.NewServer(session, logger)
+	server.Username = config.RPCUsername
+	server.Password = config.RPCPassword
+	server.Configure = func(torrent_client *client.Client) {
+		configureTorrent(torrent_client, config)
+		torrent_client.SetSequential(config.Sequential)
+	}
+
+	logger.Info().Msgf("Serving Transmission RPC on http://%s%s", listener.Addr(), transmission.RPCPath)
+	go http.Serve(listener, server.Handler())
+	return nil
+}
+
+// configureTorrent applies the per-torrent settings of the config.
+func configureTorrent(torrent_client *client.Client, config *Config) {
+	torrent_client.Rates.SetRates(config.TorrentDownloadRate, config.TorrentUploadRate)
+	torrent_client.SetPeerRates(config.PeerDownloadRate, config.PeerUploadRate)
+	if config.MaxPeersPerTorrent != 0 {
+		torrent_client.Connections.Limits.SetMaxPeers(config.MaxPeersPerTorrent)
+	}
+	if config.Readahead != 0 {
+		torrent_client.Readahead = config.Readahead
+	}
+}
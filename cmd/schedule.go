@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/schedule"
+	"github.com/rs/zerolog"
+)
+
+func scheduleFromConfig(config *Config) (schedule.Limits, []schedule.Rule, error) {
+	defaults := schedule.Limits{
+		DownloadRate:   config.DownloadRate,
+		UploadRate:     config.UploadRate,
+		UploadSlots:    config.UploadSlots,
+		ActiveTorrents: config.ActiveTorrents,
+	}
+
+	rules, err := schedule.ParseRules(config.Schedule)
+	return defaults, rules, err
+}
+
+// startScheduler switches the global limits according to the schedule in the
+// config and picks up changes to the config file while running.
+func startScheduler(config *Config, session *client.Session, logger *zerolog.Logger) (*schedule.Scheduler, error) {
+	defaults, rules, err := scheduleFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduler := schedule.New(defaults, rules, func(limits schedule.Limits) {
+		logger.Info().Msgf(
+			"Switching limits: download %d B/s, upload %d B/s, %d upload slots, %d active torrents",
+			limits.DownloadRate, limits.UploadRate, limits.UploadSlots, limits.ActiveTorrents,
+		)
+		session.GlobalRates.SetRates(limits.DownloadRate, limits.UploadRate)
+		session.SetUploadSlots(limits.UploadSlots)
+		session.SetActiveDownloads(limits.ActiveTorrents)
+	})
+	scheduler.Start(schedule.CheckInterval)
+
+	go watchConfig(configFile, schedule.CheckInterval, func(config *Config) {
+		defaults, rules, err := scheduleFromConfig(config)
+		if err != nil {
+			logger.Error().Msgf("Ignoring config change: %s", err)
+			return
+		}
+
+		logger.Info().Msg("Reloaded config")
+		for _, torrent_client := range session.Torrents() {
+			configureTorrent(torrent_client, config)
+		}
+		session.SetActiveSeeds(config.ActiveSeeds)
+		scheduler.SetRules(defaults, rules)
+	})
+
+	return scheduler, nil
+}
+
+// watchConfig reloads the config file whenever its modification time changes.
+func watchConfig(filename string, interval time.Duration, onChange func(*Config)) {
+	var last time.Time
+	if info, err := os.Stat(filename); err == nil {
+		last = info.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(filename)
+		if err != nil || info.ModTime().Equal(last) {
+			continue
+		}
+		last = info.ModTime()
+
+		config, err := loadConfig(filename)
+		if err != nil {
+			continue
+		}
+		onChange(config)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/DarkPhoenix42/p-torrent/pkg/tracker"
+	"github.com/rs/zerolog"
+)
+
+func runScrape(file_name string, logger *zerolog.Logger) {
+	torrent_file, err := torrent.NewTorrent(file_name)
+	if err != nil {
+		logger.Error().Msgf("Failed to create a torrent with error: %s", err)
+		return
+	}
+
+	fmt.Printf("%s\n", torrent_file.Info.Name)
+	fmt.Printf("Info hash: %x\n\n", torrent_file.InfoHash)
+	fmt.Printf("%-60s %8s %8s %10s\n", "TRACKER", "SEEDERS", "LEECHERS", "COMPLETED")
+
+	tiers := tracker.NewTierList(torrent_file.Announce, torrent_file.AnnounceList).Tiers()
+	for _, tier := range tiers {
+		for _, announce_url := range tier {
+			results, err := tracker.Scrape(announce_url, [][20]byte{torrent_file.InfoHash})
+			if err != nil {
+				logger.Debug().Msgf("Failed to scrape %s: %s", announce_url, err)
+				fmt.Printf("%-60s %8s %8s %10s\n", announce_url, "-", "-", "-")
+				continue
+			}
+
+			result := results[torrent_file.InfoHash]
+			fmt.Printf("%-60s %8d %8d %10d\n", announce_url, result.Seeders, result.Leechers, result.Completed)
+		}
+	}
+}
@@ -3,12 +3,10 @@ module github.com/DarkPhoenix42/p-torrent
 go 1.22.4
 
 require (
+	github.com/mattn/go-isatty v0.0.19
 	github.com/rs/zerolog v1.33.0
+	golang.org/x/sys v0.12.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.19 // indirect
-	golang.org/x/sys v0.12.0 // indirect
-)
+require github.com/mattn/go-colorable v0.1.13 // indirect
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to the API of a running Server.
+type Client struct {
+	URL   string
+	Token string
+	HTTP  *http.Client
+}
+
+func NewClient(base_url, token string) *Client {
+	return &Client{
+		URL:   strings.TrimSuffix(base_url, "/"),
+		Token: token,
+		HTTP:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends a request and decodes the JSON response into out, unless out is
+// nil. Error responses are returned as errors.
+func (c *Client) do(method, path, content_type string, body io.Reader, out any) error {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if content_type != "" {
+		req.Header.Set("Content-Type", content_type)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e errorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s", e.Error)
+		}
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) doJSON(method, path string, in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.do(method, path, "application/json", bytes.NewReader(data), out)
+}
+
+func torrentPath(hash string, parts ...string) string {
+	return "/api/torrents/" + url.PathEscape(hash) + strings.Join(parts, "")
+}
+
+func (c *Client) Stats() (*Stats, error) {
+	var stats Stats
+	err := c.do("GET", "/api/stats", "", nil, &stats)
+	return &stats, err
+}
+
+func (c *Client) SetGlobalRates(rates Rates) error {
+	return c.doJSON("PUT", "/api/rates", rates, nil)
+}
+
+func (c *Client) Torrents() ([]Torrent, error) {
+	var torrents []Torrent
+	err := c.do("GET", "/api/torrents", "", nil, &torrents)
+	return torrents, err
+}
+
+func (c *Client) Torrent(hash string) (*Torrent, error) {
+	var t Torrent
+	err := c.do("GET", torrentPath(hash), "", nil, &t)
+	return &t, err
+}
+
+// Add uploads the contents of a .torrent file.
+func (c *Client) Add(data []byte, paused bool) (*Torrent, error) {
+	var t Torrent
+	path := "/api/torrents?paused=" + strconv.FormatBool(paused)
+	err := c.do("POST", path, "application/x-bittorrent", bytes.NewReader(data), &t)
+	return &t, err
+}
+
+func (c *Client) Remove(hash string, delete_data bool) error {
+	return c.do("DELETE", torrentPath(hash)+"?delete_data="+strconv.FormatBool(delete_data), "", nil, nil)
+}
+
+func (c *Client) Pause(hash string) error {
+	return c.do("POST", torrentPath(hash, "/pause"), "", nil, nil)
+}
+
+func (c *Client) Resume(hash string) error {
+	return c.do("POST", torrentPath(hash, "/resume"), "", nil, nil)
+}
+
+func (c *Client) Recheck(hash string) error {
+	return c.do("POST", torrentPath(hash, "/recheck"), "", nil, nil)
+}
+
+func (c *Client) SetRates(hash string, rates Rates) error {
+	return c.doJSON("PUT", torrentPath(hash, "/rates"), rates, nil)
+}
+
+func (c *Client) Files(hash string) ([]File, error) {
+	var files []File
+	err := c.do("GET", torrentPath(hash, "/files"), "", nil, &files)
+	return files, err
+}
+
+func (c *Client) SetFilePriority(hash string, index int, priority string) error {
+	path := torrentPath(hash, "/files/", strconv.Itoa(index))
+	return c.doJSON("PUT", path, priorityRequest{Priority: priority}, nil)
+}
+
+func (c *Client) Peers(hash string) ([]Peer, error) {
+	var peers []Peer
+	err := c.do("GET", torrentPath(hash, "/peers"), "", nil, &peers)
+	return peers, err
+}
+
+func (c *Client) Trackers(hash string) ([]Tracker, error) {
+	var trackers []Tracker
+	err := c.do("GET", torrentPath(hash, "/trackers"), "", nil, &trackers)
+	return trackers, err
+}
+
+func (c *Client) Pieces(hash string) (string, error) {
+	var pieces Pieces
+	err := c.do("GET", torrentPath(hash, "/pieces"), "", nil, &pieces)
+	return pieces.Pieces, err
+}
@@ -0,0 +1,441 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/ratelimit"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/rs/zerolog"
+)
+
+// MaxTorrentSize limits uploaded .torrent files.
+const MaxTorrentSize = 10 << 20
+
+// Server exposes a session over a JSON HTTP API below /api/. Every request
+// needs the header "Authorization: Bearer <Token>".
+//
+// Torrents are addressed by their hex info hash or a unique prefix of it.
+type Server struct {
+	Session *client.Session
+	Token   string
+	Logger  *zerolog.Logger
+
+	// Configure is called for every added torrent before it starts, e.g.
+	// to apply the rate limits of the config.
+	Configure func(*client.Client)
+}
+
+func NewServer(session *client.Session, token string, logger *zerolog.Logger) *Server {
+	return &Server{Session: session, Token: token, Logger: logger}
+}
+
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/stats", server.getStats)
+	mux.HandleFunc("PUT /api/rates", server.setGlobalRates)
+	mux.HandleFunc("GET /api/torrents", server.listTorrents)
+	mux.HandleFunc("POST /api/torrents", server.addTorrent)
+	mux.HandleFunc("GET /api/torrents/{hash}", server.getTorrent)
+	mux.HandleFunc("DELETE /api/torrents/{hash}", server.removeTorrent)
+	mux.HandleFunc("POST /api/torrents/{hash}/pause", server.pauseTorrent)
+	mux.HandleFunc("POST /api/torrents/{hash}/resume", server.resumeTorrent)
+	mux.HandleFunc("POST /api/torrents/{hash}/recheck", server.recheckTorrent)
+	mux.HandleFunc("PUT /api/torrents/{hash}/rates", server.setTorrentRates)
+	mux.HandleFunc("GET /api/torrents/{hash}/files", server.listFiles)
+	mux.HandleFunc("PUT /api/torrents/{hash}/files/{index}", server.setFilePriority)
+	mux.HandleFunc("GET /api/torrents/{hash}/peers", server.listPeers)
+	mux.HandleFunc("GET /api/torrents/{hash}/trackers", server.listTrackers)
+	mux.HandleFunc("GET /api/torrents/{hash}/pieces", server.getPieces)
+	return server.authenticate(mux)
+}
+
+func (server *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if server.Token == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(server.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="p-torrent"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// find returns the torrent a hash or hash prefix refers to.
+func (server *Server) find(w http.ResponseWriter, req *http.Request) *client.Client {
+	prefix := strings.ToLower(req.PathValue("hash"))
+
+	var found *client.Client
+	for _, c := range server.Session.Torrents() {
+		if !strings.HasPrefix(hex.EncodeToString(c.Torrent.InfoHash[:]), prefix) {
+			continue
+		}
+		if found != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("ambiguous info hash %q", prefix))
+			return nil
+		}
+		found = c
+	}
+
+	if found == nil || prefix == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown torrent %q", prefix))
+		return nil
+	}
+	return found
+}
+
+func (server *Server) torrent(c *client.Client) Torrent {
+	state, _ := server.Session.State(c.Torrent.InfoHash)
+	done, wanted := c.Progress()
+	downloaded, uploaded := c.Transferred()
+
+	progress := 1.0
+	if wanted > 0 {
+		progress = float64(done) / float64(wanted)
+	}
+
+	c.PeersMutex.Lock()
+	peers := len(c.Peers)
+	c.PeersMutex.Unlock()
+
+	download_rate, upload_rate := measured(c.Rates)
+	return Torrent{
+		InfoHash:   hex.EncodeToString(c.Torrent.InfoHash[:]),
+		Name:       c.Torrent.Info.Name,
+		State:      state.String(),
+		Size:       c.Torrent.GetLength(),
+		Wanted:     wanted,
+		Done:       done,
+		Progress:   progress,
+		Downloaded: downloaded,
+		Uploaded:   uploaded,
+		Peers:      peers,
+		Sequential: c.Work.Sequential(),
+		Dir:        c.Storage.Dir,
+		Added:      c.Added.Unix(),
+		Rates:      Rates{Download: c.Rates.Download.Rate(), Upload: c.Rates.Upload.Rate()},
+
+		DownloadRate: download_rate,
+		UploadRate:   upload_rate,
+	}
+}
+
+// measured returns the bytes per second that recently passed the limiters of
+// pair.
+func measured(pair *ratelimit.Pair) (float64, float64) {
+	if pair == nil {
+		return 0, 0
+	}
+	return pair.Download.Meter.Rate(), pair.Upload.Meter.Rate()
+}
+
+func (server *Server) getStats(w http.ResponseWriter, req *http.Request) {
+	stats := Stats{
+		States: map[string]int{},
+		Rates: Rates{
+			Download: server.Session.GlobalRates.Download.Rate(),
+			Upload:   server.Session.GlobalRates.Upload.Rate(),
+		},
+	}
+	stats.DownloadRate, stats.UploadRate = measured(server.Session.GlobalRates)
+
+	for _, c := range server.Session.Torrents() {
+		t := server.torrent(c)
+		stats.Torrents++
+		stats.States[t.State]++
+		stats.Peers += t.Peers
+		stats.Downloaded += t.Downloaded
+		stats.Uploaded += t.Uploaded
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func decodeRates(w http.ResponseWriter, req *http.Request) (Rates, bool) {
+	var rates Rates
+	err := json.NewDecoder(req.Body).Decode(&rates)
+	if err == nil && (rates.Download < 0 || rates.Upload < 0) {
+		err = fmt.Errorf("negative rate")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return rates, false
+	}
+	return rates, true
+}
+
+func (server *Server) setGlobalRates(w http.ResponseWriter, req *http.Request) {
+	rates, ok := decodeRates(w, req)
+	if !ok {
+		return
+	}
+	server.Session.GlobalRates.SetRates(rates.Download, rates.Upload)
+	writeJSON(w, http.StatusOK, rates)
+}
+
+func (server *Server) listTorrents(w http.ResponseWriter, req *http.Request) {
+	torrents := []Torrent{}
+	for _, c := range server.Session.Torrents() {
+		torrents = append(torrents, server.torrent(c))
+	}
+	writeJSON(w, http.StatusOK, torrents)
+}
+
+// readTorrent reads the .torrent file of an add request, which is either the
+// "torrent" field of a form or the whole body.
+func readTorrent(req *http.Request) ([]byte, error) {
+	media_type, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	switch media_type {
+	case "multipart/form-data":
+		file, _, err := req.FormFile("torrent")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	default:
+		return io.ReadAll(req.Body)
+	}
+}
+
+// addTorrent adds an uploaded torrent. With ?paused=1 it waits for resume,
+// e.g. to change the file priorities first.
+func (server *Server) addTorrent(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, MaxTorrentSize)
+	data, err := readTorrent(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t, err := torrent.NewTorrentFromBencode(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid torrent: %s", err))
+		return
+	}
+
+	c, err := server.Session.Add(t, true)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if server.Configure != nil {
+		server.Configure(c)
+	}
+
+	paused, _ := strconv.ParseBool(req.URL.Query().Get("paused"))
+	if !paused {
+		server.Session.Resume(t.InfoHash)
+	}
+
+	server.Logger.Info().Msgf("Added %s over the API", t.Info.Name)
+	writeJSON(w, http.StatusCreated, server.torrent(c))
+}
+
+func (server *Server) getTorrent(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, server.torrent(c))
+}
+
+// removeTorrent removes a torrent, and its data with ?delete_data=1.
+func (server *Server) removeTorrent(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+
+	delete_data, _ := strconv.ParseBool(req.URL.Query().Get("delete_data"))
+	err := server.Session.Remove(c.Torrent.InfoHash, delete_data)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// control runs a session method on the torrent of the request.
+func (server *Server) control(w http.ResponseWriter, req *http.Request, method func([20]byte) error) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+
+	err := method(c.Torrent.InfoHash)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.torrent(c))
+}
+
+func (server *Server) pauseTorrent(w http.ResponseWriter, req *http.Request) {
+	server.control(w, req, server.Session.Pause)
+}
+
+func (server *Server) resumeTorrent(w http.ResponseWriter, req *http.Request) {
+	server.control(w, req, server.Session.Resume)
+}
+
+func (server *Server) recheckTorrent(w http.ResponseWriter, req *http.Request) {
+	server.control(w, req, server.Session.Recheck)
+}
+
+func (server *Server) setTorrentRates(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+
+	rates, ok := decodeRates(w, req)
+	if !ok {
+		return
+	}
+	c.Rates.SetRates(rates.Download, rates.Upload)
+	writeJSON(w, http.StatusOK, rates)
+}
+
+func files(c *client.Client) []File {
+	priorities := c.FilePriorities()
+	progress := c.FileProgress()
+
+	files := []File{}
+	for i, file := range c.Torrent.Files() {
+		files = append(files, File{
+			Index:    i,
+			Path:     strings.Join(file.Path, "/"),
+			Length:   file.Length,
+			Done:     progress[i],
+			Priority: priorities[i].String(),
+		})
+	}
+	return files
+}
+
+func (server *Server) listFiles(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, files(c))
+}
+
+func (server *Server) setFilePriority(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+
+	index, err := strconv.Atoi(req.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid file index %q", req.PathValue("index")))
+		return
+	}
+
+	var body priorityRequest
+	err = json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	priority, err := piece.ParsePriority(body.Priority)
+	if err == nil {
+		err = c.SetFilePriority(index, priority)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files(c)[index])
+}
+
+func (server *Server) listPeers(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+
+	c.PeersMutex.Lock()
+	defer c.PeersMutex.Unlock()
+
+	peers := []Peer{}
+	for _, p := range c.Peers {
+		peer_client := ""
+		if hs := p.ExtendedHandshake(); hs != nil {
+			peer_client = hs.Client
+		}
+		download_rate, upload_rate := measured(p.Rates)
+		peers = append(peers, Peer{
+			Address:    p.Addr.String(),
+			Client:     peer_client,
+			Incoming:   p.Incoming,
+			Encrypted:  p.Encrypted,
+			UTP:        p.OverUTP,
+			Choked:     p.IsChoked(),
+			Interested: p.IsInterested(),
+
+			DownloadRate: download_rate,
+			UploadRate:   upload_rate,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (server *Server) listTrackers(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+
+	trackers := []Tracker{}
+	for tier, urls := range c.Trackers.Tiers() {
+		for _, u := range urls {
+			trackers = append(trackers, Tracker{Tier: tier, URL: u})
+		}
+	}
+	writeJSON(w, http.StatusOK, trackers)
+}
+
+// getPieces returns the piece map as a string with one character per piece,
+// "1" for done and "0" for missing.
+func (server *Server) getPieces(w http.ResponseWriter, req *http.Request) {
+	c := server.find(w, req)
+	if c == nil {
+		return
+	}
+
+	have, _ := c.Storage.Pieces()
+	pieces := make([]byte, len(have))
+	for i, done := range have {
+		pieces[i] = '0'
+		if done {
+			pieces[i] = '1'
+		}
+	}
+	writeJSON(w, http.StatusOK, Pieces{Pieces: string(pieces)})
+}
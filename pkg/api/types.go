@@ -0,0 +1,82 @@
+package api
+
+// Torrent is a torrent of the session with its progress. Sizes are in bytes
+// and Progress is the fraction of the wanted files that is done. Rates are
+// the limits, DownloadRate and UploadRate the measured bytes per second.
+type Torrent struct {
+	InfoHash   string  `json:"info_hash"`
+	Name       string  `json:"name"`
+	State      string  `json:"state"`
+	Size       int     `json:"size"`
+	Wanted     int     `json:"wanted"`
+	Done       int     `json:"done"`
+	Progress   float64 `json:"progress"`
+	Downloaded int     `json:"downloaded"`
+	Uploaded   int     `json:"uploaded"`
+	Peers      int     `json:"peers"`
+	Sequential bool    `json:"sequential"`
+	Dir        string  `json:"dir"`
+	Added      int64   `json:"added"`
+	Rates      Rates   `json:"rates"`
+
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+}
+
+type File struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int    `json:"length"`
+	Done     int    `json:"done"`
+	Priority string `json:"priority"`
+}
+
+type Peer struct {
+	Address    string `json:"address"`
+	Client     string `json:"client"`
+	Incoming   bool   `json:"incoming"`
+	Encrypted  bool   `json:"encrypted"`
+	UTP        bool   `json:"utp"`
+	Choked     bool   `json:"choked"`
+	Interested bool   `json:"interested"`
+
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+}
+
+// Tracker is a tracker URL and the tier it belongs to.
+type Tracker struct {
+	Tier int    `json:"tier"`
+	URL  string `json:"url"`
+}
+
+type Pieces struct {
+	Pieces string `json:"pieces"`
+}
+
+// Rates are limits in bytes per second, 0 means unlimited.
+type Rates struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+// Stats sums up the session.
+type Stats struct {
+	Torrents   int            `json:"torrents"`
+	States     map[string]int `json:"states"`
+	Peers      int            `json:"peers"`
+	Downloaded int            `json:"downloaded"`
+	Uploaded   int            `json:"uploaded"`
+	Rates      Rates          `json:"rates"`
+
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+}
+
+type priorityRequest struct {
+	Priority string `json:"priority"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
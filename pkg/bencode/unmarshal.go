@@ -22,6 +22,10 @@ func UnMarshal(data []byte) (any, error) {
 }
 
 func unmarshal(data []byte, offset int) (any, int, error) {
+	if offset >= len(data) {
+		return nil, 0, fmt.Errorf("unexpected end of bencode data")
+	}
+
 	switch data[offset] {
 	case 'i':
 		return unmarshalInt(data, offset)
@@ -59,7 +63,7 @@ func unmarshalList(data []byte, offset int) ([]any, int, error) {
 	list := []any{}
 	offset += 1
 
-	for data[offset] != 'e' {
+	for offset < len(data) && data[offset] != 'e' {
 		val, new_offset, err := unmarshal(data, offset)
 		if err != nil {
 			return nil, 0, err
@@ -68,6 +72,10 @@ func unmarshalList(data []byte, offset int) ([]any, int, error) {
 		offset = new_offset
 		list = append(list, val)
 	}
+
+	if offset >= len(data) {
+		return nil, 0, fmt.Errorf("unterminated list")
+	}
 	offset += 1
 	return list, offset, nil
 }
@@ -76,7 +84,7 @@ func unmarshalDict(data []byte, offset int) (map[string]any, int, error) {
 	dict := map[string]any{}
 	offset += 1
 
-	for data[offset] != 'e' {
+	for offset < len(data) && data[offset] != 'e' {
 		key, new_offset, err := unmarshalString(data, offset)
 		if err != nil {
 			return nil, 0, err
@@ -94,6 +102,9 @@ func unmarshalDict(data []byte, offset int) (map[string]any, int, error) {
 		dict[key_str] = val
 	}
 
+	if offset >= len(data) {
+		return nil, 0, fmt.Errorf("unterminated dict")
+	}
 	offset += 1
 	return dict, offset, nil
 }
@@ -106,9 +117,12 @@ func unmarshalString(data []byte, offset int) (string, int, error) {
 
 	str_len_data := data[offset : offset+colon_idx]
 	str_len, err := strconv.Atoi(string(str_len_data))
-	if err != nil {
+	if err != nil || str_len < 0 {
 		return "", 0, fmt.Errorf("invalid value for string length")
 	}
+	if offset+colon_idx+str_len+1 > len(data) {
+		return "", 0, fmt.Errorf("string length exceeds bencode data")
+	}
 	str_data := data[offset+colon_idx+1 : offset+colon_idx+str_len+1]
 
 	offset += colon_idx + str_len + 1
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+)
+
+const (
+	// DefaultUploadSlots is how many interested peers are unchoked at once,
+	// besides the optimistic unchoke.
+	DefaultUploadSlots = 4
+	// RechokeInterval is how often the unchoked peers are picked again, the
+	// optimistic unchoke moves on every OptimisticRounds rounds.
+	RechokeInterval  = 10 * time.Second
+	OptimisticRounds = 3
+)
+
+// SetUploadSlots limits how many interested peers are unchoked at once.
+// Zero means unlimited.
+func (client *Client) SetUploadSlots(n int) {
+	client.PeersMutex.Lock()
+	client.uploadSlots = n
+	client.PeersMutex.Unlock()
+
+	client.wakeChoker()
+}
+
+// UploadSlots returns how many interested peers are unchoked at once.
+func (client *Client) UploadSlots() int {
+	client.PeersMutex.Lock()
+	defer client.PeersMutex.Unlock()
+	return client.uploadSlots
+}
+
+// wakeChoker picks the unchoked peers right away, e.g. when a peer became
+// interested and a slot may be free.
+func (client *Client) wakeChoker() {
+	select {
+	case client.rechoke <- struct{}{}:
+	default:
+	}
+}
+
+func (client *Client) chokeLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+
+	round := 0
+	for {
+		rotate := false
+		select {
+		case <-ticker.C:
+			round++
+			rotate = round%OptimisticRounds == 0
+		case <-client.rechoke:
+		case <-stop:
+			return
+		}
+
+		client.chokePeers(rotate)
+	}
+}
+
+// chokePeers unchokes the interested peers that send the most to us, or
+// while seeding those we send the most to, up to the upload slots. One more
+// interested peer is unchoked at random and replaced when rotate is set.
+func (client *Client) chokePeers(rotate bool) {
+	seeding := client.left() == 0
+
+	client.PeersMutex.Lock()
+	slots := client.uploadSlots
+	peers := make([]*peer.Peer, 0, len(client.Peers))
+	for _, p := range client.Peers {
+		if p.Responsive() {
+			peers = append(peers, p)
+		}
+	}
+	optimistic := client.optimistic
+	client.PeersMutex.Unlock()
+
+	rate := func(p *peer.Peer) float64 {
+		if seeding {
+			return p.Rates.Upload.Meter.Rate()
+		}
+		return p.Rates.Download.Meter.Rate()
+	}
+	interested := []*peer.Peer{}
+	for _, p := range peers {
+		if p.IsInterested() {
+			interested = append(interested, p)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rate(interested[i]) > rate(interested[j])
+	})
+
+	unchoke := map[*peer.Peer]bool{}
+	others := []*peer.Peer{}
+	for i, p := range interested {
+		if slots == 0 || i < slots {
+			unchoke[p] = true
+		} else {
+			others = append(others, p)
+		}
+	}
+
+	keep := false
+	for _, p := range others {
+		if p == optimistic {
+			keep = !rotate
+		}
+	}
+	if !keep {
+		optimistic = nil
+		if len(others) > 0 {
+			optimistic = others[rand.Intn(len(others))]
+		}
+	}
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+
+	client.PeersMutex.Lock()
+	client.optimistic = optimistic
+	client.PeersMutex.Unlock()
+
+	for _, p := range peers {
+		var err error
+		if unchoke[p] {
+			err = p.Unchoke()
+		} else {
+			err = p.Choke()
+		}
+		if err != nil {
+			client.Logger.Debug().Msgf("Failed to update choking of %s: %s", p.Addr, err)
+		}
+	}
+}
+
+// broadcastHave tells the connected peers about a piece we completed.
+func (client *Client) broadcastHave(index int) {
+	client.PeersMutex.Lock()
+	peers := make([]*peer.Peer, 0, len(client.Peers))
+	for _, p := range client.Peers {
+		peers = append(peers, p)
+	}
+	client.PeersMutex.Unlock()
+
+	for _, p := range peers {
+		go p.SendHave(index)
+	}
+}
@@ -2,38 +2,106 @@ package client
 
 import (
 	"crypto/rand"
-	"encoding/binary"
-	"io"
+	"fmt"
 	"net"
-	"net/http"
-	"net/url"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 
-	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+	"github.com/DarkPhoenix42/p-torrent/pkg/connmgr"
+	"github.com/DarkPhoenix42/p-torrent/pkg/dht"
+	"github.com/DarkPhoenix42/p-torrent/pkg/lsd"
+	"github.com/DarkPhoenix42/p-torrent/pkg/mse"
 	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/pex"
 	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/ratelimit"
+	"github.com/DarkPhoenix42/p-torrent/pkg/storage"
 	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/DarkPhoenix42/p-torrent/pkg/tracker"
+	"github.com/DarkPhoenix42/p-torrent/pkg/utp"
+	"github.com/DarkPhoenix42/p-torrent/pkg/webseed"
 	"github.com/rs/zerolog"
 )
 
 type Client struct {
 	Torrent *torrent.Torrent
 	PeerID  [20]byte
-	Tracker string
 
-	Downloaded     int
-	DownloadBuffer []byte
+	Trackers           *tracker.TierList
+	AnnounceToAllTiers bool
+	DHT                *dht.DHT
+	LSD                *lsd.Service
+	Extensions         *peer.ExtensionRegistry
+	Encryption         mse.Mode
+	WebSeeds           []*webseed.WebSeed
+
+	// Rates limits this torrent and GlobalRates all torrents. Every peer
+	// additionally gets its own limits with the peer rates.
+	Rates            *ratelimit.Pair
+	GlobalRates      *ratelimit.Pair
+	peerDownloadRate int
+	peerUploadRate   int
+
+	// downloaded and uploaded count the bytes of all runs, see Transferred,
+	// Added is when the torrent was first added.
+	downloaded int
+	uploaded   int
+	Added      time.Time
+	Storage    *storage.Storage
+
+	// active is the time spent downloading in earlier runs, activeSince the
+	// start of the current run. seeders and leechers are the swarm size of
+	// the last announce.
+	active      time.Duration
+	activeSince time.Time
+	seeders     int
+	leechers    int
+
+	// remaining counts the bytes of wanted pieces that are still missing,
+	// see Progress.
+	remaining      int
+	filePriorities []piece.Priority
+	filesMutex     sync.Mutex
+	filesChanged   chan struct{}
+
+	// Readahead is how many bytes after the position of a Reader are
+	// downloaded before anything else.
+	Readahead int
+	readers   map[*Reader]int
+	stored    chan struct{}
 
-	Left            int
 	TrackerInterval time.Duration
-	Peers           map[net.Addr]*peer.Peer
+	Peers           map[string]*peer.Peer
+	PeersMutex      sync.Mutex
+	Connections     *connmgr.Manager
 	Logger          *zerolog.Logger
 
-	Work    chan *piece.Piece
+	Port       int
+	Listeners  []net.Listener
+	UTPEnabled bool
+	UTP        *utp.Socket
+	Families   *Families
+	running    bool
+	seeding    bool
+	pexStates  map[string]*pex.State
+
+	// uploadSlots limits the unchoked peers, optimistic is the one unchoked
+	// besides them, see chokePeers.
+	uploadSlots int
+	optimistic  *peer.Peer
+	rechoke     chan struct{}
+
+	// session owns the listeners when the client is part of a Session.
+	session  *Session
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	Work    *piece.Queue
 	Results chan *piece.Piece
+
+	// metrics are only kept for monitoring, see Session.MetricsHandler.
+	metrics clientMetrics
+	events  eventHub
 }
 
 func NewClient(t *torrent.Torrent, logger *zerolog.Logger) *Client {
@@ -41,15 +109,36 @@ func NewClient(t *torrent.Torrent, logger *zerolog.Logger) *Client {
 		Torrent: t,
 
 		PeerID: [20]byte{},
-		Peers:  make(map[net.Addr]*peer.Peer, 0),
-
-		Downloaded:     0,
-		DownloadBuffer: make([]byte, 0),
-
-		Left:    t.GetLength(),
-		Logger:  logger,
-		Work:    make(chan *piece.Piece, len(t.Info.Pieces)),
-		Results: make(chan *piece.Piece, len(t.Info.Pieces)),
+		Peers:  make(map[string]*peer.Peer, 0),
+		Port:   DefaultPort,
+
+		Families:  DetectFamilies(),
+		pexStates: make(map[string]*pex.State),
+
+		uploadSlots: DefaultUploadSlots,
+		rechoke:     make(chan struct{}, 1),
+
+		Trackers: tracker.NewTierList(t.Announce, t.AnnounceList),
+		Rates:    ratelimit.NewPair(0, 0),
+
+		downloaded: 0,
+		Added:      time.Now(),
+		Storage:    storage.New(t, DefaultDownloadDir),
+
+		remaining:      t.GetLength(),
+		filePriorities: make([]piece.Priority, len(t.Files())),
+		filesChanged:   make(chan struct{}, 1),
+		Readahead:      DefaultReadahead,
+		readers:        make(map[*Reader]int),
+		stored:         make(chan struct{}),
+		stop:           make(chan struct{}),
+		Logger:         logger,
+		Work:           piece.NewQueue(len(t.Info.Pieces)),
+		Results:        make(chan *piece.Piece, len(t.Info.Pieces)),
+		metrics:        newClientMetrics(),
+	}
+	for i := range client.filePriorities {
+		client.filePriorities[i] = piece.PriorityNormal
 	}
 
 	_, err := rand.Read(client.PeerID[:])
@@ -57,165 +146,506 @@ func NewClient(t *torrent.Torrent, logger *zerolog.Logger) *Client {
 		panic(err)
 	}
 
-	return &client
-}
-
-func (client *Client) buildTrackerAnnounceURL() (string, error) {
+	client.Connections = connmgr.New(
+		connmgr.NewLimits(connmgr.DefaultMaxPeers, connmgr.DefaultMaxHalfOpen),
+		nil,
+		client.dialPeer,
+	)
 
-	announce_url, err := url.Parse(client.Torrent.Announce)
-	if err != nil {
-		return "", err
+	client.Extensions = peer.NewExtensionRegistry()
+	info_bytes, err := t.InfoBytes()
+	if err == nil {
+		client.Extensions.MetadataSize = len(info_bytes)
+	}
+	if client.pexEnabled() {
+		client.Extensions.Register(&pexExtension{client: &client})
 	}
 
-	params := url.Values{
-		"info_hash":  {string(client.Torrent.InfoHash[:])},
-		"peer_id":    {string(client.PeerID[:])},
-		"port":       {"6881"},
-		"uploaded":   {"0"},
-		"downloaded": {strconv.Itoa(client.Downloaded)},
-		"compact":    {"1"},
-		"left":       {strconv.Itoa(client.Left)},
-		"event":      {"started"},
+	for _, seed_url := range t.URLList {
+		ws, err := webseed.New(seed_url, t, client.Work, client.Results, logger)
+		if err != nil {
+			logger.Warn().Msgf("Ignoring web seed %s: %s", seed_url, err)
+			continue
+		}
+		ws.OnHashFailed = func(index int) {
+			client.hashFailed(index, nil)
+		}
+		client.WebSeeds = append(client.WebSeeds, ws)
 	}
 
-	announce_url.RawQuery = params.Encode()
-	return announce_url.String(), nil
+	return &client
+}
+
+func (client *Client) announceRequest(event string) tracker.AnnounceRequest {
+	downloaded, uploaded := client.Transferred()
+	return tracker.AnnounceRequest{
+		InfoHash:   client.Torrent.InfoHash,
+		PeerID:     client.PeerID,
+		Port:       client.Port,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       client.left(),
+		Event:      event,
+		IPv6:       client.Families.IPv6,
+	}
 }
 
 func (client *Client) UpdatePeers() error {
-	announce_url, err := client.buildTrackerAnnounceURL()
-	if err != nil {
-		return err
+	req := client.announceRequest(tracker.EventStarted)
+
+	var resp *tracker.AnnounceResponse
+	var err error
+
+	start := time.Now()
+	announce_url := ""
+	if client.AnnounceToAllTiers {
+		client.Logger.Info().Msg("Announcing to all tracker tiers")
+		resp, err = client.Trackers.AnnounceAll(req)
+	} else {
+		resp, announce_url, err = client.Trackers.Announce(req)
+		if err == nil {
+			client.Logger.Info().Msgf("Got peers from: %s", announce_url)
+		}
+	}
+
+	// Torrents without trackers only use the DHT, which is not an error.
+	if len(client.Trackers.Tiers()) > 0 {
+		client.metrics.observeAnnounce(start, err)
+		if err != nil {
+			client.emit(Event{Type: EventTrackerError, Err: err})
+		}
 	}
 
-	client.Logger.Info().Msgf("Getting peers from: %s", announce_url)
-	http_client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := http_client.Get(announce_url)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	interval, peers, err := parseTrackerResponse(resp.Body)
+	client.emit(Event{Type: EventTrackerAnnounced, Tracker: announce_url, Peers: len(resp.Peers)})
+	client.filesMutex.Lock()
+	client.seeders, client.leechers = resp.Seeders, resp.Leechers
+	client.filesMutex.Unlock()
+
+	client.TrackerInterval = resp.Interval
+	client.addPeers(resp.Peers)
+	return nil
+}
+
+func (client *Client) UpdateDHTPeers() error {
+	if client.DHT.Table.Len() < dht.K {
+		err := client.DHT.Bootstrap()
+		if err != nil {
+			return err
+		}
+	}
+
+	peers, err := client.DHT.Announce(client.Torrent.InfoHash, client.Port)
 	if err != nil {
 		return err
 	}
 
-	client.TrackerInterval = interval
+	client.Logger.Info().Msgf("Got %d peers from the DHT", len(peers))
+	client.addPeers(peers)
+	return nil
+}
+
+func (client *Client) newPeer(addr net.Addr) *peer.Peer {
+	p := peer.NewPeer(addr, client.Work, client.Results, len(client.Torrent.Info.Pieces))
+	client.configurePeer(p)
+	return p
+}
 
-	for _, p := range peers {
-		client.Peers[p] = peer.NewPeer(p, client.Work, client.Results, len(client.Torrent.Info.Pieces))
+func (client *Client) configurePeer(p *peer.Peer) {
+	p.Reserved[5] |= peer.ReservedExtension
+	p.Reserved[7] |= peer.ReservedFast
+	p.Extensions = client.Extensions
+	p.Encryption = client.Encryption
+	p.UTP = client.UTP
+
+	client.PeersMutex.Lock()
+	p.Rates = ratelimit.NewPair(client.peerDownloadRate, client.peerUploadRate)
+	p.Seeding = client.seeding
+	client.PeersMutex.Unlock()
+	p.SharedRates = []*ratelimit.Pair{client.Rates, client.GlobalRates}
+	p.OnHashFailed = func(p *peer.Peer, index int) {
+		client.hashFailed(index, p.Addr)
 	}
 
-	client.Logger.Info().Msgf("%d peers acquired!", len(client.Peers))
-	return nil
+	p.HavePieces = func() []bool {
+		have, _ := client.Storage.Pieces()
+		return have
+	}
+	p.ReadPiece = func(index int) ([]byte, error) {
+		if !client.Storage.Have(index) {
+			return nil, fmt.Errorf("piece #%d is missing", index)
+		}
+		return client.Storage.ReadPiece(index)
+	}
+	p.OnInterest = func(p *peer.Peer) {
+		client.wakeChoker()
+	}
+	p.OnUploaded = func(p *peer.Peer, n int) {
+		client.filesMutex.Lock()
+		client.uploaded += n
+		client.filesMutex.Unlock()
+	}
+
+	if client.DHT != nil {
+		p.Reserved[7] |= peer.ReservedDHT
+		p.OnPort = func(p *peer.Peer, port int) {
+			if tcp_addr, ok := p.Addr.(*net.TCPAddr); ok {
+				client.DHT.AddNode(&net.UDPAddr{IP: tcp_addr.IP, Port: port})
+			}
+		}
+	}
 }
 
-func parseTrackerResponse(resp_body io.Reader) (time.Duration, []net.Addr, error) {
+// SetPeerRates changes the limits of every peer, including those that are
+// already connected. Zero means unlimited.
+func (client *Client) SetPeerRates(download, upload int) {
+	client.PeersMutex.Lock()
+	defer client.PeersMutex.Unlock()
 
-	bencoded_response, err := io.ReadAll(resp_body)
-	if err != nil {
-		return 0, nil, err
+	client.peerDownloadRate = download
+	client.peerUploadRate = upload
+	for _, p := range client.Peers {
+		p.Rates.SetRates(download, upload)
 	}
+}
 
-	decoded_body, err := bencode.UnMarshal(bencoded_response)
-	if err != nil {
-		return 0, nil, err
+// onPeerConnected runs once the handshake with a peer has succeeded.
+func (client *Client) onPeerConnected(p *peer.Peer) {
+	client.Families.Connected(p.Addr)
+	client.emit(Event{Type: EventPeerConnected, Peer: p.Addr})
+
+	if p.SupportsFast() {
+		client.sendFastState(p)
 	}
 
-	interval := decoded_body.(map[string]any)["interval"].(int)
-	peers := []byte(decoded_body.(map[string]any)["peers"].(string))
+	if p.SupportsExtensions() {
+		err := p.SendExtendedHandshake()
+		if err != nil {
+			client.Logger.Debug().Msgf("Failed to send extended handshake to %s: %s", p.Addr, err)
+		}
+	}
 
-	peers_list := make([]net.Addr, len(peers)/6)
+	if client.DHT != nil && p.SupportsDHT() {
+		err := p.SendPort(client.DHT.Addr().Port)
+		if err != nil {
+			client.Logger.Debug().Msgf("Failed to send port to %s: %s", p.Addr, err)
+		}
+	}
+}
 
-	for i := 0; i < len(peers); i += 6 {
-		ip := net.IP(peers[i : i+4])
-		port := binary.BigEndian.Uint16(peers[i+4 : i+6])
-		peer := &net.TCPAddr{IP: ip, Port: int(port)}
-		peers_list[i/6] = peer
+// sendFastState tells a fast extension peer which pieces it may request from
+// us while choked.
+func (client *Client) sendFastState(p *peer.Peer) {
+	num_pieces := len(client.Torrent.Info.Pieces)
+	for _, index := range peer.GenerateAllowedFastSet(peer.AllowedFastSetSize, num_pieces, client.Torrent.InfoHash[:], p.Addr) {
+		err := p.SendAllowedFast(index)
+		if err != nil {
+			client.Logger.Debug().Msgf("Failed to send allowed fast to %s: %s", p.Addr, err)
+			return
+		}
 	}
+}
 
-	return time.Duration(interval), peers_list, nil
+func (client *Client) addPeers(addrs []net.Addr) {
+	added := client.Connections.Add(client.Families.Reachable(addrs))
+	client.Logger.Info().Msgf("%d new peers acquired! (%s)", added, client.Connections)
 }
 
-func (client *Client) ConnectToPeers() {
-	var wg sync.WaitGroup
-	var wMutex sync.RWMutex
-	inactive_peers := make([]net.Addr, 0)
+// dialPeer is called by the connection manager to connect to a candidate.
+func (client *Client) dialPeer(addr net.Addr) error {
+	p := client.newPeer(addr)
 
-	for _, p := range client.Peers {
-		wg.Add(1)
-		go func(peer *peer.Peer) {
-			err := peer.Activate(client.Torrent.InfoHash[:], client.PeerID[:])
-			if err != nil {
-				client.Logger.Error().Msgf("Failed  to activate peer %s: %s", peer.Addr, err)
-				wMutex.Lock()
-				inactive_peers = append(inactive_peers, peer.Addr)
-				wMutex.Unlock()
-			} else {
-				client.Logger.Info().Msgf("Activated peer: %s", peer.Addr)
-			}
+	err := p.Activate(client.Torrent.InfoHash[:], client.PeerID[:])
+	if err != nil {
+		client.Logger.Debug().Msgf("Failed to activate peer %s: %s", addr, err)
+		p.Close()
+		return err
+	}
 
-			wg.Done()
-		}(p)
+	client.PeersMutex.Lock()
+	if !client.running {
+		client.PeersMutex.Unlock()
+		p.Close()
+		return fmt.Errorf("run ended while connecting to %s", addr)
 	}
+	if _, ok := client.Peers[addr.String()]; ok {
+		client.PeersMutex.Unlock()
+		p.Close()
+		return fmt.Errorf("already connected to %s", addr)
+	}
+	client.Peers[addr.String()] = p
+	client.PeersMutex.Unlock()
 
-	wg.Wait()
+	// The messages after the handshake go through the rate limited
+	// connection, so they are sent without holding the peers lock.
+	client.Logger.Info().Msgf("Activated peer: %s", addr)
+	client.onPeerConnected(p)
 
-	for _, p := range inactive_peers {
-		delete(client.Peers, p)
-	}
+	go client.runPeer(p)
+	return nil
+}
 
-	client.Logger.Info().Msgf("Connected to %d peers", len(client.Peers))
+// runPeer downloads from a peer until it disconnects and then frees its slot
+// in the connection manager.
+func (client *Client) runPeer(p *peer.Peer) {
+	p.StartDownload()
+	p.Close()
+
+	client.PeersMutex.Lock()
+	if client.Peers[p.Addr.String()] == p {
+		delete(client.Peers, p.Addr.String())
+		delete(client.pexStates, p.Addr.String())
+	}
+	client.PeersMutex.Unlock()
 
+	client.Logger.Info().Msgf("Peer %s disconnected", p.Addr)
+	client.emit(Event{Type: EventPeerDisconnected, Peer: p.Addr})
+	client.Connections.Disconnected(p.Addr)
 }
 
+// StartDownload downloads the wanted files and returns once they are
+// complete or Stop is called.
 func (client *Client) StartDownload() {
+	client.download(client.stop)
+}
+
+// Stop ends StartDownload.
+func (client *Client) Stop() {
+	client.stopOnce.Do(func() { close(client.stop) })
+}
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (client *Client) download(stop <-chan struct{}) {
+	client.run(stop, false)
+}
+
+// seed uploads the pieces we have to other peers until stop is closed or
+// more pieces are wanted.
+func (client *Client) seed(stop <-chan struct{}) {
+	client.run(stop, true)
+}
+
+func (client *Client) run(stop <-chan struct{}, seeding bool) {
+	defer client.Close()
+	if !seeding {
+		client.setActive(true)
+		defer client.setActive(false)
+	}
+
+	if client.session == nil {
+		err := client.Listen()
+		if err != nil {
+			client.Logger.Warn().Msgf("Incoming connections disabled: %s", err)
+		} else {
+			client.Extensions.ListenPort = client.Port
+		}
+	}
+
+	if client.LSD != nil && !client.Torrent.Info.Private {
+		err := client.LSD.Register(client.Torrent.InfoHash, client.Torrent.Info.Private, func(addr net.Addr) {
+			client.addPeers([]net.Addr{addr})
+		})
+		if err != nil {
+			client.Logger.Warn().Msgf("Failed to announce on the local network: %s", err)
+		}
+		defer client.LSD.Unregister(client.Torrent.InfoHash)
+	}
 
 	err := client.UpdatePeers()
 	if err != nil {
 		client.Logger.Error().Msgf("Failed to update peers: %s", err)
+	}
+
+	if client.DHT != nil && !client.Torrent.Info.Private {
+		err = client.UpdateDHTPeers()
+		if err != nil {
+			client.Logger.Error().Msgf("Failed to get peers from the DHT: %s", err)
+		}
+	}
+
+	if stopped(stop) {
 		return
 	}
 
-	client.ConnectToPeers()
+	if !seeding {
+		if client.left() == 0 {
+			client.Logger.Info().Msg("Nothing to download, all wanted files are complete")
+			return
+		}
+
+		// Peers from the local network, PEX and incoming connections may
+		// still come in, so the run goes on without any.
+		if client.Connections.Len() == 0 && len(client.WebSeeds) == 0 {
+			client.Logger.Warn().Msg("No peers found yet, waiting for more")
+		}
+
+		client.Logger.Info().Msg("Adding work to the queue")
+		for i := 0; i < len(client.Torrent.Info.Pieces); i++ {
+			if client.Storage.Have(i) {
+				continue
+			}
+			// The queue allocates the data once the piece is handed out.
+			client.Work.Push(&piece.Piece{
+				Index:  i,
+				Length: client.Torrent.PieceSize(i),
+				Hash:   client.Torrent.Info.Pieces[i],
+			})
+		}
 
-	client.Logger.Info().Msg("Adding work to channels")
-	for i := 0; i < len(client.Torrent.Info.Pieces); i++ {
-		client.Work <- piece.NewPiece(i, client.Torrent.Info.PieceLength, client.Torrent.Info.Pieces[i])
+		for _, ws := range client.WebSeeds {
+			client.Logger.Info().Msgf("Downloading from web seed %s", ws.URL)
+			ws.Rates = []*ratelimit.Pair{client.Rates, client.GlobalRates}
+			ws.Start()
+			defer ws.Stop()
+		}
 	}
 
-	client.Logger.Info().Msg("Activating peers for downloading..")
+	client.Logger.Info().Msg("Activating peers..")
+	defer client.closePeers()
+	client.PeersMutex.Lock()
 	for _, p := range client.Peers {
-		go p.StartDownload()
+		go client.runPeer(p)
+	}
+	client.running = true
+	client.seeding = seeding
+	client.PeersMutex.Unlock()
+
+	// Dialing starts once the run is under way, so that a dial that
+	// completes while not running is one that outlived it.
+	client.Connections.Start()
+	defer client.Connections.Close()
+
+	loops_stop := make(chan struct{})
+	defer close(loops_stop)
+	go client.chokeLoop(loops_stop)
+	if client.pexEnabled() {
+		go client.pexLoop(loops_stop)
 	}
 
-	client.DownloadBuffer = make([]byte, client.Torrent.Info.PieceLength*len(client.Torrent.Info.Pieces))
-	client.Logger.Info().Msgf("Download buffer has been initialized with size %d", len(client.DownloadBuffer))
+	if seeding {
+		client.Logger.Info().Msg("Seeding")
+		for client.left() == 0 {
+			select {
+			case <-client.filesChanged:
+			case <-stop:
+				client.Logger.Info().Msg("Seeding stopped")
+				return
+			}
+		}
+		client.Logger.Info().Msg("More pieces wanted, seeding stopped")
+		return
+	}
 
-	downloaded := 0
-downloadLoop:
-	for {
+	for client.left() > 0 {
 		select {
-		case piece := <-client.Results:
-			client.Downloaded += piece.Length
-			client.Left -= piece.Length
-			downloaded += 1
-			client.Logger.Info().Msgf("Downloaded piece #%d [%d/%d]", piece.Index, downloaded, len(client.Torrent.Info.Pieces))
-			copy(client.DownloadBuffer[piece.Index*client.Torrent.Info.PieceLength:], piece.Data)
-
-			if client.Left <= 0 {
-				client.Logger.Info().Msg("Download complete!")
-				break downloadLoop
+		case p := <-client.Results:
+			err := client.pieceDone(p)
+			if err != nil {
+				client.Logger.Error().Msgf("Failed to store piece #%d: %s", p.Index, err)
+				client.emit(Event{Type: EventStorageError, Piece: p.Index, Err: err})
+				return
 			}
+			client.broadcastHave(p.Index)
+		case <-client.filesChanged:
+		case <-stop:
+			client.Logger.Info().Msg("Download stopped")
+			return
 		}
 	}
 
-	downloaded_file, err := os.Create(client.Torrent.Info.Name)
+	client.Logger.Info().Msg("Download complete!")
+	client.emit(Event{Type: EventTorrentFinished})
+}
+
+// closePeers disconnects every peer once the run ends.
+func (client *Client) closePeers() {
+	client.PeersMutex.Lock()
+	defer client.PeersMutex.Unlock()
+
+	client.running = false
+	for _, p := range client.Peers {
+		p.Close()
+	}
+}
+
+// Availability returns, for every piece, the number of connected peers that
+// have it.
+func (client *Client) Availability() []int {
+	availability := make([]int, len(client.Torrent.Info.Pieces))
+
+	client.PeersMutex.Lock()
+	defer client.PeersMutex.Unlock()
+
+	for _, p := range client.Peers {
+		bitfield := p.Pieces()
+		for i := range availability {
+			if i/8 < len(bitfield) && bitfield.HasPiece(i) {
+				availability[i]++
+			}
+		}
+	}
+	return availability
+}
+
+// Recheck verifies the data on disk against the piece hashes, e.g. to pick
+// up the files of an earlier run, and returns the number of pieces found.
+// It must not run while downloading.
+func (client *Client) Recheck() (int, error) {
+	found := 0
+	for i := range client.Torrent.Info.Pieces {
+		if client.Storage.Verify(i) {
+			client.Work.Remove(i)
+			found++
+		}
+	}
+
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+	return found, client.applyPriorities()
+}
+
+// pieceDone stores a verified piece and updates the progress.
+func (client *Client) pieceDone(p *piece.Piece) error {
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	// A piece handed back by a peer of an earlier run may come in twice.
+	if client.Storage.Have(p.Index) {
+		return nil
+	}
+
+	start := time.Now()
+	err := client.Storage.WritePiece(p.Index, p.Data)
+	client.metrics.writeLatency.Since(start)
 	if err != nil {
-		client.Logger.Error().Msgf("Failed to create file: %s", err)
-		return
+		return err
+	}
+	p.Data = nil
+	client.Work.Remove(p.Index)
+
+	close(client.stored)
+	client.stored = make(chan struct{})
+
+	client.downloaded += p.Length
+	if client.Work.Priority(p.Index) != piece.PrioritySkip {
+		client.remaining -= p.Length
 	}
+	client.Logger.Info().Msgf("Downloaded piece #%d [%d bytes left]", p.Index, client.remaining)
 
-	downloaded_file.Write(client.DownloadBuffer)
+	client.emit(Event{Type: EventPieceVerified, Piece: p.Index})
+	for _, file := range client.completedFiles(p.Index) {
+		client.emit(Event{Type: EventFileCompleted, Piece: p.Index, File: file})
+	}
+	return nil
 }
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	// EventTorrentAdded is sent when a torrent is added to a session,
+	// including torrents restored by Load.
+	EventTorrentAdded EventType = iota
+
+	// EventMetadataReceived is sent once the info dictionary of a torrent
+	// is known. Torrents are added from .torrent files, which carry it, so
+	// it directly follows EventTorrentAdded.
+	EventMetadataReceived
+
+	// EventPieceVerified is sent for every piece that matched its hash and
+	// was written to disk.
+	EventPieceVerified
+
+	// EventHashFailed is sent for a piece that did not match its hash. Peer
+	// is nil if it came from a web seed.
+	EventHashFailed
+
+	// EventFileCompleted is sent when the last piece of a file was written.
+	EventFileCompleted
+
+	EventPeerConnected
+	EventPeerDisconnected
+
+	// EventTrackerAnnounced carries the tracker that answered and the
+	// number of peers it returned. Tracker is empty when announcing to all
+	// tiers.
+	EventTrackerAnnounced
+	EventTrackerError
+
+	// EventTorrentFinished is sent when the last wanted piece of a torrent
+	// was written.
+	EventTorrentFinished
+
+	// EventStorageError is sent when a piece could not be written, which
+	// stops the download.
+	EventStorageError
+)
+
+var eventNames = []string{
+	"torrent added", "metadata received", "piece verified", "hash failed",
+	"file completed", "peer connected", "peer disconnected",
+	"tracker announced", "tracker error", "torrent finished", "storage error",
+}
+
+func (event_type EventType) String() string {
+	if event_type < EventTorrentAdded || event_type > EventStorageError {
+		return fmt.Sprintf("EventType(%d)", int(event_type))
+	}
+	return eventNames[event_type]
+}
+
+// Event is something that happened to a torrent. Fields that do not apply
+// to the type of the event are zero.
+type Event struct {
+	Type     EventType
+	InfoHash [20]byte
+	Time     time.Time
+
+	Piece   int
+	File    int
+	Peer    net.Addr
+	Tracker string
+	Peers   int
+	Err     error
+}
+
+// subscriber queues events without limit, so that sending never waits for
+// the reader, and hands them to the channel in order.
+type subscriber struct {
+	events chan Event
+	mutex  sync.Mutex
+	queue  []Event
+	ready  chan struct{}
+	done   chan struct{}
+}
+
+func (s *subscriber) push(event Event) {
+	s.mutex.Lock()
+	s.queue = append(s.queue, event)
+	s.mutex.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	defer close(s.events)
+
+	for {
+		s.mutex.Lock()
+		if len(s.queue) == 0 {
+			s.mutex.Unlock()
+			select {
+			case <-s.ready:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mutex.Unlock()
+
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[*subscriber]bool
+}
+
+func (hub *eventHub) subscribe() (<-chan Event, func()) {
+	s := &subscriber{
+		events: make(chan Event),
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	hub.mutex.Lock()
+	if hub.subscribers == nil {
+		hub.subscribers = make(map[*subscriber]bool)
+	}
+	hub.subscribers[s] = true
+	hub.mutex.Unlock()
+
+	go s.run()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			hub.mutex.Lock()
+			delete(hub.subscribers, s)
+			hub.mutex.Unlock()
+			close(s.done)
+		})
+	}
+	return s.events, cancel
+}
+
+func (hub *eventHub) publish(event Event) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for s := range hub.subscribers {
+		s.push(event)
+	}
+}
+
+// Subscribe returns a channel with the events of the torrent from now on
+// and a function that stops them and closes the channel. Events are queued
+// without limit so that the download never waits for a subscriber, which
+// therefore has to keep reading until it cancels.
+func (client *Client) Subscribe() (<-chan Event, func()) {
+	return client.events.subscribe()
+}
+
+// Subscribe is like Client.Subscribe for the events of all torrents of the
+// session.
+func (session *Session) Subscribe() (<-chan Event, func()) {
+	return session.events.subscribe()
+}
+
+// emit sends an event of the client to its subscribers and those of its
+// session.
+func (client *Client) emit(event Event) {
+	event.InfoHash = client.Torrent.InfoHash
+	event.Time = time.Now()
+
+	client.events.publish(event)
+	if client.session != nil {
+		client.session.events.publish(event)
+	}
+}
+
+// completedFiles returns the files that are complete but would not be
+// without the piece at index.
+func (client *Client) completedFiles(index int) []int {
+	files := []int{}
+	for i := range client.Torrent.Files() {
+		begin, end := client.Torrent.FilePieces(i)
+		if index < begin || index >= end {
+			continue
+		}
+
+		complete := true
+		for j := begin; j < end && complete; j++ {
+			complete = client.Storage.Have(j)
+		}
+		if complete {
+			files = append(files, i)
+		}
+	}
+	return files
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+)
+
+const DefaultDownloadDir = "."
+
+// FilePriorities returns the priority of every file in the order of
+// Torrent.Files().
+func (client *Client) FilePriorities() []piece.Priority {
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+	return append([]piece.Priority{}, client.filePriorities...)
+}
+
+// SetFilePriority changes the priority of the file at index. It can be
+// called before and during the download.
+func (client *Client) SetFilePriority(index int, priority piece.Priority) error {
+	if index < 0 || index >= len(client.filePriorities) {
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	if priority < piece.PrioritySkip || priority > piece.PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	client.filePriorities[index] = priority
+	return client.applyPriorities()
+}
+
+// SelectFiles downloads only the files matching selection, see MatchFiles.
+func (client *Client) SelectFiles(selection string) error {
+	selected, err := MatchFiles(client.Torrent.Files(), selection)
+	if err != nil {
+		return err
+	}
+
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	for i := range client.filePriorities {
+		if !selected[i] {
+			client.filePriorities[i] = piece.PrioritySkip
+		} else if client.filePriorities[i] == piece.PrioritySkip {
+			client.filePriorities[i] = piece.PriorityNormal
+		}
+	}
+	return client.applyPriorities()
+}
+
+// applyPriorities gives every piece the highest priority of the files it
+// overlaps and recomputes what is left to download. The files mutex must be
+// held.
+func (client *Client) applyPriorities() error {
+	num_pieces := len(client.Torrent.Info.Pieces)
+	priorities := make([]piece.Priority, num_pieces)
+
+	for i, priority := range client.filePriorities {
+		begin, end := client.Torrent.FilePieces(i)
+		for j := begin; j < end; j++ {
+			priorities[j] = max(priorities[j], priority)
+		}
+
+		err := client.Storage.SetWanted(i, priority != piece.PrioritySkip)
+		if err != nil {
+			return err
+		}
+	}
+
+	client.readaheadWindow(priorities)
+
+	client.remaining = 0
+	for i, priority := range priorities {
+		client.Work.SetPriority(i, priority)
+		if priority != piece.PrioritySkip && !client.Storage.Have(i) {
+			client.remaining += client.Torrent.PieceSize(i)
+		}
+	}
+
+	select {
+	case client.filesChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (client *Client) left() int {
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+	return client.remaining
+}
+
+// Progress returns how many bytes of the wanted files are done and how many
+// are wanted in total.
+func (client *Client) Progress() (int, int) {
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	wanted := 0
+	for i := range client.Torrent.Info.Pieces {
+		if client.Work.Priority(i) != piece.PrioritySkip {
+			wanted += client.Torrent.PieceSize(i)
+		}
+	}
+	return wanted - client.remaining, wanted
+}
+
+// Transferred returns the bytes downloaded and uploaded over all runs.
+func (client *Client) Transferred() (int, int) {
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+	return client.downloaded, client.uploaded
+}
+
+// FileProgress returns how many bytes of every file are done.
+func (client *Client) FileProgress() []int {
+	piece_length := client.Torrent.Info.PieceLength
+	progress := []int{}
+	for i, file := range client.Torrent.Files() {
+		offset := client.Torrent.FileOffset(i)
+		begin, end := client.Torrent.FilePieces(i)
+
+		done := 0
+		for j := begin; j < end; j++ {
+			if client.Storage.Have(j) {
+				start := max(offset, j*piece_length)
+				stop := min(offset+file.Length, j*piece_length+client.Torrent.PieceSize(j))
+				done += stop - start
+			}
+		}
+		progress = append(progress, done)
+	}
+	return progress
+}
+
+// MatchFiles parses a comma separated list of file indices and glob
+// patterns, e.g. "0,3,*.mkv", and reports which files it selects. Patterns
+// are matched against the whole path of a file and against its name. Every
+// entry has to match at least one file.
+func MatchFiles(files []torrent.File, selection string) ([]bool, error) {
+	selected := make([]bool, len(files))
+	if strings.TrimSpace(selection) == "" {
+		return nil, fmt.Errorf("empty file selection")
+	}
+
+	for _, entry := range strings.Split(selection, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if index, err := strconv.Atoi(entry); err == nil {
+			if index < 0 || index >= len(files) {
+				return nil, fmt.Errorf("file index %d out of range", index)
+			}
+			selected[index] = true
+			continue
+		}
+
+		matched := false
+		for i, file := range files {
+			full_path := strings.Join(file.Path, "/")
+			ok, err := path.Match(entry, full_path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %s", entry, err)
+			}
+			if !ok && len(file.Path) > 0 {
+				ok, _ = path.Match(entry, file.Path[len(file.Path)-1])
+			}
+			if ok {
+				selected[i] = true
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no file matches %q", entry)
+		}
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<ul>
+{{range .Files}}<li><a href="{{.URL}}">{{.Path}}</a> ({{.Length}} bytes)</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type indexFile struct {
+	URL    string
+	Path   string
+	Length int
+}
+
+// Handler serves the files of the torrent over HTTP while they download.
+// "/" lists the files and "/files/<index>/<name>" serves one with support
+// for range requests, so players can seek.
+func (client *Client) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", client.serveIndex)
+	mux.HandleFunc("GET /files/{index}/{name...}", client.serveFile)
+	return mux
+}
+
+func (client *Client) serveIndex(w http.ResponseWriter, req *http.Request) {
+	files := []indexFile{}
+	for i, file := range client.Torrent.Files() {
+		name := file.Path[len(file.Path)-1]
+		files = append(files, indexFile{
+			URL:    "files/" + strconv.Itoa(i) + "/" + url.PathEscape(name),
+			Path:   strings.Join(file.Path, "/"),
+			Length: file.Length,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, map[string]any{
+		"Name":  client.Torrent.Info.Name,
+		"Files": files,
+	})
+}
+
+func (client *Client) serveFile(w http.ResponseWriter, req *http.Request) {
+	index, err := strconv.Atoi(req.PathValue("index"))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	reader, err := client.NewReader(index)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer reader.Close()
+
+	// A read blocked on a missing piece must end when the player goes away.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			reader.Close()
+		case <-done:
+		}
+	}()
+
+	file := client.Torrent.Files()[index]
+	http.ServeContent(w, req, file.Path[len(file.Path)-1], time.Time{}, reader)
+}
+
+var sessionTemplate = template.Must(template.New("session").Parse(`<!DOCTYPE html>
+<html>
+<head><title>p-torrent</title></head>
+<body>
+<ul>
+{{range .}}<li><a href="torrents/{{.InfoHash}}/">{{.Name}}</a> ({{.State}})</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// Handler serves the files of all torrents. "/" lists the torrents and
+// "/torrents/<info hash>/" is the Handler of each client.
+func (session *Session) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", session.serveIndex)
+	mux.HandleFunc("GET /torrents/{hash}/", session.serveTorrent)
+	return mux
+}
+
+func (session *Session) serveIndex(w http.ResponseWriter, req *http.Request) {
+	torrents := []map[string]any{}
+	for _, client := range session.Torrents() {
+		state, _ := session.State(client.Torrent.InfoHash)
+		torrents = append(torrents, map[string]any{
+			"InfoHash": hex.EncodeToString(client.Torrent.InfoHash[:]),
+			"Name":     client.Torrent.Info.Name,
+			"State":    state,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	sessionTemplate.Execute(w, torrents)
+}
+
+func (session *Session) serveTorrent(w http.ResponseWriter, req *http.Request) {
+	var info_hash [20]byte
+	decoded, err := hex.DecodeString(req.PathValue("hash"))
+	if err != nil || len(decoded) != len(info_hash) {
+		http.NotFound(w, req)
+		return
+	}
+	copy(info_hash[:], decoded)
+
+	client := session.Get(info_hash)
+	if client == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	prefix := "/torrents/" + req.PathValue("hash")
+	http.StripPrefix(prefix, client.Handler()).ServeHTTP(w, req)
+}
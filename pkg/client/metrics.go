@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/metrics"
+)
+
+// clientMetrics are the counters of a client that only matter for
+// monitoring.
+type clientMetrics struct {
+	hashFailures    metrics.Counter
+	wasted          metrics.Counter
+	announces       metrics.Counter
+	announceErrors  metrics.Counter
+	announceLatency *metrics.Histogram
+	writeLatency    *metrics.Histogram
+}
+
+func newClientMetrics() clientMetrics {
+	return clientMetrics{
+		announceLatency: metrics.NewHistogram(metrics.LatencyBuckets),
+		writeLatency:    metrics.NewHistogram(metrics.LatencyBuckets),
+	}
+}
+
+func (m *clientMetrics) observeAnnounce(start time.Time, err error) {
+	m.announceLatency.Since(start)
+	m.announces.Inc()
+	if err != nil {
+		m.announceErrors.Inc()
+	}
+}
+
+// hashFailed counts a downloaded piece that did not match its hash. addr is
+// the peer it came from, nil for web seeds.
+func (client *Client) hashFailed(index int, addr net.Addr) {
+	client.metrics.hashFailures.Inc()
+	client.metrics.wasted.Add(client.Torrent.PieceSize(index))
+	client.emit(Event{Type: EventHashFailed, Piece: index, Peer: addr})
+}
+
+func torrentLabels(c *Client) []metrics.Label {
+	return []metrics.Label{
+		{Name: "info_hash", Value: hex.EncodeToString(c.Torrent.InfoHash[:])},
+		{Name: "name", Value: c.Torrent.Info.Name},
+	}
+}
+
+// MetricsHandler serves the metrics of the session and its torrents in the
+// Prometheus text format.
+func (session *Session) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		session.writeMetrics(metrics.NewWriter(&buf))
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+func (session *Session) writeMetrics(w *metrics.Writer) {
+	torrents := session.Torrents()
+
+	states := make([]int, len(stateNames))
+	for _, c := range torrents {
+		state, err := session.State(c.Torrent.InfoHash)
+		if err == nil {
+			states[state]++
+		}
+	}
+	w.Family("ptorrent_torrents", "gauge", "Torrents of the session by state.")
+	for state, n := range states {
+		w.Sample("ptorrent_torrents", float64(n), metrics.Label{Name: "state", Value: stateNames[state]})
+	}
+
+	if session.Connections != nil {
+		w.Family("ptorrent_connections", "gauge", "Connected peers of all torrents.")
+		w.Sample("ptorrent_connections", float64(session.Connections.Peers()))
+		w.Family("ptorrent_half_open_connections", "gauge", "Outgoing connections that are still being established.")
+		w.Sample("ptorrent_half_open_connections", float64(session.Connections.HalfOpen()))
+	}
+
+	if session.DHT != nil {
+		w.Family("ptorrent_dht_nodes", "gauge", "Nodes in the DHT routing table.")
+		w.Sample("ptorrent_dht_nodes", float64(session.DHT.Table.Len()))
+	}
+
+	counter := func(name, help string, value func(c *Client) int) {
+		w.Family(name, "counter", help)
+		for _, c := range torrents {
+			w.Sample(name, float64(value(c)), torrentLabels(c)...)
+		}
+	}
+	gauge := func(name, help string, value func(c *Client) int) {
+		w.Family(name, "gauge", help)
+		for _, c := range torrents {
+			w.Sample(name, float64(value(c)), torrentLabels(c)...)
+		}
+	}
+	histogram := func(name, help string, value func(c *Client) *metrics.Histogram) {
+		w.Family(name, "histogram", help)
+		for _, c := range torrents {
+			w.Histogram(name, value(c), torrentLabels(c)...)
+		}
+	}
+
+	counter("ptorrent_downloaded_bytes_total", "Bytes of verified pieces downloaded.", func(c *Client) int {
+		downloaded, _ := c.Transferred()
+		return downloaded
+	})
+	counter("ptorrent_uploaded_bytes_total", "Bytes uploaded to peers.", func(c *Client) int {
+		_, uploaded := c.Transferred()
+		return uploaded
+	})
+	gauge("ptorrent_left_bytes", "Bytes of the wanted files that are still missing.", func(c *Client) int {
+		done, wanted := c.Progress()
+		return wanted - done
+	})
+	gauge("ptorrent_pieces", "Pieces of the torrent.", func(c *Client) int {
+		return len(c.Torrent.Info.Pieces)
+	})
+	gauge("ptorrent_pieces_completed", "Pieces that are downloaded and verified.", func(c *Client) int {
+		have, _ := c.Storage.Pieces()
+		completed := 0
+		for _, ok := range have {
+			if ok {
+				completed++
+			}
+		}
+		return completed
+	})
+	counter("ptorrent_hash_failures_total", "Downloaded pieces that did not match their hash.", func(c *Client) int {
+		return c.metrics.hashFailures.Value()
+	})
+	counter("ptorrent_wasted_bytes_total", "Bytes of downloaded pieces that did not match their hash.", func(c *Client) int {
+		return c.metrics.wasted.Value()
+	})
+
+	w.Family("ptorrent_peers", "gauge", "Connected peers by whether they choke us.")
+	for _, c := range torrents {
+		choked, unchoked := 0, 0
+		c.PeersMutex.Lock()
+		for _, p := range c.Peers {
+			if p.IsChoked() {
+				choked++
+			} else {
+				unchoked++
+			}
+		}
+		c.PeersMutex.Unlock()
+
+		labels := torrentLabels(c)
+		w.Sample("ptorrent_peers", float64(choked), append(labels, metrics.Label{Name: "state", Value: "choked"})...)
+		w.Sample("ptorrent_peers", float64(unchoked), append(labels, metrics.Label{Name: "state", Value: "unchoked"})...)
+	}
+
+	counter("ptorrent_tracker_announces_total", "Announces to the trackers.", func(c *Client) int {
+		return c.metrics.announces.Value()
+	})
+	counter("ptorrent_tracker_announce_errors_total", "Announces that no tracker answered.", func(c *Client) int {
+		return c.metrics.announceErrors.Value()
+	})
+	histogram("ptorrent_tracker_announce_duration_seconds", "Time an announce to the trackers took.", func(c *Client) *metrics.Histogram {
+		return c.metrics.announceLatency
+	})
+	histogram("ptorrent_disk_write_duration_seconds", "Time writing a piece to disk took.", func(c *Client) *metrics.Histogram {
+		return c.metrics.writeLatency
+	})
+}
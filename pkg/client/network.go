@@ -0,0 +1,289 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/mse"
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/utp"
+	"github.com/rs/zerolog"
+)
+
+const DefaultPort = 6881
+
+// Families records which address families we can use to reach peers.
+type Families struct {
+	mutex sync.Mutex
+
+	IPv4 net.IP
+	IPv6 net.IP
+
+	connectedIPv4 int
+	connectedIPv6 int
+}
+
+func isIPv4(addr net.Addr) bool {
+	tcp_addr, ok := addr.(*net.TCPAddr)
+	return !ok || tcp_addr.IP.To4() != nil
+}
+
+// DetectFamilies looks up the global unicast addresses of the local interfaces.
+func DetectFamilies() *Families {
+	families := &Families{}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return families
+	}
+
+	for _, addr := range addrs {
+		ip_net, ok := addr.(*net.IPNet)
+		if !ok || !ip_net.IP.IsGlobalUnicast() {
+			continue
+		}
+
+		if ip_net.IP.To4() != nil {
+			if families.IPv4 == nil {
+				families.IPv4 = ip_net.IP
+			}
+		} else if families.IPv6 == nil && !ip_net.IP.IsPrivate() {
+			families.IPv6 = ip_net.IP
+		}
+	}
+
+	return families
+}
+
+func (families *Families) Connected(addr net.Addr) {
+	families.mutex.Lock()
+	defer families.mutex.Unlock()
+
+	if isIPv4(addr) {
+		families.connectedIPv4++
+	} else {
+		families.connectedIPv6++
+	}
+}
+
+// Reachable drops the addresses of families we have no route for and orders the
+// rest so that the family with more successful connections is dialed first.
+func (families *Families) Reachable(addrs []net.Addr) []net.Addr {
+	families.mutex.Lock()
+	prefer_ipv6 := families.connectedIPv6 > families.connectedIPv4
+	has_ipv6 := families.IPv6 != nil
+	families.mutex.Unlock()
+
+	reachable := make([]net.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if !isIPv4(addr) && !has_ipv6 {
+			continue
+		}
+		reachable = append(reachable, addr)
+	}
+
+	sort.SliceStable(reachable, func(i, j int) bool {
+		return isIPv4(reachable[i]) != prefer_ipv6 && isIPv4(reachable[j]) == prefer_ipv6
+	})
+
+	return reachable
+}
+
+// incoming accepts the peer connections of a standalone client or of a
+// session, negotiates their encryption and hands them to the client of the
+// torrent they are for.
+type incoming struct {
+	encryption mse.Mode
+	logger     *zerolog.Logger
+
+	// keys returns the info hashes an encrypted handshake may use, lookup
+	// the client that takes connections for an info hash, if any.
+	keys   func() [][]byte
+	lookup func(info_hash [20]byte) *Client
+}
+
+// listen accepts incoming peer connections on both IPv4 and IPv6, over TCP
+// and, if enabled, over uTP on the same port.
+func (in *incoming) listen(port int, utp_enabled bool) ([]net.Listener, *utp.Socket, error) {
+	listeners := []net.Listener{}
+	for _, network := range []string{"tcp4", "tcp6"} {
+		listener, err := net.Listen(network, ":"+strconv.Itoa(port))
+		if err != nil {
+			in.logger.Warn().Msgf("Failed to listen on %s port %d: %s", network, port, err)
+			continue
+		}
+
+		listeners = append(listeners, listener)
+		go in.acceptLoop(listener)
+	}
+
+	var socket *utp.Socket
+	if utp_enabled {
+		var err error
+		socket, err = utp.Listen("udp", ":"+strconv.Itoa(port))
+		if err != nil {
+			in.logger.Warn().Msgf("Failed to listen for uTP on port %d: %s", port, err)
+		} else {
+			go in.acceptLoop(socket)
+		}
+	}
+
+	if len(listeners) == 0 && socket == nil {
+		return nil, nil, fmt.Errorf("failed to listen on port %d", port)
+	}
+
+	in.logger.Info().Msgf("Listening for peers on port %d", port)
+	return listeners, socket, nil
+}
+
+func (in *incoming) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go in.handle(conn)
+	}
+}
+
+// negotiate detects whether an incoming connection starts with MSE,
+// completes the encryption handshake if our mode allows it and returns the
+// info hash the peer asks for.
+func (in *incoming) negotiate(raw_conn net.Conn) (net.Conn, [20]byte, bool, error) {
+	var info_hash [20]byte
+
+	conn, plaintext, err := mse.Detect(raw_conn, peer.BitTorrentProtocolHeader)
+	if err != nil {
+		return nil, info_hash, false, err
+	}
+
+	if plaintext {
+		if in.encryption == mse.ModeForced {
+			return nil, info_hash, false, fmt.Errorf("plaintext connection refused")
+		}
+		conn, info_hash, err = peer.PeekInfoHash(conn)
+		return conn, info_hash, false, err
+	}
+
+	if in.encryption == mse.ModeDisabled {
+		return nil, info_hash, false, fmt.Errorf("encrypted connection refused")
+	}
+
+	encrypted_conn, skey, err := mse.Accept(conn, in.keys(), in.encryption.Select)
+	if err != nil {
+		return nil, info_hash, false, err
+	}
+	copy(info_hash[:], skey)
+	return encrypted_conn, info_hash, encrypted_conn.Method == mse.CryptoRC4, nil
+}
+
+// handle finds the torrent an incoming connection is for, from the info
+// hash of the handshake or the key of the encryption handshake.
+func (in *incoming) handle(raw_conn net.Conn) {
+	conn, info_hash, encrypted, err := in.negotiate(raw_conn)
+	if err != nil {
+		in.logger.Debug().Msgf("Rejected incoming peer %s: %s", raw_conn.RemoteAddr(), err)
+		raw_conn.Close()
+		return
+	}
+
+	client := in.lookup(info_hash)
+	if client == nil {
+		in.logger.Debug().Msgf("Rejected incoming peer %s: torrent %x is not active", raw_conn.RemoteAddr(), info_hash)
+		raw_conn.Close()
+		return
+	}
+
+	client.addIncoming(conn, encrypted)
+}
+
+// Listen accepts incoming peer connections for this torrent alone, see
+// Session.Listen for the listeners shared by several torrents.
+func (client *Client) Listen() error {
+	in := &incoming{
+		encryption: client.Encryption,
+		logger:     client.Logger,
+		keys: func() [][]byte {
+			return [][]byte{client.Torrent.InfoHash[:]}
+		},
+		lookup: func(info_hash [20]byte) *Client {
+			if info_hash != client.Torrent.InfoHash {
+				return nil
+			}
+			return client
+		},
+	}
+
+	listeners, socket, err := in.listen(client.Port, client.UTPEnabled)
+	if err != nil {
+		return err
+	}
+	client.Listeners = listeners
+	client.UTP = socket
+	return nil
+}
+
+// addIncoming completes the handshake of an incoming connection whose
+// encryption has been negotiated and runs the peer if the torrent runs.
+func (client *Client) addIncoming(conn net.Conn, encrypted bool) {
+	p := peer.NewIncomingPeer(conn, client.Work, client.Results, len(client.Torrent.Info.Pieces))
+	p.Encrypted = encrypted
+	client.configurePeer(p)
+
+	// The slot is taken before the handshake, so that a full client does
+	// not answer peers it is going to drop anyway.
+	if !client.Connections.Accept(p.Addr) {
+		client.Logger.Debug().Msgf("Rejected incoming peer %s: connection limit reached", p.Addr)
+		conn.Close()
+		return
+	}
+
+	err := p.ActivateIncoming(client.Torrent.InfoHash[:], client.PeerID[:])
+	if err != nil {
+		client.Logger.Debug().Msgf("Rejected incoming peer %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		client.Connections.Disconnected(p.Addr)
+		return
+	}
+
+	client.PeersMutex.Lock()
+	if _, ok := client.Peers[p.Addr.String()]; ok {
+		client.PeersMutex.Unlock()
+		conn.Close()
+		client.Connections.Disconnected(p.Addr)
+		return
+	}
+	client.Peers[p.Addr.String()] = p
+	running := client.running
+	client.PeersMutex.Unlock()
+
+	client.Logger.Info().Msgf("Accepted incoming peer: %s", p.Addr)
+	client.onPeerConnected(p)
+
+	if running {
+		go client.runPeer(p)
+	}
+}
+
+func (client *Client) Close() {
+	if client.session == nil {
+		for _, listener := range client.Listeners {
+			listener.Close()
+		}
+		client.Listeners = nil
+
+		if client.UTP != nil {
+			client.UTP.Close()
+			client.UTP = nil
+		}
+	}
+
+	err := client.Storage.Close()
+	if err != nil {
+		client.Logger.Error().Msgf("Failed to close files: %s", err)
+	}
+}
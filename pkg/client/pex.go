@@ -0,0 +1,162 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/pex"
+)
+
+type pexExtension struct {
+	client *Client
+}
+
+func (ext *pexExtension) Name() string {
+	return pex.ExtensionName
+}
+
+func (ext *pexExtension) HandleMessage(p *peer.Peer, payload []byte) error {
+	ext.client.handlePex(p, payload)
+	return nil
+}
+
+func (client *Client) pexEnabled() bool {
+	return !client.Torrent.Info.Private
+}
+
+func (client *Client) pexState(p *peer.Peer) *pex.State {
+	client.PeersMutex.Lock()
+	defer client.PeersMutex.Unlock()
+
+	state, ok := client.pexStates[p.Addr.String()]
+	if !ok {
+		state = pex.NewState()
+		client.pexStates[p.Addr.String()] = state
+	}
+	return state
+}
+
+// pexAddr returns the address other peers can connect to p on. Incoming
+// peers connected from an ephemeral port, so theirs is only known if their
+// extended handshake tells their listen port.
+func pexAddr(p *peer.Peer) (*net.TCPAddr, bool) {
+	tcp_addr, ok := p.Addr.(*net.TCPAddr)
+	if !ok || !p.Incoming {
+		return tcp_addr, ok
+	}
+
+	handshake := p.ExtendedHandshake()
+	if handshake == nil || handshake.Port <= 0 || handshake.Port > 65535 {
+		return nil, false
+	}
+	return &net.TCPAddr{IP: tcp_addr.IP, Port: handshake.Port, Zone: tcp_addr.Zone}, true
+}
+
+func (client *Client) connectedPeerInfo() []pex.PeerInfo {
+	client.PeersMutex.Lock()
+	defer client.PeersMutex.Unlock()
+
+	connected := make([]pex.PeerInfo, 0, len(client.Peers))
+	for _, p := range client.Peers {
+		if p.Conn == nil || !p.Responsive() {
+			continue
+		}
+		addr, ok := pexAddr(p)
+		if !ok {
+			continue
+		}
+
+		info := pex.PeerInfo{Addr: addr}
+		if !p.Incoming {
+			info.Flags |= pex.FlagReachable
+		}
+		if p.Encrypted {
+			info.Flags |= pex.FlagEncryption
+		}
+		if p.OverUTP {
+			info.Flags |= pex.FlagUTP
+		}
+		if p.HasAll() {
+			info.Flags |= pex.FlagSeed
+		}
+		connected = append(connected, info)
+	}
+	return connected
+}
+
+func (client *Client) pexLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(pex.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		connected := client.connectedPeerInfo()
+
+		client.PeersMutex.Lock()
+		targets := make([]*peer.Peer, 0, len(client.Peers))
+		for _, p := range client.Peers {
+			if p.Conn != nil && p.Responsive() && p.SupportsExtension(pex.ExtensionName) {
+				targets = append(targets, p)
+			}
+		}
+		client.PeersMutex.Unlock()
+
+		for _, p := range targets {
+			self, _ := pexAddr(p)
+			others := make([]pex.PeerInfo, 0, len(connected))
+			for _, info := range connected {
+				if self == nil || info.Addr.String() != self.String() {
+					others = append(others, info)
+				}
+			}
+
+			msg := client.pexState(p).Diff(others)
+			if msg == nil {
+				continue
+			}
+
+			payload, err := msg.Marshal()
+			if err != nil {
+				client.Logger.Error().Msgf("Failed to encode pex message: %s", err)
+				continue
+			}
+
+			err = p.SendExtended(pex.ExtensionName, payload)
+			if err != nil {
+				client.Logger.Debug().Msgf("Failed to send pex message to %s: %s", p.Addr, err)
+			}
+		}
+	}
+}
+
+func (client *Client) handlePex(p *peer.Peer, payload []byte) {
+	if !client.pexState(p).AllowReceive() {
+		client.Logger.Debug().Msgf("Dropping pex message from %s: too frequent", p.Addr)
+		return
+	}
+
+	msg, err := pex.Unmarshal(payload)
+	if err != nil {
+		client.Logger.Debug().Msgf("Invalid pex message from %s: %s", p.Addr, err)
+		return
+	}
+
+	added := msg.Added
+	if len(added) > pex.MaxPeersPerMessage {
+		added = added[:pex.MaxPeersPerMessage]
+	}
+
+	addrs := make([]net.Addr, len(added))
+	for i, info := range added {
+		addrs[i] = info.Addr
+	}
+
+	client.Logger.Debug().Msgf("Got %d peers via pex from %s", len(addrs), p.Addr)
+	client.addPeers(addrs)
+}
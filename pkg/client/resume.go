@@ -0,0 +1,283 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+)
+
+// SaveInterval is how often a session with a StateDir saves its torrents,
+// besides when it is closed.
+const SaveInterval = time.Minute
+
+const resumeExtension = ".resume"
+
+func packBits(bits []bool) string {
+	bitfield := make(peer.BitField, (len(bits)+7)/8)
+	for i, set := range bits {
+		if set {
+			bitfield.SetPiece(i)
+		}
+	}
+	return string(bitfield)
+}
+
+func unpackBits(packed string, n int) []bool {
+	bitfield := peer.BitField(packed)
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = i/8 < len(bitfield) && bitfield.HasPiece(i)
+	}
+	return bits
+}
+
+// resumeData encodes everything needed to pick the torrent up in a later
+// run: the torrent itself, where and which files are stored, the pieces
+// that are done and the statistics.
+func (client *Client) resumeData(paused bool, position int) ([]byte, error) {
+	torrent_bytes, err := client.Torrent.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	priorities := []any{}
+	for _, priority := range client.filePriorities {
+		priorities = append(priorities, int(priority))
+	}
+	have, parted := client.Storage.Pieces()
+
+	state := map[string]any{
+		"torrent":    torrent_bytes,
+		"dir":        client.Storage.Dir,
+		"priorities": priorities,
+		"sequential": 0,
+		"paused":     0,
+		"position":   position,
+		"have":       packBits(have),
+		"parted":     packBits(parted),
+		"downloaded": client.downloaded,
+		"uploaded":   client.uploaded,
+		"added":      int(client.Added.Unix()),
+		"active":     int(client.activeTime().Seconds()),
+	}
+	if client.Work.Sequential() {
+		state["sequential"] = 1
+	}
+	if paused {
+		state["paused"] = 1
+	}
+	return bencode.Marshal(state)
+}
+
+// restore applies the resume data of an earlier run to a client that has
+// not started yet.
+func (client *Client) restore(state map[string]any) {
+	if dir, ok := state["dir"].(string); ok && dir != "" {
+		client.Storage.Dir = dir
+	}
+	if sequential, _ := state["sequential"].(int); sequential != 0 {
+		client.Work.SetSequential(true)
+	}
+
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	priorities, _ := state["priorities"].([]any)
+	if len(priorities) == len(client.filePriorities) {
+		for i, value := range priorities {
+			priority, ok := value.(int)
+			if ok && piece.Priority(priority) >= piece.PrioritySkip && piece.Priority(priority) <= piece.PriorityHigh {
+				client.filePriorities[i] = piece.Priority(priority)
+			}
+		}
+	}
+
+	client.downloaded, _ = state["downloaded"].(int)
+	client.uploaded, _ = state["uploaded"].(int)
+	if added, ok := state["added"].(int); ok {
+		client.Added = time.Unix(int64(added), 0)
+	}
+	if active, ok := state["active"].(int); ok {
+		client.active = time.Duration(active) * time.Second
+	}
+
+	num_pieces := len(client.Torrent.Info.Pieces)
+	have, _ := state["have"].(string)
+	parted, _ := state["parted"].(string)
+	restored := client.Storage.Restore(unpackBits(have, num_pieces), unpackBits(parted, num_pieces))
+	client.Logger.Debug().Msgf("Restored %d of %d pieces", restored, num_pieces)
+
+	err := client.applyPriorities()
+	if err != nil {
+		client.Logger.Error().Msgf("Failed to restore the file priorities: %s", err)
+	}
+}
+
+// loadState reads a state file written by Save.
+func loadState(filename string) (*torrent.Torrent, map[string]any, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoded, err := bencode.UnMarshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state, ok := decoded.(map[string]any)
+	torrent_bytes, _ := state["torrent"].(string)
+	if !ok || torrent_bytes == "" {
+		return nil, nil, fmt.Errorf("invalid state file")
+	}
+
+	t, err := torrent.NewTorrentFromBencode([]byte(torrent_bytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, state, nil
+}
+
+func (session *Session) statePath(info_hash [20]byte) string {
+	return filepath.Join(session.StateDir, hex.EncodeToString(info_hash[:])+resumeExtension)
+}
+
+// Load adds the torrents saved in StateDir with their saved files, pieces,
+// statistics and queue position, and keeps saving them every SaveInterval
+// until the session is closed. Torrents that were not paused are resumed
+// without checking their data again, use Recheck for that.
+func (session *Session) Load() error {
+	err := os.MkdirAll(session.StateDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(session.StateDir)
+	if err != nil {
+		return err
+	}
+
+	type saved struct {
+		torrent *torrent.Torrent
+		state   map[string]any
+	}
+	torrents := []saved{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), resumeExtension) {
+			continue
+		}
+
+		t, state, err := loadState(filepath.Join(session.StateDir, entry.Name()))
+		if err != nil {
+			session.Logger.Warn().Msgf("Ignoring state file %s: %s", entry.Name(), err)
+			continue
+		}
+		torrents = append(torrents, saved{t, state})
+	}
+
+	sort.SliceStable(torrents, func(i, j int) bool {
+		a, _ := torrents[i].state["position"].(int)
+		b, _ := torrents[j].state["position"].(int)
+		return a < b
+	})
+
+	restored := 0
+	for _, saved := range torrents {
+		client, err := session.Add(saved.torrent, true)
+		if err != nil {
+			session.Logger.Warn().Msgf("Failed to restore %s: %s", saved.torrent.Info.Name, err)
+			continue
+		}
+		client.restore(saved.state)
+		restored++
+
+		if paused, _ := saved.state["paused"].(int); paused == 0 {
+			session.Resume(saved.torrent.InfoHash)
+		}
+	}
+	session.Logger.Info().Msgf("Restored %d torrents", restored)
+
+	go session.saveLoop()
+	return nil
+}
+
+func (session *Session) saveLoop() {
+	ticker := time.NewTicker(SaveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		session.mutex.Lock()
+		closed := session.closed
+		session.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		err := session.Save()
+		if err != nil {
+			session.Logger.Error().Msgf("Failed to save the session: %s", err)
+		}
+	}
+}
+
+// Save writes the state of every torrent to a file in StateDir.
+func (session *Session) Save() error {
+	session.saveMutex.Lock()
+	defer session.saveMutex.Unlock()
+
+	files := map[string][]byte{}
+	var first error
+
+	session.mutex.Lock()
+	for position, info_hash := range session.order {
+		st := session.torrents[info_hash]
+		data, err := st.client.resumeData(st.state == StatePaused, position)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		files[session.statePath(info_hash)] = data
+	}
+	session.mutex.Unlock()
+
+	for path, data := range files {
+		err := writeFileAtomic(path, data)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// removeState forgets a removed torrent. The save mutex must be held.
+func (session *Session) removeState(info_hash [20]byte) {
+	err := os.Remove(session.statePath(info_hash))
+	if err != nil && !os.IsNotExist(err) {
+		session.Logger.Error().Msgf("Failed to remove the state of %x: %s", info_hash, err)
+	}
+}
+
+// writeFileAtomic replaces the file at path, so a crash while saving leaves
+// the previous state intact.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
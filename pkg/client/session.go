@@ -0,0 +1,596 @@
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/connmgr"
+	"github.com/DarkPhoenix42/p-torrent/pkg/dht"
+	"github.com/DarkPhoenix42/p-torrent/pkg/lsd"
+	"github.com/DarkPhoenix42/p-torrent/pkg/mse"
+	"github.com/DarkPhoenix42/p-torrent/pkg/ratelimit"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/DarkPhoenix42/p-torrent/pkg/utp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultActiveDownloads = 3
+	DefaultActiveSeeds     = 5
+)
+
+type State int
+
+const (
+	StateQueued State = iota
+	StateChecking
+	StateDownloading
+	StateSeeding
+	StatePaused
+)
+
+var stateNames = []string{"queued", "checking", "downloading", "seeding", "paused"}
+
+func (state State) String() string {
+	if state < StateQueued || state > StatePaused {
+		return fmt.Sprintf("State(%d)", int(state))
+	}
+	return stateNames[state]
+}
+
+type sessionTorrent struct {
+	client *Client
+	state  State
+
+	// stop ends the current run and is nil while the torrent neither
+	// downloads nor seeds. done is closed once the last run or check has
+	// ended.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Session runs many torrents in one process. They share the listeners, the
+// peer ID, the global rate limits and connection caps, the DHT and local
+// service discovery. A queue limits how many torrents download and seed at
+// once; the others wait in the order they were added. Zero limits mean
+// unlimited. With a StateDir the torrents survive restarts, see Load.
+type Session struct {
+	PeerID             [20]byte
+	Port               int
+	UTPEnabled         bool
+	Encryption         mse.Mode
+	AnnounceToAllTiers bool
+	DownloadDir        string
+	StateDir           string
+	DHT                *dht.DHT
+	LSD                *lsd.Service
+	GlobalRates        *ratelimit.Pair
+	Connections        *connmgr.Limits
+	Families           *Families
+	Logger             *zerolog.Logger
+
+	Listeners []net.Listener
+	UTP       *utp.Socket
+
+	mutex           sync.Mutex
+	changed         *sync.Cond
+	torrents        map[[20]byte]*sessionTorrent
+	order           [][20]byte
+	activeDownloads int
+	activeSeeds     int
+	uploadSlots     int
+	closed          bool
+	saveMutex       sync.Mutex
+	events          eventHub
+}
+
+func NewSession(logger *zerolog.Logger) *Session {
+	session := &Session{
+		Port:            DefaultPort,
+		DownloadDir:     DefaultDownloadDir,
+		GlobalRates:     ratelimit.NewPair(0, 0),
+		Families:        DetectFamilies(),
+		Logger:          logger,
+		torrents:        make(map[[20]byte]*sessionTorrent),
+		activeDownloads: DefaultActiveDownloads,
+		activeSeeds:     DefaultActiveSeeds,
+		uploadSlots:     DefaultUploadSlots,
+	}
+	session.changed = sync.NewCond(&session.mutex)
+
+	_, err := rand.Read(session.PeerID[:])
+	if err != nil {
+		panic(err)
+	}
+	return session
+}
+
+// Listen opens the listeners all torrents share. It has to be called before
+// torrents are added.
+func (session *Session) Listen() error {
+	in := &incoming{
+		encryption: session.Encryption,
+		logger:     session.Logger,
+		keys:       session.runningKeys,
+		lookup:     session.runningClient,
+	}
+
+	listeners, socket, err := in.listen(session.Port, session.UTPEnabled)
+	if err != nil {
+		return err
+	}
+	session.Listeners = listeners
+	session.UTP = socket
+	return nil
+}
+
+// runningKeys returns the info hashes of the downloading and seeding
+// torrents, which are the keys an encrypted handshake may use.
+func (session *Session) runningKeys() [][]byte {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	keys := [][]byte{}
+	for info_hash, st := range session.torrents {
+		if st.state == StateDownloading || st.state == StateSeeding {
+			keys = append(keys, info_hash[:])
+		}
+	}
+	return keys
+}
+
+// runningClient returns the client of a downloading or seeding torrent,
+// the only ones that take incoming peers.
+func (session *Session) runningClient(info_hash [20]byte) *Client {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	st, ok := session.torrents[info_hash]
+	if !ok || (st.state != StateDownloading && st.state != StateSeeding) {
+		return nil
+	}
+	return st.client
+}
+
+// Add adds a torrent to the end of the queue. Paused torrents wait for
+// Resume, e.g. to select files first.
+func (session *Session) Add(t *torrent.Torrent, paused bool) (*Client, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.closed {
+		return nil, fmt.Errorf("session closed")
+	}
+	if _, ok := session.torrents[t.InfoHash]; ok {
+		return nil, fmt.Errorf("torrent %x already added", t.InfoHash)
+	}
+
+	logger := session.Logger.With().Str("torrent", t.Info.Name).Logger()
+	client := NewClient(t, &logger)
+	client.session = session
+	client.PeerID = session.PeerID
+	client.Port = session.Port
+	client.UTP = session.UTP
+	client.Encryption = session.Encryption
+	client.AnnounceToAllTiers = session.AnnounceToAllTiers
+	client.DHT = session.DHT
+	client.LSD = session.LSD
+	client.Families = session.Families
+	client.GlobalRates = session.GlobalRates
+	client.Connections.Global = session.Connections
+	client.Storage.Dir = session.DownloadDir
+	client.SetUploadSlots(session.uploadSlots)
+	if len(session.Listeners) > 0 || session.UTP != nil {
+		client.Extensions.ListenPort = session.Port
+	}
+
+	st := &sessionTorrent{client: client, state: StateQueued}
+	if paused {
+		st.state = StatePaused
+	}
+	session.torrents[t.InfoHash] = st
+	session.order = append(session.order, t.InfoHash)
+	client.emit(Event{Type: EventTorrentAdded})
+	client.emit(Event{Type: EventMetadataReceived})
+
+	session.update()
+	return client, nil
+}
+
+func (session *Session) get(info_hash [20]byte) (*sessionTorrent, error) {
+	st, ok := session.torrents[info_hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown torrent %x", info_hash)
+	}
+	return st, nil
+}
+
+// Get returns the client of a torrent or nil.
+func (session *Session) Get(info_hash [20]byte) *Client {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	st, ok := session.torrents[info_hash]
+	if !ok {
+		return nil
+	}
+	return st.client
+}
+
+// Torrents returns the clients of all torrents in queue order.
+func (session *Session) Torrents() []*Client {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	clients := make([]*Client, 0, len(session.order))
+	for _, info_hash := range session.order {
+		clients = append(clients, session.torrents[info_hash].client)
+	}
+	return clients
+}
+
+func (session *Session) State(info_hash [20]byte) (State, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	st, err := session.get(info_hash)
+	if err != nil {
+		return StateQueued, err
+	}
+	return st.state, nil
+}
+
+// Remove stops a torrent and forgets it. With delete_data its files are
+// deleted once the download has stopped.
+func (session *Session) Remove(info_hash [20]byte, delete_data bool) error {
+	// A Save that is under way must not write the state back.
+	session.saveMutex.Lock()
+	defer session.saveMutex.Unlock()
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	st, err := session.get(info_hash)
+	if err != nil {
+		return err
+	}
+	if session.StateDir != "" {
+		session.removeState(info_hash)
+	}
+
+	session.stopRun(st)
+	delete(session.torrents, info_hash)
+	for i, queued := range session.order {
+		if queued == info_hash {
+			session.order = append(session.order[:i], session.order[i+1:]...)
+			break
+		}
+	}
+	session.update()
+
+	done := st.done
+	go func() {
+		if done != nil {
+			<-done
+		}
+		st.client.Close()
+		if delete_data {
+			err := st.client.Storage.Remove()
+			if err != nil {
+				st.client.Logger.Error().Msgf("Failed to delete data: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Pause stops a torrent until Resume is called.
+func (session *Session) Pause(info_hash [20]byte) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	st, err := session.get(info_hash)
+	if err != nil {
+		return err
+	}
+
+	session.stopRun(st)
+	st.state = StatePaused
+	session.update()
+	return nil
+}
+
+// Resume puts a paused torrent back into the queue.
+func (session *Session) Resume(info_hash [20]byte) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	st, err := session.get(info_hash)
+	if err != nil {
+		return err
+	}
+
+	if st.state == StatePaused {
+		st.state = StateQueued
+		session.update()
+	}
+	return nil
+}
+
+// Recheck stops a torrent, verifies its data on disk and queues it again,
+// unless it was paused.
+func (session *Session) Recheck(info_hash [20]byte) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	st, err := session.get(info_hash)
+	if err != nil {
+		return err
+	}
+	if st.state == StateChecking {
+		return nil
+	}
+
+	paused := st.state == StatePaused
+	session.stopRun(st)
+	st.state = StateChecking
+
+	prev := st.done
+	done := make(chan struct{})
+	st.done = done
+	session.update()
+
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+
+		found, err := st.client.Recheck()
+		if err != nil {
+			st.client.Logger.Error().Msgf("Recheck failed: %s", err)
+		} else {
+			st.client.Logger.Info().Msgf("Recheck found %d of %d pieces", found, len(st.client.Torrent.Info.Pieces))
+		}
+
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+
+		if st.state == StateChecking {
+			st.state = StateQueued
+			if paused {
+				st.state = StatePaused
+			}
+		}
+		session.update()
+	}()
+	return nil
+}
+
+// SetActiveDownloads limits how many torrents download at once.
+func (session *Session) SetActiveDownloads(n int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.activeDownloads = n
+	session.update()
+}
+
+// SetActiveSeeds limits how many completed torrents seed at once.
+func (session *Session) SetActiveSeeds(n int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.activeSeeds = n
+	session.update()
+}
+
+// SetUploadSlots limits how many peers every torrent uploads to at once.
+func (session *Session) SetUploadSlots(n int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.uploadSlots = n
+	for _, st := range session.torrents {
+		st.client.SetUploadSlots(n)
+	}
+}
+
+// ActiveLimits returns how many torrents download and seed at once.
+func (session *Session) ActiveLimits() (int, int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.activeDownloads, session.activeSeeds
+}
+
+// SetDownloadDir changes where torrents added from now on are stored.
+func (session *Session) SetDownloadDir(dir string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.DownloadDir = dir
+}
+
+// DownloadDirectory returns where torrents added from now on are stored.
+func (session *Session) DownloadDirectory() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.DownloadDir
+}
+
+// startRun starts downloading or seeding a torrent once its previous run has
+// ended. The mutex must be held.
+func (session *Session) startRun(st *sessionTorrent, state State) {
+	stop := make(chan struct{})
+	prev := st.done
+	done := make(chan struct{})
+
+	st.state = state
+	st.stop = stop
+	st.done = done
+
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+
+		switch {
+		case stopped(stop):
+		case state == StateSeeding:
+			st.client.seed(stop)
+		default:
+			st.client.download(stop)
+		}
+		session.finished(st, stop)
+	}()
+}
+
+// stopRun ends the current run of a torrent. The mutex must be held.
+func (session *Session) stopRun(st *sessionTorrent) {
+	if st.stop != nil {
+		close(st.stop)
+		st.stop = nil
+	}
+}
+
+// finished handles a run that ended. A run that was not stopped either
+// completed, or gave up, e.g. after a storage error, and is paused. A seed
+// run ends on its own when more pieces are wanted.
+func (session *Session) finished(st *sessionTorrent, stop chan struct{}) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if st.stop == stop {
+		st.stop = nil
+		if st.client.left() == 0 {
+			st.state = StateQueued
+		} else {
+			st.client.Logger.Warn().Msg("Download stopped, pausing the torrent")
+			st.state = StatePaused
+		}
+	}
+	session.update()
+}
+
+// update enforces the queue limits: surplus torrents go back to the queue
+// and queued torrents take free slots in the order they were added. The
+// mutex must be held.
+func (session *Session) update() {
+	if session.closed {
+		session.changed.Broadcast()
+		return
+	}
+
+	downloads, seeds := 0, 0
+	for _, info_hash := range session.order {
+		st := session.torrents[info_hash]
+		switch st.state {
+		case StateDownloading:
+			if session.activeDownloads > 0 && downloads >= session.activeDownloads {
+				session.stopRun(st)
+				st.state = StateQueued
+			} else {
+				downloads++
+			}
+		case StateSeeding:
+			if session.activeSeeds > 0 && seeds >= session.activeSeeds {
+				session.stopRun(st)
+				st.state = StateQueued
+			} else {
+				seeds++
+			}
+		}
+	}
+
+	for _, info_hash := range session.order {
+		st := session.torrents[info_hash]
+		if st.state != StateQueued {
+			continue
+		}
+
+		if st.client.left() == 0 {
+			if session.activeSeeds == 0 || seeds < session.activeSeeds {
+				st.client.Logger.Info().Msg("Starting to seed")
+				session.startRun(st, StateSeeding)
+				seeds++
+			}
+		} else if session.activeDownloads == 0 || downloads < session.activeDownloads {
+			st.client.Logger.Info().Msg("Starting download")
+			session.startRun(st, StateDownloading)
+			downloads++
+		}
+	}
+
+	session.changed.Broadcast()
+}
+
+// busy reports whether a torrent is still checking, downloading or waiting
+// for a download slot. The mutex must be held.
+func (session *Session) busy() bool {
+	for _, st := range session.torrents {
+		switch st.state {
+		case StateChecking, StateDownloading:
+			return true
+		case StateQueued:
+			if st.client.left() > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wait blocks until no torrent is left to download, that is until every
+// torrent is complete or paused, or the session is closed.
+func (session *Session) Wait() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	for !session.closed && session.busy() {
+		session.changed.Wait()
+	}
+}
+
+// Close stops all torrents and the shared listeners, and saves the torrents
+// if there is a StateDir.
+func (session *Session) Close() {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return
+	}
+	session.closed = true
+	runs := []chan struct{}{}
+	clients := []*Client{}
+	for _, st := range session.torrents {
+		session.stopRun(st)
+		if st.done != nil {
+			runs = append(runs, st.done)
+		}
+		clients = append(clients, st.client)
+	}
+	session.changed.Broadcast()
+	session.mutex.Unlock()
+
+	for _, done := range runs {
+		<-done
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+
+	if session.StateDir != "" {
+		err := session.Save()
+		if err != nil {
+			session.Logger.Error().Msgf("Failed to save the session: %s", err)
+		}
+	}
+
+	for _, listener := range session.Listeners {
+		listener.Close()
+	}
+	if session.UTP != nil {
+		session.UTP.Close()
+	}
+}
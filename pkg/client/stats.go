@@ -0,0 +1,120 @@
+package client
+
+import "time"
+
+// Stats is a snapshot of the progress and transfers of a torrent. Sizes are
+// in bytes and rates in bytes per second.
+type Stats struct {
+	// Size is the length of the torrent, Wanted that of the files that are
+	// not skipped, of which Done are complete and Left are missing.
+	Size   int
+	Wanted int
+	Done   int
+	Left   int
+
+	// Files are the bytes done of every file, Pieces tells which pieces
+	// are complete.
+	Files  []int
+	Pieces []bool
+
+	// Downloaded and Uploaded count the payload of all runs. Wasted counts
+	// the pieces that failed their hash check.
+	Downloaded   int
+	Uploaded     int
+	Wasted       int
+	HashFailures int
+
+	// DownloadRate and UploadRate are measured over the last few seconds
+	// and include protocol overhead. The averages are over the active time.
+	DownloadRate        float64
+	UploadRate          float64
+	AverageDownloadRate float64
+	AverageUploadRate   float64
+
+	// ETA is the time the missing bytes take at the current rate, or -1 if
+	// nothing is being downloaded.
+	ETA   time.Duration
+	Ratio float64
+
+	// Seeders and Leechers are the connected peers with and without every
+	// piece, the swarm counts are those of the last tracker announce.
+	Seeders       int
+	Leechers      int
+	SwarmSeeders  int
+	SwarmLeechers int
+
+	// Active is the time spent downloading over all runs.
+	Added  time.Time
+	Active time.Duration
+}
+
+// setActive starts or stops counting the active time.
+func (client *Client) setActive(active bool) {
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	if active {
+		client.activeSince = time.Now()
+	} else if !client.activeSince.IsZero() {
+		client.active += time.Since(client.activeSince)
+		client.activeSince = time.Time{}
+	}
+}
+
+// activeTime returns the time spent downloading, including the current run.
+// The files mutex must be held.
+func (client *Client) activeTime() time.Duration {
+	if client.activeSince.IsZero() {
+		return client.active
+	}
+	return client.active + time.Since(client.activeSince)
+}
+
+// Stats returns a snapshot of the progress and transfers of the torrent. It
+// is safe to call while the torrent runs.
+func (client *Client) Stats() Stats {
+	stats := Stats{
+		Size:         client.Torrent.GetLength(),
+		Files:        client.FileProgress(),
+		Wasted:       client.metrics.wasted.Value(),
+		HashFailures: client.metrics.hashFailures.Value(),
+		DownloadRate: client.Rates.Download.Meter.Rate(),
+		UploadRate:   client.Rates.Upload.Meter.Rate(),
+		ETA:          -1,
+	}
+	stats.Pieces, _ = client.Storage.Pieces()
+	stats.Done, stats.Wanted = client.Progress()
+	stats.Left = stats.Wanted - stats.Done
+
+	client.filesMutex.Lock()
+	stats.Downloaded, stats.Uploaded = client.downloaded, client.uploaded
+	stats.SwarmSeeders, stats.SwarmLeechers = client.seeders, client.leechers
+	stats.Added = client.Added
+	stats.Active = client.activeTime()
+	client.filesMutex.Unlock()
+
+	if stats.Active > 0 {
+		stats.AverageDownloadRate = float64(stats.Downloaded) / stats.Active.Seconds()
+		stats.AverageUploadRate = float64(stats.Uploaded) / stats.Active.Seconds()
+	}
+	if stats.Left == 0 {
+		stats.ETA = 0
+	} else if stats.DownloadRate >= 1 {
+		stats.ETA = time.Duration(float64(stats.Left) / stats.DownloadRate * float64(time.Second))
+	}
+	if stats.Downloaded > 0 {
+		stats.Ratio = float64(stats.Uploaded) / float64(stats.Downloaded)
+	}
+
+	client.PeersMutex.Lock()
+	for _, p := range client.Peers {
+		if p.HasAll() {
+			stats.Seeders++
+		} else {
+			stats.Leechers++
+		}
+	}
+	client.PeersMutex.Unlock()
+
+	return stats
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+)
+
+// DefaultReadahead is how far ahead of a reader pieces are downloaded first.
+const DefaultReadahead = 8 << 20
+
+var ErrReaderClosed = errors.New("reader closed")
+
+// SetSequential switches the piece selection between random and in-order,
+// which lets media players start before the download is complete.
+func (client *Client) SetSequential(sequential bool) {
+	client.Work.SetSequential(sequential)
+}
+
+// readaheadWindow applies PriorityNow to the pieces in front of every open
+// reader. The files mutex must be held.
+func (client *Client) readaheadWindow(priorities []piece.Priority) {
+	piece_length := client.Torrent.Info.PieceLength
+	window := max(1, (client.Readahead+piece_length-1)/piece_length)
+
+	for r, current := range client.readers {
+		_, end := client.Torrent.FilePieces(r.file)
+		for i := current; i < min(current+window, end); i++ {
+			priorities[i] = piece.PriorityNow
+		}
+	}
+}
+
+// waitPiece blocks until the piece at index is stored or cancel is closed.
+func (client *Client) waitPiece(index int, cancel <-chan struct{}) error {
+	for {
+		client.filesMutex.Lock()
+		have := client.Storage.Have(index)
+		stored := client.stored
+		client.filesMutex.Unlock()
+
+		if have {
+			return nil
+		}
+
+		select {
+		case <-stored:
+		case <-cancel:
+			return ErrReaderClosed
+		}
+	}
+}
+
+// Reader reads a file of the torrent while it downloads. Reads block until
+// the pieces they need have arrived, and the pieces after the read position
+// are downloaded before everything else. Reading a skipped file downloads
+// the pieces it reads, so a download has to be running.
+type Reader struct {
+	client *Client
+	file   int
+	offset int64
+	length int64
+	pos    int64
+
+	data       []byte
+	data_index int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReader opens the file at index for reading.
+func (client *Client) NewReader(index int) (*Reader, error) {
+	files := client.Torrent.Files()
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("file index %d out of range", index)
+	}
+
+	r := &Reader{
+		client:     client,
+		file:       index,
+		offset:     int64(client.Torrent.FileOffset(index)),
+		length:     int64(files[index].Length),
+		data_index: -1,
+		closed:     make(chan struct{}),
+	}
+
+	begin, _ := client.Torrent.FilePieces(index)
+
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	client.readers[r] = begin
+	return r, client.applyPriorities()
+}
+
+// moveTo moves the readahead window of r to the piece at index.
+func (client *Client) moveTo(r *Reader, index int) error {
+	client.filesMutex.Lock()
+	defer client.filesMutex.Unlock()
+
+	current, ok := client.readers[r]
+	if !ok {
+		return ErrReaderClosed
+	}
+	if current == index {
+		return nil
+	}
+
+	client.readers[r] = index
+	return client.applyPriorities()
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+
+	piece_length := int64(r.client.Torrent.Info.PieceLength)
+	position := r.offset + r.pos
+	index := int(position / piece_length)
+
+	if index != r.data_index {
+		err := r.client.moveTo(r, index)
+		if err != nil {
+			return 0, err
+		}
+
+		err = r.client.waitPiece(index, r.closed)
+		if err != nil {
+			return 0, err
+		}
+
+		r.data, err = r.client.Storage.ReadPiece(index)
+		if err != nil {
+			return 0, err
+		}
+		r.data_index = index
+	}
+
+	begin := position - int64(index)*piece_length
+	n := copy(b[:min(int64(len(b)), r.length-r.pos)], r.data[begin:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return r.pos, fmt.Errorf("negative position %d", offset)
+	}
+	r.pos = offset
+	return r.pos, nil
+}
+
+// Close unblocks a pending Read and gives the readahead window back.
+func (r *Reader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+
+		r.client.filesMutex.Lock()
+		defer r.client.filesMutex.Unlock()
+
+		delete(r.client.readers, r)
+		r.client.applyPriorities()
+	})
+	return nil
+}
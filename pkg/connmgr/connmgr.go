@@ -0,0 +1,366 @@
+package connmgr
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxPeers    = 50
+	DefaultMaxHalfOpen = 8
+
+	MinBackoff   = 30 * time.Second
+	MaxBackoff   = 30 * time.Minute
+	MaxFailures  = 8
+	FillInterval = time.Second
+)
+
+// Limits caps the number of connections and half-open dials. The managers of
+// all torrents share one Limits for the global caps. Zero means unlimited.
+type Limits struct {
+	mutex sync.Mutex
+
+	MaxPeers    int
+	MaxHalfOpen int
+
+	peers     int
+	half_open int
+}
+
+func NewLimits(max_peers, max_half_open int) *Limits {
+	return &Limits{MaxPeers: max_peers, MaxHalfOpen: max_half_open}
+}
+
+func (limits *Limits) acquireHalfOpen() bool {
+	if limits == nil {
+		return true
+	}
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	if limits.MaxHalfOpen > 0 && limits.half_open >= limits.MaxHalfOpen {
+		return false
+	}
+	if limits.MaxPeers > 0 && limits.peers+limits.half_open >= limits.MaxPeers {
+		return false
+	}
+	limits.half_open++
+	return true
+}
+
+func (limits *Limits) releaseHalfOpen(connected bool) {
+	if limits == nil {
+		return
+	}
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	limits.half_open--
+	if connected {
+		limits.peers++
+	}
+}
+
+func (limits *Limits) acquirePeer() bool {
+	if limits == nil {
+		return true
+	}
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	if limits.MaxPeers > 0 && limits.peers+limits.half_open >= limits.MaxPeers {
+		return false
+	}
+	limits.peers++
+	return true
+}
+
+func (limits *Limits) releasePeer() {
+	if limits == nil {
+		return
+	}
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	limits.peers--
+}
+
+// SetMaxPeers changes the connection cap, e.g. when the config is reloaded.
+// Connections above a lowered cap are kept until they close.
+func (limits *Limits) SetMaxPeers(max_peers int) {
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	limits.MaxPeers = max_peers
+}
+
+func (limits *Limits) Peers() int {
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	return limits.peers
+}
+
+func (limits *Limits) HalfOpen() int {
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	return limits.half_open
+}
+
+const (
+	stateIdle = iota
+	stateDialing
+	stateConnected
+)
+
+type candidate struct {
+	addr         net.Addr
+	state        int
+	incoming     bool
+	failures     int
+	next_attempt time.Time
+}
+
+// DialFunc connects to a peer. It returns once the handshake has completed.
+type DialFunc func(addr net.Addr) error
+
+// Manager keeps the pool of candidate peer addresses of a torrent and dials
+// them while the connection limits allow, retrying failed addresses with
+// exponential backoff.
+type Manager struct {
+	mutex      sync.Mutex
+	candidates map[string]*candidate
+	dial       DialFunc
+
+	Limits *Limits
+	Global *Limits
+
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxFailures int
+	Now         func() time.Time
+
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+func New(limits, global *Limits, dial DialFunc) *Manager {
+	return &Manager{
+		candidates:  make(map[string]*candidate),
+		dial:        dial,
+		Limits:      limits,
+		Global:      global,
+		MinBackoff:  MinBackoff,
+		MaxBackoff:  MaxBackoff,
+		MaxFailures: MaxFailures,
+		Now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (m *Manager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add puts new addresses into the pool and returns how many were unknown.
+func (m *Manager) Add(addrs []net.Addr) int {
+	m.mutex.Lock()
+	added := 0
+	for _, addr := range addrs {
+		if _, ok := m.candidates[addr.String()]; ok {
+			continue
+		}
+		m.candidates[addr.String()] = &candidate{addr: addr}
+		added++
+	}
+	m.mutex.Unlock()
+
+	if added > 0 {
+		m.notify()
+	}
+	return added
+}
+
+// Accept registers an incoming connection. It returns false if the limits are
+// reached or we are already connected to or dialing the address.
+func (m *Manager) Accept(addr net.Addr) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.candidates[addr.String()]
+	if ok && c.state != stateIdle {
+		return false
+	}
+
+	if !m.Limits.acquirePeer() {
+		return false
+	}
+	if !m.Global.acquirePeer() {
+		m.Limits.releasePeer()
+		return false
+	}
+
+	if !ok {
+		c = &candidate{addr: addr, incoming: true}
+		m.candidates[addr.String()] = c
+	}
+	c.state = stateConnected
+	c.failures = 0
+	return true
+}
+
+// Disconnected frees the slot of a peer that went away so that another
+// candidate can take it. Outgoing addresses are retried after a backoff.
+func (m *Manager) Disconnected(addr net.Addr) {
+	m.mutex.Lock()
+	c, ok := m.candidates[addr.String()]
+	if !ok || c.state != stateConnected {
+		m.mutex.Unlock()
+		return
+	}
+
+	m.Limits.releasePeer()
+	m.Global.releasePeer()
+
+	if c.incoming {
+		// The remote port of an incoming connection is not a listen port.
+		delete(m.candidates, addr.String())
+	} else {
+		c.state = stateIdle
+		c.next_attempt = m.Now().Add(m.MinBackoff)
+	}
+	m.mutex.Unlock()
+
+	m.notify()
+}
+
+func (m *Manager) backoff(failures int) time.Duration {
+	delay := m.MinBackoff
+	for i := 1; i < failures && delay < m.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, m.MaxBackoff)
+}
+
+// Fill dials candidates until the half-open or connection limits are reached.
+// Addresses that failed the least are tried first.
+func (m *Manager) Fill() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.Now()
+	ready := []*candidate{}
+	for _, c := range m.candidates {
+		if c.state == stateIdle && !c.next_attempt.After(now) {
+			ready = append(ready, c)
+		}
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		if ready[i].failures != ready[j].failures {
+			return ready[i].failures < ready[j].failures
+		}
+		return ready[i].next_attempt.Before(ready[j].next_attempt)
+	})
+
+	for _, c := range ready {
+		if !m.Limits.acquireHalfOpen() {
+			return
+		}
+		if !m.Global.acquireHalfOpen() {
+			m.Limits.releaseHalfOpen(false)
+			return
+		}
+
+		c.state = stateDialing
+		go m.connect(c)
+	}
+}
+
+func (m *Manager) connect(c *candidate) {
+	err := m.dial(c.addr)
+
+	m.mutex.Lock()
+	connected := err == nil
+	m.Limits.releaseHalfOpen(connected)
+	m.Global.releaseHalfOpen(connected)
+
+	if connected {
+		c.state = stateConnected
+		c.failures = 0
+	} else {
+		c.state = stateIdle
+		c.failures++
+		c.next_attempt = m.Now().Add(m.backoff(c.failures))
+		if c.failures >= m.MaxFailures {
+			delete(m.candidates, c.addr.String())
+		}
+	}
+	m.mutex.Unlock()
+
+	m.notify()
+}
+
+// Start keeps the connection slots filled until Close is called. A closed
+// manager can be started again.
+func (m *Manager) Start() {
+	m.mutex.Lock()
+	if m.closed != nil {
+		m.mutex.Unlock()
+		return
+	}
+	closed := make(chan struct{})
+	m.closed = closed
+	m.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(FillInterval)
+		defer ticker.Stop()
+
+		for {
+			m.Fill()
+
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			case <-m.wake:
+			}
+		}
+	}()
+}
+
+func (m *Manager) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed != nil {
+		close(m.closed)
+		m.closed = nil
+	}
+}
+
+// Len returns the number of known addresses, including connected ones.
+func (m *Manager) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.candidates)
+}
+
+func (m *Manager) String() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counts := [3]int{}
+	for _, c := range m.candidates {
+		counts[c.state]++
+	}
+	return fmt.Sprintf("%d connected, %d dialing, %d waiting", counts[stateConnected], counts[stateDialing], counts[stateIdle])
+}
@@ -0,0 +1,536 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+	"github.com/rs/zerolog"
+)
+
+const (
+	QueryTimeout    = 2 * time.Second
+	SecretRotation  = 5 * time.Minute
+	PeerExpiry      = 30 * time.Minute
+	RefreshInterval = 15 * time.Minute
+	MaxStoredPeers  = 200
+)
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type Config struct {
+	Address        string
+	BootstrapNodes []string
+	StateFile      string
+	Logger         *zerolog.Logger
+}
+
+type DHT struct {
+	ID    NodeID
+	Table *RoutingTable
+
+	conn   *net.UDPConn
+	config Config
+	logger *zerolog.Logger
+
+	mutex    sync.Mutex
+	pending  map[string]chan *Message
+	next_tid uint16
+
+	secrets_mutex sync.RWMutex
+	secret        [20]byte
+	prev_secret   [20]byte
+
+	peers_mutex sync.Mutex
+	peers       map[[20]byte]map[string]time.Time
+
+	closed    chan struct{}
+	close_err sync.Once
+}
+
+func New(config Config) (*DHT, error) {
+	if config.Logger == nil {
+		logger := zerolog.Nop()
+		config.Logger = &logger
+	}
+
+	d := &DHT{
+		ID:      RandomNodeID(),
+		config:  config,
+		logger:  config.Logger,
+		pending: make(map[string]chan *Message),
+		peers:   make(map[[20]byte]map[string]time.Time),
+		closed:  make(chan struct{}),
+	}
+	rand.Read(d.secret[:])
+	d.prev_secret = d.secret
+
+	nodes := []*Node{}
+	if config.StateFile != "" {
+		id, saved_nodes, err := LoadState(config.StateFile)
+		if err == nil {
+			d.ID = id
+			nodes = saved_nodes
+		} else if !os.IsNotExist(err) {
+			d.logger.Warn().Msgf("Failed to load DHT state: %s", err)
+		}
+	}
+
+	d.Table = NewRoutingTable(d.ID)
+	for _, n := range nodes {
+		d.Table.Insert(n)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (d *DHT) Start() {
+	go d.readLoop()
+	go d.maintenance()
+}
+
+func (d *DHT) Close() error {
+	var err error
+	d.close_err.Do(func() {
+		close(d.closed)
+		if d.config.StateFile != "" {
+			err = d.SaveState(d.config.StateFile)
+		}
+		d.conn.Close()
+	})
+	return err
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 65536)
+	backoff := time.Duration(0)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Errors like ICMP unreachables come and go, but a broken socket
+			// fails every read, so wait longer each time instead of spinning.
+			backoff = min(max(2*backoff, 10*time.Millisecond), time.Second)
+			d.logger.Warn().Msgf("Reading from the DHT socket failed, retrying in %s: %s", backoff, err)
+			select {
+			case <-d.closed:
+				return
+			case <-time.After(backoff):
+				continue
+			}
+		}
+		backoff = 0
+
+		msg, err := parseMessage(buf[:n], addr)
+		if err != nil {
+			d.logger.Debug().Msgf("Dropping malformed DHT packet from %s: %s", addr, err)
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg)
+		case "r", "e":
+			d.mutex.Lock()
+			ch, ok := d.pending[msg.T]
+			delete(d.pending, msg.T)
+			d.mutex.Unlock()
+
+			if ok {
+				ch <- msg
+			}
+		}
+	}
+}
+
+func (d *DHT) maintenance() {
+	rotate := time.NewTicker(SecretRotation)
+	refresh := time.NewTicker(RefreshInterval)
+	defer rotate.Stop()
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+
+		case <-rotate.C:
+			d.secrets_mutex.Lock()
+			d.prev_secret = d.secret
+			rand.Read(d.secret[:])
+			d.secrets_mutex.Unlock()
+			d.expirePeers()
+
+		case <-refresh.C:
+			for _, n := range d.Table.Stale(RefreshInterval) {
+				go d.Ping(n.Addr)
+			}
+		}
+	}
+}
+
+func (d *DHT) send(msg *Message, addr *net.UDPAddr) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]any) (*Message, error) {
+	d.mutex.Lock()
+	d.next_tid++
+	tid := make([]byte, 2)
+	binary.BigEndian.PutUint16(tid, d.next_tid)
+	ch := make(chan *Message, 1)
+	d.pending[string(tid)] = ch
+	d.mutex.Unlock()
+
+	args["id"] = string(d.ID[:])
+	msg := &Message{T: string(tid), Y: "q", Q: method, A: args}
+
+	err := d.send(msg, addr)
+	if err != nil {
+		d.mutex.Lock()
+		delete(d.pending, string(tid))
+		d.mutex.Unlock()
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if err := resp.err(); err != nil {
+			return nil, err
+		}
+
+		id, ok := resp.senderID()
+		if !ok {
+			return nil, fmt.Errorf("response from %s has no valid id", addr)
+		}
+
+		d.Table.Insert(&Node{ID: id, Addr: addr})
+		return resp, nil
+
+	case <-time.After(QueryTimeout):
+		d.mutex.Lock()
+		delete(d.pending, string(tid))
+		d.mutex.Unlock()
+
+		for _, n := range d.Table.Nodes() {
+			if n.Addr.String() == addr.String() {
+				d.Table.Failed(n.ID)
+			}
+		}
+		return nil, fmt.Errorf("query %s to %s timed out", method, addr)
+
+	case <-d.closed:
+		return nil, fmt.Errorf("dht closed")
+	}
+}
+
+func (d *DHT) Ping(addr *net.UDPAddr) error {
+	_, err := d.query(addr, "ping", map[string]any{})
+	return err
+}
+
+func nodesFromResponse(r map[string]any) []*Node {
+	nodes := []*Node{}
+	if compact, ok := r["nodes"].(string); ok {
+		decoded, err := DecodeNodes(compact, false)
+		if err == nil {
+			nodes = append(nodes, decoded...)
+		}
+	}
+	if compact, ok := r["nodes6"].(string); ok {
+		decoded, err := DecodeNodes(compact, true)
+		if err == nil {
+			nodes = append(nodes, decoded...)
+		}
+	}
+	return nodes
+}
+
+func (d *DHT) FindNode(addr *net.UDPAddr, target NodeID) ([]*Node, error) {
+	resp, err := d.query(addr, "find_node", map[string]any{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	return nodesFromResponse(resp.R), nil
+}
+
+// GetPeers asks a single node for peers of the info hash. It returns the peers
+// it knows about, or nodes closer to the info hash, plus a token for announcing.
+func (d *DHT) GetPeers(addr *net.UDPAddr, info_hash [20]byte) ([]net.Addr, []*Node, string, error) {
+	resp, err := d.query(addr, "get_peers", map[string]any{"info_hash": string(info_hash[:])})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	token, _ := resp.R["token"].(string)
+	values, _ := resp.R["values"].([]any)
+	return decodePeers(values), nodesFromResponse(resp.R), token, nil
+}
+
+func (d *DHT) AnnouncePeer(addr *net.UDPAddr, info_hash [20]byte, port int, token string) error {
+	_, err := d.query(addr, "announce_peer", map[string]any{
+		"info_hash":    string(info_hash[:]),
+		"port":         port,
+		"token":        token,
+		"implied_port": 0,
+	})
+	return err
+}
+
+// AddNode pings the address and adds it to the routing table if it responds.
+func (d *DHT) AddNode(addr *net.UDPAddr) {
+	go d.Ping(addr)
+}
+
+func (d *DHT) Bootstrap() error {
+	bootstrap_nodes := d.config.BootstrapNodes
+	if bootstrap_nodes == nil {
+		bootstrap_nodes = DefaultBootstrapNodes
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range bootstrap_nodes {
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			d.logger.Debug().Msgf("Failed to resolve bootstrap node %s: %s", host, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			nodes, err := d.FindNode(addr, d.ID)
+			if err != nil {
+				d.logger.Debug().Msgf("Bootstrap node %s failed: %s", addr, err)
+				return
+			}
+			for _, n := range nodes {
+				d.Table.Insert(n)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if d.Table.Len() == 0 {
+		return fmt.Errorf("no bootstrap node responded")
+	}
+
+	d.lookup(d.ID, false)
+	d.logger.Info().Msgf("DHT bootstrapped with %d nodes", d.Table.Len())
+	return nil
+}
+
+func (d *DHT) token(ip net.IP, secret [20]byte) string {
+	hash := sha1.New()
+	hash.Write(secret[:])
+	hash.Write(ip)
+	return string(hash.Sum(nil)[:8])
+}
+
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	d.secrets_mutex.RLock()
+	defer d.secrets_mutex.RUnlock()
+	return token == d.token(ip, d.secret) || token == d.token(ip, d.prev_secret)
+}
+
+func (d *DHT) storePeer(info_hash [20]byte, addr *net.TCPAddr) {
+	d.peers_mutex.Lock()
+	defer d.peers_mutex.Unlock()
+
+	peers, ok := d.peers[info_hash]
+	if !ok {
+		peers = make(map[string]time.Time)
+		d.peers[info_hash] = peers
+	}
+
+	if len(peers) < MaxStoredPeers {
+		peers[string(encodeCompactAddr(&net.UDPAddr{IP: addr.IP, Port: addr.Port}))] = time.Now()
+	}
+}
+
+func (d *DHT) storedPeers(info_hash [20]byte) []any {
+	d.peers_mutex.Lock()
+	defer d.peers_mutex.Unlock()
+
+	values := []any{}
+	for compact := range d.peers[info_hash] {
+		values = append(values, compact)
+	}
+	return values
+}
+
+func (d *DHT) expirePeers() {
+	d.peers_mutex.Lock()
+	defer d.peers_mutex.Unlock()
+
+	for info_hash, peers := range d.peers {
+		for compact, announced := range peers {
+			if time.Since(announced) > PeerExpiry {
+				delete(peers, compact)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, info_hash)
+		}
+	}
+}
+
+func (d *DHT) handleQuery(msg *Message) {
+	id, ok := msg.senderID()
+	if !ok {
+		d.sendError(msg, ErrProtocol, "invalid id")
+		return
+	}
+	d.Table.Insert(&Node{ID: id, Addr: msg.Addr})
+
+	r := map[string]any{"id": string(d.ID[:])}
+
+	switch msg.Q {
+	case "ping":
+
+	case "find_node":
+		target, ok := msg.A["target"].(string)
+		if !ok || len(target) != 20 {
+			d.sendError(msg, ErrProtocol, "invalid target")
+			return
+		}
+		d.addClosestNodes(r, target)
+
+	case "get_peers":
+		info_hash, ok := msg.A["info_hash"].(string)
+		if !ok || len(info_hash) != 20 {
+			d.sendError(msg, ErrProtocol, "invalid info_hash")
+			return
+		}
+
+		d.secrets_mutex.RLock()
+		r["token"] = d.token(msg.Addr.IP, d.secret)
+		d.secrets_mutex.RUnlock()
+
+		var key [20]byte
+		copy(key[:], info_hash)
+		if values := d.storedPeers(key); len(values) > 0 {
+			r["values"] = values
+		} else {
+			d.addClosestNodes(r, info_hash)
+		}
+
+	case "announce_peer":
+		info_hash, ok := msg.A["info_hash"].(string)
+		token, _ := msg.A["token"].(string)
+		port, _ := msg.A["port"].(int)
+		implied_port, _ := msg.A["implied_port"].(int)
+
+		if !ok || len(info_hash) != 20 {
+			d.sendError(msg, ErrProtocol, "invalid info_hash")
+			return
+		}
+		if !d.validToken(token, msg.Addr.IP) {
+			d.sendError(msg, ErrProtocol, "bad token")
+			return
+		}
+		if implied_port != 0 {
+			port = msg.Addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(msg, ErrProtocol, "invalid port")
+			return
+		}
+
+		var key [20]byte
+		copy(key[:], info_hash)
+		d.storePeer(key, &net.TCPAddr{IP: msg.Addr.IP, Port: port})
+
+	default:
+		d.sendError(msg, ErrMethodUnknown, "method unknown")
+		return
+	}
+
+	d.send(&Message{T: msg.T, Y: "r", R: r}, msg.Addr)
+}
+
+func (d *DHT) addClosestNodes(r map[string]any, target string) {
+	var id NodeID
+	copy(id[:], target)
+
+	nodes, nodes6 := EncodeNodes(d.Table.Closest(id, K))
+	r["nodes"] = nodes
+	if nodes6 != "" {
+		r["nodes6"] = nodes6
+	}
+}
+
+func (d *DHT) sendError(msg *Message, code int, message string) {
+	d.send(&Message{T: msg.T, Y: "e", E: []any{code, message}}, msg.Addr)
+}
+
+func (d *DHT) SaveState(filename string) error {
+	nodes, nodes6 := EncodeNodes(d.Table.Nodes())
+	data, err := bencode.Marshal(map[string]any{
+		"id":     string(d.ID[:]),
+		"nodes":  nodes,
+		"nodes6": nodes6,
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, data, 0644)
+}
+
+func LoadState(filename string) (NodeID, []*Node, error) {
+	var id NodeID
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return id, nil, err
+	}
+
+	decoded, err := bencode.UnMarshal(data)
+	if err != nil {
+		return id, nil, err
+	}
+
+	state, ok := decoded.(map[string]any)
+	saved_id, _ := state["id"].(string)
+	if !ok || len(saved_id) != len(id) {
+		return id, nil, fmt.Errorf("invalid dht state file")
+	}
+	copy(id[:], saved_id)
+
+	return id, nodesFromResponse(state), nil
+}
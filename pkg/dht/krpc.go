@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+)
+
+const (
+	ErrGeneric       = 201
+	ErrServer        = 202
+	ErrProtocol      = 203
+	ErrMethodUnknown = 204
+)
+
+// Message is a KRPC query, response or error as described in BEP 5.
+type Message struct {
+	T string
+	Y string
+	Q string
+	A map[string]any
+	R map[string]any
+	E []any
+
+	Addr *net.UDPAddr
+}
+
+func parseMessage(data []byte, addr *net.UDPAddr) (*Message, error) {
+	decoded, err := bencode.UnMarshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("krpc message is not a dict")
+	}
+
+	msg := &Message{Addr: addr}
+	msg.T, _ = dict["t"].(string)
+	msg.Y, _ = dict["y"].(string)
+
+	switch msg.Y {
+	case "q":
+		msg.Q, _ = dict["q"].(string)
+		msg.A, ok = dict["a"].(map[string]any)
+	case "r":
+		msg.R, ok = dict["r"].(map[string]any)
+	case "e":
+		msg.E, ok = dict["e"].([]any)
+	default:
+		ok = false
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("malformed krpc message")
+	}
+	return msg, nil
+}
+
+func (msg *Message) encode() ([]byte, error) {
+	dict := map[string]any{
+		"t": msg.T,
+		"y": msg.Y,
+	}
+
+	switch msg.Y {
+	case "q":
+		dict["q"] = msg.Q
+		dict["a"] = msg.A
+	case "r":
+		dict["r"] = msg.R
+	case "e":
+		dict["e"] = msg.E
+	}
+
+	return bencode.Marshal(dict)
+}
+
+func (msg *Message) senderID() (NodeID, bool) {
+	args := msg.A
+	if msg.Y == "r" {
+		args = msg.R
+	}
+
+	var id NodeID
+	str, ok := args["id"].(string)
+	if !ok || len(str) != len(id) {
+		return id, false
+	}
+
+	copy(id[:], str)
+	return id, true
+}
+
+func (msg *Message) err() error {
+	if msg.Y != "e" {
+		return nil
+	}
+
+	code, message := 0, ""
+	if len(msg.E) > 0 {
+		code, _ = msg.E[0].(int)
+	}
+	if len(msg.E) > 1 {
+		message, _ = msg.E[1].(string)
+	}
+	return fmt.Errorf("krpc error %d: %s", code, message)
+}
@@ -0,0 +1,157 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+const (
+	Alpha           = 3
+	MaxLookupRounds = 20
+)
+
+type candidate struct {
+	node      *Node
+	queried   bool
+	responded bool
+	token     string
+}
+
+// lookup performs an iterative Kademlia search for the target. For get_peers
+// lookups it also collects the peers returned along the way.
+func (d *DHT) lookup(target NodeID, get_peers bool) ([]net.Addr, []*candidate) {
+	candidates := map[NodeID]*candidate{}
+	for _, n := range d.Table.Closest(target, K) {
+		candidates[n.ID] = &candidate{node: n}
+	}
+
+	var mutex sync.Mutex
+	peers := []net.Addr{}
+	seen_peers := map[string]bool{}
+
+	closest := func() []*candidate {
+		sorted := make([]*candidate, 0, len(candidates))
+		for _, c := range candidates {
+			sorted = append(sorted, c)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return target.Closer(sorted[i].node.ID, sorted[j].node.ID)
+		})
+		return sorted
+	}
+
+	for round := 0; round < MaxLookupRounds; round++ {
+		mutex.Lock()
+		to_query := []*candidate{}
+		responded := 0
+		for _, c := range closest() {
+			if responded >= K || len(to_query) >= Alpha {
+				break
+			}
+			if c.responded {
+				responded++
+			} else if !c.queried {
+				c.queried = true
+				to_query = append(to_query, c)
+			}
+		}
+		mutex.Unlock()
+
+		if len(to_query) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range to_query {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+
+				var found_peers []net.Addr
+				var nodes []*Node
+				var token string
+				var err error
+
+				if get_peers {
+					found_peers, nodes, token, err = d.GetPeers(c.node.Addr, [20]byte(target))
+				} else {
+					nodes, err = d.FindNode(c.node.Addr, target)
+				}
+				if err != nil {
+					return
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				c.responded = true
+				c.token = token
+				for _, p := range found_peers {
+					if !seen_peers[p.String()] {
+						seen_peers[p.String()] = true
+						peers = append(peers, p)
+					}
+				}
+				for _, n := range nodes {
+					if _, ok := candidates[n.ID]; !ok && n.ID != d.ID {
+						candidates[n.ID] = &candidate{node: n}
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	closest_responded := []*candidate{}
+	for _, c := range closest() {
+		if c.responded {
+			closest_responded = append(closest_responded, c)
+		}
+		if len(closest_responded) == K {
+			break
+		}
+	}
+
+	return peers, closest_responded
+}
+
+// Peers searches the DHT for peers of the info hash.
+func (d *DHT) Peers(info_hash [20]byte) ([]net.Addr, error) {
+	if d.Table.Len() == 0 {
+		return nil, fmt.Errorf("routing table is empty")
+	}
+
+	peers, _ := d.lookup(NodeID(info_hash), true)
+	return peers, nil
+}
+
+// Announce searches the DHT for peers of the info hash and announces that we
+// accept connections on the given port to the closest nodes.
+func (d *DHT) Announce(info_hash [20]byte, port int) ([]net.Addr, error) {
+	if d.Table.Len() == 0 {
+		return nil, fmt.Errorf("routing table is empty")
+	}
+
+	peers, closest := d.lookup(NodeID(info_hash), true)
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			err := d.AnnouncePeer(c.node.Addr, info_hash, port, c.token)
+			if err != nil {
+				d.logger.Debug().Msgf("announce_peer to %s failed: %s", c.node, err)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return peers, nil
+}
@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"time"
+)
+
+type NodeID [20]byte
+
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) Xor(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// CommonPrefixLen returns the number of leading bits shared by both ids.
+func (id NodeID) CommonPrefixLen(other NodeID) int {
+	distance := id.Xor(other)
+	for i, b := range distance {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return len(id) * 8
+}
+
+// Closer reports whether a is closer to the target than b.
+func (target NodeID) Closer(a, b NodeID) bool {
+	da, db := target.Xor(a), target.Xor(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+type Node struct {
+	ID       NodeID
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	Failures int
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("%x@%s", n.ID[:4], n.Addr)
+}
+
+func encodeCompactAddr(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], uint16(addr.Port))
+	return buf
+}
+
+func decodeCompactAddr(data []byte) (*net.UDPAddr, error) {
+	if len(data) != 6 && len(data) != 18 {
+		return nil, fmt.Errorf("invalid compact address length %d", len(data))
+	}
+
+	ip := make(net.IP, len(data)-2)
+	copy(ip, data)
+	port := binary.BigEndian.Uint16(data[len(data)-2:])
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// EncodeNodes serialises nodes into the compact "nodes" (IPv4) and "nodes6" (IPv6) strings.
+func EncodeNodes(nodes []*Node) (string, string) {
+	var nodes4, nodes6 bytes.Buffer
+	for _, n := range nodes {
+		if n.Addr.IP.To4() != nil {
+			nodes4.Write(n.ID[:])
+			nodes4.Write(encodeCompactAddr(n.Addr))
+		} else {
+			nodes6.Write(n.ID[:])
+			nodes6.Write(encodeCompactAddr(n.Addr))
+		}
+	}
+	return nodes4.String(), nodes6.String()
+}
+
+func DecodeNodes(data string, ipv6 bool) ([]*Node, error) {
+	size := 26
+	if ipv6 {
+		size = 38
+	}
+
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid compact nodes length %d", len(data))
+	}
+
+	nodes := make([]*Node, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		n := &Node{}
+		copy(n.ID[:], data[i:i+20])
+		addr, err := decodeCompactAddr([]byte(data[i+20 : i+size]))
+		if err != nil {
+			return nil, err
+		}
+		n.Addr = addr
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func decodePeers(values []any) []net.Addr {
+	peers := make([]net.Addr, 0, len(values))
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		addr, err := decodeCompactAddr([]byte(str))
+		if err != nil {
+			continue
+		}
+		peers = append(peers, &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	return peers
+}
@@ -0,0 +1,150 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	K           = 8
+	MaxFailures = 3
+)
+
+// RoutingTable keeps up to K nodes per bucket, where bucket i holds the nodes
+// sharing exactly i leading bits with our own id.
+type RoutingTable struct {
+	mutex   sync.RWMutex
+	self    NodeID
+	buckets [161][]*Node
+}
+
+func NewRoutingTable(self NodeID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+func (table *RoutingTable) bucketIndex(id NodeID) int {
+	return table.self.CommonPrefixLen(id)
+}
+
+// Insert adds or refreshes a node. It returns false if the node was dropped
+// because its bucket is full of good nodes.
+func (table *RoutingTable) Insert(n *Node) bool {
+	if n.ID == table.self {
+		return false
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	index := table.bucketIndex(n.ID)
+	bucket := table.buckets[index]
+
+	for i, existing := range bucket {
+		if existing.ID == n.ID {
+			existing.Addr = n.Addr
+			existing.LastSeen = time.Now()
+			existing.Failures = 0
+			table.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), existing)
+			return true
+		}
+	}
+
+	n.LastSeen = time.Now()
+	if len(bucket) < K {
+		table.buckets[index] = append(bucket, n)
+		return true
+	}
+
+	for i, existing := range bucket {
+		if existing.Failures >= MaxFailures {
+			table.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (table *RoutingTable) Failed(id NodeID) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, n := range table.buckets[table.bucketIndex(id)] {
+		if n.ID == id {
+			n.Failures++
+			return
+		}
+	}
+}
+
+func (table *RoutingTable) Remove(id NodeID) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	index := table.bucketIndex(id)
+	bucket := table.buckets[index]
+	for i, n := range bucket {
+		if n.ID == id {
+			table.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to count good nodes ordered by distance to the target.
+func (table *RoutingTable) Closest(target NodeID, count int) []*Node {
+	nodes := table.Nodes()
+
+	good := nodes[:0]
+	for _, n := range nodes {
+		if n.Failures < MaxFailures {
+			good = append(good, n)
+		}
+	}
+
+	sort.Slice(good, func(i, j int) bool {
+		return target.Closer(good[i].ID, good[j].ID)
+	})
+
+	if len(good) > count {
+		good = good[:count]
+	}
+	return good
+}
+
+func (table *RoutingTable) Nodes() []*Node {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	nodes := []*Node{}
+	for _, bucket := range table.buckets {
+		for _, n := range bucket {
+			copied := *n
+			nodes = append(nodes, &copied)
+		}
+	}
+	return nodes
+}
+
+func (table *RoutingTable) Len() int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	count := 0
+	for _, bucket := range table.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// Stale returns the nodes that have not been heard from within the given duration.
+func (table *RoutingTable) Stale(age time.Duration) []*Node {
+	stale := []*Node{}
+	for _, n := range table.Nodes() {
+		if time.Since(n.LastSeen) > age {
+			stale = append(stale, n)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,348 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	Interval      = 5 * time.Minute
+	MaxHashesSent = 10
+)
+
+var (
+	MulticastIPv4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	MulticastIPv6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// PacketConn is the subset of net.PacketConn used by the service, so that
+// tests can replace the multicast socket with an in-memory stand-in.
+type PacketConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Close() error
+}
+
+type groupConn struct {
+	conn  PacketConn
+	group *net.UDPAddr
+}
+
+type Announce struct {
+	Port       int
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+// Service implements Local Service Discovery as described in BEP 14.
+type Service struct {
+	Port   int
+	Logger *zerolog.Logger
+
+	cookie   string
+	conns    []groupConn
+	mutex    sync.Mutex
+	torrents map[[20]byte]func(addr net.Addr)
+	recent   map[string]time.Time
+	closed   chan struct{}
+}
+
+func New(port int, logger *zerolog.Logger) *Service {
+	if logger == nil {
+		nop := zerolog.Nop()
+		logger = &nop
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	return &Service{
+		Port:     port,
+		Logger:   logger,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]func(addr net.Addr)),
+		recent:   make(map[string]time.Time),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Listen joins the IPv4 and IPv6 multicast groups on every interface that is
+// up and supports multicast, with a socket per interface so that announces
+// are sent out on each of them. Without such interfaces it falls back to the
+// default one.
+func (s *Service) Listen() error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		s.Logger.Debug().Msgf("Failed to list network interfaces: %s", err)
+	}
+
+	joined := 0
+	for _, group := range []*net.UDPAddr{MulticastIPv4, MulticastIPv6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		joined_group := 0
+		for i := range interfaces {
+			ifi := &interfaces[i]
+			if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+
+			conn, err := net.ListenMulticastUDP(network, ifi, group)
+			if err != nil {
+				s.Logger.Debug().Msgf("Failed to join LSD group %s on %s: %s", group, ifi.Name, err)
+				continue
+			}
+			s.AddConn(conn, group)
+			joined_group++
+		}
+
+		if joined_group == 0 {
+			conn, err := net.ListenMulticastUDP(network, nil, group)
+			if err != nil {
+				s.Logger.Debug().Msgf("Failed to join LSD group %s: %s", group, err)
+				continue
+			}
+			s.AddConn(conn, group)
+			joined_group++
+		}
+		joined += joined_group
+	}
+
+	if joined == 0 {
+		return fmt.Errorf("failed to join any LSD multicast group")
+	}
+	return nil
+}
+
+func (s *Service) AddConn(conn PacketConn, group *net.UDPAddr) {
+	s.mutex.Lock()
+	s.conns = append(s.conns, groupConn{conn: conn, group: group})
+	s.mutex.Unlock()
+
+	go s.readLoop(conn)
+}
+
+// Register starts announcing the info hash on the local network and calls
+// handler for every LAN peer found for it. Private torrents are refused.
+func (s *Service) Register(info_hash [20]byte, private bool, handler func(addr net.Addr)) error {
+	if private {
+		return fmt.Errorf("local service discovery is disabled for private torrents")
+	}
+
+	s.mutex.Lock()
+	s.torrents[info_hash] = handler
+	s.mutex.Unlock()
+
+	return s.announce([][20]byte{info_hash})
+}
+
+func (s *Service) Unregister(info_hash [20]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.torrents, info_hash)
+}
+
+func (s *Service) Start() {
+	go func() {
+		ticker := time.NewTicker(Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-ticker.C:
+				s.AnnounceAll()
+			}
+		}
+	}()
+}
+
+func (s *Service) Close() {
+	close(s.closed)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+func (s *Service) AnnounceAll() error {
+	s.mutex.Lock()
+	hashes := make([][20]byte, 0, len(s.torrents))
+	for info_hash := range s.torrents {
+		hashes = append(hashes, info_hash)
+	}
+	s.mutex.Unlock()
+
+	for start := 0; start < len(hashes); start += MaxHashesSent {
+		end := min(start+MaxHashesSent, len(hashes))
+		err := s.announce(hashes[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) announce(hashes [][20]byte) error {
+	s.mutex.Lock()
+	conns := make([]groupConn, len(s.conns))
+	copy(conns, s.conns)
+	s.mutex.Unlock()
+
+	var last_err error
+	for _, c := range conns {
+		msg := Announce{Port: s.Port, InfoHashes: hashes, Cookie: s.cookie}
+		_, err := c.conn.WriteTo(msg.Marshal(c.group), c.group)
+		if err != nil {
+			last_err = err
+		}
+	}
+	return last_err
+}
+
+func (s *Service) readLoop(conn PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		msg, err := ParseAnnounce(buf[:n])
+		if err != nil {
+			s.Logger.Debug().Msgf("Invalid LSD message from %s: %s", addr, err)
+			continue
+		}
+
+		if msg.Cookie == s.cookie || s.duplicate(buf[:n], addr) {
+			continue
+		}
+
+		udp_addr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		peer_addr := &net.TCPAddr{IP: udp_addr.IP, Port: msg.Port, Zone: udp_addr.Zone}
+
+		for _, info_hash := range msg.InfoHashes {
+			s.mutex.Lock()
+			handler, ok := s.torrents[info_hash]
+			s.mutex.Unlock()
+
+			if ok {
+				s.Logger.Debug().Msgf("Found LAN peer %s for %x", peer_addr, info_hash)
+				handler(peer_addr)
+			}
+		}
+	}
+}
+
+// duplicate reports whether the same message from addr was already read
+// within the last second. The sockets of all interfaces are bound to the
+// same port, so each of them may receive a copy of every announce.
+func (s *Service) duplicate(data []byte, addr net.Addr) bool {
+	key := addr.String() + "\n" + string(data)
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for k, seen := range s.recent {
+		if now.Sub(seen) > time.Second {
+			delete(s.recent, k)
+		}
+	}
+	if _, ok := s.recent[key]; ok {
+		return true
+	}
+	s.recent[key] = now
+	return false
+}
+
+func (msg *Announce) Marshal(group *net.UDPAddr) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buf.WriteString("Host: " + group.String() + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(msg.Port) + "\r\n")
+	for _, info_hash := range msg.InfoHashes {
+		buf.WriteString("Infohash: " + hex.EncodeToString(info_hash[:]) + "\r\n")
+	}
+	if msg.Cookie != "" {
+		buf.WriteString("cookie: " + msg.Cookie + "\r\n")
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func ParseAnnounce(data []byte) (*Announce, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	request_line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(request_line, "BT-SEARCH * HTTP/1.1") {
+		return nil, fmt.Errorf("not a BT-SEARCH message")
+	}
+
+	msg := &Announce{}
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" || err != nil {
+			break
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch http.CanonicalHeaderKey(strings.TrimSpace(key)) {
+		case "Port":
+			msg.Port, err = strconv.Atoi(value)
+			if err != nil || msg.Port <= 0 || msg.Port > 65535 {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+		case "Infohash":
+			decoded, err := hex.DecodeString(value)
+			if err != nil || len(decoded) != 20 {
+				return nil, fmt.Errorf("invalid infohash %q", value)
+			}
+			var info_hash [20]byte
+			copy(info_hash[:], decoded)
+			msg.InfoHashes = append(msg.InfoHashes, info_hash)
+		case "Cookie":
+			msg.Cookie = value
+		}
+	}
+
+	if msg.Port == 0 || len(msg.InfoHashes) == 0 {
+		return nil, fmt.Errorf("incomplete BT-SEARCH message")
+	}
+	return msg, nil
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds in seconds used for network and disk
+// latencies.
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Counter is a value that only goes up. It is safe for concurrent use.
+type Counter struct {
+	value atomic.Int64
+}
+
+func (c *Counter) Add(n int) {
+	c.value.Add(int64(n))
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Value() int {
+	return int(c.value.Load())
+}
+
+// Histogram counts observations into buckets by upper bound. It is safe for
+// concurrent use.
+type Histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Since observes the seconds passed since start.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Label is a name and value that tells samples of the same metric apart.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Writer writes metrics in the Prometheus text exposition format. All
+// samples of a metric have to follow its Family line. The first error is
+// kept and returned by Err.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) printf(format string, args ...any) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, args...)
+	}
+}
+
+// Family starts a metric of the kind "counter", "gauge" or "histogram".
+func (w *Writer) Family(name, kind, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, kind)
+}
+
+func (w *Writer) Sample(name string, value float64, labels ...Label) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+// Histogram writes the buckets, sum and count of h.
+func (w *Writer) Histogram(name string, h *Histogram, labels ...Label) {
+	h.mutex.Lock()
+	counts := append([]uint64{}, h.counts...)
+	sum, count := h.sum, h.count
+	h.mutex.Unlock()
+
+	bucket := append(append([]Label{}, labels...), Label{Name: "le"})
+	for i, bound := range h.bounds {
+		bucket[len(labels)].Value = formatValue(bound)
+		w.Sample(name+"_bucket", float64(counts[i]), bucket...)
+	}
+	bucket[len(labels)].Value = "+Inf"
+	w.Sample(name+"_bucket", float64(count), bucket...)
+	w.Sample(name+"_sum", sum, labels...)
+	w.Sample(name+"_count", float64(count), labels...)
+}
+
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label.Name + `="` + labelEscaper.Replace(label.Value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,396 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+
+	KeyLength      = 96
+	MaxPadLength   = 512
+	HandshakeLimit = 30 * time.Second
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	verificationConstant = make([]byte, 8)
+)
+
+type Mode int
+
+const (
+	ModeDisabled Mode = iota
+	ModeEnabled
+	ModeForced
+)
+
+func ParseMode(mode string) (Mode, error) {
+	switch mode {
+	case "", "disabled":
+		return ModeDisabled, nil
+	case "enabled":
+		return ModeEnabled, nil
+	case "forced":
+		return ModeForced, nil
+	default:
+		return ModeDisabled, fmt.Errorf("unknown encryption mode %q", mode)
+	}
+}
+
+func (mode Mode) String() string {
+	switch mode {
+	case ModeEnabled:
+		return "enabled"
+	case ModeForced:
+		return "forced"
+	default:
+		return "disabled"
+	}
+}
+
+// Provide returns the crypto methods we offer when initiating a connection.
+func (mode Mode) Provide() uint32 {
+	if mode == ModeForced {
+		return CryptoRC4
+	}
+	return CryptoRC4 | CryptoPlaintext
+}
+
+// Select picks the crypto method for an incoming connection, preferring RC4.
+func (mode Mode) Select(provided uint32) uint32 {
+	if provided&CryptoRC4 != 0 {
+		return CryptoRC4
+	}
+	if provided&CryptoPlaintext != 0 && mode != ModeForced {
+		return CryptoPlaintext
+	}
+	return 0
+}
+
+// Conn is a connection that went through the MSE handshake. Depending on the
+// negotiated method the payload stream is RC4 encrypted or plaintext.
+type Conn struct {
+	net.Conn
+	reader  io.Reader
+	pending []byte
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+
+	Method uint32
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.reader.Read(b)
+	if c.decrypt != nil && n > 0 {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	encrypted := make([]byte, len(b))
+	c.encrypt.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func newCipher(key_name string, secret, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(key_name), secret, skey))
+	discard := make([]byte, 1024)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func randomPad() []byte {
+	n, _ := rand.Int(rand.Reader, big.NewInt(MaxPadLength+1))
+	pad := make([]byte, n.Int64())
+	rand.Read(pad)
+	return pad
+}
+
+func keyPair() (*big.Int, []byte) {
+	private := make([]byte, 20)
+	rand.Read(private)
+	x := new(big.Int).SetBytes(private)
+
+	public := new(big.Int).Exp(generator, x, prime).FillBytes(make([]byte, KeyLength))
+	return x, public
+}
+
+func sharedSecret(x *big.Int, remote_public []byte) []byte {
+	y := new(big.Int).SetBytes(remote_public)
+	return new(big.Int).Exp(y, x, prime).FillBytes(make([]byte, KeyLength))
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// synchronize reads from r until pattern has been seen, giving up after limit bytes.
+func synchronize(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit+len(pattern))
+	for len(window) < limit+len(pattern) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("mse: failed to synchronize")
+}
+
+// Initiate performs the MSE handshake as the connecting side. The info hash
+// of the torrent is used as the shared secret SKEY.
+func Initiate(conn net.Conn, skey []byte, provide uint32) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeLimit))
+	defer conn.SetDeadline(time.Time{})
+
+	x, public := keyPair()
+	_, err := conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	remote_public := make([]byte, KeyLength)
+	_, err = io.ReadFull(reader, remote_public)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := sharedSecret(x, remote_public)
+	encrypt := newCipher("keyA", secret, skey)
+	decrypt := newCipher("keyB", secret, skey)
+
+	var buf bytes.Buffer
+	buf.Write(hash([]byte("req1"), secret))
+	buf.Write(xor(hash([]byte("req2"), skey), hash([]byte("req3"), secret)))
+
+	var plain bytes.Buffer
+	plain.Write(verificationConstant)
+	binary.Write(&plain, binary.BigEndian, provide)
+	binary.Write(&plain, binary.BigEndian, uint16(0))
+	binary.Write(&plain, binary.BigEndian, uint16(0))
+
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	buf.Write(encrypted)
+
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted_vc := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(encrypted_vc, verificationConstant)
+	err = synchronize(reader, encrypted_vc, MaxPadLength)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	selected := binary.BigEndian.Uint32(header[0:4])
+	if selected&provide == 0 || (selected != CryptoRC4 && selected != CryptoPlaintext) {
+		return nil, fmt.Errorf("mse: peer selected unsupported crypto method %d", selected)
+	}
+
+	pad_length := int(binary.BigEndian.Uint16(header[4:6]))
+	if pad_length > MaxPadLength {
+		return nil, fmt.Errorf("mse: pad too long")
+	}
+	pad := make([]byte, pad_length)
+	_, err = io.ReadFull(reader, pad)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	c := &Conn{Conn: conn, reader: reader, Method: selected}
+	if selected == CryptoRC4 {
+		c.encrypt = encrypt
+		c.decrypt = decrypt
+	}
+	return c, nil
+}
+
+// Accept performs the MSE handshake as the receiving side. skeys lists the
+// info hashes we serve; the one the peer asked for is returned. selectMethod
+// picks the crypto method from the ones the peer provides.
+func Accept(conn net.Conn, skeys [][]byte, selectMethod func(provided uint32) uint32) (*Conn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeLimit))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	remote_public := make([]byte, KeyLength)
+	_, err := io.ReadFull(reader, remote_public)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x, public := keyPair()
+	_, err = conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret := sharedSecret(x, remote_public)
+	err = synchronize(reader, hash([]byte("req1"), secret), MaxPadLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skey_hash := make([]byte, 20)
+	_, err = io.ReadFull(reader, skey_hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req3 := hash([]byte("req3"), secret)
+	var skey []byte
+	for _, candidate := range skeys {
+		if bytes.Equal(xor(hash([]byte("req2"), candidate), req3), skey_hash) {
+			skey = candidate
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, fmt.Errorf("mse: unknown info hash")
+	}
+
+	decrypt := newCipher("keyA", secret, skey)
+	encrypt := newCipher("keyB", secret, skey)
+
+	header := make([]byte, 14)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	if !bytes.Equal(header[0:8], verificationConstant) {
+		return nil, nil, fmt.Errorf("mse: invalid verification constant")
+	}
+
+	provided := binary.BigEndian.Uint32(header[8:12])
+	pad_length := int(binary.BigEndian.Uint16(header[12:14]))
+	if pad_length > MaxPadLength {
+		return nil, nil, fmt.Errorf("mse: pad too long")
+	}
+
+	rest := make([]byte, pad_length+2)
+	_, err = io.ReadFull(reader, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(rest, rest)
+
+	ia := make([]byte, binary.BigEndian.Uint16(rest[pad_length:]))
+	_, err = io.ReadFull(reader, ia)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(ia, ia)
+
+	selected := selectMethod(provided)
+	if selected == 0 {
+		return nil, nil, fmt.Errorf("mse: no acceptable crypto method in %d", provided)
+	}
+
+	var plain bytes.Buffer
+	plain.Write(verificationConstant)
+	binary.Write(&plain, binary.BigEndian, selected)
+	pad := randomPad()
+	binary.Write(&plain, binary.BigEndian, uint16(len(pad)))
+	plain.Write(pad)
+
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	_, err = conn.Write(encrypted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The initial payload has already been decrypted, so it is handed out
+	// before anything else is read from the connection.
+	c := &Conn{Conn: conn, reader: reader, pending: ia, Method: selected}
+	if selected == CryptoRC4 {
+		c.encrypt = encrypt
+		c.decrypt = decrypt
+	}
+	return c, skey, nil
+}
+
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// Detect peeks at the first bytes of an incoming connection to tell a
+// plaintext BitTorrent handshake from an MSE handshake. The returned
+// connection replays the peeked bytes.
+func Detect(conn net.Conn, protocol_header string) (net.Conn, bool, error) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeLimit))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix := make([]byte, len(protocol_header))
+	_, err := io.ReadFull(conn, prefix)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &prefixConn{Conn: conn, prefix: prefix}, string(prefix) == protocol_header, nil
+}
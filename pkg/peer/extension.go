@@ -0,0 +1,306 @@
+package peer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+)
+
+const (
+	MsgExtended MsgType = 20
+
+	ExtendedHandshakeID = 0
+	ReservedExtension   = 0x10
+
+	ClientVersion = "p-torrent 0.1"
+)
+
+// Extension is a named BEP 10 extension that handles its own messages.
+type Extension interface {
+	Name() string
+	HandleMessage(p *Peer, payload []byte) error
+}
+
+// HandshakeHandler is implemented by extensions that want to inspect the
+// extended handshake of a peer, e.g. to read the metadata size.
+type HandshakeHandler interface {
+	HandleHandshake(p *Peer, hs *ExtendedHandshake)
+}
+
+type ExtendedHandshake struct {
+	M            map[string]int
+	Client       string
+	Port         int
+	RequestQueue int
+	YourIP       net.IP
+	MetadataSize int
+}
+
+// ExtensionRegistry assigns local message ids to extensions and builds the
+// extended handshake we send to peers.
+type ExtensionRegistry struct {
+	mutex      sync.RWMutex
+	extensions map[string]Extension
+	ids        map[string]int
+	next_id    int
+
+	ClientName   string
+	ListenPort   int
+	RequestQueue int
+	MetadataSize int
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		extensions:   make(map[string]Extension),
+		ids:          make(map[string]int),
+		next_id:      1,
+		ClientName:   ClientVersion,
+		RequestQueue: MaxPendingBlocks,
+	}
+}
+
+// Register adds the extension and returns the message id peers must use to
+// send messages to it.
+func (registry *ExtensionRegistry) Register(ext Extension) int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if id, ok := registry.ids[ext.Name()]; ok {
+		registry.extensions[ext.Name()] = ext
+		return id
+	}
+
+	id := registry.next_id
+	registry.next_id++
+	registry.extensions[ext.Name()] = ext
+	registry.ids[ext.Name()] = id
+	return id
+}
+
+func (registry *ExtensionRegistry) Unregister(name string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	delete(registry.extensions, name)
+	delete(registry.ids, name)
+}
+
+func (registry *ExtensionRegistry) Names() []string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	names := make([]string, 0, len(registry.ids))
+	for name := range registry.ids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (registry *ExtensionRegistry) byID(id int) (Extension, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	for name, ext_id := range registry.ids {
+		if ext_id == id {
+			return registry.extensions[name], true
+		}
+	}
+	return nil, false
+}
+
+func (registry *ExtensionRegistry) handshakeHandlers() []HandshakeHandler {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	handlers := []HandshakeHandler{}
+	for _, ext := range registry.extensions {
+		if handler, ok := ext.(HandshakeHandler); ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
+
+func (registry *ExtensionRegistry) handshake(remote net.Addr) map[string]any {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	m := map[string]any{}
+	for name, id := range registry.ids {
+		m[name] = id
+	}
+
+	hs := map[string]any{"m": m}
+	if registry.ClientName != "" {
+		hs["v"] = registry.ClientName
+	}
+	if registry.ListenPort > 0 {
+		hs["p"] = registry.ListenPort
+	}
+	if registry.RequestQueue > 0 {
+		hs["reqq"] = registry.RequestQueue
+	}
+	if registry.MetadataSize > 0 {
+		hs["metadata_size"] = registry.MetadataSize
+	}
+	if tcp_addr, ok := remote.(*net.TCPAddr); ok {
+		if ip := tcp_addr.IP.To4(); ip != nil {
+			hs["yourip"] = []byte(ip)
+		} else {
+			hs["yourip"] = []byte(tcp_addr.IP.To16())
+		}
+	}
+	return hs
+}
+
+func (p *Peer) SupportsExtensions() bool {
+	return p.PeerReserved[5]&ReservedExtension != 0
+}
+
+// SupportsExtension reports whether the peer announced the named extension in
+// its extended handshake.
+func (p *Peer) SupportsExtension(name string) bool {
+	p.extMutex.RLock()
+	defer p.extMutex.RUnlock()
+
+	if p.RemoteHandshake == nil {
+		return false
+	}
+	_, ok := p.RemoteHandshake.M[name]
+	return ok
+}
+
+func (p *Peer) ExtendedHandshake() *ExtendedHandshake {
+	p.extMutex.RLock()
+	defer p.extMutex.RUnlock()
+	return p.RemoteHandshake
+}
+
+func (p *Peer) SendExtendedHandshake() error {
+	if p.Extensions == nil {
+		return fmt.Errorf("[%s] No extension registry", p.Addr)
+	}
+
+	payload, err := bencode.Marshal(p.Extensions.handshake(p.Addr))
+	if err != nil {
+		return err
+	}
+
+	return p.sendExtended(ExtendedHandshakeID, payload)
+}
+
+// SendExtended sends an extension message using the id the peer assigned to it.
+func (p *Peer) SendExtended(name string, payload []byte) error {
+	p.extMutex.RLock()
+	id, ok := 0, false
+	if p.RemoteHandshake != nil {
+		id, ok = p.RemoteHandshake.M[name]
+	}
+	p.extMutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("[%s] Peer does not support %s", p.Addr, name)
+	}
+
+	return p.sendExtended(id, payload)
+}
+
+func (p *Peer) sendExtended(id int, payload []byte) error {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(id))
+	buf.Write(payload)
+
+	return p.send(Message{ID: MsgExtended, Payload: buf.Bytes()})
+}
+
+func (p *Peer) handleExtended(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("empty extended message")
+	}
+
+	if payload[0] == ExtendedHandshakeID {
+		return p.handleExtendedHandshake(payload[1:])
+	}
+
+	if p.Extensions == nil {
+		return fmt.Errorf("unexpected extended message")
+	}
+
+	ext, ok := p.Extensions.byID(int(payload[0]))
+	if !ok {
+		return fmt.Errorf("unknown extended message id %d", payload[0])
+	}
+
+	return ext.HandleMessage(p, payload[1:])
+}
+
+// parseExtendedHandshake decodes an extended handshake and also returns the
+// extensions the peer disabled by sending an id of zero.
+func parseExtendedHandshake(payload []byte) (*ExtendedHandshake, []string, error) {
+	decoded, err := bencode.UnMarshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid extended handshake")
+	}
+
+	hs := &ExtendedHandshake{M: make(map[string]int)}
+	disabled := []string{}
+	m, _ := dict["m"].(map[string]any)
+	for name, value := range m {
+		id, ok := value.(int)
+		if ok && id > 0 && id < 256 {
+			hs.M[name] = id
+		} else if ok && id == 0 {
+			disabled = append(disabled, name)
+		}
+	}
+
+	hs.Client, _ = dict["v"].(string)
+	hs.Port, _ = dict["p"].(int)
+	hs.RequestQueue, _ = dict["reqq"].(int)
+	hs.MetadataSize, _ = dict["metadata_size"].(int)
+	if yourip, ok := dict["yourip"].(string); ok && (len(yourip) == 4 || len(yourip) == 16) {
+		hs.YourIP = net.IP([]byte(yourip))
+	}
+
+	return hs, disabled, nil
+}
+
+func (p *Peer) handleExtendedHandshake(payload []byte) error {
+	hs, disabled, err := parseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+
+	p.extMutex.Lock()
+	if p.RemoteHandshake != nil {
+		// Later handshakes only update the extensions they mention.
+		for name, id := range p.RemoteHandshake.M {
+			if _, ok := hs.M[name]; !ok {
+				hs.M[name] = id
+			}
+		}
+	}
+	for _, name := range disabled {
+		delete(hs.M, name)
+	}
+	p.RemoteHandshake = hs
+	p.extMutex.Unlock()
+
+	if p.Extensions != nil {
+		for _, handler := range p.Extensions.handshakeHandlers() {
+			handler.HandleHandshake(p, hs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+)
+
+const (
+	MsgSuggest     MsgType = 0x0D
+	MsgHaveAll     MsgType = 0x0E
+	MsgHaveNone    MsgType = 0x0F
+	MsgReject      MsgType = 0x10
+	MsgAllowedFast MsgType = 0x11
+
+	ReservedFast = 0x04
+
+	AllowedFastSetSize = 10
+)
+
+func (p *Peer) SupportsFast() bool {
+	return p.Reserved[7]&ReservedFast != 0 && p.PeerReserved[7]&ReservedFast != 0
+}
+
+func (p *Peer) IsAllowedFast(piece_index int) bool {
+	p.fastMutex.Lock()
+	defer p.fastMutex.Unlock()
+	return p.AllowedFast[piece_index]
+}
+
+func (p *Peer) hasAllowedFast() bool {
+	p.fastMutex.Lock()
+	defer p.fastMutex.Unlock()
+	return len(p.AllowedFast) > 0
+}
+
+// sendInitialState announces the pieces we have right after the handshake
+// and, unless seeding, that we are interested in those of the peer.
+func (p *Peer) sendInitialState() error {
+	have := []bool{}
+	if p.HavePieces != nil {
+		have = p.HavePieces()
+	}
+	count := 0
+	for _, ok := range have {
+		if ok {
+			count++
+		}
+	}
+
+	var err error
+	switch {
+	case p.SupportsFast() && count == 0:
+		err = p.SendHaveNone()
+	case p.SupportsFast() && count == p.NumPieces:
+		err = p.SendHaveAll()
+	case count > 0:
+		err = p.SendBitfield(have)
+	}
+	if err != nil || p.Seeding {
+		return err
+	}
+	return p.SendInterested()
+}
+
+func (p *Peer) SendHaveAll() error {
+	return p.send(Message{ID: MsgHaveAll})
+}
+
+func (p *Peer) SendHaveNone() error {
+	return p.send(Message{ID: MsgHaveNone})
+}
+
+// SendAllowedFast lets the peer request a piece while we choke it.
+func (p *Peer) SendAllowedFast(piece_index int) error {
+	p.uploadMutex.Lock()
+	p.offeredFast[piece_index] = true
+	p.uploadMutex.Unlock()
+
+	msg := Message{ID: MsgAllowedFast, Payload: make([]byte, 4)}
+	binary.BigEndian.PutUint32(msg.Payload, uint32(piece_index))
+	return p.send(msg)
+}
+
+func (p *Peer) SendReject(index, begin, length int) error {
+	msg := Message{ID: MsgReject, Payload: make([]byte, 12)}
+	binary.BigEndian.PutUint32(msg.Payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(msg.Payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(msg.Payload[8:12], uint32(length))
+	return p.send(msg)
+}
+
+// GenerateAllowedFastSet computes the canonical allowed fast set for a peer
+// as described in BEP 6. Only IPv4 peers get a set.
+func GenerateAllowedFastSet(k, num_pieces int, info_hash []byte, addr net.Addr) []int {
+	tcp_addr, ok := addr.(*net.TCPAddr)
+	if !ok || tcp_addr.IP.To4() == nil || num_pieces == 0 {
+		return nil
+	}
+	k = min(k, num_pieces)
+
+	ip := tcp_addr.IP.To4()
+	x := []byte{ip[0], ip[1], ip[2], 0}
+	x = append(x, info_hash...)
+
+	set := []int{}
+	seen := map[int]bool{}
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(num_pieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// handleFast processes the fast extension messages. It returns false if the
+// message is not part of the fast extension.
+func (p *Peer) handleFast(msg Message) bool {
+	switch msg.ID {
+	case MsgHaveAll:
+		p.bitfieldMutex.Lock()
+		for i := 0; i < p.NumPieces; i++ {
+			p.BitField.SetPiece(i)
+		}
+		p.bitfieldMutex.Unlock()
+
+	case MsgHaveNone:
+		p.bitfieldMutex.Lock()
+		for i := range p.BitField {
+			p.BitField[i] = 0
+		}
+		p.bitfieldMutex.Unlock()
+
+	case MsgSuggest:
+		// Suggestions are advisory and ignored, the queue picks pieces by
+		// priority instead.
+
+	case MsgAllowedFast:
+		if len(msg.Payload) == 4 {
+			index := int(binary.BigEndian.Uint32(msg.Payload))
+			if index < p.NumPieces {
+				p.fastMutex.Lock()
+				p.AllowedFast[index] = true
+				p.fastMutex.Unlock()
+				p.signal()
+			}
+		}
+
+	case MsgReject:
+		if len(msg.Payload) != 12 {
+			return true
+		}
+
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		p.stateMutex.Lock()
+		var work *piece.Piece
+		if p.PieceInProgress != nil && p.PieceInProgress.Index == index {
+			// The peer will never send the rejected block, so hand the piece
+			// back right away instead of waiting for the read timeout.
+			work = p.takePiece()
+		}
+		p.stateMutex.Unlock()
+		p.pushPiece(work)
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// requeuePiece hands the piece in progress back to the queue.
+func (p *Peer) requeuePiece() {
+	p.stateMutex.Lock()
+	work := p.takePiece()
+	p.stateMutex.Unlock()
+	p.pushPiece(work)
+}
+
+// takePiece clears the download state and returns the piece that was in
+// progress. The state mutex must be held.
+func (p *Peer) takePiece() *piece.Piece {
+	work := p.PieceInProgress
+	p.PieceInProgress = nil
+	p.PendingBlocks = 0
+	p.Downloaded = 0
+	p.signal()
+	return work
+}
+
+// pushPiece returns a piece taken from the download state to the queue. It
+// must not be called with the state mutex held, as the queue calls back into
+// the peer while picking.
+func (p *Peer) pushPiece(work *piece.Piece) {
+	if work != nil {
+		p.Work.Push(work)
+	}
+}
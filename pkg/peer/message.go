@@ -20,9 +20,11 @@ const (
 	MsgRequest
 	MsgPiece
 	MsgCancel
-	MsgKeepAlive
+	MsgPort
 )
 
+const MsgKeepAlive MsgType = -1
+
 type Message struct {
 	ID      MsgType
 	Payload []byte
@@ -61,28 +63,72 @@ func (bitfield BitField) SetPiece(piece_index int) {
 	bitfield[byte_index] |= 1 << uint(7-offset)
 }
 
+func (p *Peer) send(msg Message) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	_, err := p.Conn.Write(msg.Serialise())
+	return err
+}
+
+func (p *Peer) SendChoke() error {
+	msg := Message{
+		ID: MsgChoke,
+	}
+
+	return p.send(msg)
+}
+
 func (p *Peer) SendUnchoke() error {
 	msg := Message{
 		ID: MsgUnChoke,
 	}
 
-	_, err := p.Conn.Write(msg.Serialise())
-	if err != nil {
-		return err
-	}
-	return nil
+	return p.send(msg)
 }
 
 func (p *Peer) SendInterested() error {
 	msg := Message{
 		ID: MsgInterested,
 	}
-	_, err := p.Conn.Write(msg.Serialise())
-	if err != nil {
-		return err
+	return p.send(msg)
+}
+
+func (p *Peer) SendHave(index int) error {
+	msg := Message{
+		ID:      MsgHave,
+		Payload: make([]byte, 4),
 	}
 
-	return nil
+	binary.BigEndian.PutUint32(msg.Payload, uint32(index))
+
+	return p.send(msg)
+}
+
+// SendBitfield announces the pieces we have.
+func (p *Peer) SendBitfield(have []bool) error {
+	bitfield := make(BitField, (p.NumPieces+7)/8)
+	for i, ok := range have {
+		if ok && i < p.NumPieces {
+			bitfield.SetPiece(i)
+		}
+	}
+
+	return p.send(Message{ID: MsgBitfield, Payload: bitfield})
+}
+
+// SendBlock answers a request with the block of a piece.
+func (p *Peer) SendBlock(index, begin int, block []byte) error {
+	msg := Message{
+		ID:      MsgPiece,
+		Payload: make([]byte, 8, 8+len(block)),
+	}
+
+	binary.BigEndian.PutUint32(msg.Payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(msg.Payload[4:8], uint32(begin))
+	msg.Payload = append(msg.Payload, block...)
+
+	return p.send(msg)
 }
 
 func (p *Peer) SendPieceRequest(index, begin, length int) error {
@@ -95,23 +141,41 @@ func (p *Peer) SendPieceRequest(index, begin, length int) error {
 	binary.BigEndian.PutUint32(msg.Payload[4:8], uint32(begin))
 	binary.BigEndian.PutUint32(msg.Payload[8:12], uint32(length))
 
-	_, err := p.Conn.Write(msg.Serialise())
-	if err != nil {
-		return err
+	return p.send(msg)
+}
+
+func (p *Peer) SendPort(port int) error {
+	msg := Message{
+		ID:      MsgPort,
+		Payload: make([]byte, 2),
 	}
 
-	return nil
+	binary.BigEndian.PutUint16(msg.Payload, uint16(port))
+
+	return p.send(msg)
 }
 
+// ParsePieceMessage copies the block of a piece message into piece, after
+// checking that it belongs to the piece and fits into it.
 func ParsePieceMessage(msg Message, piece *piece.Piece) error {
-	index := binary.BigEndian.Uint32(msg.Payload[0:4])
-	begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+	if len(msg.Payload) < 8 {
+		return fmt.Errorf("piece message of %d bytes", len(msg.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	block := msg.Payload[8:]
 
-	if int(index) != piece.Index {
+	if piece == nil {
+		return fmt.Errorf("unexpected block of piece %d", index)
+	}
+	if index != piece.Index {
 		return fmt.Errorf("expected piece index %d, got %d", piece.Index, index)
 	}
+	if begin > len(piece.Data) || len(block) > len(piece.Data)-begin {
+		return fmt.Errorf("block at %d of %d bytes exceeds piece #%d", begin, len(block), index)
+	}
 
-	copy(piece.Data[begin:], msg.Payload[8:])
+	copy(piece.Data[begin:], block)
 
 	return nil
 }
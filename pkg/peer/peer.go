@@ -6,41 +6,106 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DarkPhoenix42/p-torrent/pkg/mse"
 	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/ratelimit"
+	"github.com/DarkPhoenix42/p-torrent/pkg/utp"
 )
 
 const (
 	BitTorrentProtocolHeader = "\x13BitTorrent protocol"
-	BitTorrentExtensions     = "\x00\x00\x00\x00\x00\x00\x00\x00"
 	ReadTimeout              = 15
 	DialTimeout              = 10
+	UTPDialTimeout           = 5
 
 	BlockReqLength   = int(1 << 14)
 	MaxPendingBlocks = 25
+
+	ReservedDHT = 0x01
 )
 
+// Output receives the diagnostics of all peers. Set it before connecting to
+// peers, e.g. to io.Discard while a terminal UI owns the screen.
+var Output io.Writer = os.Stdout
+
 type Peer struct {
 	Addr net.Addr
 	Conn net.Conn
 
-	ID         [20]byte
-	Choked     bool
-	Interested bool
-	BitField   BitField
-
-	Work            chan *piece.Piece
-	Results         chan *piece.Piece
+	ID           [20]byte
+	Reserved     [8]byte
+	PeerReserved [8]byte
+	OnPort       func(p *Peer, port int)
+	OnHashFailed func(p *Peer, index int)
+	Incoming     bool
+	Encryption   mse.Mode
+	Encrypted    bool
+	UTP          *utp.Socket
+	OverUTP      bool
+
+	// Rates limits this peer alone, SharedRates are the torrent and global
+	// limits the peer shares with others.
+	Rates       *ratelimit.Pair
+	SharedRates []*ratelimit.Pair
+
+	Extensions      *ExtensionRegistry
+	RemoteHandshake *ExtendedHandshake
+	extMutex        sync.RWMutex
+	writeMutex      sync.Mutex
+
+	NumPieces   int
+	AllowedFast map[int]bool
+	fastMutex   sync.Mutex
+
+	// HavePieces and ReadPiece give access to the pieces we upload, both
+	// are optional. Seeding peers are not asked for pieces.
+	HavePieces func() []bool
+	ReadPiece  func(index int) ([]byte, error)
+	OnInterest func(p *Peer)
+	OnUploaded func(p *Peer, n int)
+	Seeding    bool
+
+	// choking and interested are our side and the peer's side of uploads,
+	// requests the blocks the peer waits for and offeredFast the pieces it
+	// may request while choked. uploadMutex guards them.
+	choking     bool
+	interested  bool
+	requests    []blockRequest
+	offeredFast map[int]bool
+	uploadMutex sync.Mutex
+	uploadWake  chan struct{}
+
+	// BitField is written by the message loop while others read it, so it
+	// is only accessed under bitfieldMutex, e.g. through Pieces.
+	BitField      BitField
+	bitfieldMutex sync.RWMutex
+
+	Work    *piece.Queue
+	Results chan *piece.Piece
+
+	// Choked and the download of PieceInProgress are shared by the download
+	// loop and the message loop, stateMutex guards them.
+	Choked          bool
 	PieceInProgress *piece.Piece
+	PendingBlocks   int
+	Downloaded      int
+	stateMutex      sync.Mutex
 
-	Responsive    bool
-	PendingBlocks int
-	Downloaded    int
+	// wake tells the download loop that it may be able to request again.
+	wake chan struct{}
+
+	responsive atomic.Bool
+	done       chan struct{}
+	closeOnce  sync.Once
 }
 
-func NewPeer(addr net.Addr, work, results chan *piece.Piece, numPieces int) *Peer {
-	return &Peer{
+func NewPeer(addr net.Addr, work *piece.Queue, results chan *piece.Piece, numPieces int) *Peer {
+	p := &Peer{
 		Addr: addr,
 		Conn: nil,
 
@@ -48,90 +113,327 @@ func NewPeer(addr net.Addr, work, results chan *piece.Piece, numPieces int) *Pee
 		Choked:   true,
 		BitField: make([]byte, (numPieces+7)/8),
 
+		NumPieces:   numPieces,
+		AllowedFast: make(map[int]bool),
+
+		choking:     true,
+		offeredFast: make(map[int]bool),
+		uploadWake:  make(chan struct{}, 1),
+
 		Work:            work,
 		Results:         results,
 		PieceInProgress: nil,
 
-		Responsive:    true,
 		PendingBlocks: 0,
 		Downloaded:    0,
+
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
 	}
+	p.responsive.Store(true)
+	return p
 }
 
-func (p *Peer) HandShake(info_hash []byte, peer_id []byte) error {
-	var err error
+// Close drops the connection and stops the download loop of the peer.
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		p.responsive.Store(false)
+		if p.Conn != nil {
+			p.Conn.Close()
+		}
+		close(p.done)
+	})
+}
 
-	p.Conn, err = net.DialTimeout("tcp", p.Addr.String(), DialTimeout*time.Second)
-	if err != nil {
-		return err
+// Responsive reports whether the connection to the peer is still up.
+func (p *Peer) Responsive() bool {
+	return p.responsive.Load()
+}
+
+// IsChoked reports whether the peer chokes us.
+func (p *Peer) IsChoked() bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.Choked
+}
+
+// HasPiece reports whether the peer has the piece at index.
+func (p *Peer) HasPiece(index int) bool {
+	p.bitfieldMutex.RLock()
+	defer p.bitfieldMutex.RUnlock()
+	return index >= 0 && index/8 < len(p.BitField) && p.BitField.HasPiece(index)
+}
+
+// HasAll reports whether the peer has every piece, i.e. is a seed.
+func (p *Peer) HasAll() bool {
+	p.bitfieldMutex.RLock()
+	defer p.bitfieldMutex.RUnlock()
+
+	if p.NumPieces == 0 || (p.NumPieces+7)/8 > len(p.BitField) {
+		return false
+	}
+	for i := 0; i < p.NumPieces; i++ {
+		if !p.BitField.HasPiece(i) {
+			return false
+		}
 	}
+	return true
+}
+
+// Pieces returns a copy of the bitfield of the peer.
+func (p *Peer) Pieces() BitField {
+	p.bitfieldMutex.RLock()
+	defer p.bitfieldMutex.RUnlock()
+	return append(BitField{}, p.BitField...)
+}
+
+// Done is closed once the peer has been closed.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+func NewIncomingPeer(conn net.Conn, work *piece.Queue, results chan *piece.Piece, numPieces int) *Peer {
+	addr := conn.RemoteAddr()
+	over_utp := false
+
+	// Peers are identified by their TCP address everywhere else, and uTP
+	// clients use the same port for both transports.
+	if udp_addr, ok := addr.(*net.UDPAddr); ok {
+		addr = &net.TCPAddr{IP: udp_addr.IP, Port: udp_addr.Port, Zone: udp_addr.Zone}
+		over_utp = true
+	}
+
+	p := NewPeer(addr, work, results, numPieces)
+	p.Conn = conn
+	p.Incoming = true
+	p.OverUTP = over_utp
+	return p
+}
 
+// limitConn applies the rate limits to the connection.
+func (p *Peer) limitConn() {
+	pairs := append([]*ratelimit.Pair{p.Rates}, p.SharedRates...)
+	p.Conn = ratelimit.NewConn(p.Conn, pairs...)
+}
+
+func (p *Peer) writeHandShake(info_hash []byte, peer_id []byte) error {
 	var buf bytes.Buffer
 	buf.WriteString(BitTorrentProtocolHeader)
-	buf.WriteString(BitTorrentExtensions)
+	buf.Write(p.Reserved[:])
 	buf.Write(info_hash)
 	buf.Write(peer_id)
 
-	_, err = p.Conn.Write(buf.Bytes())
-	if err != nil {
-		return err
-	}
+	_, err := p.Conn.Write(buf.Bytes())
+	return err
+}
 
+func (p *Peer) readHandShake() ([]byte, error) {
 	response := make([]byte, 68)
 	p.Conn.SetReadDeadline(time.Now().Add(ReadTimeout * time.Second))
 	defer p.Conn.SetReadDeadline(time.Time{})
 
-	_, err = io.ReadFull(p.Conn, response)
+	_, err := io.ReadFull(p.Conn, response)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(response[:20]) != BitTorrentProtocolHeader {
+		return nil, fmt.Errorf("[%s] Unexpected handshake response.", p.Addr.String())
+	}
+
+	copy(p.PeerReserved[:], response[20:28])
+	copy(p.ID[:], response[48:68])
+	return response, nil
+}
+
+// replayConn returns the bytes that were read ahead before reading on.
+type replayConn struct {
+	net.Conn
+	prefix []byte
+}
 
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// PeekInfoHash reads an incoming plaintext handshake up to the info hash, so
+// that a listener shared by several torrents can pick the right one. The
+// returned connection replays what was read.
+func PeekInfoHash(conn net.Conn) (net.Conn, [20]byte, error) {
+	var info_hash [20]byte
+
+	start := make([]byte, 48)
+	conn.SetReadDeadline(time.Now().Add(ReadTimeout * time.Second))
+	_, err := io.ReadFull(conn, start)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, info_hash, err
+	}
+
+	if string(start[:20]) != BitTorrentProtocolHeader {
+		return nil, info_hash, fmt.Errorf("unexpected handshake from %s", conn.RemoteAddr())
+	}
+
+	copy(info_hash[:], start[28:48])
+	return &replayConn{Conn: conn, prefix: start}, info_hash, nil
+}
+
+// connect opens the transport to the peer. With a uTP socket uTP and TCP are
+// dialed at once, the first connection wins and the other one is closed.
+func (p *Peer) connect() (net.Conn, error) {
+	if p.UTP == nil {
+		p.OverUTP = false
+		return net.DialTimeout("tcp", p.Addr.String(), DialTimeout*time.Second)
+	}
+
+	type dialed struct {
+		conn     net.Conn
+		over_utp bool
+		err      error
+	}
+	results := make(chan dialed, 2)
+
+	go func() {
+		conn, err := p.UTP.DialTimeout(p.Addr.String(), UTPDialTimeout*time.Second)
+		if err != nil {
+			results <- dialed{err: err, over_utp: true}
+			return
+		}
+		results <- dialed{conn: conn, over_utp: true}
+	}()
+	go func() {
+		conn, err := net.DialTimeout("tcp", p.Addr.String(), DialTimeout*time.Second)
+		results <- dialed{conn: conn, err: err}
+	}()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.err != nil {
+			if !result.over_utp || err == nil {
+				err = result.err
+			}
+			continue
+		}
+
+		if i == 0 {
+			go func() {
+				if loser := <-results; loser.err == nil {
+					loser.conn.Close()
+				}
+			}()
+		}
+		p.OverUTP = result.over_utp
+		return result.conn, nil
+	}
+
+	return nil, err
+}
+
+// dial connects to the peer, negotiating message stream encryption first if
+// it is enabled. In enabled mode a failed negotiation falls back to plaintext.
+func (p *Peer) dial(info_hash []byte) (net.Conn, error) {
+	conn, err := p.connect()
+	if err != nil || p.Encryption == mse.ModeDisabled {
+		return conn, err
+	}
+
+	encrypted_conn, err := mse.Initiate(conn, info_hash, p.Encryption.Provide())
+	if err == nil {
+		p.Encrypted = encrypted_conn.Method == mse.CryptoRC4
+		return encrypted_conn, nil
+	}
+
+	conn.Close()
+	if p.Encryption == mse.ModeForced {
+		return nil, err
+	}
+
+	return p.connect()
+}
+
+func (p *Peer) HandShake(info_hash []byte, peer_id []byte) error {
+	var err error
+
+	p.Conn, err = p.dial(info_hash)
 	if err != nil {
 		return err
 	}
+	p.limitConn()
 
-	if string(response[:20]) != BitTorrentProtocolHeader {
-		return fmt.Errorf("[%s] Unexpected handshake response.", p.Addr.String())
+	err = p.writeHandShake(info_hash, peer_id)
+	if err != nil {
+		return err
+	}
+
+	response, err := p.readHandShake()
+	if err != nil {
+		return err
 	}
 
 	if string(response[28:48]) != string(info_hash) {
 		return fmt.Errorf("[%s] Unexpected handshake response.", p.Addr.String())
 	}
 
-	copy(p.ID[:], response[48:68])
 	return nil
 }
 
-func (p *Peer) Activate(info_hash []byte, peer_id []byte) error {
-	err := p.HandShake(info_hash, peer_id)
+// ReceiveHandShake answers the handshake of a peer that connected to us.
+func (p *Peer) ReceiveHandShake(info_hash []byte, peer_id []byte) error {
+	p.limitConn()
+
+	response, err := p.readHandShake()
 	if err != nil {
 		return err
 	}
 
-	err = p.SendUnchoke()
+	if string(response[28:48]) != string(info_hash) {
+		return fmt.Errorf("[%s] Handshake for unknown info hash.", p.Addr.String())
+	}
+
+	return p.writeHandShake(info_hash, peer_id)
+}
+
+func (p *Peer) Activate(info_hash []byte, peer_id []byte) error {
+	err := p.HandShake(info_hash, peer_id)
 	if err != nil {
 		return err
 	}
-	err = p.SendInterested()
+
+	return p.sendInitialState()
+}
+
+func (p *Peer) ActivateIncoming(info_hash []byte, peer_id []byte) error {
+	err := p.ReceiveHandShake(info_hash, peer_id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return p.sendInitialState()
+}
+
+func (p *Peer) SupportsDHT() bool {
+	return p.PeerReserved[7]&ReservedDHT != 0
 }
 
 func (p *Peer) HandleIncoming() error {
+	defer p.Close()
+
 	msg_len := make([]byte, 4)
 	for {
 		p.Conn.SetReadDeadline(time.Now().Add(30 * time.Second))
 		_, err := io.ReadFull(p.Conn, msg_len)
 		p.Conn.SetReadDeadline(time.Time{})
 
-		if err != io.EOF && err != nil {
-			fmt.Printf("[%s] Error reading message len: %s\n", p.Addr, err)
-			if p.PieceInProgress != nil {
-				p.Work <- p.PieceInProgress
-				p.PieceInProgress = nil
-			}
-
-			p.Responsive = false
+		if err != nil {
+			fmt.Fprintf(Output, "[%s] Error reading message len: %s\n", p.Addr, err)
+			p.requeuePiece()
+			p.responsive.Store(false)
 			return err
 		}
 
@@ -141,111 +443,209 @@ func (p *Peer) HandleIncoming() error {
 		_, err = io.ReadFull(p.Conn, msg_bytes)
 		p.Conn.SetReadDeadline(time.Time{})
 
-		if err != io.EOF && err != nil {
-			fmt.Printf("[%s] Error reading message bytes: %s\n", p.Addr, err)
-			if p.PieceInProgress != nil {
-				p.Work <- p.PieceInProgress
-				p.PieceInProgress = nil
-			}
-			p.Responsive = false
+		if err != nil {
+			fmt.Fprintf(Output, "[%s] Error reading message bytes: %s\n", p.Addr, err)
+			p.requeuePiece()
+			p.responsive.Store(false)
 			return err
 		}
 
 		msg := DeserialiseMessage(msg_bytes)
 		switch msg.ID {
 		case MsgChoke:
+			p.stateMutex.Lock()
 			p.Choked = true
+			var work *piece.Piece
+			if !p.SupportsFast() && p.PieceInProgress != nil && !p.IsAllowedFast(p.PieceInProgress.Index) {
+				// Without the fast extension a choke discards all pending requests.
+				work = p.takePiece()
+			}
+			p.stateMutex.Unlock()
+			p.pushPiece(work)
 
 		case MsgUnChoke:
+			p.stateMutex.Lock()
 			p.Choked = false
+			p.stateMutex.Unlock()
+			p.signal()
 
 		case MsgHave:
+			if len(msg.Payload) != 4 {
+				continue
+			}
 			piece_index := int(binary.BigEndian.Uint32(msg.Payload))
-			p.BitField.SetPiece(piece_index)
+			if piece_index < p.NumPieces {
+				p.bitfieldMutex.Lock()
+				p.BitField.SetPiece(piece_index)
+				p.bitfieldMutex.Unlock()
+			}
+
+		case MsgInterested:
+			p.setInterested(true)
+
+		case MsgNotInterested:
+			p.setInterested(false)
+
+		case MsgRequest:
+			p.handleRequest(msg.Payload)
+
+		case MsgCancel:
+			p.handleCancel(msg.Payload)
 
 		case MsgPiece:
+			p.stateMutex.Lock()
+			if !p.expectsBlock(msg.Payload) {
+				// A block we no longer wait for, e.g. requested before a
+				// choke or reject handed the piece back.
+				p.stateMutex.Unlock()
+				continue
+			}
 			err := ParsePieceMessage(msg, p.PieceInProgress)
-
 			if err != nil {
-				fmt.Printf("Error parsing piece message from %s : %s\n", p.Addr, err)
-				p.Work <- p.PieceInProgress
-				p.PieceInProgress = nil
+				work := p.takePiece()
+				p.stateMutex.Unlock()
+
+				fmt.Fprintf(Output, "Error parsing piece message from %s : %s\n", p.Addr, err)
+				p.pushPiece(work)
 				continue
 			}
 
 			p.Downloaded += BlockReqLength
 			p.PendingBlocks--
 
+			var work *piece.Piece
 			if p.Downloaded >= p.PieceInProgress.Length && p.PendingBlocks == 0 {
-				if p.PieceInProgress.Validate() {
-					p.Results <- p.PieceInProgress
-				} else {
-					fmt.Printf("[%s] Invalid piece #%d\n", p.Addr, p.PieceInProgress.Index)
-					p.Work <- p.PieceInProgress
-				}
+				work = p.takePiece()
+			}
+			p.stateMutex.Unlock()
 
-				p.Downloaded = 0
-				p.PieceInProgress = nil
+			if work == nil {
+				continue
+			}
+			if work.Validate() {
+				p.Results <- work
+			} else {
+				fmt.Fprintf(Output, "[%s] Invalid piece #%d\n", p.Addr, work.Index)
+				if p.OnHashFailed != nil {
+					p.OnHashFailed(p, work.Index)
+				}
+				p.Work.Push(work)
 			}
 
 		case MsgBitfield:
+			p.bitfieldMutex.Lock()
 			copy(p.BitField, msg.Payload)
+			p.bitfieldMutex.Unlock()
+
+		case MsgExtended:
+			err := p.handleExtended(msg.Payload)
+			if err != nil {
+				fmt.Fprintf(Output, "[%s] Error handling extended message: %s\n", p.Addr, err)
+			}
+
+		case MsgPort:
+			if len(msg.Payload) == 2 && p.OnPort != nil {
+				p.OnPort(p, int(binary.BigEndian.Uint16(msg.Payload)))
+			}
+
+		default:
+			if p.SupportsFast() {
+				p.handleFast(msg)
+			}
 		}
 
 	}
 }
 
+// DownloadPiece requests the blocks of the piece in progress.
 func (p *Peer) DownloadPiece() error {
-	p.PendingBlocks = 0
-	requested := 0
+	p.stateMutex.Lock()
+	work := p.PieceInProgress
+	if work == nil {
+		p.stateMutex.Unlock()
+		return nil
+	}
 
-	fmt.Printf("[%s] Requested piece #%d\n", p.Addr, p.PieceInProgress.Index)
+	// The requests are counted before they are sent, as the blocks may
+	// arrive before the last request is written.
+	blocks := 0
+	if !p.Choked || p.IsAllowedFast(work.Index) {
+		blocks = min((work.Length+BlockReqLength-1)/BlockReqLength, MaxPendingBlocks)
+	}
+	p.PendingBlocks = blocks
+	p.stateMutex.Unlock()
 
-	for p.PendingBlocks < MaxPendingBlocks && requested < p.PieceInProgress.Length && !p.Choked {
-		blockSize := BlockReqLength
-
-		if p.PieceInProgress.Length-requested < blockSize {
-			blockSize = p.PieceInProgress.Length - requested
-		}
-		err := p.SendPieceRequest(p.PieceInProgress.Index, requested, blockSize)
+	fmt.Fprintf(Output, "[%s] Requested piece #%d\n", p.Addr, work.Index)
 
+	for i := 0; i < blocks; i++ {
+		begin := i * BlockReqLength
+		err := p.SendPieceRequest(work.Index, begin, min(BlockReqLength, work.Length-begin))
 		if err != nil {
 			return err
 		}
-
-		p.PendingBlocks++
-		requested += blockSize
 	}
 
 	return nil
 }
 
+// expectsBlock reports whether the payload of a piece message is for the
+// piece in progress. The state mutex must be held.
+func (p *Peer) expectsBlock(payload []byte) bool {
+	return len(payload) >= 4 && p.PieceInProgress != nil &&
+		int(binary.BigEndian.Uint32(payload[0:4])) == p.PieceInProgress.Index
+}
+
+// signal wakes the download loop up, if it waits.
+func (p *Peer) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// canDownload reports whether the piece at index can be requested right now.
+func (p *Peer) canDownload(index int) bool {
+	return p.HasPiece(index) && (!p.IsChoked() || p.IsAllowedFast(index))
+}
+
 func (p *Peer) StartDownload() {
 	go p.HandleIncoming()
+	go p.serveRequests()
 
 	for {
-		if p.Choked || p.PieceInProgress != nil {
+		if !p.Responsive() {
+			return
+		}
+
+		p.stateMutex.Lock()
+		busy := p.PieceInProgress != nil || (p.Choked && !p.hasAllowedFast())
+		p.stateMutex.Unlock()
+		if busy {
+			select {
+			case <-p.wake:
+			case <-p.done:
+				return
+			}
 			continue
 		}
 
-		if !p.Responsive {
+		work, ok := p.Work.Pop(p.canDownload, p.done)
+		if !ok {
 			return
 		}
+		if !p.canDownload(work.Index) {
+			p.Work.Push(work)
+			continue
+		}
 
-		p.PieceInProgress = <-p.Work
-		if p.BitField.HasPiece(p.PieceInProgress.Index) {
-			err := p.DownloadPiece()
-
-			if err != nil {
-				fmt.Printf("[%s] Error downloading piece #%d : %s\n", p.Addr, p.PieceInProgress.Index, err)
-				p.Work <- p.PieceInProgress
-				p.PieceInProgress = nil
-			}
+		p.stateMutex.Lock()
+		p.PieceInProgress = work
+		p.stateMutex.Unlock()
 
-		} else {
-			p.Work <- p.PieceInProgress
-			p.PieceInProgress = nil
+		err := p.DownloadPiece()
+		if err != nil {
+			fmt.Fprintf(Output, "[%s] Error downloading piece #%d : %s\n", p.Addr, work.Index, err)
+			p.requeuePiece()
 		}
-
 	}
 }
@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MaxRequestLength is the largest block a peer may request, larger
+	// requests are rejected.
+	MaxRequestLength = 1 << 17
+	// MaxQueuedRequests limits the requests of a peer that wait to be
+	// served, requests beyond it are rejected.
+	MaxQueuedRequests = 250
+)
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+func parseRequest(payload []byte) (blockRequest, bool) {
+	if len(payload) != 12 {
+		return blockRequest{}, false
+	}
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, true
+}
+
+// IsChoking reports whether we choke the peer.
+func (p *Peer) IsChoking() bool {
+	p.uploadMutex.Lock()
+	defer p.uploadMutex.Unlock()
+	return p.choking
+}
+
+// IsInterested reports whether the peer is interested in our pieces.
+func (p *Peer) IsInterested() bool {
+	p.uploadMutex.Lock()
+	defer p.uploadMutex.Unlock()
+	return p.interested
+}
+
+// Choke stops serving the peer. Its pending requests are dropped, with the
+// fast extension they are rejected unless they are allowed fast.
+func (p *Peer) Choke() error {
+	p.uploadMutex.Lock()
+	if p.choking {
+		p.uploadMutex.Unlock()
+		return nil
+	}
+	p.choking = true
+
+	kept, dropped := []blockRequest{}, []blockRequest{}
+	for _, req := range p.requests {
+		if p.SupportsFast() && p.offeredFast[req.index] {
+			kept = append(kept, req)
+		} else {
+			dropped = append(dropped, req)
+		}
+	}
+	p.requests = kept
+	p.uploadMutex.Unlock()
+
+	err := p.SendChoke()
+	if err != nil {
+		return err
+	}
+	if p.SupportsFast() {
+		for _, req := range dropped {
+			err = p.SendReject(req.index, req.begin, req.length)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Unchoke lets the peer request blocks from us.
+func (p *Peer) Unchoke() error {
+	p.uploadMutex.Lock()
+	if !p.choking {
+		p.uploadMutex.Unlock()
+		return nil
+	}
+	p.choking = false
+	p.uploadMutex.Unlock()
+
+	return p.SendUnchoke()
+}
+
+func (p *Peer) setInterested(interested bool) {
+	p.uploadMutex.Lock()
+	changed := p.interested != interested
+	p.interested = interested
+	p.uploadMutex.Unlock()
+
+	if changed && p.OnInterest != nil {
+		p.OnInterest(p)
+	}
+}
+
+// rejectRequest turns a request down, which only the fast extension can
+// tell the peer about.
+func (p *Peer) rejectRequest(req blockRequest) {
+	if p.SupportsFast() {
+		p.SendReject(req.index, req.begin, req.length)
+	}
+}
+
+// handleRequest queues a block request of the peer for serveRequests.
+func (p *Peer) handleRequest(payload []byte) {
+	req, ok := parseRequest(payload)
+	if !ok {
+		return
+	}
+	if req.index >= p.NumPieces || req.length <= 0 || req.length > MaxRequestLength {
+		p.rejectRequest(req)
+		return
+	}
+
+	p.uploadMutex.Lock()
+	allowed := !p.choking || (p.SupportsFast() && p.offeredFast[req.index])
+	queued := allowed && len(p.requests) < MaxQueuedRequests
+	if queued {
+		p.requests = append(p.requests, req)
+	}
+	p.uploadMutex.Unlock()
+
+	if !queued {
+		p.rejectRequest(req)
+		return
+	}
+
+	select {
+	case p.uploadWake <- struct{}{}:
+	default:
+	}
+}
+
+// handleCancel drops a request the peer no longer needs.
+func (p *Peer) handleCancel(payload []byte) {
+	req, ok := parseRequest(payload)
+	if !ok {
+		return
+	}
+
+	p.uploadMutex.Lock()
+	defer p.uploadMutex.Unlock()
+
+	for i, queued := range p.requests {
+		if queued == req {
+			p.requests = append(p.requests[:i], p.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextRequest takes the oldest request that waits to be served.
+func (p *Peer) nextRequest() (blockRequest, bool) {
+	p.uploadMutex.Lock()
+	defer p.uploadMutex.Unlock()
+
+	if len(p.requests) == 0 {
+		return blockRequest{}, false
+	}
+	req := p.requests[0]
+	p.requests = p.requests[1:]
+	return req, true
+}
+
+// serveRequests sends the blocks the peer requests until it disconnects.
+// The last piece read is kept, as peers request a piece block by block.
+func (p *Peer) serveRequests() {
+	cached_index := -1
+	var cached []byte
+
+	for {
+		req, ok := p.nextRequest()
+		if !ok {
+			select {
+			case <-p.uploadWake:
+				continue
+			case <-p.done:
+				return
+			}
+		}
+
+		if req.index != cached_index {
+			if p.ReadPiece == nil {
+				p.rejectRequest(req)
+				continue
+			}
+			data, err := p.ReadPiece(req.index)
+			if err != nil {
+				p.rejectRequest(req)
+				continue
+			}
+			cached, cached_index = data, req.index
+		}
+
+		if req.begin > len(cached) || req.length > len(cached)-req.begin {
+			p.rejectRequest(req)
+			continue
+		}
+
+		err := p.SendBlock(req.index, req.begin, cached[req.begin:req.begin+req.length])
+		if err != nil {
+			fmt.Fprintf(Output, "[%s] Error sending block of piece #%d : %s\n", p.Addr, req.index, err)
+			return
+		}
+		if p.OnUploaded != nil {
+			p.OnUploaded(p, req.length)
+		}
+	}
+}
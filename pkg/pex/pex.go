@@ -0,0 +1,215 @@
+package pex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+)
+
+const (
+	ExtensionName = "ut_pex"
+
+	FlagEncryption = 0x01
+	FlagSeed       = 0x02
+	FlagUTP        = 0x04
+	FlagHolepunch  = 0x08
+	FlagReachable  = 0x10
+
+	MaxPeersPerMessage = 50
+	Interval           = time.Minute
+)
+
+type PeerInfo struct {
+	Addr  *net.TCPAddr
+	Flags byte
+}
+
+// Message is a ut_pex message as described in BEP 11.
+type Message struct {
+	Added   []PeerInfo
+	Dropped []*net.TCPAddr
+}
+
+func compactAddr(addr *net.TCPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], uint16(addr.Port))
+	return buf
+}
+
+func (msg *Message) Marshal() ([]byte, error) {
+	var added, added_f, added6, added6_f, dropped, dropped6 bytes.Buffer
+
+	for _, p := range msg.Added {
+		if p.Addr.IP.To4() != nil {
+			added.Write(compactAddr(p.Addr))
+			added_f.WriteByte(p.Flags)
+		} else {
+			added6.Write(compactAddr(p.Addr))
+			added6_f.WriteByte(p.Flags)
+		}
+	}
+
+	for _, addr := range msg.Dropped {
+		if addr.IP.To4() != nil {
+			dropped.Write(compactAddr(addr))
+		} else {
+			dropped6.Write(compactAddr(addr))
+		}
+	}
+
+	return bencode.Marshal(map[string]any{
+		"added":    added.String(),
+		"added.f":  added_f.String(),
+		"added6":   added6.String(),
+		"added6.f": added6_f.String(),
+		"dropped":  dropped.String(),
+		"dropped6": dropped6.String(),
+	})
+}
+
+func parseAddrs(data string, size int) ([]*net.TCPAddr, error) {
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid compact peers length %d", len(data))
+	}
+
+	addrs := make([]*net.TCPAddr, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		ip := make(net.IP, size-2)
+		copy(ip, data[i:i+size-2])
+		port := binary.BigEndian.Uint16([]byte(data[i+size-2 : i+size]))
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: int(port)})
+	}
+	return addrs, nil
+}
+
+func parseAdded(dict map[string]any, key string, size int) ([]PeerInfo, error) {
+	data, _ := dict[key].(string)
+	flags, _ := dict[key+".f"].(string)
+
+	addrs, err := parseAddrs(data, size)
+	if err != nil {
+		return nil, err
+	}
+
+	added := make([]PeerInfo, len(addrs))
+	for i, addr := range addrs {
+		added[i].Addr = addr
+		if i < len(flags) {
+			added[i].Flags = flags[i]
+		}
+	}
+	return added, nil
+}
+
+func Unmarshal(data []byte) (*Message, error) {
+	decoded, err := bencode.UnMarshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid pex message")
+	}
+
+	msg := &Message{}
+	for _, family := range []struct {
+		suffix string
+		size   int
+	}{{"", 6}, {"6", 18}} {
+		added, err := parseAdded(dict, "added"+family.suffix, family.size)
+		if err != nil {
+			return nil, err
+		}
+		msg.Added = append(msg.Added, added...)
+
+		dropped_data, _ := dict["dropped"+family.suffix].(string)
+		dropped, err := parseAddrs(dropped_data, family.size)
+		if err != nil {
+			return nil, err
+		}
+		msg.Dropped = append(msg.Dropped, dropped...)
+	}
+
+	return msg, nil
+}
+
+// State remembers which peers were already sent to a remote peer so that
+// only the changes are exchanged on the next round.
+type State struct {
+	mutex     sync.Mutex
+	sent      map[string]PeerInfo
+	last_sent time.Time
+
+	last_received time.Time
+}
+
+func NewState() *State {
+	return &State{sent: make(map[string]PeerInfo)}
+}
+
+// Diff builds the next message from the currently connected peers. It returns
+// nil if nothing changed or if the previous message was sent less than
+// Interval ago.
+func (state *State) Diff(connected []PeerInfo) *Message {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if time.Since(state.last_sent) < Interval {
+		return nil
+	}
+
+	msg := &Message{}
+	current := make(map[string]PeerInfo, len(connected))
+	for _, p := range connected {
+		current[p.Addr.String()] = p
+		if _, ok := state.sent[p.Addr.String()]; !ok && len(msg.Added) < MaxPeersPerMessage {
+			msg.Added = append(msg.Added, p)
+		}
+	}
+
+	for key, p := range state.sent {
+		if _, ok := current[key]; !ok && len(msg.Dropped) < MaxPeersPerMessage {
+			msg.Dropped = append(msg.Dropped, p.Addr)
+		}
+	}
+
+	if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+		return nil
+	}
+
+	for _, p := range msg.Added {
+		state.sent[p.Addr.String()] = p
+	}
+	for _, addr := range msg.Dropped {
+		delete(state.sent, addr.String())
+	}
+	state.last_sent = time.Now()
+
+	return msg
+}
+
+// AllowReceive rate limits incoming messages from a peer to one per interval,
+// with some slack for clock differences.
+func (state *State) AllowReceive() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if time.Since(state.last_received) < Interval/2 {
+		return false
+	}
+
+	state.last_received = time.Now()
+	return true
+}
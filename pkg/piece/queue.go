@@ -0,0 +1,195 @@
+package piece
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryInterval bounds how long Pop waits before asking its accept function
+// again, since a peer may get new pieces or be unchoked without the queue
+// noticing.
+const RetryInterval = 500 * time.Millisecond
+
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+
+	// PriorityNow marks pieces a reader is about to read. They are always
+	// handed out in order, whatever the mode of the queue.
+	PriorityNow
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high", "now"}
+
+func (priority Priority) String() string {
+	if priority < PrioritySkip || priority > PriorityNow {
+		return fmt.Sprintf("Priority(%d)", int(priority))
+	}
+	return priorityNames[priority]
+}
+
+// ParsePriority parses the name of a file priority.
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames[:PriorityNow] {
+		if strings.EqualFold(s, name) {
+			return Priority(i), nil
+		}
+	}
+	return PrioritySkip, fmt.Errorf("unknown priority %q", s)
+}
+
+// Queue holds the pieces that still have to be downloaded and hands them out
+// highest priority first. Within a priority pieces are picked from a random
+// starting point so that peers of a swarm do not all want the same pieces,
+// or in order in sequential mode. Pieces with PrioritySkip stay queued but
+// are not handed out until their priority is raised again.
+type Queue struct {
+	mutex      sync.Mutex
+	pending    []*Piece
+	priority   []Priority
+	sequential bool
+	changed    chan struct{}
+}
+
+func NewQueue(num_pieces int) *Queue {
+	queue := &Queue{
+		pending:  make([]*Piece, num_pieces),
+		priority: make([]Priority, num_pieces),
+		changed:  make(chan struct{}),
+	}
+	for i := range queue.priority {
+		queue.priority[i] = PriorityNormal
+	}
+	return queue
+}
+
+// notify wakes up everyone waiting in Pop. The mutex must be held.
+func (queue *Queue) notify() {
+	close(queue.changed)
+	queue.changed = make(chan struct{})
+}
+
+// Push adds a piece, or returns one that could not be downloaded.
+func (queue *Queue) Push(p *Piece) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.pending[p.Index] = p
+	queue.notify()
+}
+
+func (queue *Queue) pick(accept func(index int) bool) *Piece {
+	n := len(queue.pending)
+	start := 0
+	if !queue.sequential && n > 0 {
+		start = rand.Intn(n)
+	}
+
+	best := -1
+	for j := 0; j < n; j++ {
+		i := (start + j) % n
+		if queue.pending[i] == nil || queue.priority[i] == PrioritySkip {
+			continue
+		}
+		if best >= 0 && queue.priority[i] <= queue.priority[best] {
+			if queue.priority[i] != PriorityNow || i > best {
+				continue
+			}
+		}
+		if accept != nil && !accept(i) {
+			continue
+		}
+		best = i
+	}
+
+	if best < 0 {
+		return nil
+	}
+
+	p := queue.pending[best]
+	queue.pending[best] = nil
+	if p.Data == nil {
+		p.Data = make([]byte, p.Length)
+	}
+	return p
+}
+
+// Pop blocks until there is a piece that accept agrees to and removes it
+// from the queue. A nil accept takes any piece. It returns false once cancel
+// is closed.
+func (queue *Queue) Pop(accept func(index int) bool, cancel <-chan struct{}) (*Piece, bool) {
+	for {
+		queue.mutex.Lock()
+		p := queue.pick(accept)
+		changed := queue.changed
+		queue.mutex.Unlock()
+
+		if p != nil {
+			return p, true
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(RetryInterval):
+		case <-cancel:
+			return nil, false
+		}
+	}
+}
+
+// Remove drops the piece at index, e.g. because it was found on disk.
+func (queue *Queue) Remove(index int) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.pending[index] = nil
+}
+
+// SetSequential switches between random and in-order picking.
+func (queue *Queue) SetSequential(sequential bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.sequential = sequential
+}
+
+func (queue *Queue) Sequential() bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.sequential
+}
+
+func (queue *Queue) SetPriority(index int, priority Priority) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.priority[index] != priority {
+		queue.priority[index] = priority
+		queue.notify()
+	}
+}
+
+func (queue *Queue) Priority(index int) Priority {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.priority[index]
+}
+
+// Len returns the number of queued pieces that are not skipped.
+func (queue *Queue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	n := 0
+	for i, p := range queue.pending {
+		if p != nil && queue.priority[i] != PrioritySkip {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MeterWindow is how many seconds a Meter averages its rate over.
+const MeterWindow = 5
+
+// Meter measures the bytes passing and their recent rate. It keeps one
+// bucket per second, plus one for the current second.
+type Meter struct {
+	mutex   sync.Mutex
+	total   int
+	buckets [MeterWindow + 1]int
+	newest  int64
+	start   time.Time
+
+	Now func() time.Time
+}
+
+func NewMeter() *Meter {
+	return &Meter{Now: time.Now}
+}
+
+// advance empties the buckets of the seconds up to second. The mutex must be
+// held.
+func (meter *Meter) advance(second int64) {
+	for s := meter.newest + 1; s <= second && s <= meter.newest+int64(len(meter.buckets)); s++ {
+		meter.buckets[s%int64(len(meter.buckets))] = 0
+	}
+	meter.newest = max(meter.newest, second)
+}
+
+func (meter *Meter) Add(n int) {
+	if meter == nil {
+		return
+	}
+
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+
+	now := meter.Now()
+	if meter.start.IsZero() {
+		meter.start = now
+		meter.newest = now.Unix()
+	}
+	meter.advance(now.Unix())
+	meter.buckets[now.Unix()%int64(len(meter.buckets))] += n
+	meter.total += n
+}
+
+// Total returns all bytes that have passed.
+func (meter *Meter) Total() int {
+	if meter == nil {
+		return 0
+	}
+
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+	return meter.total
+}
+
+// Rate returns the bytes per second of the last MeterWindow seconds, or
+// since the first byte if that was later.
+func (meter *Meter) Rate() float64 {
+	if meter == nil {
+		return 0
+	}
+
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+
+	if meter.start.IsZero() {
+		return 0
+	}
+	now := meter.Now()
+	meter.advance(now.Unix())
+
+	sum := 0
+	for _, n := range meter.buckets {
+		sum += n
+	}
+
+	span := MeterWindow + now.Sub(time.Unix(now.Unix(), 0)).Seconds()
+	span = max(1, min(span, now.Sub(meter.start).Seconds()))
+	return float64(sum) / span
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// MinBurst keeps very low rates from splitting blocks into tiny writes.
+	MinBurst  = 16 * 1024
+	ChunkSize = 16 * 1024
+
+	// MaxWait bounds a single sleep so that rate changes take effect quickly.
+	MaxWait = 100 * time.Millisecond
+)
+
+// Limiter is a token bucket limiting a byte rate. A rate of zero means
+// unlimited. The rate can be changed at any time, also while callers wait.
+// Meter measures the bytes that pass, limited or not.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+
+	Meter *Meter
+	Now   func() time.Time
+	Sleep func(time.Duration)
+}
+
+func New(rate int) *Limiter {
+	return &Limiter{
+		rate:  rate,
+		Meter: NewMeter(),
+		Now:   time.Now,
+		Sleep: time.Sleep,
+	}
+}
+
+func (limiter *Limiter) burst() float64 {
+	return float64(max(limiter.rate, MinBurst))
+}
+
+func (limiter *Limiter) refill(now time.Time) {
+	if !limiter.last.IsZero() {
+		elapsed := now.Sub(limiter.last).Seconds()
+		limiter.tokens = min(limiter.tokens+elapsed*float64(limiter.rate), limiter.burst())
+	} else {
+		limiter.tokens = limiter.burst()
+	}
+	limiter.last = now
+}
+
+func (limiter *Limiter) SetRate(rate int) {
+	if limiter == nil {
+		return
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.refill(limiter.Now())
+	limiter.rate = max(rate, 0)
+	limiter.tokens = min(limiter.tokens, limiter.burst())
+}
+
+func (limiter *Limiter) Rate() int {
+	if limiter == nil {
+		return 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.rate
+}
+
+// take removes n tokens if they are available. Otherwise it returns how long
+// to wait before trying again.
+func (limiter *Limiter) take(n int) (time.Duration, bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.rate == 0 {
+		return 0, true
+	}
+
+	limiter.refill(limiter.Now())
+	if limiter.tokens >= float64(n) {
+		limiter.tokens -= float64(n)
+		return 0, true
+	}
+
+	missing := float64(n) - limiter.tokens
+	wait := time.Duration(missing / float64(limiter.rate) * float64(time.Second))
+	return min(max(wait, time.Millisecond), MaxWait), false
+}
+
+// WaitN blocks until n bytes may pass.
+func (limiter *Limiter) WaitN(n int) {
+	if limiter == nil {
+		return
+	}
+	limiter.Meter.Add(n)
+
+	for n > 0 {
+		limiter.mutex.Lock()
+		chunk := min(n, int(limiter.burst()))
+		limiter.mutex.Unlock()
+
+		for {
+			wait, ok := limiter.take(chunk)
+			if ok {
+				break
+			}
+			limiter.Sleep(wait)
+		}
+		n -= chunk
+	}
+}
+
+// Pair limits the download and upload direction.
+type Pair struct {
+	Download *Limiter
+	Upload   *Limiter
+}
+
+func NewPair(download, upload int) *Pair {
+	return &Pair{Download: New(download), Upload: New(upload)}
+}
+
+func (pair *Pair) SetRates(download, upload int) {
+	pair.Download.SetRate(download)
+	pair.Upload.SetRate(upload)
+}
+
+// Conn applies the limiters of all pairs to a connection. Reads are charged
+// after they happen, writes before.
+type Conn struct {
+	net.Conn
+	pairs []*Pair
+}
+
+func NewConn(conn net.Conn, pairs ...*Pair) *Conn {
+	active := []*Pair{}
+	for _, pair := range pairs {
+		if pair != nil {
+			active = append(active, pair)
+		}
+	}
+	return &Conn{Conn: conn, pairs: active}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) > ChunkSize {
+		b = b[:ChunkSize]
+	}
+
+	n, err := c.Conn.Read(b)
+	for _, pair := range c.pairs {
+		pair.Download.WaitN(n)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(written+ChunkSize, len(b))]
+		for _, pair := range c.pairs {
+			pair.Upload.WaitN(len(chunk))
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,216 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CheckInterval = 30 * time.Second
+
+// Limits are the settings a rule switches. Zero rates mean unlimited.
+type Limits struct {
+	DownloadRate   int
+	UploadRate     int
+	UploadSlots    int
+	ActiveTorrents int
+}
+
+// RuleConfig is a rule as written in config.yaml.
+type RuleConfig struct {
+	Days           []string `yaml:"days"`
+	Start          string   `yaml:"start"`
+	End            string   `yaml:"end"`
+	DownloadRate   int      `yaml:"download_rate"`
+	UploadRate     int      `yaml:"upload_rate"`
+	UploadSlots    int      `yaml:"upload_slots"`
+	ActiveTorrents int      `yaml:"active_torrents"`
+}
+
+// Rule applies its limits between Start and End on the given days. A rule
+// whose end is before its start runs past midnight into the next day.
+type Rule struct {
+	Days   [7]bool
+	Start  time.Duration
+	End    time.Duration
+	Limits Limits
+}
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+	"daily":    {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func ParseRule(config RuleConfig) (Rule, error) {
+	rule := Rule{Limits: Limits{
+		DownloadRate:   config.DownloadRate,
+		UploadRate:     config.UploadRate,
+		UploadSlots:    config.UploadSlots,
+		ActiveTorrents: config.ActiveTorrents,
+	}}
+
+	days := config.Days
+	if len(days) == 0 {
+		days = []string{"daily"}
+	}
+	for _, name := range days {
+		weekdays, ok := dayNames[strings.ToLower(name)]
+		if !ok {
+			return rule, fmt.Errorf("unknown day %q", name)
+		}
+		for _, day := range weekdays {
+			rule.Days[day] = true
+		}
+	}
+
+	var err error
+	rule.Start, err = parseClock(config.Start)
+	if err != nil {
+		return rule, err
+	}
+	rule.End, err = parseClock(config.End)
+	if err != nil {
+		return rule, err
+	}
+	if rule.Start == rule.End {
+		return rule, fmt.Errorf("rule %s-%s is empty", config.Start, config.End)
+	}
+
+	return rule, nil
+}
+
+func ParseRules(configs []RuleConfig) ([]Rule, error) {
+	rules := make([]Rule, 0, len(configs))
+	for i, config := range configs {
+		rule, err := ParseRule(config)
+		if err != nil {
+			return nil, fmt.Errorf("schedule rule %d: %s", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Matches reports whether the rule is in effect at t.
+func (rule *Rule) Matches(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+
+	if rule.Start < rule.End {
+		return rule.Days[day] && clock >= rule.Start && clock < rule.End
+	}
+
+	yesterday := (day + 6) % 7
+	return (rule.Days[day] && clock >= rule.Start) || (rule.Days[yesterday] && clock < rule.End)
+}
+
+// Scheduler switches between the default limits and the limits of the first
+// matching rule as time passes.
+type Scheduler struct {
+	update   sync.Mutex
+	mutex    sync.Mutex
+	defaults Limits
+	rules    []Rule
+	current  Limits
+	applied  bool
+	apply    func(Limits)
+
+	Now func() time.Time
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func New(defaults Limits, rules []Rule, apply func(Limits)) *Scheduler {
+	return &Scheduler{
+		defaults: defaults,
+		rules:    rules,
+		apply:    apply,
+		Now:      time.Now,
+		closed:   make(chan struct{}),
+	}
+}
+
+// Active returns the limits in effect right now.
+func (s *Scheduler) Active() Limits {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.active(s.Now())
+}
+
+func (s *Scheduler) active(now time.Time) Limits {
+	for _, rule := range s.rules {
+		if rule.Matches(now) {
+			return rule.Limits
+		}
+	}
+	return s.defaults
+}
+
+// SetRules replaces the defaults and rules, e.g. after the config changed,
+// and applies the result right away.
+func (s *Scheduler) SetRules(defaults Limits, rules []Rule) {
+	s.mutex.Lock()
+	s.defaults = defaults
+	s.rules = rules
+	s.mutex.Unlock()
+
+	s.Update()
+}
+
+// Update applies the active limits if they changed since the last call.
+func (s *Scheduler) Update() {
+	s.update.Lock()
+	defer s.update.Unlock()
+
+	s.mutex.Lock()
+	limits := s.active(s.Now())
+	changed := !s.applied || limits != s.current
+	s.current = limits
+	s.applied = true
+	s.mutex.Unlock()
+
+	if changed {
+		s.apply(limits)
+	}
+}
+
+// Start applies the limits now and then checks every interval until Close.
+func (s *Scheduler) Start(interval time.Duration) {
+	s.Update()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-ticker.C:
+				s.Update()
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) Close() {
+	s.once.Do(func() { close(s.closed) })
+}
@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+)
+
+// span is the part of a single file that a piece covers.
+type span struct {
+	file   int
+	offset int
+	begin  int
+	length int
+}
+
+// Storage writes verified pieces into the files of a torrent below Dir.
+// Files that are not wanted are never created. A piece that overlaps one of
+// them is kept whole in a hidden parts file instead, so the boundary pieces
+// of wanted neighbours are not lost and can be moved into place if the file
+// is wanted later.
+type Storage struct {
+	Dir     string
+	Torrent *torrent.Torrent
+
+	mutex   sync.Mutex
+	files   []torrent.File
+	offsets []int
+	wanted  []bool
+	have    []bool
+	parted  []bool
+	handles map[int]*os.File
+	parts   *os.File
+}
+
+// New creates the storage of t below dir with every file wanted.
+func New(t *torrent.Torrent, dir string) *Storage {
+	files := t.Files()
+	storage := &Storage{
+		Dir:     dir,
+		Torrent: t,
+		files:   files,
+		offsets: make([]int, len(files)),
+		wanted:  make([]bool, len(files)),
+		have:    make([]bool, len(t.Info.Pieces)),
+		parted:  make([]bool, len(t.Info.Pieces)),
+		handles: make(map[int]*os.File),
+	}
+
+	offset := 0
+	for i, file := range files {
+		storage.offsets[i] = offset
+		storage.wanted[i] = true
+		offset += file.Length
+	}
+	return storage
+}
+
+// cleanPath turns the path of a file in the torrent into a relative path
+// that cannot leave the download directory.
+func cleanPath(segments []string) string {
+	clean := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		segment = strings.ReplaceAll(segment, string(filepath.Separator), "_")
+		if segment == "" || segment == "." || segment == ".." {
+			segment = "_"
+		}
+		clean = append(clean, segment)
+	}
+	return filepath.Join(clean...)
+}
+
+// FilePath returns where the file at index is stored.
+func (storage *Storage) FilePath(index int) string {
+	path := cleanPath(storage.files[index].Path)
+	if len(storage.Torrent.Info.Files) > 0 {
+		path = filepath.Join(cleanPath([]string{storage.Torrent.Info.Name}), path)
+	}
+	return filepath.Join(storage.Dir, path)
+}
+
+// PartsPath returns the file that holds the pieces of unwanted files.
+func (storage *Storage) PartsPath() string {
+	return filepath.Join(storage.Dir, "."+cleanPath([]string{storage.Torrent.Info.Name})+".parts")
+}
+
+// spans maps the byte range of a piece onto the files of the torrent.
+func (storage *Storage) spans(index, length int) []span {
+	start := index * storage.Torrent.Info.PieceLength
+	end := start + length
+
+	spans := []span{}
+	for i, file := range storage.files {
+		file_start := storage.offsets[i]
+		file_end := file_start + file.Length
+		if file_end > start && file_start < end {
+			offset := max(start, file_start) - file_start
+			spans = append(spans, span{
+				file:   i,
+				offset: offset,
+				begin:  file_start + offset - start,
+				length: min(end, file_end) - file_start - offset,
+			})
+		}
+	}
+	return spans
+}
+
+func (storage *Storage) open(index int) (*os.File, error) {
+	if f, ok := storage.handles[index]; ok {
+		return f, nil
+	}
+
+	path := storage.FilePath(index)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	storage.handles[index] = f
+	return f, nil
+}
+
+func (storage *Storage) openParts() (*os.File, error) {
+	if storage.parts != nil {
+		return storage.parts, nil
+	}
+
+	err := os.MkdirAll(storage.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.parts, err = os.OpenFile(storage.PartsPath(), os.O_RDWR|os.O_CREATE, 0644)
+	return storage.parts, err
+}
+
+func (storage *Storage) partsOffset(index int) int64 {
+	return int64(index) * int64(storage.Torrent.Info.PieceLength)
+}
+
+// Have reports whether the piece at index has been written.
+func (storage *Storage) Have(index int) bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.have[index]
+}
+
+func (storage *Storage) Wanted(index int) bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.wanted[index]
+}
+
+// SetWanted changes whether the file at index is written to disk. Pieces of
+// a newly wanted file that were already downloaded are copied out of the
+// parts file.
+func (storage *Storage) SetWanted(index int, wanted bool) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.wanted[index] == wanted {
+		return nil
+	}
+	storage.wanted[index] = wanted
+	if !wanted {
+		return nil
+	}
+
+	begin, end := storage.Torrent.FilePieces(index)
+	for i := begin; i < end; i++ {
+		if !storage.have[i] || !storage.parted[i] {
+			continue
+		}
+
+		parts, err := storage.openParts()
+		if err != nil {
+			return err
+		}
+		data := make([]byte, storage.Torrent.PieceSize(i))
+		_, err = parts.ReadAt(data, storage.partsOffset(i))
+		if err != nil {
+			return err
+		}
+
+		for _, s := range storage.spans(i, len(data)) {
+			if s.file != index {
+				continue
+			}
+			err = storage.writeSpan(s, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (storage *Storage) writeSpan(s span, data []byte) error {
+	f, err := storage.open(s.file)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data[s.begin:s.begin+s.length], int64(s.offset))
+	return err
+}
+
+// WritePiece stores a verified piece.
+func (storage *Storage) WritePiece(index int, data []byte) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	parted := false
+	for _, s := range storage.spans(index, len(data)) {
+		if !storage.wanted[s.file] {
+			parted = true
+			continue
+		}
+		err := storage.writeSpan(s, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if parted {
+		parts, err := storage.openParts()
+		if err != nil {
+			return err
+		}
+		_, err = parts.WriteAt(data, storage.partsOffset(index))
+		if err != nil {
+			return err
+		}
+		storage.parted[index] = true
+	}
+
+	storage.have[index] = true
+	return nil
+}
+
+// ReadPiece reads back a piece that has been written.
+func (storage *Storage) ReadPiece(index int) ([]byte, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	data := make([]byte, storage.Torrent.PieceSize(index))
+	if storage.parted[index] {
+		parts, err := storage.openParts()
+		if err != nil {
+			return nil, err
+		}
+		_, err = parts.ReadAt(data, storage.partsOffset(index))
+		return data, err
+	}
+
+	for _, s := range storage.spans(index, len(data)) {
+		err := storage.readSpan(s, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// readSpan reads without creating files that do not exist.
+func (storage *Storage) readSpan(s span, data []byte) error {
+	f, ok := storage.handles[s.file]
+	if !ok {
+		var err error
+		f, err = os.Open(storage.FilePath(s.file))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	_, err := f.ReadAt(data[s.begin:s.begin+s.length], int64(s.offset))
+	return err
+}
+
+// Verify checks the piece at index against its hash and records whether we
+// have it. Data of a previous run is found this way.
+func (storage *Storage) Verify(index int) bool {
+	data, err := storage.ReadPiece(index)
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.have[index] = err == nil && sha1.Sum(data) == storage.Torrent.Info.Pieces[index]
+	return storage.have[index]
+}
+
+// Pieces returns which pieces have been written and which of them are kept
+// in the parts file, e.g. to save them for the next run.
+func (storage *Storage) Pieces() ([]bool, []bool) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return append([]bool{}, storage.have...), append([]bool{}, storage.parted...)
+}
+
+// Restore takes over the pieces of an earlier run without hashing them. A
+// piece is only restored if the files it was written to are still large
+// enough to hold it. It returns the number of restored pieces.
+func (storage *Storage) Restore(have, parted []bool) int {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	sizes := map[string]int64{}
+	size := func(path string) int64 {
+		if n, ok := sizes[path]; ok {
+			return n
+		}
+		info, err := os.Stat(path)
+		if err == nil {
+			sizes[path] = info.Size()
+		}
+		return sizes[path]
+	}
+
+	restored := 0
+	for i := range storage.have {
+		if i >= len(have) || !have[i] {
+			continue
+		}
+
+		length := storage.Torrent.PieceSize(i)
+		is_parted := i < len(parted) && parted[i]
+		ok := true
+		if is_parted {
+			ok = size(storage.PartsPath()) >= storage.partsOffset(i)+int64(length)
+		} else {
+			for _, s := range storage.spans(i, length) {
+				if size(storage.FilePath(s.file)) < int64(s.offset+s.length) {
+					ok = false
+				}
+			}
+		}
+
+		if ok {
+			storage.have[i] = true
+			storage.parted[i] = is_parted
+			restored++
+		}
+	}
+	return restored
+}
+
+// Close closes all files. The parts file is removed once every file is
+// wanted, since everything in it has been copied out by then.
+func (storage *Storage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	var first error
+	for index, f := range storage.handles {
+		err := f.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+		delete(storage.handles, index)
+	}
+
+	if storage.parts == nil {
+		return first
+	}
+
+	err := storage.parts.Close()
+	if err != nil && first == nil {
+		first = err
+	}
+	storage.parts = nil
+
+	for _, wanted := range storage.wanted {
+		if !wanted {
+			return first
+		}
+	}
+	os.Remove(storage.PartsPath())
+	for i := range storage.parted {
+		storage.parted[i] = false
+	}
+	return first
+}
+
+// Remove closes the storage and deletes every file it wrote.
+func (storage *Storage) Remove() error {
+	storage.Close()
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	var first error
+	for i := range storage.files {
+		err := os.Remove(storage.FilePath(i))
+		if err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+
+	err := os.Remove(storage.PartsPath())
+	if err != nil && !os.IsNotExist(err) && first == nil {
+		first = err
+	}
+
+	for i := range storage.files {
+		removeEmptyDirs(filepath.Dir(storage.FilePath(i)), storage.Dir)
+	}
+	for i := range storage.have {
+		storage.have[i] = false
+		storage.parted[i] = false
+	}
+	return first
+}
+
+// removeEmptyDirs removes dir and its parents up to root as long as they are
+// empty.
+func removeEmptyDirs(dir, root string) {
+	root = filepath.Clean(root)
+	for dir != root && dir != "." && dir != string(filepath.Separator) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
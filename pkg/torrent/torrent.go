@@ -2,15 +2,18 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"fmt"
 	"os"
 
 	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
 )
 
 type Torrent struct {
-	InfoHash [20]byte
-	Info     Info
-	Announce string
+	InfoHash     [20]byte
+	Info         Info
+	Announce     string
+	AnnounceList [][]string
+	URLList      []string
 }
 
 type Info struct {
@@ -19,6 +22,7 @@ type Info struct {
 	Pieces      [][20]byte
 	Length      int
 	Files       []File
+	Private     bool
 }
 
 type File struct {
@@ -72,6 +76,8 @@ func newInfo(m map[string]any) Info {
 			for _, file := range value.([]any) {
 				info.Files = append(info.Files, newFile(file.(map[string]any)))
 			}
+		case "private":
+			info.Private = value.(int) == 1
 		}
 	}
 	return info
@@ -95,9 +101,51 @@ func marshallableInfo(info Info) map[string]any {
 	for _, file := range info.Files {
 		m["files"] = append(m["files"].([]any), marshallableFile(file))
 	}
+	if info.Private {
+		m["private"] = 1
+	}
 	return m
 }
 
+func newAnnounceList(l []any) [][]string {
+	announce_list := make([][]string, 0, len(l))
+	for _, tier := range l {
+		tier_list, ok := tier.([]any)
+		if !ok {
+			continue
+		}
+		urls := []string{}
+		for _, u := range tier_list {
+			if url, ok := u.(string); ok && url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			announce_list = append(announce_list, urls)
+		}
+	}
+	return announce_list
+}
+
+// newURLList parses the BEP 19 url-list, which is either a single URL or a list.
+func newURLList(value any) []string {
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []any:
+		urls := []string{}
+		for _, u := range v {
+			if s, ok := u.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+		return urls
+	}
+	return nil
+}
+
 func NewTorrent(filename string) (*Torrent, error) {
 	file_data, err := os.ReadFile(filename)
 	if err != nil {
@@ -106,22 +154,40 @@ func NewTorrent(filename string) (*Torrent, error) {
 	return NewTorrentFromBencode(file_data)
 }
 
-func NewTorrentFromBencode(bencoded []byte) (*Torrent, error) {
+func NewTorrentFromBencode(bencoded []byte) (t *Torrent, err error) {
+	// The parsers assume the types of a valid torrent, so a malformed one
+	// is reported instead of crashing, e.g. when it was uploaded.
+	defer func() {
+		if r := recover(); r != nil {
+			t, err = nil, fmt.Errorf("malformed torrent: %v", r)
+		}
+	}()
+
 	unmarshalled_data, err := bencode.UnMarshal(bencoded)
 	if err != nil {
 		return nil, err
 	}
 
-	t := &Torrent{}
+	t = &Torrent{}
 	for key, value := range unmarshalled_data.(map[string]any) {
 		switch key {
 		case "info":
 			t.Info = newInfo(value.(map[string]any))
 		case "announce":
 			t.Announce = value.(string)
+		case "announce-list":
+			if l, ok := value.([]any); ok {
+				t.AnnounceList = newAnnounceList(l)
+			}
+		case "url-list":
+			t.URLList = newURLList(value)
 		}
 	}
 
+	if t.Info.PieceLength <= 0 || len(t.Info.Pieces) != (t.GetLength()+t.Info.PieceLength-1)/t.Info.PieceLength {
+		return nil, fmt.Errorf("malformed torrent: pieces do not match the length")
+	}
+
 	err = t.updateInfoHash()
 	if err != nil {
 		return nil, err
@@ -130,10 +196,40 @@ func NewTorrentFromBencode(bencoded []byte) (*Torrent, error) {
 	return t, nil
 }
 
+func (torrent *Torrent) InfoBytes() ([]byte, error) {
+	return bencode.Marshal(marshallableInfo(torrent.Info))
+}
+
+// Bytes encodes the torrent as a .torrent file.
+func (torrent *Torrent) Bytes() ([]byte, error) {
+	m := map[string]any{"info": marshallableInfo(torrent.Info)}
+	if torrent.Announce != "" {
+		m["announce"] = torrent.Announce
+	}
+	if len(torrent.AnnounceList) > 0 {
+		announce_list := []any{}
+		for _, tier := range torrent.AnnounceList {
+			urls := []any{}
+			for _, u := range tier {
+				urls = append(urls, u)
+			}
+			announce_list = append(announce_list, urls)
+		}
+		m["announce-list"] = announce_list
+	}
+	if len(torrent.URLList) > 0 {
+		url_list := []any{}
+		for _, u := range torrent.URLList {
+			url_list = append(url_list, u)
+		}
+		m["url-list"] = url_list
+	}
+	return bencode.Marshal(m)
+}
+
 func (torrent *Torrent) updateInfoHash() error {
 
-	info := marshallableInfo(torrent.Info)
-	info_bencoded, err := bencode.Marshal(info)
+	info_bencoded, err := torrent.InfoBytes()
 	if err != nil {
 		return err
 	}
@@ -153,3 +249,42 @@ func (torrent *Torrent) GetLength() int {
 
 	return torrent.Info.Length
 }
+
+// PieceSize returns the length of the piece at index. Only the last piece can
+// be shorter than the piece length.
+func (torrent *Torrent) PieceSize(index int) int {
+	start := index * torrent.Info.PieceLength
+	return min(torrent.Info.PieceLength, torrent.GetLength()-start)
+}
+
+// Files lists the files of the torrent. A single-file torrent has one file
+// named after the torrent.
+func (torrent *Torrent) Files() []File {
+	if len(torrent.Info.Files) > 0 {
+		return torrent.Info.Files
+	}
+	return []File{{Length: torrent.Info.Length, Path: []string{torrent.Info.Name}}}
+}
+
+// FileOffset returns where the file at index starts in the torrent data.
+func (torrent *Torrent) FileOffset(index int) int {
+	offset := 0
+	for _, file := range torrent.Files()[:index] {
+		offset += file.Length
+	}
+	return offset
+}
+
+// FilePieces returns the range of pieces [begin, end) that overlap the file
+// at index. Empty files overlap no pieces.
+func (torrent *Torrent) FilePieces(index int) (int, int) {
+	offset := torrent.FileOffset(index)
+	length := torrent.Files()[index].Length
+	if length == 0 {
+		return 0, 0
+	}
+
+	begin := offset / torrent.Info.PieceLength
+	end := (offset+length-1)/torrent.Info.PieceLength + 1
+	return begin, end
+}
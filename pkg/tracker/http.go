@@ -0,0 +1,116 @@
+package tracker
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+)
+
+func buildAnnounceURL(u *url.URL, req AnnounceRequest) string {
+	announce_url := *u
+
+	params := announce_url.Query()
+	params.Set("info_hash", string(req.InfoHash[:]))
+	params.Set("peer_id", string(req.PeerID[:]))
+	params.Set("port", strconv.Itoa(req.Port))
+	params.Set("uploaded", strconv.Itoa(req.Uploaded))
+	params.Set("downloaded", strconv.Itoa(req.Downloaded))
+	params.Set("left", strconv.Itoa(req.Left))
+	params.Set("compact", "1")
+	if req.Event != EventNone {
+		params.Set("event", req.Event)
+	}
+	if req.IPv6 != nil {
+		params.Set("ipv6", req.IPv6.String())
+	}
+
+	announce_url.RawQuery = params.Encode()
+	return announce_url.String()
+}
+
+func announceHTTP(u *url.URL, req AnnounceRequest) (*AnnounceResponse, error) {
+	http_client := &http.Client{Timeout: AnnounceTimeout * time.Second}
+	resp, err := http_client.Get(buildAnnounceURL(u, req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responded with status %s", resp.Status)
+	}
+
+	return parseAnnounceResponse(resp.Body)
+}
+
+func parseAnnounceResponse(resp_body io.Reader) (*AnnounceResponse, error) {
+	bencoded_response, err := io.ReadAll(resp_body)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded_body, err := bencode.UnMarshal(bencoded_response)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded_body.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid tracker response")
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker failure: %s", reason)
+	}
+
+	interval, _ := dict["interval"].(int)
+	resp := &AnnounceResponse{Interval: time.Duration(interval) * time.Second}
+	resp.Seeders, _ = dict["complete"].(int)
+	resp.Leechers, _ = dict["incomplete"].(int)
+
+	switch peers := dict["peers"].(type) {
+	case string:
+		resp.Peers, err = parseCompactPeers([]byte(peers))
+		if err != nil {
+			return nil, err
+		}
+	case []any:
+		resp.Peers = parsePeerDicts(peers)
+	}
+
+	if peers6, ok := dict["peers6"].(string); ok {
+		peers_list, err := parseCompactPeers6([]byte(peers6))
+		if err != nil {
+			return nil, err
+		}
+		resp.Peers = append(resp.Peers, peers_list...)
+	}
+
+	return resp, nil
+}
+
+func parsePeerDicts(peers []any) []net.Addr {
+	peers_list := make([]net.Addr, 0, len(peers))
+	for _, p := range peers {
+		dict, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		ip_str, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int)
+		ip := net.ParseIP(ip_str)
+		if ip == nil || port <= 0 {
+			continue
+		}
+
+		peers_list = append(peers_list, &net.TCPAddr{IP: ip, Port: port})
+	}
+	return peers_list
+}
@@ -0,0 +1,168 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+)
+
+const HTTPMaxScrapeHashes = 50
+
+type ScrapeResult struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+func Scrape(announce_url string, info_hashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(announce_url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(u, info_hashes)
+	case "udp":
+		return scrapeUDP(u, info_hashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL,
+// following the convention that the last path component starts with "announce".
+func ScrapeURL(announce_url string) (string, error) {
+	u, err := url.Parse(announce_url)
+	if err != nil {
+		return "", err
+	}
+
+	dir, last := path.Split(u.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce_url)
+	}
+
+	u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+func scrapeHTTP(u *url.URL, info_hashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrape_url, err := ScrapeURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(info_hashes))
+	for start := 0; start < len(info_hashes); start += HTTPMaxScrapeHashes {
+		end := min(start+HTTPMaxScrapeHashes, len(info_hashes))
+		err := scrapeHTTPBatch(scrape_url, info_hashes[start:end], results)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func scrapeHTTPBatch(scrape_url string, info_hashes [][20]byte, results map[[20]byte]ScrapeResult) error {
+	u, err := url.Parse(scrape_url)
+	if err != nil {
+		return err
+	}
+
+	params := u.Query()
+	for _, info_hash := range info_hashes {
+		params.Add("info_hash", string(info_hash[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	http_client := &http.Client{Timeout: AnnounceTimeout * time.Second}
+	resp, err := http_client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tracker responded with status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	decoded_body, err := bencode.UnMarshal(body)
+	if err != nil {
+		return err
+	}
+
+	dict, ok := decoded_body.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid scrape response")
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		return fmt.Errorf("tracker failure: %s", reason)
+	}
+
+	files, _ := dict["files"].(map[string]any)
+	for hash, value := range files {
+		stats, ok := value.(map[string]any)
+		if !ok || len(hash) != 20 {
+			continue
+		}
+
+		var info_hash [20]byte
+		copy(info_hash[:], hash)
+		seeders, _ := stats["complete"].(int)
+		leechers, _ := stats["incomplete"].(int)
+		completed, _ := stats["downloaded"].(int)
+		results[info_hash] = ScrapeResult{Seeders: seeders, Leechers: leechers, Completed: completed}
+	}
+
+	return nil
+}
+
+func scrapeUDP(u *url.URL, info_hashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	t, err := dialUDP(u)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	results := make(map[[20]byte]ScrapeResult, len(info_hashes))
+	for start := 0; start < len(info_hashes); start += UDPMaxScrapeHashes {
+		end := min(start+UDPMaxScrapeHashes, len(info_hashes))
+		batch := info_hashes[start:end]
+
+		buf := t.header(udpActionScrape)
+		for _, info_hash := range batch {
+			buf.Write(info_hash[:])
+		}
+
+		resp, err := t.roundTrip(buf.Bytes(), 8+12*len(batch))
+		if err != nil {
+			return nil, err
+		}
+
+		for i, info_hash := range batch {
+			offset := 8 + 12*i
+			results[info_hash] = ScrapeResult{
+				Seeders:   int(binary.BigEndian.Uint32(resp[offset : offset+4])),
+				Completed: int(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+				Leechers:  int(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+			}
+		}
+	}
+
+	return results, nil
+}
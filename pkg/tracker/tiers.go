@@ -0,0 +1,147 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// TierList holds the trackers of a torrent grouped into tiers as described in BEP 12.
+type TierList struct {
+	mutex sync.Mutex
+	tiers [][]string
+}
+
+func NewTierList(announce string, announce_list [][]string) *TierList {
+	tl := &TierList{}
+
+	if len(announce_list) == 0 {
+		if announce != "" {
+			tl.tiers = [][]string{{announce}}
+		}
+		return tl
+	}
+
+	tl.tiers = make([][]string, len(announce_list))
+	for i, tier := range announce_list {
+		tl.tiers[i] = make([]string, len(tier))
+		copy(tl.tiers[i], tier)
+		rand.Shuffle(len(tl.tiers[i]), func(a, b int) {
+			tl.tiers[i][a], tl.tiers[i][b] = tl.tiers[i][b], tl.tiers[i][a]
+		})
+	}
+
+	return tl
+}
+
+func (tl *TierList) Tiers() [][]string {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	tiers := make([][]string, len(tl.tiers))
+	for i, tier := range tl.tiers {
+		tiers[i] = make([]string, len(tier))
+		copy(tiers[i], tier)
+	}
+	return tiers
+}
+
+func (tl *TierList) promote(tier int, tracker string) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	for i, t := range tl.tiers[tier] {
+		if t == tracker {
+			copy(tl.tiers[tier][1:i+1], tl.tiers[tier][:i])
+			tl.tiers[tier][0] = tracker
+			return
+		}
+	}
+}
+
+func (tl *TierList) announceTier(tier int, trackers []string, req AnnounceRequest) (*AnnounceResponse, string, error) {
+	var errs []error
+	for _, tracker := range trackers {
+		resp, err := Announce(tracker, req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tracker, err))
+			continue
+		}
+
+		tl.promote(tier, tracker)
+		return resp, tracker, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// Announce tries the trackers tier by tier and returns the first successful response
+// along with the tracker that produced it.
+func (tl *TierList) Announce(req AnnounceRequest) (*AnnounceResponse, string, error) {
+	tiers := tl.Tiers()
+	if len(tiers) == 0 {
+		return nil, "", fmt.Errorf("torrent has no trackers")
+	}
+
+	var errs []error
+	for i, trackers := range tiers {
+		resp, tracker, err := tl.announceTier(i, trackers, req)
+		if err == nil {
+			return resp, tracker, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, "", errors.Join(errs...)
+}
+
+// AnnounceAll announces to every tier in parallel and merges the peers returned.
+func (tl *TierList) AnnounceAll(req AnnounceRequest) (*AnnounceResponse, error) {
+	tiers := tl.Tiers()
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*AnnounceResponse, len(tiers))
+	errs := make([]error, len(tiers))
+
+	for i, trackers := range tiers {
+		wg.Add(1)
+		go func(i int, trackers []string) {
+			defer wg.Done()
+			responses[i], _, errs[i] = tl.announceTier(i, trackers, req)
+		}(i, trackers)
+	}
+	wg.Wait()
+
+	merged := &AnnounceResponse{}
+	seen := make(map[string]bool)
+	succeeded := false
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+		succeeded = true
+
+		if merged.Interval == 0 || (resp.Interval > 0 && resp.Interval < merged.Interval) {
+			merged.Interval = resp.Interval
+		}
+		// The tiers see the same swarm, so take the largest count.
+		merged.Seeders = max(merged.Seeders, resp.Seeders)
+		merged.Leechers = max(merged.Leechers, resp.Leechers)
+
+		for _, addr := range resp.Peers {
+			if !seen[addr.String()] {
+				seen[addr.String()] = true
+				merged.Peers = append(merged.Peers, addr)
+			}
+		}
+	}
+
+	if !succeeded {
+		return nil, errors.Join(errs...)
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,85 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventStopped   = "stopped"
+	EventCompleted = "completed"
+
+	AnnounceTimeout = 10
+)
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      string
+	IPv6       net.IP
+}
+
+// AnnounceResponse holds the peers a tracker returned. Seeders and Leechers
+// are the size of the swarm as far as the tracker knows.
+type AnnounceResponse struct {
+	Interval time.Duration
+	Peers    []net.Addr
+	Seeders  int
+	Leechers int
+}
+
+func Announce(announce_url string, req AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(announce_url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(u, req)
+	case "udp":
+		return announceUDP(u, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+func parseCompactPeers(peers []byte) ([]net.Addr, error) {
+	if len(peers)%6 != 0 {
+		return nil, fmt.Errorf("invalid compact peers length %d", len(peers))
+	}
+
+	peers_list := make([]net.Addr, len(peers)/6)
+	for i := 0; i < len(peers); i += 6 {
+		ip := make(net.IP, 4)
+		copy(ip, peers[i:i+4])
+		port := int(peers[i+4])<<8 | int(peers[i+5])
+		peers_list[i/6] = &net.TCPAddr{IP: ip, Port: port}
+	}
+
+	return peers_list, nil
+}
+
+func parseCompactPeers6(peers []byte) ([]net.Addr, error) {
+	if len(peers)%18 != 0 {
+		return nil, fmt.Errorf("invalid compact peers6 length %d", len(peers))
+	}
+
+	peers_list := make([]net.Addr, len(peers)/18)
+	for i := 0; i < len(peers); i += 18 {
+		ip := make(net.IP, 16)
+		copy(ip, peers[i:i+16])
+		port := int(peers[i+16])<<8 | int(peers[i+17])
+		peers_list[i/18] = &net.TCPAddr{IP: ip, Port: port}
+	}
+
+	return peers_list, nil
+}
@@ -0,0 +1,233 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	UDPRetries         = 3
+	UDPMaxScrapeHashes = 74
+)
+
+var udpEvents = map[string]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+type udpTracker struct {
+	conn          net.Conn
+	connection_id uint64
+}
+
+func dialUDP(u *url.URL) (*udpTracker, error) {
+	return dialUDPNetwork("udp", u.Host)
+}
+
+func dialUDPNetwork(network, host string) (*udpTracker, error) {
+	conn, err := net.DialTimeout(network, host, AnnounceTimeout*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &udpTracker{conn: conn}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint64(udpProtocolID))
+	binary.Write(&buf, binary.BigEndian, uint32(udpActionConnect))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+
+	resp, err := t.roundTrip(buf.Bytes(), 16)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t.connection_id = binary.BigEndian.Uint64(resp[8:16])
+	return t, nil
+}
+
+func (t *udpTracker) Close() error {
+	return t.conn.Close()
+}
+
+// roundTrip fills in the transaction id of the request (bytes 12:16), sends it
+// and waits for a matching response of at least min_len bytes.
+func (t *udpTracker) roundTrip(req []byte, min_len int) ([]byte, error) {
+	if len(req) < 16 {
+		return nil, fmt.Errorf("udp tracker request too short: %d bytes", len(req))
+	}
+
+	transaction_id := make([]byte, 4)
+	rand.Read(transaction_id)
+	copy(req[12:16], transaction_id)
+
+	action := binary.BigEndian.Uint32(req[8:12])
+	resp := make([]byte, 2048)
+
+	var err error
+	for attempt := 0; attempt < UDPRetries; attempt++ {
+		_, err = t.conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		t.conn.SetReadDeadline(time.Now().Add(time.Duration(attempt+1) * 3 * time.Second))
+		var n int
+		n, err = t.conn.Read(resp)
+		if err != nil {
+			continue
+		}
+
+		if n < 8 || !bytes.Equal(resp[4:8], transaction_id) {
+			err = fmt.Errorf("invalid udp tracker response")
+			continue
+		}
+
+		resp_action := binary.BigEndian.Uint32(resp[0:4])
+		if resp_action == udpActionError {
+			return nil, fmt.Errorf("tracker failure: %s", resp[8:n])
+		}
+
+		if resp_action != action || n < min_len {
+			return nil, fmt.Errorf("invalid udp tracker response")
+		}
+
+		return resp[:n], nil
+	}
+
+	return nil, err
+}
+
+func (t *udpTracker) header(action uint32) *bytes.Buffer {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, t.connection_id)
+	binary.Write(&buf, binary.BigEndian, action)
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	return &buf
+}
+
+func (t *udpTracker) announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	buf := t.header(udpActionAnnounce)
+	buf.Write(req.InfoHash[:])
+	buf.Write(req.PeerID[:])
+	binary.Write(buf, binary.BigEndian, uint64(req.Downloaded))
+	binary.Write(buf, binary.BigEndian, uint64(req.Left))
+	binary.Write(buf, binary.BigEndian, uint64(req.Uploaded))
+	binary.Write(buf, binary.BigEndian, udpEvents[req.Event])
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	key := make([]byte, 4)
+	rand.Read(key)
+	buf.Write(key)
+	binary.Write(buf, binary.BigEndian, int32(-1))
+	binary.Write(buf, binary.BigEndian, uint16(req.Port))
+
+	resp, err := t.roundTrip(buf.Bytes(), 20)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := binary.BigEndian.Uint32(resp[8:12])
+
+	var peers []net.Addr
+	if remote, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && remote.IP.To4() == nil {
+		peers, err = parseCompactPeers6(resp[20:])
+	} else {
+		peers, err = parseCompactPeers(resp[20:])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Interval: time.Duration(interval) * time.Second,
+		Peers:    peers,
+		Leechers: int(binary.BigEndian.Uint32(resp[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[16:20])),
+	}, nil
+}
+
+// announceUDP announces over every address family the tracker host resolves to,
+// so that the tracker learns about both our IPv4 and IPv6 endpoints.
+func announceUDP(u *url.URL, req AnnounceRequest) (*AnnounceResponse, error) {
+	networks := []string{}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	has_ipv4, has_ipv6 := false, false
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			has_ipv4 = true
+		} else {
+			has_ipv6 = true
+		}
+	}
+	if has_ipv4 {
+		networks = append(networks, "udp4")
+	}
+	if has_ipv6 && req.IPv6 != nil {
+		networks = append(networks, "udp6")
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("no reachable address for tracker %s", u.Host)
+	}
+
+	responses := make([]*AnnounceResponse, len(networks))
+	errs := make([]error, len(networks))
+	var wg sync.WaitGroup
+
+	for i, network := range networks {
+		wg.Add(1)
+		go func(i int, network string) {
+			defer wg.Done()
+
+			t, err := dialUDPNetwork(network, u.Host)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer t.Close()
+
+			responses[i], errs[i] = t.announce(req)
+		}(i, network)
+	}
+	wg.Wait()
+
+	var merged *AnnounceResponse
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+		if merged == nil {
+			merged = resp
+			continue
+		}
+		merged.Peers = append(merged.Peers, resp.Peers...)
+		// Both families see the same swarm.
+		merged.Seeders = max(merged.Seeders, resp.Seeders)
+		merged.Leechers = max(merged.Leechers, resp.Leechers)
+	}
+
+	if merged == nil {
+		return nil, errors.Join(errs...)
+	}
+	return merged, nil
+}
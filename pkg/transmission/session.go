@@ -0,0 +1,145 @@
+package transmission
+
+import (
+	"encoding/json"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/mse"
+)
+
+var encryptionNames = map[mse.Mode]string{
+	mse.ModeDisabled: "tolerated",
+	mse.ModeEnabled:  "preferred",
+	mse.ModeForced:   "required",
+}
+
+func (server *Server) sessionGet() map[string]any {
+	downloads, seeds := server.Session.ActiveLimits()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return map[string]any{
+		"version":                  Version,
+		"rpc-version":              RPCVersion,
+		"rpc-version-minimum":      1,
+		"session-id":               server.sessionID,
+		"download-dir":             server.Session.DownloadDirectory(),
+		"peer-port":                server.Session.Port,
+		"encryption":               encryptionNames[server.Session.Encryption],
+		"dht-enabled":              server.Session.DHT != nil,
+		"lpd-enabled":              server.Session.LSD != nil,
+		"utp-enabled":              server.Session.UTPEnabled,
+		"pex-enabled":              true,
+		"speed-limit-down":         server.downLimit,
+		"speed-limit-down-enabled": server.downEnabled,
+		"speed-limit-up":           server.upLimit,
+		"speed-limit-up-enabled":   server.upEnabled,
+		"download-queue-size":      downloads,
+		"download-queue-enabled":   downloads > 0,
+		"seed-queue-size":          seeds,
+		"seed-queue-enabled":       seeds > 0,
+		"units": map[string]any{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  speedBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+// sessionSet changes the download directory, the global speed limits and the
+// queue sizes. Other settings are ignored.
+func (server *Server) sessionSet(raw json.RawMessage) error {
+	var args struct {
+		DownloadDir           *string `json:"download-dir"`
+		SpeedLimitDown        *int    `json:"speed-limit-down"`
+		SpeedLimitDownEnabled *bool   `json:"speed-limit-down-enabled"`
+		SpeedLimitUp          *int    `json:"speed-limit-up"`
+		SpeedLimitUpEnabled   *bool   `json:"speed-limit-up-enabled"`
+		DownloadQueueSize     *int    `json:"download-queue-size"`
+		DownloadQueueEnabled  *bool   `json:"download-queue-enabled"`
+		SeedQueueSize         *int    `json:"seed-queue-size"`
+		SeedQueueEnabled      *bool   `json:"seed-queue-enabled"`
+	}
+	err := decode(raw, &args)
+	if err != nil {
+		return err
+	}
+
+	if args.DownloadDir != nil && *args.DownloadDir != "" {
+		server.Session.SetDownloadDir(*args.DownloadDir)
+	}
+
+	server.mutex.Lock()
+	set(&server.downLimit, args.SpeedLimitDown)
+	set(&server.downEnabled, args.SpeedLimitDownEnabled)
+	set(&server.upLimit, args.SpeedLimitUp)
+	set(&server.upEnabled, args.SpeedLimitUpEnabled)
+
+	download, upload := 0, 0
+	if server.downEnabled {
+		download = server.downLimit * speedBytes
+	}
+	if server.upEnabled {
+		upload = server.upLimit * speedBytes
+	}
+	server.mutex.Unlock()
+	server.Session.GlobalRates.SetRates(download, upload)
+
+	downloads, seeds := server.Session.ActiveLimits()
+	server.Session.SetActiveDownloads(queueSize(downloads, args.DownloadQueueSize, args.DownloadQueueEnabled))
+	server.Session.SetActiveSeeds(queueSize(seeds, args.SeedQueueSize, args.SeedQueueEnabled))
+	return nil
+}
+
+func set[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+// queueSize applies an optional queue size and its switch to a limit, where
+// 0 means no queue.
+func queueSize(current int, size *int, enabled *bool) int {
+	if enabled != nil && !*enabled {
+		return 0
+	}
+	if size != nil && *size >= 0 {
+		return *size
+	}
+	return current
+}
+
+func (server *Server) sessionStats() map[string]any {
+	torrents := server.Session.Torrents()
+
+	active, downloaded, uploaded := 0, 0, 0
+	for _, c := range torrents {
+		switch server.status(c) {
+		case StatusDownload, StatusSeed, StatusCheck:
+			active++
+		}
+		down, up := c.Transferred()
+		downloaded += down
+		uploaded += up
+	}
+
+	totals := map[string]any{
+		"downloadedBytes": downloaded,
+		"uploadedBytes":   uploaded,
+		"filesAdded":      0,
+		"sessionCount":    1,
+		"secondsActive":   0,
+	}
+	return map[string]any{
+		"torrentCount":       len(torrents),
+		"activeTorrentCount": active,
+		"pausedTorrentCount": len(torrents) - active,
+		"downloadSpeed":      int(server.Session.GlobalRates.Download.Meter.Rate()),
+		"uploadSpeed":        int(server.Session.GlobalRates.Upload.Meter.Rate()),
+		"cumulative-stats":   totals,
+		"current-stats":      totals,
+	}
+}
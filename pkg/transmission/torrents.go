@@ -0,0 +1,510 @@
+package transmission
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+)
+
+// Torrent states of the RPC protocol.
+const (
+	StatusStopped = iota
+	StatusCheckWait
+	StatusCheck
+	StatusDownloadWait
+	StatusDownload
+	StatusSeedWait
+	StatusSeed
+)
+
+// maxTorrentSize limits .torrent files fetched for torrent-add.
+const maxTorrentSize = 10 << 20
+
+// fetchClient fetches the .torrent files of torrent-add, so that a stalled
+// server cannot hold the RPC request forever.
+var fetchClient = &http.Client{Timeout: 30 * time.Second}
+
+// selected returns the torrents that ids refers to. ids is a number, a hash,
+// a list of both or "recently-active"; without ids all torrents are meant.
+func (server *Server) selected(ids json.RawMessage) ([]*client.Client, error) {
+	torrents := server.Session.Torrents()
+	if len(ids) == 0 {
+		return torrents, nil
+	}
+
+	var list []any
+	var single any
+	err := json.Unmarshal(ids, &single)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ids: %s", err)
+	}
+	switch v := single.(type) {
+	case []any:
+		list = v
+	case string:
+		if v == "recently-active" {
+			return torrents, nil
+		}
+		list = []any{v}
+	default:
+		list = []any{v}
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	selected := []*client.Client{}
+	for _, c := range torrents {
+		id := server.id(c.Torrent.InfoHash)
+		hash := hex.EncodeToString(c.Torrent.InfoHash[:])
+		for _, want := range list {
+			switch want := want.(type) {
+			case float64:
+				if int(want) == id {
+					selected = append(selected, c)
+				}
+			case string:
+				if strings.EqualFold(want, hash) {
+					selected = append(selected, c)
+				}
+			}
+		}
+	}
+	return selected, nil
+}
+
+type idsArguments struct {
+	IDs json.RawMessage `json:"ids"`
+}
+
+// forEach runs a session method on every selected torrent.
+func (server *Server) forEach(raw json.RawMessage, method func([20]byte) error) error {
+	var args idsArguments
+	err := decode(raw, &args)
+	if err != nil {
+		return err
+	}
+
+	torrents, err := server.selected(args.IDs)
+	if err != nil {
+		return err
+	}
+	for _, c := range torrents {
+		err = method(c.Torrent.InfoHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decode(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(raw, v)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %s", err)
+	}
+	return nil
+}
+
+// readTorrent reads the torrent of torrent-add: the base64 metainfo, or the
+// filename, which is a local path or an HTTP URL.
+func readTorrent(metainfo, filename string) ([]byte, error) {
+	switch {
+	case metainfo != "":
+		return base64.StdEncoding.DecodeString(metainfo)
+	case strings.HasPrefix(filename, "magnet:"):
+		return nil, fmt.Errorf("magnet links are not supported")
+	case strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://"):
+		resp, err := fetchClient.Get(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", filename, resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxTorrentSize))
+	case filename != "":
+		return os.ReadFile(filename)
+	default:
+		return nil, fmt.Errorf("no filename or metainfo")
+	}
+}
+
+func (server *Server) torrentAdd(raw json.RawMessage) (any, error) {
+	var args struct {
+		Filename           string `json:"filename"`
+		Metainfo           string `json:"metainfo"`
+		Paused             bool   `json:"paused"`
+		DownloadDir        string `json:"download-dir"`
+		FilesUnwanted      []int  `json:"files-unwanted"`
+		PriorityHigh       []int  `json:"priority-high"`
+		PriorityLow        []int  `json:"priority-low"`
+		SequentialDownload bool   `json:"sequentialDownload"`
+	}
+	err := decode(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readTorrent(args.Metainfo, args.Filename)
+	if err != nil {
+		return nil, err
+	}
+	t, err := torrent.NewTorrentFromBencode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing := server.Session.Get(t.InfoHash); existing != nil {
+		return map[string]any{"torrent-duplicate": server.addedTorrent(existing)}, nil
+	}
+
+	c, err := server.Session.Add(t, true)
+	if err != nil {
+		return nil, err
+	}
+	if server.Configure != nil {
+		server.Configure(c)
+	}
+	if args.DownloadDir != "" {
+		c.Storage.Dir = args.DownloadDir
+	}
+	if args.SequentialDownload {
+		c.SetSequential(true)
+	}
+
+	for _, list := range []struct {
+		indices  []int
+		priority piece.Priority
+	}{
+		{args.FilesUnwanted, piece.PrioritySkip},
+		{args.PriorityHigh, piece.PriorityHigh},
+		{args.PriorityLow, piece.PriorityLow},
+	} {
+		for _, index := range list.indices {
+			err = c.SetFilePriority(index, list.priority)
+			if err != nil {
+				server.Session.Remove(t.InfoHash, false)
+				return nil, err
+			}
+		}
+	}
+
+	if !args.Paused {
+		server.Session.Resume(t.InfoHash)
+	}
+	server.Logger.Info().Msgf("Added %s over Transmission RPC", t.Info.Name)
+	return map[string]any{"torrent-added": server.addedTorrent(c)}, nil
+}
+
+func (server *Server) addedTorrent(c *client.Client) map[string]any {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return map[string]any{
+		"id":         server.id(c.Torrent.InfoHash),
+		"name":       c.Torrent.Info.Name,
+		"hashString": hex.EncodeToString(c.Torrent.InfoHash[:]),
+	}
+}
+
+func (server *Server) torrentGet(raw json.RawMessage) (any, error) {
+	var args struct {
+		IDs    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+	}
+	err := decode(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	torrents, err := server.selected(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]any{}
+	for _, c := range torrents {
+		fields := server.fields(c)
+		if len(args.Fields) > 0 {
+			filtered := map[string]any{}
+			for _, name := range args.Fields {
+				if value, ok := fields[name]; ok {
+					filtered[name] = value
+				}
+			}
+			fields = filtered
+		}
+		list = append(list, fields)
+	}
+
+	return map[string]any{"torrents": list, "removed": []int{}}, nil
+}
+
+func (server *Server) status(c *client.Client) int {
+	state, _ := server.Session.State(c.Torrent.InfoHash)
+	done, wanted := c.Progress()
+
+	switch state {
+	case client.StateChecking:
+		return StatusCheck
+	case client.StateDownloading:
+		return StatusDownload
+	case client.StateSeeding:
+		return StatusSeed
+	case client.StateQueued:
+		if done < wanted {
+			return StatusDownloadWait
+		}
+		return StatusSeedWait
+	default:
+		return StatusStopped
+	}
+}
+
+// rpcPriority maps file priorities onto the -1, 0 and 1 of the protocol.
+func rpcPriority(priority piece.Priority) int {
+	switch {
+	case priority >= piece.PriorityHigh:
+		return 1
+	case priority == piece.PriorityLow:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// fields returns every torrent field torrent-get supports.
+func (server *Server) fields(c *client.Client) map[string]any {
+	stats := c.Stats()
+	done, wanted := stats.Done, stats.Wanted
+	downloaded, uploaded := stats.Downloaded, stats.Uploaded
+	size := stats.Size
+
+	server.mutex.Lock()
+	id := server.id(c.Torrent.InfoHash)
+	server.mutex.Unlock()
+
+	percent_done := 1.0
+	if wanted > 0 {
+		percent_done = float64(done) / float64(wanted)
+	}
+	ratio := -1.0
+	if downloaded > 0 {
+		ratio = float64(uploaded) / float64(downloaded)
+	}
+
+	eta := -1
+	if stats.ETA >= 0 {
+		eta = int(stats.ETA.Seconds())
+	}
+
+	files := []map[string]any{}
+	file_stats := []map[string]any{}
+	priorities := []int{}
+	wanted_files := []int{}
+	progress := stats.Files
+	for i, priority := range c.FilePriorities() {
+		file := c.Torrent.Files()[i]
+		name := strings.Join(file.Path, "/")
+		if len(c.Torrent.Info.Files) > 0 {
+			name = c.Torrent.Info.Name + "/" + name
+		}
+
+		is_wanted := 0
+		if priority != piece.PrioritySkip {
+			is_wanted = 1
+		}
+		files = append(files, map[string]any{
+			"name":           name,
+			"length":         file.Length,
+			"bytesCompleted": progress[i],
+		})
+		file_stats = append(file_stats, map[string]any{
+			"bytesCompleted": progress[i],
+			"wanted":         is_wanted == 1,
+			"priority":       rpcPriority(priority),
+		})
+		priorities = append(priorities, rpcPriority(priority))
+		wanted_files = append(wanted_files, is_wanted)
+	}
+
+	trackers := []map[string]any{}
+	for tier, urls := range c.Trackers.Tiers() {
+		for _, u := range urls {
+			trackers = append(trackers, map[string]any{
+				"id":       len(trackers),
+				"announce": u,
+				"scrape":   "",
+				"tier":     tier,
+			})
+		}
+	}
+
+	queue_position := 0
+	for i, other := range server.Session.Torrents() {
+		if other == c {
+			queue_position = i
+		}
+	}
+
+	return map[string]any{
+		"id":                 id,
+		"hashString":         hex.EncodeToString(c.Torrent.InfoHash[:]),
+		"name":               c.Torrent.Info.Name,
+		"status":             server.status(c),
+		"totalSize":          size,
+		"sizeWhenDone":       wanted,
+		"leftUntilDone":      wanted - done,
+		"haveValid":          done,
+		"haveUnchecked":      0,
+		"percentDone":        percent_done,
+		"downloadedEver":     downloaded,
+		"uploadedEver":       uploaded,
+		"uploadRatio":        ratio,
+		"rateDownload":       int(stats.DownloadRate),
+		"rateUpload":         int(stats.UploadRate),
+		"eta":                eta,
+		"corruptEver":        stats.Wasted,
+		"secondsDownloading": int(stats.Active.Seconds()),
+		"peersConnected":     stats.Seeders + stats.Leechers,
+		"downloadDir":        c.Storage.Dir,
+		"addedDate":          c.Added.Unix(),
+		"isFinished":         done == wanted,
+		"isPrivate":          c.Torrent.Info.Private,
+		"pieceCount":         len(c.Torrent.Info.Pieces),
+		"pieceSize":          c.Torrent.Info.PieceLength,
+		"queuePosition":      queue_position,
+		"sequentialDownload": c.Work.Sequential(),
+		"error":              0,
+		"errorString":        "",
+		"files":              files,
+		"fileStats":          file_stats,
+		"priorities":         priorities,
+		"wanted":             wanted_files,
+		"trackers":           trackers,
+		"downloadLimit":      c.Rates.Download.Rate() / speedBytes,
+		"downloadLimited":    c.Rates.Download.Rate() > 0,
+		"uploadLimit":        c.Rates.Upload.Rate() / speedBytes,
+		"uploadLimited":      c.Rates.Upload.Rate() > 0,
+	}
+}
+
+// torrentSet changes the files and speed limits of torrents.
+func (server *Server) torrentSet(raw json.RawMessage) error {
+	var args struct {
+		IDs             json.RawMessage `json:"ids"`
+		FilesWanted     []int           `json:"files-wanted"`
+		FilesUnwanted   []int           `json:"files-unwanted"`
+		PriorityHigh    []int           `json:"priority-high"`
+		PriorityNormal  []int           `json:"priority-normal"`
+		PriorityLow     []int           `json:"priority-low"`
+		DownloadLimit   *int            `json:"downloadLimit"`
+		DownloadLimited *bool           `json:"downloadLimited"`
+		UploadLimit     *int            `json:"uploadLimit"`
+		UploadLimited   *bool           `json:"uploadLimited"`
+	}
+	err := decode(raw, &args)
+	if err != nil {
+		return err
+	}
+
+	torrents, err := server.selected(args.IDs)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range torrents {
+		priorities := c.FilePriorities()
+		for _, index := range args.FilesWanted {
+			if index >= 0 && index < len(priorities) && priorities[index] == piece.PrioritySkip {
+				priorities[index] = piece.PriorityNormal
+			}
+		}
+		for _, list := range []struct {
+			indices  []int
+			priority piece.Priority
+		}{
+			{args.FilesUnwanted, piece.PrioritySkip},
+			{args.PriorityHigh, piece.PriorityHigh},
+			{args.PriorityNormal, piece.PriorityNormal},
+			{args.PriorityLow, piece.PriorityLow},
+		} {
+			for _, index := range list.indices {
+				if index >= 0 && index < len(priorities) {
+					priorities[index] = list.priority
+				}
+			}
+		}
+		for i, priority := range priorities {
+			err = c.SetFilePriority(i, priority)
+			if err != nil {
+				return err
+			}
+		}
+
+		download, upload := c.Rates.Download.Rate(), c.Rates.Upload.Rate()
+		download = limit(download, args.DownloadLimit, args.DownloadLimited)
+		upload = limit(upload, args.UploadLimit, args.UploadLimited)
+		c.Rates.SetRates(download, upload)
+	}
+	return nil
+}
+
+// limit applies an optional limit in kB/s and its switch to a rate. A new
+// limit only takes effect while limiting is enabled.
+func limit(rate int, kbps *int, enabled *bool) int {
+	on := rate > 0
+	if enabled != nil {
+		on = *enabled
+	}
+	if !on {
+		return 0
+	}
+	if kbps != nil {
+		return *kbps * speedBytes
+	}
+	return rate
+}
+
+func (server *Server) torrentRemove(raw json.RawMessage) error {
+	var args struct {
+		IDs             json.RawMessage `json:"ids"`
+		DeleteLocalData bool            `json:"delete-local-data"`
+	}
+	err := decode(raw, &args)
+	if err != nil {
+		return err
+	}
+
+	torrents, err := server.selected(args.IDs)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range torrents {
+		err = server.Session.Remove(c.Torrent.InfoHash, args.DeleteLocalData)
+		if err != nil {
+			return err
+		}
+
+		server.mutex.Lock()
+		delete(server.ids, c.Torrent.InfoHash)
+		server.mutex.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package transmission
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/rs/zerolog"
+)
+
+const (
+	SessionIDHeader = "X-Transmission-Session-Id"
+	RPCPath         = "/transmission/rpc"
+
+	// RPCVersion is the Transmission RPC version whose methods are served.
+	RPCVersion = 15
+
+	// Version is reported to clients that check the daemon version.
+	Version = "2.94 (p-torrent)"
+
+	// speedBytes is the size of the kB in speed limits.
+	speedBytes = 1000
+)
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       any             `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string `json:"result"`
+	Arguments any    `json:"arguments"`
+	Tag       any    `json:"tag,omitempty"`
+}
+
+// Server answers the core Transmission RPC methods on RPCPath, so tools
+// written for Transmission can drive a session. Clients first get a
+// 409 with the session ID in SessionIDHeader and have to send it with every
+// request, which protects against cross-site requests. With a Username the
+// requests additionally need basic authentication.
+type Server struct {
+	Session  *client.Session
+	Username string
+	Password string
+	Logger   *zerolog.Logger
+
+	// Configure is called for every added torrent before it starts.
+	Configure func(*client.Client)
+
+	sessionID string
+
+	// Transmission numbers torrents; ids are handed out as torrents are
+	// first seen. The limits remember the speeds while they are disabled.
+	mutex       sync.Mutex
+	ids         map[[20]byte]int
+	next_id     int
+	downLimit   int
+	downEnabled bool
+	upLimit     int
+	upEnabled   bool
+}
+
+func NewServer(session *client.Session, logger *zerolog.Logger) *Server {
+	id := make([]byte, 24)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+
+	server := &Server{
+		Session:   session,
+		Logger:    logger,
+		sessionID: hex.EncodeToString(id),
+		ids:       make(map[[20]byte]int),
+		next_id:   1,
+	}
+
+	server.downLimit = session.GlobalRates.Download.Rate() / speedBytes
+	server.downEnabled = server.downLimit > 0
+	server.upLimit = session.GlobalRates.Upload.Rate() / speedBytes
+	server.upEnabled = server.upLimit > 0
+	return server
+}
+
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(RPCPath, server.serveRPC)
+	return mux
+}
+
+func (server *Server) authorized(req *http.Request) bool {
+	if server.Username == "" {
+		return true
+	}
+
+	username, password, ok := req.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(server.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(server.Password)) == 1
+}
+
+func (server *Server) serveRPC(w http.ResponseWriter, req *http.Request) {
+	if !server.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.Header.Get(SessionIDHeader) != server.sessionID {
+		w.Header().Set(SessionIDHeader, server.sessionID)
+		http.Error(w, "Invalid or missing "+SessionIDHeader, http.StatusConflict)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r request
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<20)).Decode(&r)
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	arguments, err := server.call(r.Method, r.Arguments)
+	resp := response{Result: "success", Arguments: arguments, Tag: r.Tag}
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	if err != nil || arguments == nil {
+		resp.Arguments = map[string]any{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (server *Server) call(method string, raw json.RawMessage) (any, error) {
+	switch method {
+	case "torrent-add":
+		return server.torrentAdd(raw)
+	case "torrent-get":
+		return server.torrentGet(raw)
+	case "torrent-set":
+		return nil, server.torrentSet(raw)
+	case "torrent-start", "torrent-start-now":
+		return nil, server.forEach(raw, server.Session.Resume)
+	case "torrent-stop":
+		return nil, server.forEach(raw, server.Session.Pause)
+	case "torrent-verify":
+		return nil, server.forEach(raw, server.Session.Recheck)
+	case "torrent-remove":
+		return nil, server.torrentRemove(raw)
+	case "session-get":
+		return server.sessionGet(), nil
+	case "session-set":
+		return nil, server.sessionSet(raw)
+	case "session-stats":
+		return server.sessionStats(), nil
+	default:
+		return nil, fmt.Errorf("method name not recognized")
+	}
+}
+
+// id returns the number of a torrent. The mutex must be held.
+func (server *Server) id(info_hash [20]byte) int {
+	id, ok := server.ids[info_hash]
+	if !ok {
+		id = server.next_id
+		server.next_id++
+		server.ids[info_hash] = id
+	}
+	return id
+}
@@ -0,0 +1,108 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FormatBytes formats a size with decimal units, e.g. "1.5 MB".
+func FormatBytes(n int) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(n)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// FormatRate formats a rate limit, where 0 means unlimited.
+func FormatRate(rate int) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return FormatBytes(rate) + "/s"
+}
+
+// FormatETA formats the time to download left bytes at rate bytes per
+// second, or "-" when it cannot be estimated.
+func FormatETA(left int, rate float64) string {
+	if left == 0 {
+		return "done"
+	}
+	if rate < 1 {
+		return "-"
+	}
+	eta := time.Duration(float64(left)/rate) * time.Second
+	if eta > 100*24*time.Hour {
+		return "-"
+	}
+	return eta.Round(time.Second).String()
+}
+
+// Bar draws a progress bar of width characters for a fraction from 0 to 1.
+func Bar(fraction float64, width int) string {
+	fraction = min(max(fraction, 0), 1)
+	filled := int(fraction * float64(width))
+	return strings.Repeat("#", filled) + strings.Repeat("-", width-filled)
+}
+
+// PieceBar draws the pieces of a torrent into width characters. Every
+// character stands for a range of pieces: "█" if all are done, "▓" if some
+// are, "▒" if none are done but every missing piece is available from a
+// connected peer, "░" if some are not and " " if none are.
+func PieceBar(have []bool, availability []int, width int) string {
+	if len(have) == 0 || width <= 0 {
+		return ""
+	}
+	width = min(width, len(have))
+
+	var bar strings.Builder
+	for c := 0; c < width; c++ {
+		begin := c * len(have) / width
+		end := max(begin+1, (c+1)*len(have)/width)
+
+		done, available := 0, 0
+		for i := begin; i < end; i++ {
+			if have[i] {
+				done++
+			} else if i < len(availability) && availability[i] > 0 {
+				available++
+			}
+		}
+
+		missing := end - begin - done
+		switch {
+		case missing == 0:
+			bar.WriteString("█")
+		case done > 0:
+			bar.WriteString("▓")
+		case available == missing:
+			bar.WriteString("▒")
+		case available > 0:
+			bar.WriteString("░")
+		default:
+			bar.WriteString(" ")
+		}
+	}
+	return bar.String()
+}
+
+// fit cuts or pads s to exactly width characters.
+func fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	n := utf8.RuneCountInString(s)
+	if n <= width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	runes := []rune(s)
+	return string(runes[:width])
+}
@@ -0,0 +1,45 @@
+package tui
+
+import (
+	"strings"
+	"sync"
+)
+
+// LogBuffer keeps the last lines written to it, so that log output can be
+// shown inside the UI instead of scrolling over it.
+type LogBuffer struct {
+	mutex   sync.Mutex
+	lines   []string
+	partial string
+	size    int
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{size: size}
+}
+
+func (buffer *LogBuffer) Write(b []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	lines := strings.Split(buffer.partial+string(b), "\n")
+	buffer.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		buffer.lines = append(buffer.lines, strings.TrimRight(line, "\r"))
+	}
+	if len(buffer.lines) > buffer.size {
+		buffer.lines = append([]string{}, buffer.lines[len(buffer.lines)-buffer.size:]...)
+	}
+	return len(b), nil
+}
+
+// Lines returns up to the last n complete lines, oldest first.
+func (buffer *LogBuffer) Lines(n int) []string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if n > len(buffer.lines) {
+		n = len(buffer.lines)
+	}
+	return append([]string{}, buffer.lines[len(buffer.lines)-n:]...)
+}
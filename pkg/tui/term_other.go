@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package tui
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("terminal control is not supported on this platform")
+
+func makeRaw(file *os.File) (func(), error) {
+	return nil, errUnsupported
+}
+
+func terminalSize(file *os.File) (int, int, error) {
+	return 0, 0, errUnsupported
+}
@@ -0,0 +1,495 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	// PlainInterval is how often the plain progress line is printed.
+	PlainInterval = 5 * time.Second
+
+	// LogLines is how many lines of log output are worth keeping for the UI.
+	LogLines = 200
+
+	// rateSmoothing weighs the newest sample of a transfer rate against the
+	// older ones.
+	rateSmoothing = 0.3
+
+	help = "↑↓ torrent  [ ] file  space priority  p pause/resume  +/- download limit  </> upload limit  0 unlimited  q quit"
+)
+
+// rateSteps are the limits +, -, > and < step through, 0 is unlimited.
+var rateSteps = []int{
+	10_000, 20_000, 50_000, 100_000, 200_000, 500_000,
+	1_000_000, 2_000_000, 5_000_000, 10_000_000, 20_000_000, 50_000_000, 0,
+}
+
+// IsTerminal reports whether the standard output is a terminal, in which
+// case Run shows the full UI.
+func IsTerminal() bool {
+	return isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd())
+}
+
+// meter estimates a transfer rate from the growth of a byte counter.
+type meter struct {
+	total int
+	time  time.Time
+	rate  float64
+}
+
+func (m *meter) update(total int, now time.Time) float64 {
+	if !m.time.IsZero() && now.After(m.time) {
+		current := max(0, float64(total-m.total)/now.Sub(m.time).Seconds())
+		m.rate = rateSmoothing*current + (1-rateSmoothing)*m.rate
+	}
+	m.total, m.time = total, now
+	return m.rate
+}
+
+// torrentView is what the UI shows of a torrent.
+type torrentView struct {
+	client *client.Client
+	state  client.State
+	done   int
+	wanted int
+	peers  int
+	down   float64
+	up     float64
+}
+
+func (view torrentView) fraction() float64 {
+	if view.wanted == 0 {
+		return 1
+	}
+	return float64(view.done) / float64(view.wanted)
+}
+
+// UI shows the torrents of a session in the terminal and controls them with
+// the keyboard. Nothing else may write to the terminal while it runs, so
+// log output should go to Log.
+type UI struct {
+	Session *client.Session
+	Log     *LogBuffer
+
+	in     *os.File
+	out    *os.File
+	meters map[[20]byte]*[2]meter
+	views  []torrentView
+
+	selected [20]byte
+	file     int
+	message  string
+}
+
+func New(session *client.Session, log *LogBuffer) *UI {
+	return &UI{
+		Session: session,
+		Log:     log,
+		in:      os.Stdin,
+		out:     os.Stdout,
+		meters:  make(map[[20]byte]*[2]meter),
+	}
+}
+
+// Run shows the UI until done is closed or the user quits. If the standard
+// output is not a terminal it prints a plain progress line every
+// PlainInterval instead.
+func (ui *UI) Run(done <-chan struct{}) {
+	if !IsTerminal() {
+		ui.runPlain(done)
+		return
+	}
+
+	// Leave a summary on the normal screen.
+	defer func() { fmt.Fprintln(ui.out, ui.plainLine()) }()
+
+	keys := make(chan string)
+	restore, err := makeRaw(ui.in)
+	if err != nil {
+		ui.message = fmt.Sprintf("Keyboard controls disabled: %s", err)
+	} else {
+		defer restore()
+		go readKeys(ui.in, keys)
+	}
+
+	// Use the alternate screen and hide the cursor while running.
+	fmt.Fprint(ui.out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(ui.out, "\x1b[?25h\x1b[?1049l")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	ui.sample()
+	ui.render()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ui.sample()
+		case key := <-keys:
+			if key == "q" {
+				return
+			}
+			ui.handleKey(key)
+		}
+		ui.render()
+	}
+}
+
+// readKeys sends the keys pressed on in, with arrow keys as "up", "down",
+// "left" and "right".
+func readKeys(in *os.File, keys chan<- string) {
+	arrows := map[byte]string{'A': "up", 'B': "down", 'C': "right", 'D': "left"}
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			if buf[i] == 0x1b && i+2 < n && buf[i+1] == '[' {
+				if name, ok := arrows[buf[i+2]]; ok {
+					keys <- name
+				}
+				i += 2
+				continue
+			}
+			keys <- string(buf[i])
+		}
+	}
+}
+
+// sample updates the views of all torrents and their rates.
+func (ui *UI) sample() {
+	now := time.Now()
+	ui.views = ui.views[:0]
+	seen := make(map[[20]byte]bool)
+
+	for _, c := range ui.Session.Torrents() {
+		info_hash := c.Torrent.InfoHash
+		seen[info_hash] = true
+
+		state, err := ui.Session.State(info_hash)
+		if err != nil {
+			continue
+		}
+		view := torrentView{client: c, state: state}
+		view.done, view.wanted = c.Progress()
+
+		c.PeersMutex.Lock()
+		view.peers = len(c.Peers)
+		c.PeersMutex.Unlock()
+
+		meters := ui.meters[info_hash]
+		if meters == nil {
+			meters = &[2]meter{}
+			ui.meters[info_hash] = meters
+		}
+		downloaded, uploaded := c.Transferred()
+		view.down = meters[0].update(downloaded, now)
+		view.up = meters[1].update(uploaded, now)
+
+		ui.views = append(ui.views, view)
+	}
+
+	for info_hash := range ui.meters {
+		if !seen[info_hash] {
+			delete(ui.meters, info_hash)
+		}
+	}
+}
+
+// total sums up the views of all torrents.
+func (ui *UI) total() torrentView {
+	total := torrentView{}
+	for _, view := range ui.views {
+		total.done += view.done
+		total.wanted += view.wanted
+		total.peers += view.peers
+		total.down += view.down
+		total.up += view.up
+	}
+	return total
+}
+
+// current returns the index of the selected torrent, selecting the first
+// one if the selected torrent is gone.
+func (ui *UI) current() int {
+	for i, view := range ui.views {
+		if view.client.Torrent.InfoHash == ui.selected {
+			return i
+		}
+	}
+	if len(ui.views) == 0 {
+		return -1
+	}
+	ui.selected = ui.views[0].client.Torrent.InfoHash
+	ui.file = 0
+	return 0
+}
+
+func (ui *UI) handleKey(key string) {
+	index := ui.current()
+	if index < 0 {
+		return
+	}
+	view := ui.views[index]
+	c := view.client
+	ui.message = ""
+
+	switch key {
+	case "up", "k", "down", "j":
+		if key == "up" || key == "k" {
+			index = max(0, index-1)
+		} else {
+			index = min(len(ui.views)-1, index+1)
+		}
+		ui.selected = ui.views[index].client.Torrent.InfoHash
+		ui.file = 0
+
+	case "[", "]":
+		if key == "[" {
+			ui.file = max(0, ui.file-1)
+		} else {
+			ui.file = min(len(c.Torrent.Files())-1, ui.file+1)
+		}
+
+	case " ":
+		priority := c.FilePriorities()[ui.file]
+		priority = (priority + 1) % piece.PriorityNow
+		err := c.SetFilePriority(ui.file, priority)
+		if err != nil {
+			ui.message = err.Error()
+		}
+
+	case "p":
+		var err error
+		if view.state == client.StatePaused {
+			err = ui.Session.Resume(c.Torrent.InfoHash)
+		} else {
+			err = ui.Session.Pause(c.Torrent.InfoHash)
+		}
+		if err != nil {
+			ui.message = err.Error()
+		}
+		ui.sample()
+
+	case "+", "=", "-":
+		limiter := ui.Session.GlobalRates.Download
+		limiter.SetRate(stepRate(limiter.Rate(), key != "-"))
+		ui.message = "Download limit " + FormatRate(limiter.Rate())
+
+	case ">", ".", "<", ",":
+		limiter := ui.Session.GlobalRates.Upload
+		limiter.SetRate(stepRate(limiter.Rate(), key == ">" || key == "."))
+		ui.message = "Upload limit " + FormatRate(limiter.Rate())
+
+	case "0":
+		ui.Session.GlobalRates.SetRates(0, 0)
+		ui.message = "Rate limits removed"
+	}
+}
+
+// stepRate returns the next higher or lower step of rateSteps from rate.
+func stepRate(rate int, up bool) int {
+	current := len(rateSteps) - 1
+	for i, step := range rateSteps[:len(rateSteps)-1] {
+		if rate != 0 && rate <= step {
+			current = i
+			break
+		}
+	}
+	if up {
+		// A limit between two steps goes up to the next one.
+		if rate != 0 && rate < rateSteps[current] {
+			return rateSteps[current]
+		}
+		return rateSteps[min(len(rateSteps)-1, current+1)]
+	}
+	return rateSteps[max(0, current-1)]
+}
+
+func (ui *UI) render() {
+	width, height, err := terminalSize(ui.out)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	lines := ui.lines(width, height-1)
+	lines = append(lines, help)
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			screen.WriteString("\n")
+		}
+		screen.WriteString(fit(line, width))
+	}
+	screen.WriteString("\x1b[J")
+	fmt.Fprint(ui.out, screen.String())
+}
+
+// lines lays out everything but the help line into at most height lines.
+func (ui *UI) lines(width, height int) []string {
+	total := ui.total()
+	rates := ui.Session.GlobalRates
+	lines := []string{
+		fmt.Sprintf("p-torrent  %d torrents  %d peers  down %s/s (%s)  up %s/s (%s)",
+			len(ui.views), total.peers,
+			FormatBytes(int(total.down)), FormatRate(rates.Download.Rate()),
+			FormatBytes(int(total.up)), FormatRate(rates.Upload.Rate())),
+		fmt.Sprintf("[%s] %5.1f%%  %s of %s  ETA %s",
+			Bar(total.fraction(), max(10, width/3)), total.fraction()*100,
+			FormatBytes(total.done), FormatBytes(total.wanted), FormatETA(total.wanted-total.done, total.down)),
+		ui.message,
+		fmt.Sprintf("  %-30s %-12s %7s %12s %6s", "Name", "State", "Done", "Down", "Peers"),
+	}
+
+	index := ui.current()
+	for i, view := range ui.views {
+		marker := " "
+		if i == index {
+			marker = ">"
+		}
+		lines = append(lines, fmt.Sprintf("%s %-30s %-12s %6.1f%% %10s/s %6d",
+			marker, fit(view.client.Torrent.Info.Name, 30), view.state,
+			view.fraction()*100, FormatBytes(int(view.down)), view.peers))
+	}
+	if index < 0 {
+		lines = append(lines, "  No torrents")
+		return lines
+	}
+
+	view := ui.views[index]
+	c := view.client
+	have, _ := c.Storage.Pieces()
+	lines = append(lines, "",
+		fmt.Sprintf("%s  ETA %s", c.Torrent.Info.Name, FormatETA(view.wanted-view.done, view.down)),
+		"["+PieceBar(have, c.Availability(), width-2)+"]")
+
+	files := ui.fileLines()
+	peer_lines := peerLines(c)
+
+	// Files and peers get up to a third of the free rows each, the log
+	// gets the rest.
+	free := max(0, height-len(lines)-4)
+	file_rows := min(len(files), max(1, free/3))
+	peer_rows := min(len(peer_lines), max(1, free/3))
+	log_rows := max(0, free-file_rows-peer_rows)
+
+	first := max(0, ui.file-file_rows+1)
+	lines = append(lines, fmt.Sprintf("Files (%d)", len(files)))
+	lines = append(lines, files[first:min(len(files), first+file_rows)]...)
+	lines = append(lines, fmt.Sprintf("Peers (%d)", len(peer_lines)))
+	lines = append(lines, peer_lines[:peer_rows]...)
+	if log_rows > 0 && ui.Log != nil {
+		lines = append(lines, "Log")
+		lines = append(lines, ui.Log.Lines(log_rows)...)
+	}
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	return lines
+}
+
+func (ui *UI) fileLines() []string {
+	c := ui.views[ui.current()].client
+	priorities := c.FilePriorities()
+	progress := c.FileProgress()
+
+	lines := []string{}
+	for i, file := range c.Torrent.Files() {
+		marker := " "
+		if i == ui.file {
+			marker = ">"
+		}
+		lines = append(lines, fmt.Sprintf("%s %3d %6.1f%% %10s %-6s %s",
+			marker, i, percent(progress[i], file.Length), FormatBytes(file.Length),
+			priorities[i], strings.Join(file.Path, "/")))
+	}
+	return lines
+}
+
+// peerLines describes the connected peers of c, sorted by address.
+func peerLines(c *client.Client) []string {
+	c.PeersMutex.Lock()
+	defer c.PeersMutex.Unlock()
+
+	lines := []string{}
+	for _, p := range c.Peers {
+		peer_client := ""
+		if hs := p.ExtendedHandshake(); hs != nil {
+			peer_client = hs.Client
+		}
+
+		flags := []string{}
+		for _, flag := range []struct {
+			set  bool
+			name string
+		}{
+			{p.Incoming, "incoming"}, {p.Encrypted, "encrypted"}, {p.OverUTP, "uTP"},
+			{p.IsChoked(), "choked"}, {p.IsInterested(), "interested"},
+		} {
+			if flag.set {
+				flags = append(flags, flag.name)
+			}
+		}
+
+		bitfield := p.Pieces()
+		pieces := 0
+		for i := 0; i < p.NumPieces && i/8 < len(bitfield); i++ {
+			if bitfield.HasPiece(i) {
+				pieces++
+			}
+		}
+
+		lines = append(lines, fmt.Sprintf("  %-24s %-20s %6.1f%%  %s",
+			p.Addr, fit(peer_client, 20), percent(pieces, p.NumPieces), strings.Join(flags, ", ")))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func percent(done, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(done) * 100 / float64(total)
+}
+
+// runPlain prints a progress line of all torrents until done is closed.
+func (ui *UI) runPlain(done <-chan struct{}) {
+	ticker := time.NewTicker(PlainInterval)
+	defer ticker.Stop()
+
+	ui.sample()
+	for {
+		select {
+		case <-done:
+			ui.sample()
+			fmt.Fprintln(ui.out, ui.plainLine())
+			return
+		case <-ticker.C:
+			ui.sample()
+			fmt.Fprintln(ui.out, ui.plainLine())
+		}
+	}
+}
+
+func (ui *UI) plainLine() string {
+	total := ui.total()
+	return fmt.Sprintf("[%s] %5.1f%%  %s of %s  %s/s  ETA %s  %d torrents  %d peers",
+		Bar(total.fraction(), 30), total.fraction()*100, FormatBytes(total.done), FormatBytes(total.wanted),
+		FormatBytes(int(total.down)), FormatETA(total.wanted-total.done, total.down), len(ui.views), total.peers)
+}
@@ -0,0 +1,584 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	MaxPayload     = 1200
+	RecvWindow     = 1 << 20
+	TargetDelay    = 100 * time.Millisecond
+	Gain           = 1.0
+	MinCwnd        = 2 * MaxPayload
+	InitialCwnd    = 4 * MaxPayload
+	MaxCwnd        = RecvWindow
+	InitialRTO     = time.Second
+	MinRTO         = 500 * time.Millisecond
+	MaxRTO         = 30 * time.Second
+	MaxRetransmits = 8
+	BaseDelayReset = 2 * time.Minute
+	CloseTimeout   = 10 * time.Second
+	Linger         = 2 * time.Second
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosing
+	stateClosed
+)
+
+type outPacket struct {
+	h             header
+	payload       []byte
+	sent_at       time.Time
+	transmissions int
+	sacked        bool
+	fast_resent   bool
+}
+
+type inPacket struct {
+	payload []byte
+	fin     bool
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	socket  *Socket
+	remote  net.Addr
+	recv_id uint16
+	send_id uint16
+
+	mutex  sync.Mutex
+	state  int
+	seq_nr uint16
+	ack_nr uint16
+	err    error
+
+	outbound   []*outPacket
+	cur_window int
+	cwnd       float64
+	peer_wnd   int
+	rtt        time.Duration
+	rtt_var    time.Duration
+	rto        time.Duration
+	dup_acks   int
+	last_ack   uint16
+	recovering bool
+	recover_nr uint16
+	slow_start bool
+
+	base_delay      uint32
+	prev_base_delay uint32
+	base_reset_at   time.Time
+	reply_micro     uint32
+
+	read_buf     bytes.Buffer
+	reorder      map[uint16]inPacket
+	eof          bool
+	closing_at   time.Time
+	closed_at    time.Time
+	fin_sent     bool
+	connected    chan struct{}
+	notify_read  chan struct{}
+	notify_write chan struct{}
+
+	read_deadline  time.Time
+	write_deadline time.Time
+}
+
+func newConn(socket *Socket, remote net.Addr, recv_id, send_id uint16) *Conn {
+	return &Conn{
+		socket:        socket,
+		remote:        remote,
+		recv_id:       recv_id,
+		send_id:       send_id,
+		cwnd:          InitialCwnd,
+		slow_start:    true,
+		peer_wnd:      RecvWindow,
+		rto:           InitialRTO,
+		base_reset_at: time.Now(),
+		reorder:       make(map[uint16]inPacket),
+		connected:     make(chan struct{}),
+		notify_read:   make(chan struct{}, 1),
+		notify_write:  make(chan struct{}, 1),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) wakeAll() {
+	signal(c.notify_read)
+	signal(c.notify_write)
+}
+
+func (c *Conn) window() uint32 {
+	free := RecvWindow - c.read_buf.Len()
+	for _, p := range c.reorder {
+		free -= len(p.payload)
+	}
+	return uint32(max(free, 0))
+}
+
+// sendPacket must be called with the mutex held.
+func (c *Conn) sendPacket(h header, payload []byte) {
+	h.conn_id = c.send_id
+	if h.typ == stSyn {
+		h.conn_id = c.recv_id
+	}
+	h.ts = timestamp()
+	h.ts_diff = c.reply_micro
+	h.wnd = c.window()
+	c.socket.write(h.marshal(payload), c.remote)
+}
+
+func (c *Conn) sendAck() {
+	c.sendPacket(header{typ: stState, seq_nr: c.seq_nr, ack_nr: c.ack_nr, sack: c.selectiveAck()}, nil)
+}
+
+// selectiveAck builds the bitmask of out of order packets we are holding.
+func (c *Conn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+
+	var mask [maxSackBytes]byte
+	size := 0
+	for seq_nr := range c.reorder {
+		offset := int(seq_nr - c.ack_nr - 2)
+		if offset >= maxSackBytes*8 {
+			continue
+		}
+		mask[offset/8] |= 1 << (offset % 8)
+		size = max(size, offset/32*4+4)
+	}
+	if size == 0 {
+		return nil
+	}
+	return append([]byte{}, mask[:size]...)
+}
+
+// queue sends a packet that must be acknowledged and keeps it for retransmission.
+func (c *Conn) queue(typ byte, payload []byte) {
+	p := &outPacket{
+		h:       header{typ: typ, seq_nr: c.seq_nr},
+		payload: payload,
+	}
+	c.seq_nr++
+
+	c.outbound = append(c.outbound, p)
+	c.cur_window += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.h.ack_nr = c.ack_nr
+	p.sent_at = time.Now()
+	p.transmissions++
+	c.sendPacket(p.h, p.payload)
+}
+
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+	c.closed_at = time.Now()
+	c.wakeAll()
+	select {
+	case <-c.connected:
+	default:
+		close(c.connected)
+	}
+}
+
+// handle processes a packet addressed to this connection.
+func (c *Conn) handle(h header, payload []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == stateClosed {
+		// Keep acknowledging the FIN of the peer while lingering, so it can
+		// finish closing its side cleanly.
+		if h.typ == stFin && c.err == nil {
+			c.ack_nr = h.seq_nr
+			c.sendAck()
+		}
+		return
+	}
+
+	c.reply_micro = timestamp() - h.ts
+	c.peer_wnd = int(h.wnd)
+
+	switch h.typ {
+	case stReset:
+		c.fail(syscall.ECONNRESET)
+		return
+
+	case stState:
+		if c.state == stateSynSent {
+			c.ack_nr = h.seq_nr - 1
+			c.state = stateConnected
+			close(c.connected)
+		}
+	}
+
+	c.processAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.processData(h, payload)
+		c.sendAck()
+	}
+}
+
+func (c *Conn) processAck(h header) {
+	now := time.Now()
+	bytes_acked := 0
+
+	// Packets acked after a hole was filled sat in the reorder buffer of the
+	// peer, so they would inflate the round trip time.
+	sample_rtt := !c.recovering && c.dup_acks == 0
+
+	for len(c.outbound) > 0 && !seqLess(h.ack_nr, c.outbound[0].h.seq_nr) {
+		p := c.outbound[0]
+		c.outbound = c.outbound[1:]
+		c.cur_window -= len(p.payload)
+		bytes_acked += len(p.payload)
+
+		if p.transmissions == 1 && sample_rtt {
+			c.updateRTT(now.Sub(p.sent_at))
+		}
+	}
+
+	if bytes_acked > 0 {
+		c.dup_acks = 0
+		c.updateCwnd(h.ts_diff, bytes_acked)
+		signal(c.notify_write)
+
+		if c.recovering {
+			if seqLess(h.ack_nr, c.recover_nr) && len(c.outbound) > 0 {
+				if !c.outbound[0].fast_resent {
+					// A partial ack means the next packet was lost as well.
+					c.outbound[0].fast_resent = true
+					c.transmit(c.outbound[0])
+				}
+			} else {
+				c.recovering = false
+			}
+		}
+	} else if h.typ == stState && h.ack_nr == c.last_ack && len(c.outbound) > 0 {
+		c.dup_acks++
+		if c.dup_acks == 3 && !c.recovering {
+			// Fast retransmit of the packet the peer is still waiting for.
+			c.startRecovery()
+			c.cwnd = max(c.cwnd/2, MinCwnd)
+			c.slow_start = false
+		}
+	}
+	c.last_ack = h.ack_nr
+
+	if len(h.sack) > 0 {
+		c.processSelectiveAck(h.ack_nr, h.sack)
+	}
+
+	if c.state == stateClosing && c.fin_sent && len(c.outbound) == 0 {
+		c.state = stateClosed
+		c.closed_at = time.Now()
+		c.wakeAll()
+	}
+}
+
+// processSelectiveAck marks the packets the peer holds out of order and
+// retransmits every packet that three later packets have overtaken.
+func (c *Conn) processSelectiveAck(ack_nr uint16, sack []byte) {
+	for _, p := range c.outbound {
+		offset := int(p.h.seq_nr - ack_nr - 2)
+		if offset < len(sack)*8 && sack[offset/8]&(1<<(offset%8)) != 0 {
+			p.sacked = true
+		}
+	}
+
+	lost := false
+	overtaken := 0
+	for i := len(c.outbound) - 1; i >= 0; i-- {
+		p := c.outbound[i]
+		if p.sacked {
+			overtaken++
+			continue
+		}
+		if overtaken >= 3 && !p.fast_resent {
+			p.fast_resent = true
+			c.transmit(p)
+			lost = true
+		}
+	}
+
+	if lost && !c.recovering {
+		c.recovering = true
+		c.recover_nr = c.seq_nr - 1
+		c.cwnd = max(c.cwnd/2, MinCwnd)
+		c.slow_start = false
+	}
+}
+
+// startRecovery retransmits the oldest unacked packet and keeps retransmitting
+// on partial acks until everything sent so far has been acknowledged.
+func (c *Conn) startRecovery() {
+	c.recovering = true
+	c.recover_nr = c.seq_nr - 1
+	c.outbound[0].fast_resent = true
+	c.transmit(c.outbound[0])
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rtt_var = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rtt_var += (delta - c.rtt_var) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rtt_var, MinRTO), MaxRTO)
+}
+
+// updateCwnd applies the LEDBAT controller: the window grows while the
+// queuing delay measured by the peer is below the target and shrinks above it.
+func (c *Conn) updateCwnd(delay_sample uint32, bytes_acked int) {
+	if delay_sample == 0 {
+		return
+	}
+
+	if time.Since(c.base_reset_at) > BaseDelayReset {
+		c.prev_base_delay = c.base_delay
+		c.base_delay = 0
+		c.base_reset_at = time.Now()
+	}
+	if c.base_delay == 0 || delay_sample < c.base_delay {
+		c.base_delay = delay_sample
+	}
+
+	base_delay := c.base_delay
+	if c.prev_base_delay != 0 && c.prev_base_delay < base_delay {
+		base_delay = c.prev_base_delay
+	}
+
+	queuing_delay := time.Duration(delay_sample-base_delay) * time.Microsecond
+	if c.slow_start && queuing_delay < TargetDelay/2 {
+		c.cwnd = min(c.cwnd+float64(bytes_acked), MaxCwnd)
+		return
+	}
+	c.slow_start = false
+
+	off_target := float64(TargetDelay-queuing_delay) / float64(TargetDelay)
+	c.cwnd += Gain * off_target * float64(bytes_acked) * MaxPayload / c.cwnd
+	c.cwnd = min(max(c.cwnd, MinCwnd), MaxCwnd)
+}
+
+func (c *Conn) processData(h header, payload []byte) {
+	if c.state == stateSynSent || c.eof {
+		return
+	}
+
+	if h.seq_nr != c.ack_nr+1 {
+		if seqLess(c.ack_nr, h.seq_nr) && len(c.reorder) < RecvWindow/MaxPayload {
+			c.reorder[h.seq_nr] = inPacket{payload: append([]byte{}, payload...), fin: h.typ == stFin}
+		}
+		return
+	}
+
+	c.deliver(inPacket{payload: payload, fin: h.typ == stFin})
+	for !c.eof {
+		next, ok := c.reorder[c.ack_nr+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ack_nr+1)
+		c.deliver(next)
+	}
+}
+
+func (c *Conn) deliver(p inPacket) {
+	c.ack_nr++
+	c.read_buf.Write(p.payload)
+	if p.fin {
+		c.eof = true
+	}
+	signal(c.notify_read)
+}
+
+// tick retransmits timed out packets and finishes closing connections. It
+// returns true once the connection can be forgotten by the socket.
+func (c *Conn) tick(now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == stateClosing {
+		if !c.fin_sent && len(c.outbound) == 0 {
+			c.queue(stFin, nil)
+			c.fin_sent = true
+		}
+		if now.Sub(c.closing_at) > CloseTimeout {
+			c.fail(net.ErrClosed)
+		}
+	}
+
+	if len(c.outbound) > 0 && now.Sub(c.outbound[0].sent_at) > c.rto {
+		if c.outbound[0].transmissions > MaxRetransmits {
+			c.fail(os.ErrDeadlineExceeded)
+		} else {
+			c.cwnd = MinCwnd
+			c.slow_start = false
+			c.rto = min(c.rto*2, MaxRTO)
+			c.startRecovery()
+		}
+	}
+
+	return c.state == stateClosed && now.Sub(c.closed_at) > Linger
+}
+
+func waitDeadline(deadline time.Time) <-chan time.Time {
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(deadline))
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		if c.read_buf.Len() > 0 {
+			was_full := c.window() < MaxPayload
+			n, _ := c.read_buf.Read(b)
+			if was_full {
+				// Tell the peer the window opened up again.
+				c.sendAck()
+			}
+			c.mutex.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mutex.Unlock()
+			return 0, err
+		}
+		if c.state >= stateClosing {
+			c.mutex.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline := c.read_deadline
+		c.mutex.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		select {
+		case <-c.notify_read:
+		case <-waitDeadline(deadline):
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mutex.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mutex.Unlock()
+			return written, err
+		}
+		if c.state != stateConnected {
+			c.mutex.Unlock()
+			return written, net.ErrClosed
+		}
+
+		window := min(int(c.cwnd), c.peer_wnd)
+		if c.cur_window+MaxPayload <= window || c.cur_window == 0 {
+			size := min(MaxPayload, len(b)-written)
+			payload := append([]byte{}, b[written:written+size]...)
+			c.queue(stData, payload)
+			written += size
+			c.mutex.Unlock()
+			continue
+		}
+		deadline := c.write_deadline
+		c.mutex.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		select {
+		case <-c.notify_write:
+		case <-waitDeadline(deadline):
+		}
+	}
+	return written, nil
+}
+
+// Close sends a FIN once all outstanding data has been acknowledged.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch c.state {
+	case stateConnected:
+		c.state = stateClosing
+		c.closing_at = time.Now()
+		c.wakeAll()
+	case stateSynSent:
+		c.fail(net.ErrClosed)
+	case stateClosing, stateClosed:
+		return nil
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.read_deadline = t
+	c.mutex.Unlock()
+	signal(c.notify_read)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.write_deadline = t
+	c.mutex.Unlock()
+	signal(c.notify_write)
+	return nil
+}
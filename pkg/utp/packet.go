@@ -0,0 +1,114 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+
+	version    = 1
+	headerSize = 20
+
+	extSelectiveAck = 1
+	maxSackBytes    = 32
+)
+
+type header struct {
+	typ     byte
+	conn_id uint16
+	ts      uint32
+	ts_diff uint32
+	wnd     uint32
+	seq_nr  uint16
+	ack_nr  uint16
+
+	// sack is the selective ack bitmask. Bit i marks ack_nr+2+i as received.
+	sack []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	ext_size := 0
+	if len(h.sack) > 0 {
+		ext_size = 2 + len(h.sack)
+	}
+
+	buf := make([]byte, headerSize+ext_size+len(payload))
+	buf[0] = h.typ<<4 | version
+	buf[1] = 0
+	binary.BigEndian.PutUint16(buf[2:4], h.conn_id)
+	binary.BigEndian.PutUint32(buf[4:8], h.ts)
+	binary.BigEndian.PutUint32(buf[8:12], h.ts_diff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq_nr)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack_nr)
+	if ext_size > 0 {
+		buf[1] = extSelectiveAck
+		buf[headerSize] = 0
+		buf[headerSize+1] = byte(len(h.sack))
+		copy(buf[headerSize+2:], h.sack)
+	}
+	copy(buf[headerSize+ext_size:], payload)
+	return buf
+}
+
+// parsePacket decodes the header and the selective ack extension. Unknown
+// extensions are skipped.
+func parsePacket(data []byte) (header, []byte, error) {
+	var h header
+	if len(data) < headerSize {
+		return h, nil, fmt.Errorf("utp: packet too short")
+	}
+
+	if data[0]&0x0f != version {
+		return h, nil, fmt.Errorf("utp: unsupported version %d", data[0]&0x0f)
+	}
+
+	h.typ = data[0] >> 4
+	if h.typ > stSyn {
+		return h, nil, fmt.Errorf("utp: unknown packet type %d", h.typ)
+	}
+
+	h.conn_id = binary.BigEndian.Uint16(data[2:4])
+	h.ts = binary.BigEndian.Uint32(data[4:8])
+	h.ts_diff = binary.BigEndian.Uint32(data[8:12])
+	h.wnd = binary.BigEndian.Uint32(data[12:16])
+	h.seq_nr = binary.BigEndian.Uint16(data[16:18])
+	h.ack_nr = binary.BigEndian.Uint16(data[18:20])
+
+	ext := data[1]
+	offset := headerSize
+	for ext != 0 {
+		if offset+2 > len(data) {
+			return h, nil, fmt.Errorf("utp: truncated extension")
+		}
+		typ := ext
+		ext = data[offset]
+		length := int(data[offset+1])
+		offset += 2
+		if offset+length > len(data) {
+			return h, nil, fmt.Errorf("utp: truncated extension")
+		}
+		if typ == extSelectiveAck {
+			h.sack = data[offset : offset+length]
+		}
+		offset += length
+	}
+
+	return h, data[offset:], nil
+}
+
+func timestamp() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// seqLess compares sequence numbers taking wrap around into account.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,290 @@
+package utp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TickInterval = 50 * time.Millisecond
+	AcceptQueue  = 32
+	MaxPacket    = 64 * 1024
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket. It implements
+// net.Listener for incoming connections.
+type Socket struct {
+	conn net.PacketConn
+
+	mutex     sync.Mutex
+	conns     map[connKey]*Conn
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	ephemeral bool
+}
+
+// Listen opens a UDP socket for uTP on the given address.
+func Listen(network, address string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs uTP on top of an existing packet connection.
+func NewSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:   conn,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, AcceptQueue),
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Dial connects to address over a temporary socket that is closed together
+// with the connection.
+func Dial(network, address string, timeout time.Duration) (*Conn, error) {
+	s, err := Listen(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	s.ephemeral = true
+
+	conn, err := s.DialTimeout(address, timeout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socket) Dial(address string) (*Conn, error) {
+	return s.DialTimeout(address, 0)
+}
+
+func (s *Socket) DialTimeout(address string, timeout time.Duration) (*Conn, error) {
+	network := "udp"
+	if local, ok := s.conn.LocalAddr().(*net.UDPAddr); ok && local.IP != nil && !local.IP.IsUnspecified() {
+		if local.IP.To4() != nil {
+			network = "udp4"
+		} else {
+			network = "udp6"
+		}
+	}
+
+	remote, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	var recv_id uint16
+	for {
+		recv_id = uint16(rand.Intn(1 << 16))
+		_, taken := s.conns[connKey{remote.String(), recv_id}]
+		if !taken {
+			break
+		}
+	}
+	c := newConn(s, remote, recv_id, recv_id+1)
+	s.conns[connKey{remote.String(), recv_id}] = c
+	s.mutex.Unlock()
+
+	c.mutex.Lock()
+	c.state = stateSynSent
+	c.seq_nr = 1
+	c.queue(stSyn, nil)
+	c.mutex.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	select {
+	case <-c.connected:
+	case <-expired:
+		c.mutex.Lock()
+		c.fail(fmt.Errorf("utp: dial %s: timeout", address))
+		c.mutex.Unlock()
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close resets all open connections and closes the UDP socket.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.mutex.Lock()
+		conns := s.conns
+		s.conns = make(map[connKey]*Conn)
+		s.mutex.Unlock()
+
+		for _, c := range conns {
+			c.mutex.Lock()
+			if c.state != stateClosed {
+				c.sendPacket(header{typ: stReset, seq_nr: c.seq_nr, ack_nr: c.ack_nr}, nil)
+				c.fail(net.ErrClosed)
+			}
+			c.mutex.Unlock()
+		}
+
+		close(s.closed)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *Socket) write(data []byte, addr net.Addr) {
+	s.conn.WriteTo(data, addr)
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, MaxPacket)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(h, append([]byte{}, payload...), addr)
+	}
+}
+
+func (s *Socket) dispatch(h header, payload []byte, addr net.Addr) {
+	s.mutex.Lock()
+
+	if h.typ == stSyn {
+		s.handleSyn(h, addr)
+		s.mutex.Unlock()
+		return
+	}
+
+	c, ok := s.conns[connKey{addr.String(), h.conn_id}]
+	s.mutex.Unlock()
+
+	if ok {
+		c.handle(h, payload)
+		return
+	}
+
+	if h.typ != stReset {
+		reset := header{typ: stReset, conn_id: h.conn_id, ts: timestamp(), ack_nr: h.seq_nr}
+		s.write(reset.marshal(nil), addr)
+	}
+}
+
+// handleSyn accepts a new connection. It must be called with the mutex held.
+func (s *Socket) handleSyn(h header, addr net.Addr) {
+	key := connKey{addr.String(), h.conn_id + 1}
+	if c, ok := s.conns[key]; ok {
+		// Our reply got lost, so the peer sent the SYN again.
+		c.mutex.Lock()
+		c.sendAck()
+		c.mutex.Unlock()
+		return
+	}
+
+	c := newConn(s, addr, h.conn_id+1, h.conn_id)
+	c.state = stateConnected
+	c.seq_nr = uint16(rand.Intn(1 << 16))
+	c.ack_nr = h.seq_nr
+	c.peer_wnd = int(h.wnd)
+	c.reply_micro = timestamp() - h.ts
+	close(c.connected)
+
+	select {
+	case s.accept <- c:
+	default:
+		reset := header{typ: stReset, conn_id: h.conn_id, ts: timestamp(), ack_nr: h.seq_nr}
+		s.write(reset.marshal(nil), addr)
+		return
+	}
+
+	s.conns[key] = c
+	c.mutex.Lock()
+	c.sendAck()
+	c.mutex.Unlock()
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			conns := make(map[connKey]*Conn, len(s.conns))
+			for key, c := range s.conns {
+				conns[key] = c
+			}
+			s.mutex.Unlock()
+
+			for key, c := range conns {
+				if c.tick(now) {
+					s.mutex.Lock()
+					delete(s.conns, key)
+					s.mutex.Unlock()
+				}
+			}
+
+			s.mutex.Lock()
+			done := s.ephemeral && len(s.conns) == 0
+			s.mutex.Unlock()
+			if done {
+				s.Close()
+				return
+			}
+		}
+	}
+}
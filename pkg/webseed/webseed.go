@@ -0,0 +1,269 @@
+package webseed
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/ratelimit"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/rs/zerolog"
+)
+
+const (
+	RequestTimeout = 60 * time.Second
+	MinBackoff     = 5 * time.Second
+	MaxBackoff     = 10 * time.Minute
+)
+
+// span is the part of a single file that a piece covers.
+type span struct {
+	url    string
+	offset int
+	length int
+	whole  bool
+}
+
+// WebSeed downloads pieces from an HTTP mirror listed in the url-list of a
+// torrent as described in BEP 19. It takes work from the same queue as the
+// peers and behaves like a peer that has every piece.
+type WebSeed struct {
+	URL     string
+	Torrent *torrent.Torrent
+	Client  *http.Client
+	Logger  *zerolog.Logger
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Downloaded int
+
+	// Rates are the download limits the web seed shares with the peers.
+	Rates []*ratelimit.Pair
+
+	// OnHashFailed is called for every downloaded piece with a wrong hash.
+	OnHashFailed func(index int)
+
+	Work    *piece.Queue
+	Results chan *piece.Piece
+
+	backoff time.Duration
+	mutex   sync.Mutex
+	stop    chan struct{}
+}
+
+// New creates a web seed for seed_url. Only HTTP and HTTPS mirrors are
+// supported; FTP entries in the url-list are rejected.
+func New(seed_url string, t *torrent.Torrent, work *piece.Queue, results chan *piece.Piece, logger *zerolog.Logger) (*WebSeed, error) {
+	parsed, err := url.Parse(seed_url)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported web seed scheme %q", parsed.Scheme)
+	}
+
+	if logger == nil {
+		nop := zerolog.Nop()
+		logger = &nop
+	}
+
+	return &WebSeed{
+		URL:        seed_url,
+		Torrent:    t,
+		Client:     &http.Client{Timeout: RequestTimeout},
+		Logger:     logger,
+		MinBackoff: MinBackoff,
+		MaxBackoff: MaxBackoff,
+		Work:       work,
+		Results:    results,
+	}, nil
+}
+
+// fileURL builds the URL of a file. Multi-file torrents and URLs ending in a
+// slash get the torrent name and the file path appended.
+func (ws *WebSeed) fileURL(path []string) string {
+	base := ws.URL
+	if len(ws.Torrent.Info.Files) == 0 && !strings.HasSuffix(base, "/") {
+		return base
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	segments := []string{url.PathEscape(ws.Torrent.Info.Name)}
+	for _, segment := range path {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return base + strings.Join(segments, "/")
+}
+
+// spans maps the byte range of a piece onto the files of the torrent.
+func (ws *WebSeed) spans(index, length int) []span {
+	start := index * ws.Torrent.Info.PieceLength
+	end := start + length
+
+	if len(ws.Torrent.Info.Files) == 0 {
+		return []span{{
+			url:    ws.fileURL(nil),
+			offset: start,
+			length: length,
+			whole:  start == 0 && length == ws.Torrent.Info.Length,
+		}}
+	}
+
+	spans := []span{}
+	file_start := 0
+	for _, file := range ws.Torrent.Info.Files {
+		file_end := file_start + file.Length
+		if file_end > start && file_start < end {
+			offset := max(start, file_start) - file_start
+			size := min(end, file_end) - file_start - offset
+			spans = append(spans, span{
+				url:    ws.fileURL(file.Path),
+				offset: offset,
+				length: size,
+				whole:  offset == 0 && size == file.Length,
+			})
+		}
+		file_start = file_end
+	}
+	return spans
+}
+
+// retryError carries the delay a mirror asked for with Retry-After.
+type retryError struct {
+	status int
+	delay  time.Duration
+}
+
+func (err *retryError) Error() string {
+	return fmt.Sprintf("mirror returned %d, retry after %s", err.status, err.delay)
+}
+
+func (ws *WebSeed) fetch(s span, buf []byte) error {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.offset, s.offset+s.length-1))
+
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && s.whole:
+		// Servers may ignore the range when it covers the whole file.
+	case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests:
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			seconds = 0
+		}
+		return &retryError{status: resp.StatusCode, delay: time.Duration(seconds) * time.Second}
+	default:
+		return fmt.Errorf("unexpected status %s for %s", resp.Status, s.url)
+	}
+
+	_, err = io.ReadFull(resp.Body, buf)
+	for _, pair := range ws.Rates {
+		if pair != nil {
+			pair.Download.WaitN(len(buf))
+		}
+	}
+	return err
+}
+
+// DownloadPiece fetches all the file ranges of a piece and validates it.
+func (ws *WebSeed) DownloadPiece(p *piece.Piece) error {
+	offset := 0
+	for _, s := range ws.spans(p.Index, p.Length) {
+		err := ws.fetch(s, p.Data[offset:offset+s.length])
+		if err != nil {
+			return err
+		}
+		offset += s.length
+	}
+
+	if !p.Validate() {
+		if ws.OnHashFailed != nil {
+			ws.OnHashFailed(p.Index)
+		}
+		return fmt.Errorf("invalid piece #%d", p.Index)
+	}
+	return nil
+}
+
+// wait sleeps for the current backoff and doubles it. It returns false if the
+// web seed was stopped in the meantime.
+func (ws *WebSeed) wait(err error, stop <-chan struct{}) bool {
+	delay := ws.backoff
+	if retry, ok := err.(*retryError); ok && retry.delay > delay {
+		delay = retry.delay
+	}
+	ws.backoff = min(ws.backoff*2, ws.MaxBackoff)
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Start downloads pieces from the work queue in the background until Stop
+// is called. Failed pieces go back to the queue so peers can pick them up
+// while the web seed backs off. A stopped web seed can be started again.
+func (ws *WebSeed) Start() {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	if ws.stop == nil {
+		ws.stop = make(chan struct{})
+		go ws.run(ws.stop)
+	}
+}
+
+func (ws *WebSeed) run(stop <-chan struct{}) {
+	ws.backoff = ws.MinBackoff
+
+	for {
+		p, ok := ws.Work.Pop(nil, stop)
+		if !ok {
+			return
+		}
+
+		err := ws.DownloadPiece(p)
+		if err != nil {
+			ws.Logger.Debug().Msgf("[%s] Failed to download piece #%d: %s", ws.URL, p.Index, err)
+			ws.Work.Push(p)
+			if !ws.wait(err, stop) {
+				return
+			}
+			continue
+		}
+
+		ws.backoff = ws.MinBackoff
+		ws.Downloaded += p.Length
+		ws.Results <- p
+	}
+}
+
+func (ws *WebSeed) Stop() {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	if ws.stop != nil {
+		close(ws.stop)
+		ws.stop = nil
+	}
+}
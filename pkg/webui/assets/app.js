@@ -0,0 +1,300 @@
+"use strict";
+
+const POLL_INTERVAL = 2000;
+const PRIORITIES = ["skip", "low", "normal", "high"];
+
+let token = localStorage.getItem("p-torrent-token") || "";
+let selected = null;
+let timer = null;
+
+const $ = (id) => document.getElementById(id);
+
+// el creates an element. Text is always set as text, never as HTML, since
+// torrent and file names come from untrusted .torrent files.
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    if (key.startsWith("on")) {
+      node.addEventListener(key.slice(2), value);
+    } else {
+      node.setAttribute(key, value);
+    }
+  }
+  for (const child of children) {
+    node.append(child instanceof Node ? child : String(child));
+  }
+  return node;
+}
+
+function formatBytes(n) {
+  const units = ["B", "kB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1000 && i < units.length - 1) {
+    n /= 1000;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function formatRate(n) {
+  return formatBytes(Math.round(n)) + "/s";
+}
+
+function progressBar(fraction) {
+  const percent = (fraction * 100).toFixed(1) + "%";
+  return el("div", { class: "bar" }, el("div", { style: "width: " + percent }), el("span", {}, percent));
+}
+
+async function api(method, path, body, contentType) {
+  const headers = { Authorization: "Bearer " + token };
+  if (contentType) {
+    headers["Content-Type"] = contentType;
+  }
+
+  const resp = await fetch("api/" + path, { method, headers, body });
+  if (resp.status === 401) {
+    showLogin();
+    throw new Error("invalid token");
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+
+  const data = await resp.json();
+  if (!resp.ok) {
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+function showError(err) {
+  $("error").textContent = err ? String(err.message || err) : "";
+  $("error").hidden = !err;
+}
+
+function showLogin() {
+  clearTimeout(timer);
+  $("app").hidden = true;
+  $("login").hidden = false;
+  $("token").focus();
+}
+
+function showApp() {
+  $("login").hidden = true;
+  $("app").hidden = false;
+  refresh();
+}
+
+async function refresh() {
+  clearTimeout(timer);
+  try {
+    const [torrents, stats] = await Promise.all([api("GET", "torrents"), api("GET", "stats")]);
+    renderTorrents(torrents);
+    $("totals").textContent = stats.torrents + " torrents, " + stats.peers + " peers, " +
+      formatBytes(stats.downloaded) + " downloaded, " +
+      formatRate(stats.download_rate) + " down, " + formatRate(stats.upload_rate) + " up";
+    if (selected && torrents.some((t) => t.info_hash === selected)) {
+      await renderDetails(torrents.find((t) => t.info_hash === selected));
+    } else {
+      selected = null;
+      $("details").hidden = true;
+    }
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  if (!$("app").hidden) {
+    timer = setTimeout(refresh, POLL_INTERVAL);
+  }
+}
+
+function renderTorrents(torrents) {
+  const body = $("torrents").tBodies[0];
+  body.replaceChildren();
+
+  for (const t of torrents) {
+    const paused = t.state === "paused";
+    const actions = el("td", {},
+      el("button", { type: "button", onclick: (e) => control(e, t, paused ? "resume" : "pause") }, paused ? "Resume" : "Pause"),
+      " ",
+      el("button", { type: "button", onclick: (e) => remove(e, t) }, "Remove"));
+
+    const row = el("tr", { onclick: () => select(t.info_hash) },
+      el("td", {}, t.name),
+      el("td", {}, t.state),
+      el("td", {}, progressBar(t.progress)),
+      el("td", {}, formatBytes(t.wanted)),
+      el("td", {}, formatRate(t.download_rate)),
+      el("td", {}, formatRate(t.upload_rate)),
+      el("td", {}, t.peers),
+      actions);
+    if (t.info_hash === selected) {
+      row.classList.add("selected");
+    }
+    body.append(row);
+  }
+  $("empty").hidden = torrents.length > 0;
+}
+
+async function renderDetails(t) {
+  const path = "torrents/" + t.info_hash;
+  const [files, peers, trackers, pieces] = await Promise.all([
+    api("GET", path + "/files"),
+    api("GET", path + "/peers"),
+    api("GET", path + "/trackers"),
+    api("GET", path + "/pieces"),
+  ]);
+
+  $("details").hidden = false;
+  $("details-name").textContent = t.name;
+  drawPieces(pieces.pieces);
+
+  // Keep a priority menu the user is about to change.
+  const filesBody = $("files").tBodies[0];
+  if (!filesBody.contains(document.activeElement)) {
+    renderFiles(t, files);
+  }
+
+  $("peers").tBodies[0].replaceChildren(...peers.map((p) => {
+    const flags = [[p.incoming, "incoming"], [p.encrypted, "encrypted"], [p.utp, "uTP"], [p.choked, "choked"], [p.interested, "interested"]]
+      .filter(([set]) => set).map(([, name]) => name).join(", ");
+    return el("tr", {},
+      el("td", {}, p.address),
+      el("td", {}, p.client),
+      el("td", {}, formatRate(p.download_rate)),
+      el("td", {}, formatRate(p.upload_rate)),
+      el("td", {}, flags));
+  }));
+
+  $("trackers").tBodies[0].replaceChildren(...trackers.map((tr) =>
+    el("tr", {}, el("td", {}, tr.tier), el("td", {}, tr.url))));
+}
+
+function renderFiles(t, files) {
+  $("files").tBodies[0].replaceChildren(...files.map((f) => {
+    const priority = el("select", { onchange: (e) => setPriority(t, f.index, e.target.value) },
+      ...PRIORITIES.map((p) => el("option", { value: p }, p)));
+    priority.value = f.priority;
+    return el("tr", {},
+      el("td", {}, f.path),
+      el("td", {}, progressBar(f.length ? f.done / f.length : 1)),
+      el("td", {}, formatBytes(f.length)),
+      el("td", {}, priority));
+  }));
+}
+
+// drawPieces draws one column per piece, or the share of done pieces per
+// column when there are more pieces than pixels.
+function drawPieces(pieces) {
+  const canvas = $("pieces");
+  canvas.width = canvas.clientWidth;
+  const ctx = canvas.getContext("2d");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+  const columns = Math.min(canvas.width, pieces.length);
+  const width = canvas.width / columns;
+  for (let c = 0; c < columns; c++) {
+    const begin = Math.floor(c * pieces.length / columns);
+    const end = Math.max(begin + 1, Math.floor((c + 1) * pieces.length / columns));
+    let done = 0;
+    for (let i = begin; i < end; i++) {
+      done += pieces[i] === "1" ? 1 : 0;
+    }
+    ctx.fillStyle = "rgba(60, 141, 64, " + done / (end - begin) + ")";
+    ctx.fillRect(c * width, 0, Math.ceil(width), canvas.height);
+  }
+}
+
+function select(hash) {
+  selected = hash;
+  refresh();
+}
+
+async function control(event, t, action) {
+  event.stopPropagation();
+  try {
+    await api("POST", "torrents/" + t.info_hash + "/" + action);
+  } catch (err) {
+    showError(err);
+  }
+  refresh();
+}
+
+async function remove(event, t) {
+  event.stopPropagation();
+  if (!confirm("Remove " + t.name + "?")) {
+    return;
+  }
+  const deleteData = confirm("Also delete the downloaded files of " + t.name + "?");
+  try {
+    await api("DELETE", "torrents/" + t.info_hash + "?delete_data=" + deleteData);
+  } catch (err) {
+    showError(err);
+  }
+  refresh();
+}
+
+async function setPriority(t, index, priority) {
+  try {
+    await api("PUT", "torrents/" + t.info_hash + "/files/" + index, JSON.stringify({ priority }), "application/json");
+  } catch (err) {
+    showError(err);
+  }
+  refresh();
+}
+
+async function upload(files) {
+  for (const file of files) {
+    try {
+      await api("POST", "torrents", await file.arrayBuffer(), "application/x-bittorrent");
+    } catch (err) {
+      showError(file.name + ": " + err.message);
+    }
+  }
+  refresh();
+}
+
+$("login").addEventListener("submit", (e) => {
+  e.preventDefault();
+  token = $("token").value;
+  localStorage.setItem("p-torrent-token", token);
+  showApp();
+});
+
+$("logout").addEventListener("click", () => {
+  token = "";
+  localStorage.removeItem("p-torrent-token");
+  showLogin();
+});
+
+$("file-input").addEventListener("change", (e) => {
+  upload(e.target.files);
+  e.target.value = "";
+});
+
+// Drag and drop anywhere on the page adds the dropped .torrent files.
+let dragDepth = 0;
+document.addEventListener("dragenter", (e) => {
+  e.preventDefault();
+  dragDepth++;
+  $("drop").hidden = $("app").hidden;
+});
+document.addEventListener("dragleave", () => {
+  dragDepth = Math.max(0, dragDepth - 1);
+  $("drop").hidden = dragDepth > 0 ? $("drop").hidden : true;
+});
+document.addEventListener("dragover", (e) => e.preventDefault());
+document.addEventListener("drop", (e) => {
+  e.preventDefault();
+  dragDepth = 0;
+  $("drop").hidden = true;
+  if (!$("app").hidden) {
+    upload(e.dataTransfer.files);
+  }
+});
+
+if (token) {
+  showApp();
+} else {
+  showLogin();
+}
@@ -0,0 +1,21 @@
+package webui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed assets
+var assets embed.FS
+
+// Handler serves the web interface. It runs in the browser on top of the
+// API of the api package, which has to be served on the same address, and
+// asks for the API token on first use.
+func Handler() http.Handler {
+	root, err := fs.Sub(assets, "assets")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(root))
+}
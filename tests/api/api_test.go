@@ -0,0 +1,166 @@
+package api_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/api"
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/rs/zerolog"
+)
+
+const token = "secret"
+
+// seededTorrent returns the .torrent file of a single-file torrent that a
+// web seed serves.
+func seededTorrent(t *testing.T, name string) []byte {
+	content := make([]byte, 4*1024)
+	rand.Read(content)
+
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(seed.Close)
+
+	tor := &torrent.Torrent{
+		Info:    torrent.Info{Name: name, PieceLength: 1024, Length: len(content)},
+		URLList: []string{seed.URL},
+	}
+	for i := 0; i < len(content); i += 1024 {
+		tor.Info.Pieces = append(tor.Info.Pieces, sha1.Sum(content[i:i+1024]))
+	}
+
+	data, err := tor.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newAPI(t *testing.T) (*client.Session, *api.Client) {
+	logger := zerolog.Nop()
+	session := client.NewSession(&logger)
+	session.Port = 0
+	session.DownloadDir = t.TempDir()
+	t.Cleanup(session.Close)
+
+	server := httptest.NewServer(api.NewServer(session, token, &logger).Handler())
+	t.Cleanup(server.Close)
+	return session, api.NewClient(server.URL, token)
+}
+
+func waitTorrent(t *testing.T, c *api.Client, hash, state string) *api.Torrent {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := c.Torrent(hash)
+		if err == nil && info.State == state {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent is %s, %v; want %s", info.State, err, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	_, c := newAPI(t)
+
+	for _, wrong := range []string{"", "wrong"} {
+		c.Token = wrong
+		if _, err := c.Torrents(); err == nil {
+			t.Errorf("request with token %q succeeded", wrong)
+		}
+	}
+
+	c.Token = token
+	if _, err := c.Torrents(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	session, c := newAPI(t)
+
+	data := seededTorrent(t, "video")
+	added, err := c.Add(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.State != "paused" || added.Size != 4*1024 || len(added.InfoHash) != 40 {
+		t.Errorf("added torrent = %+v", added)
+	}
+	if _, err := c.Add(data, true); err == nil {
+		t.Error("adding a torrent twice succeeded")
+	}
+	if _, err := c.Add([]byte("d4:infoi1ee"), false); err == nil {
+		t.Error("adding a malformed torrent succeeded")
+	}
+
+	// Torrents can be addressed by a prefix of their info hash.
+	hash := added.InfoHash[:8]
+	if err := c.SetRates(hash, api.Rates{Download: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Resume(hash); err != nil {
+		t.Fatal(err)
+	}
+	done := waitTorrent(t, c, hash, "seeding")
+	if done.Progress != 1 || done.Downloaded != 4*1024 || done.Rates.Download != 1<<20 {
+		t.Errorf("completed torrent = %+v", done)
+	}
+	if done.DownloadRate <= 0 || done.UploadRate != 0 {
+		t.Errorf("measured rates = %v down, %v up; want some download", done.DownloadRate, done.UploadRate)
+	}
+
+	pieces, err := c.Pieces(hash)
+	if err != nil || pieces != "1111" {
+		t.Errorf("pieces = %q, %v; want 1111", pieces, err)
+	}
+
+	files, err := c.Files(hash)
+	if err != nil || len(files) != 1 || files[0].Done != 4*1024 || files[0].Priority != "normal" {
+		t.Errorf("files = %+v, %v", files, err)
+	}
+	if err := c.SetFilePriority(hash, 0, "high"); err != nil {
+		t.Error(err)
+	}
+	if err := c.SetFilePriority(hash, 1, "high"); err == nil {
+		t.Error("setting the priority of a missing file succeeded")
+	}
+
+	stats, err := c.Stats()
+	if err != nil || stats.Torrents != 1 || stats.States["seeding"] != 1 || stats.DownloadRate <= 0 {
+		t.Errorf("stats = %+v, %v", stats, err)
+	}
+
+	if err := c.Remove(hash, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Torrents()) != 0 {
+		t.Error("torrent still in the session after remove")
+	}
+	if _, err := c.Torrent(hash); err == nil {
+		t.Error("removed torrent still found")
+	}
+}
+
+func TestGlobalRates(t *testing.T) {
+	session, c := newAPI(t)
+
+	if err := c.SetGlobalRates(api.Rates{Download: 1000, Upload: 500}); err != nil {
+		t.Fatal(err)
+	}
+	if session.GlobalRates.Download.Rate() != 1000 || session.GlobalRates.Upload.Rate() != 500 {
+		t.Error("global rates were not applied")
+	}
+	if err := c.SetGlobalRates(api.Rates{Download: -1}); err == nil {
+		t.Error("negative rate accepted")
+	}
+}
@@ -0,0 +1,80 @@
+package client_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+)
+
+func TestEvents(t *testing.T) {
+	tor, content := seededTorrent(t, "video", 20*time.Millisecond)
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "video", time.Time{}, bytes.NewReader(make([]byte, len(content))))
+	}))
+	defer bad.Close()
+	tor.URLList = append(tor.URLList, bad.URL)
+
+	session := newSession(t, t.TempDir())
+	events, cancel := session.Subscribe()
+	defer cancel()
+
+	if _, err := session.Add(tor, false); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[client.EventType]int{}
+	var order []client.EventType
+	timeout := time.After(5 * time.Second)
+	for counts[client.EventTorrentFinished] == 0 {
+		select {
+		case event := <-events:
+			if event.InfoHash != tor.InfoHash {
+				t.Fatalf("event %s for torrent %x", event.Type, event.InfoHash[:4])
+			}
+			if event.Type == client.EventHashFailed && event.Peer != nil {
+				t.Errorf("hash failure from a web seed has peer %s", event.Peer)
+			}
+			counts[event.Type]++
+			order = append(order, event.Type)
+		case <-timeout:
+			t.Fatalf("no finished event, got %v", counts)
+		}
+	}
+
+	if order[0] != client.EventTorrentAdded || order[1] != client.EventMetadataReceived {
+		t.Errorf("first events are %s, %s", order[0], order[1])
+	}
+	for event_type, want := range map[client.EventType]int{
+		client.EventPieceVerified: 8,
+		client.EventHashFailed:    1,
+		client.EventFileCompleted: 1,
+	} {
+		if counts[event_type] != want {
+			t.Errorf("got %d %s events, want %d", counts[event_type], event_type, want)
+		}
+	}
+
+	// The file completes with its last piece, before the torrent finishes.
+	if order[len(order)-2] != client.EventFileCompleted {
+		t.Errorf("event before finishing is %s", order[len(order)-2])
+	}
+}
+
+func TestEventsCancel(t *testing.T) {
+	events, cancel := newClient(t).Subscribe()
+	cancel()
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("got an event after cancelling")
+		}
+	case <-time.After(time.Second):
+		t.Error("channel not closed after cancelling")
+	}
+}
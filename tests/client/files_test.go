@@ -0,0 +1,98 @@
+package client_test
+
+import (
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/rs/zerolog"
+)
+
+// newTorrent has three files spread over 6 pieces of 100 bytes:
+// a.mkv in #0-#2, b.nfo in #2 and extras/c.mkv in #2-#5.
+func newTorrent() *torrent.Torrent {
+	return &torrent.Torrent{Info: torrent.Info{
+		Name:        "movie",
+		PieceLength: 100,
+		Pieces:      make([][20]byte, 6),
+		Files: []torrent.File{
+			{Length: 250, Path: []string{"a.mkv"}},
+			{Length: 20, Path: []string{"b.nfo"}},
+			{Length: 280, Path: []string{"extras", "c.mkv"}},
+		},
+	}}
+}
+
+func newClient(t *testing.T) *client.Client {
+	logger := zerolog.Nop()
+	c := client.NewClient(newTorrent(), &logger)
+	c.Storage.Dir = t.TempDir()
+	return c
+}
+
+func TestMatchFiles(t *testing.T) {
+	files := newTorrent().Files()
+	tests := []struct {
+		selection string
+		want      []bool
+	}{
+		{"0", []bool{true, false, false}},
+		{"*.mkv", []bool{true, false, true}},
+		{"extras/*", []bool{false, false, true}},
+		{"1, c.mkv", []bool{false, true, true}},
+	}
+
+	for _, test := range tests {
+		got, err := client.MatchFiles(files, test.selection)
+		if err != nil {
+			t.Errorf("MatchFiles(%q): %s", test.selection, err)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("MatchFiles(%q) = %v; want %v", test.selection, got, test.want)
+				break
+			}
+		}
+	}
+
+	for _, selection := range []string{"", "3", "*.iso", "[", "-1"} {
+		if _, err := client.MatchFiles(files, selection); err == nil {
+			t.Errorf("MatchFiles(%q) succeeded", selection)
+		}
+	}
+}
+
+func TestFilePriorities(t *testing.T) {
+	c := newClient(t)
+
+	if err := c.SelectFiles("b.nfo"); err != nil {
+		t.Fatal(err)
+	}
+	if done, wanted := c.Progress(); done != 0 || wanted != 100 {
+		t.Errorf("Progress = %d/%d with only the boundary piece wanted; want 0/100", done, wanted)
+	}
+
+	if err := c.SetFilePriority(2, piece.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	want := []piece.Priority{piece.PrioritySkip, piece.PrioritySkip, piece.PriorityHigh, piece.PriorityHigh, piece.PriorityHigh, piece.PriorityHigh}
+	for i, priority := range want {
+		if got := c.Work.Priority(i); got != priority {
+			t.Errorf("piece #%d has priority %s; want %s", i, got, priority)
+		}
+	}
+	if done, wanted := c.Progress(); done != 0 || wanted != 350 {
+		t.Errorf("Progress = %d/%d; want 0/350", done, wanted)
+	}
+
+	got := c.FilePriorities()
+	if got[0] != piece.PrioritySkip || got[1] != piece.PriorityNormal || got[2] != piece.PriorityHigh {
+		t.Errorf("FilePriorities() = %v", got)
+	}
+
+	if err := c.SetFilePriority(3, piece.PriorityLow); err == nil {
+		t.Error("SetFilePriority() accepted an index out of range")
+	}
+}
@@ -0,0 +1,57 @@
+package client_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+)
+
+func TestMetrics(t *testing.T) {
+	tor, content := seededTorrent(t, "video", 20*time.Millisecond)
+
+	// A second web seed serves garbage, so one piece fails its hash before
+	// that seed backs off.
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "video", time.Time{}, bytes.NewReader(make([]byte, len(content))))
+	}))
+	defer bad.Close()
+	tor.URLList = append(tor.URLList, bad.URL)
+
+	session := newSession(t, t.TempDir())
+	if _, err := session.Add(tor, false); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateSeeding)
+
+	server := httptest.NewServer(session.MetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	labels := `{info_hash="` + hex.EncodeToString(tor.InfoHash[:]) + `",name="video"}`
+	for _, want := range []string{
+		`ptorrent_torrents{state="seeding"} 1`,
+		"ptorrent_downloaded_bytes_total" + labels + " 8192",
+		"ptorrent_left_bytes" + labels + " 0",
+		"ptorrent_pieces_completed" + labels + " 8",
+		"ptorrent_hash_failures_total" + labels + " 1",
+		"ptorrent_wasted_bytes_total" + labels + " 1024",
+		"ptorrent_disk_write_duration_seconds_count" + labels + " 8",
+		"# TYPE ptorrent_tracker_announce_duration_seconds histogram",
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
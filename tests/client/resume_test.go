@@ -0,0 +1,125 @@
+package client_test
+
+import (
+	"crypto/sha1"
+	"os"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+)
+
+// hashedTorrent gives a torrent its real info hash, which is what a saved
+// torrent gets back when it is loaded.
+func hashedTorrent(t *testing.T, tor *torrent.Torrent) *torrent.Torrent {
+	info_bytes, err := tor.InfoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.InfoHash = sha1.Sum(info_bytes)
+	return tor
+}
+
+func TestSessionRestore(t *testing.T) {
+	dir, state_dir := t.TempDir(), t.TempDir()
+	done, _ := seededTorrent(t, "done", 0)
+	hashedTorrent(t, done)
+	paused := hashedTorrent(t, newTorrent())
+
+	session := newSession(t, dir)
+	session.StateDir = state_dir
+	if err := session.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Add(done, false); err != nil {
+		t.Fatal(err)
+	}
+	c, err := session.Add(paused, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetFilePriority(1, piece.PrioritySkip)
+	c.SetSequential(true)
+	waitState(t, session, done.InfoHash, client.StateSeeding)
+	session.Close()
+
+	restored := newSession(t, dir)
+	restored.StateDir = state_dir
+	if err := restored.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	torrents := restored.Torrents()
+	if len(torrents) != 2 || torrents[0].Torrent.InfoHash != done.InfoHash || torrents[1].Torrent.InfoHash != paused.InfoHash {
+		t.Fatalf("restored %d torrents, want both in the order they were added", len(torrents))
+	}
+
+	// The complete torrent seeds again without downloading anything.
+	waitState(t, restored, done.InfoHash, client.StateSeeding)
+	if downloaded, _ := torrents[0].Transferred(); downloaded != done.GetLength() {
+		t.Errorf("Downloaded = %d; want %d", downloaded, done.GetLength())
+	}
+	for i := range done.Info.Pieces {
+		if !torrents[0].Storage.Have(i) {
+			t.Errorf("piece #%d was not restored", i)
+		}
+	}
+
+	waitState(t, restored, paused.InfoHash, client.StatePaused)
+	priorities := torrents[1].FilePriorities()
+	if priorities[0] != piece.PriorityNormal || priorities[1] != piece.PrioritySkip {
+		t.Errorf("priorities = %v; want [normal skip normal]", priorities)
+	}
+	if !torrents[1].Work.Sequential() {
+		t.Error("sequential mode was not restored")
+	}
+
+	// A removed torrent is not restored again.
+	restored.Remove(paused.InfoHash, false)
+	restored.Close()
+
+	again := newSession(t, dir)
+	again.StateDir = state_dir
+	if err := again.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Torrents()) != 1 {
+		t.Errorf("restored %d torrents after Remove, want 1", len(again.Torrents()))
+	}
+}
+
+func TestSessionRestoreMissingData(t *testing.T) {
+	dir, state_dir := t.TempDir(), t.TempDir()
+	tor, _ := seededTorrent(t, "video", 0)
+	hashedTorrent(t, tor)
+
+	session := newSession(t, dir)
+	session.StateDir = state_dir
+	session.Load()
+	c, err := session.Add(tor, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateSeeding)
+	session.Close()
+
+	if err := os.Remove(c.Storage.FilePath(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pieces whose data is gone are downloaded again.
+	restored := newSession(t, dir)
+	restored.StateDir = state_dir
+	if err := restored.Load(); err != nil {
+		t.Fatal(err)
+	}
+	restored_client := restored.Get(tor.InfoHash)
+	if restored_client == nil {
+		t.Fatal("torrent was not restored")
+	}
+	waitState(t, restored, tor.InfoHash, client.StateSeeding)
+	if _, err := os.Stat(restored_client.Storage.FilePath(0)); err != nil {
+		t.Errorf("data was not downloaded again: %s", err)
+	}
+}
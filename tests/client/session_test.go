@@ -0,0 +1,335 @@
+package client_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/rs/zerolog"
+)
+
+// seededTorrent returns a single-file torrent whose url-list points to a web
+// seed that serves it, waiting delay before each response.
+func seededTorrent(t *testing.T, name string, delay time.Duration) (*torrent.Torrent, []byte) {
+	content := make([]byte, 8*1024)
+	rand.Read(content)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	tor := &torrent.Torrent{
+		Info:    torrent.Info{Name: name, PieceLength: 1024, Length: len(content)},
+		URLList: []string{server.URL},
+	}
+	for i := 0; i < len(content); i += 1024 {
+		tor.Info.Pieces = append(tor.Info.Pieces, sha1.Sum(content[i:i+1024]))
+	}
+	tor.InfoHash = sha1.Sum([]byte(name))
+	return tor, content
+}
+
+func newSession(t *testing.T, dir string) *client.Session {
+	logger := zerolog.Nop()
+	session := client.NewSession(&logger)
+	session.Port = 0
+	session.DownloadDir = dir
+	t.Cleanup(session.Close)
+	return session
+}
+
+func waitState(t *testing.T, session *client.Session, info_hash [20]byte, want client.State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := session.State(info_hash)
+		if err == nil && state == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent %x is %s; want %s", info_hash[:4], state, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionQueue(t *testing.T) {
+	session := newSession(t, t.TempDir())
+	session.SetActiveDownloads(1)
+	session.SetActiveSeeds(1)
+
+	first, _ := seededTorrent(t, "first", 20*time.Millisecond)
+	second, content := seededTorrent(t, "second", time.Millisecond)
+	if _, err := session.Add(first, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Add(second, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Add(first, false); err == nil {
+		t.Error("adding a torrent twice succeeded")
+	}
+
+	waitState(t, session, first.InfoHash, client.StateDownloading)
+	waitState(t, session, second.InfoHash, client.StateQueued)
+
+	// Pausing the first torrent frees its slot for the second.
+	session.Pause(first.InfoHash)
+	waitState(t, session, second.InfoHash, client.StateDownloading)
+	waitState(t, session, second.InfoHash, client.StateSeeding)
+
+	// With the only seed slot taken, the first torrent completes and waits.
+	session.Resume(first.InfoHash)
+	session.Wait()
+	waitState(t, session, first.InfoHash, client.StateQueued)
+
+	data, err := os.ReadFile(session.Get(second.InfoHash).Storage.FilePath(0))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("second torrent was not stored correctly: %v", err)
+	}
+}
+
+func TestSessionRecheck(t *testing.T) {
+	dir := t.TempDir()
+	tor, content := seededTorrent(t, "video", 0)
+
+	if err := os.WriteFile(filepath.Join(dir, "video"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tor.URLList = nil
+
+	session := newSession(t, dir)
+	if _, err := session.Add(tor, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Recheck(tor.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StatePaused)
+
+	session.Resume(tor.InfoHash)
+	waitState(t, session, tor.InfoHash, client.StateSeeding)
+}
+
+func TestSessionRemove(t *testing.T) {
+	session := newSession(t, t.TempDir())
+	tor, _ := seededTorrent(t, "video", 0)
+
+	c, err := session.Add(tor, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateSeeding)
+
+	if err := session.Remove(tor.InfoHash, true); err != nil {
+		t.Fatal(err)
+	}
+	if session.Get(tor.InfoHash) != nil || len(session.Torrents()) != 0 {
+		t.Error("torrent still in the session after Remove")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(c.Storage.FilePath(0)); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("data was not deleted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func handshake(info_hash [20]byte) []byte {
+	msg := []byte(peer.BitTorrentProtocolHeader)
+	msg = append(msg, make([]byte, 8)...)
+	msg = append(msg, info_hash[:]...)
+	return append(msg, make([]byte, 20)...)
+}
+
+func TestSessionIncoming(t *testing.T) {
+	session := newSession(t, t.TempDir())
+	if err := session.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	addr := session.Listeners[0].Addr().String()
+
+	tor, _ := seededTorrent(t, "video", time.Second)
+	if _, err := session.Add(tor, false); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateDownloading)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(handshake(tor.InfoHash))
+
+	response := make([]byte, 68)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response[28:48], tor.InfoHash[:]) || !bytes.Equal(response[48:68], session.PeerID[:]) {
+		t.Error("handshake answered with the wrong info hash or peer ID")
+	}
+
+	unknown, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unknown.Close()
+	unknown.Write(handshake(sha1.Sum([]byte("unknown"))))
+
+	// The session hangs up without answering, which may surface as a reset.
+	unknown.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := unknown.Read(response); n != 0 || err == nil || os.IsTimeout(err) {
+		t.Errorf("connection for an unknown torrent got %d bytes, %v; want it closed", n, err)
+	}
+}
+
+func TestSessionWaitsForPeers(t *testing.T) {
+	session := newSession(t, t.TempDir())
+	if err := session.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	addr := session.Listeners[0].Addr().String()
+
+	// Without trackers and web seeds only incoming peers are left.
+	tor, _ := seededTorrent(t, "lonely", 0)
+	tor.URLList = nil
+	if _, err := session.Add(tor, false); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateDownloading)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(handshake(tor.InfoHash))
+
+	response := make([]byte, 68)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("incoming peer not accepted: %s", err)
+	}
+	if state, _ := session.State(tor.InfoHash); state != client.StateDownloading {
+		t.Errorf("torrent is %s; want it still downloading", state)
+	}
+}
+
+func TestSessionUploadSlots(t *testing.T) {
+	session := newSession(t, t.TempDir())
+
+	first, _ := seededTorrent(t, "first", 0)
+	c, err := session.Add(first, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UploadSlots() != client.DefaultUploadSlots {
+		t.Errorf("new torrent has %d upload slots; want %d", c.UploadSlots(), client.DefaultUploadSlots)
+	}
+
+	session.SetUploadSlots(2)
+	second, _ := seededTorrent(t, "second", 0)
+	added, err := session.Add(second, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UploadSlots() != 2 || added.UploadSlots() != 2 {
+		t.Errorf("upload slots are %d and %d; want 2 for both", c.UploadSlots(), added.UploadSlots())
+	}
+}
+
+// readPeerMessage reads the next message of a peer connection, skipping
+// keep-alives.
+func readPeerMessage(t *testing.T, conn net.Conn) peer.Message {
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg_len := make([]byte, 4)
+		if _, err := io.ReadFull(conn, msg_len); err != nil {
+			t.Fatalf("reading message len: %s", err)
+		}
+		msg_bytes := make([]byte, binary.BigEndian.Uint32(msg_len))
+		if _, err := io.ReadFull(conn, msg_bytes); err != nil {
+			t.Fatalf("reading message: %s", err)
+		}
+		if len(msg_bytes) > 0 {
+			return peer.DeserialiseMessage(msg_bytes)
+		}
+	}
+}
+
+// seedTo connects to a seeding session, asks for the first block of the
+// torrent and returns it.
+func seedTo(t *testing.T, addr string, info_hash [20]byte) []byte {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(handshake(info_hash))
+
+	response := make([]byte, 68)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readPeerMessage(t, conn); msg.ID != peer.MsgBitfield || msg.Payload[0] != 0xff {
+		t.Fatalf("got message %d %x after the handshake; want a full bitfield", msg.ID, msg.Payload)
+	}
+
+	interested := peer.Message{ID: peer.MsgInterested}
+	conn.Write(interested.Serialise())
+	for {
+		if readPeerMessage(t, conn).ID == peer.MsgUnChoke {
+			break
+		}
+	}
+
+	request := peer.Message{ID: peer.MsgRequest, Payload: make([]byte, 12)}
+	binary.BigEndian.PutUint32(request.Payload[8:12], 1024)
+	conn.Write(request.Serialise())
+	for {
+		msg := readPeerMessage(t, conn)
+		if msg.ID == peer.MsgPiece {
+			return msg.Payload[8:]
+		}
+	}
+}
+
+func TestSessionSeeding(t *testing.T) {
+	session := newSession(t, t.TempDir())
+	if err := session.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	tor, content := seededTorrent(t, "seeded", 0)
+	if _, err := session.Add(tor, false); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateSeeding)
+
+	block := seedTo(t, session.Listeners[0].Addr().String(), tor.InfoHash)
+	if !bytes.Equal(block, content[:1024]) {
+		t.Error("seeded block does not match the torrent")
+	}
+}
@@ -0,0 +1,138 @@
+package client_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+)
+
+func TestStats(t *testing.T) {
+	tor, _ := seededTorrent(t, "video", 0)
+	session := newSession(t, t.TempDir())
+	torrent_client, err := session.Add(tor, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := torrent_client.Stats()
+	if stats.Size != 8192 || stats.Wanted != 8192 || stats.Done != 0 || stats.Left != 8192 {
+		t.Errorf("before downloading: size %d, wanted %d, done %d, left %d", stats.Size, stats.Wanted, stats.Done, stats.Left)
+	}
+	if stats.ETA != -1 || stats.Active != 0 {
+		t.Errorf("before downloading: ETA %s, active %s", stats.ETA, stats.Active)
+	}
+
+	session.Resume(tor.InfoHash)
+	waitState(t, session, tor.InfoHash, client.StateSeeding)
+
+	stats = torrent_client.Stats()
+	if stats.Done != 8192 || stats.Left != 0 || stats.ETA != 0 {
+		t.Errorf("after downloading: done %d, left %d, ETA %s", stats.Done, stats.Left, stats.ETA)
+	}
+	if len(stats.Files) != 1 || stats.Files[0] != 8192 {
+		t.Errorf("file progress = %v", stats.Files)
+	}
+	for i, ok := range stats.Pieces {
+		if !ok {
+			t.Errorf("piece %d is missing", i)
+		}
+	}
+	if stats.Downloaded != 8192 || stats.Ratio != 0 || stats.Wasted != 0 {
+		t.Errorf("downloaded %d, ratio %v, wasted %d", stats.Downloaded, stats.Ratio, stats.Wasted)
+	}
+	if stats.DownloadRate <= 0 || stats.AverageDownloadRate <= 0 {
+		t.Errorf("rate %v, average %v", stats.DownloadRate, stats.AverageDownloadRate)
+	}
+
+	// The active time stops with the download.
+	time.Sleep(20 * time.Millisecond)
+	if active := torrent_client.Stats().Active; active != stats.Active || active <= 0 {
+		t.Errorf("active time went from %s to %s while seeding", stats.Active, active)
+	}
+}
+
+// TestStatsWhilePeersSendHaves runs Stats while the message loop of a peer
+// updates its bitfield, for the race detector to check.
+func TestStatsWhilePeersSendHaves(t *testing.T) {
+	session := newSession(t, t.TempDir())
+	if err := session.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	tor, _ := seededTorrent(t, "video", time.Second)
+	torrent_client, err := session.Add(tor, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateDownloading)
+
+	conn, err := net.Dial("tcp", session.Listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(handshake(tor.InfoHash))
+	if _, err := io.ReadFull(conn, make([]byte, 68)); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := range tor.Info.Pieces {
+			have := []byte{0, 0, 0, 5, byte(peer.MsgHave), 0, 0, 0, byte(i)}
+			if _, err := conn.Write(have); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := torrent_client.Stats()
+		torrent_client.Availability()
+		if stats.Seeders == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer counted as %d seeders, %d leechers; want a seeder", stats.Seeders, stats.Leechers)
+		}
+	}
+}
+
+func TestStatsUploaded(t *testing.T) {
+	session := newSession(t, t.TempDir())
+	if err := session.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	tor, _ := seededTorrent(t, "video", 0)
+	torrent_client, err := session.Add(tor, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, session, tor.InfoHash, client.StateSeeding)
+	seedTo(t, session.Listeners[0].Addr().String(), tor.InfoHash)
+
+	// The block is counted once it is written, which may be after the peer
+	// read it.
+	deadline := time.Now().Add(2 * time.Second)
+	stats := torrent_client.Stats()
+	for stats.Uploaded != 1024 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		stats = torrent_client.Stats()
+	}
+
+	if stats.Uploaded != 1024 || stats.Ratio != 0.125 {
+		t.Errorf("uploaded %d, ratio %v; want 1024 and 0.125", stats.Uploaded, stats.Ratio)
+	}
+	if stats.UploadRate <= 0 || stats.AverageUploadRate <= 0 {
+		t.Errorf("upload rate %v, average %v", stats.UploadRate, stats.AverageUploadRate)
+	}
+	if _, uploaded := torrent_client.Transferred(); uploaded != 1024 {
+		t.Errorf("Transferred reports %d bytes uploaded; want 1024", uploaded)
+	}
+}
@@ -0,0 +1,151 @@
+package client_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/DarkPhoenix42/p-torrent/pkg/webseed"
+	"github.com/rs/zerolog"
+)
+
+func TestReadahead(t *testing.T) {
+	c := newClient(t)
+	c.Readahead = 150
+
+	r, err := c.NewReader(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// extras/c.mkv starts in piece #2, the window covers two pieces.
+	want := []piece.Priority{piece.PriorityNormal, piece.PriorityNormal, piece.PriorityNow, piece.PriorityNow, piece.PriorityNormal, piece.PriorityNormal}
+	for i, priority := range want {
+		if got := c.Work.Priority(i); got != priority {
+			t.Errorf("piece #%d has priority %s while reading; want %s", i, got, priority)
+		}
+	}
+
+	r.Close()
+	for i := range want {
+		if got := c.Work.Priority(i); got != piece.PriorityNormal {
+			t.Errorf("piece #%d has priority %s after Close; want normal", i, got)
+		}
+	}
+
+	if _, err := r.Read(make([]byte, 10)); err != client.ErrReaderClosed {
+		t.Errorf("Read() after Close returned %v", err)
+	}
+}
+
+// startSeeded starts a download of a single file that a slow web seed
+// serves and returns the client and the file content.
+func startSeeded(t *testing.T) (*client.Client, []byte) {
+	content := make([]byte, 10*1024+300)
+	rand.Read(content)
+
+	tor := &torrent.Torrent{Info: torrent.Info{Name: "video.mp4", PieceLength: 1024, Length: len(content)}}
+	for i := 0; i < len(content); i += 1024 {
+		tor.Info.Pieces = append(tor.Info.Pieces, sha1.Sum(content[i:min(i+1024, len(content))]))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		http.ServeContent(w, req, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	logger := zerolog.Nop()
+	c := client.NewClient(tor, &logger)
+	c.Storage.Dir = t.TempDir()
+	c.Port = 0
+	c.SetSequential(true)
+
+	ws, err := webseed.New(server.URL, tor, c.Work, c.Results, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WebSeeds = []*webseed.WebSeed{ws}
+
+	// Let the download finish before the temporary directory is removed.
+	done := make(chan struct{})
+	go func() {
+		c.StartDownload()
+		close(done)
+	}()
+	t.Cleanup(func() { <-done })
+	return c, content
+}
+
+func TestReaderBlocksUntilPiecesArrive(t *testing.T) {
+	c, content := startSeeded(t)
+
+	r, err := c.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.Seek(-500, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail := make([]byte, 500)
+	if _, err := io.ReadFull(r, tail); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, content[len(content)-500:]) {
+		t.Error("tail of the file differs")
+	}
+
+	r.Seek(0, io.SeekStart)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("file read while downloading differs")
+	}
+}
+
+func TestHandlerRange(t *testing.T) {
+	c, content := startSeeded(t)
+	server := httptest.NewServer(c.Handler())
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/files/0/video.mp4", nil)
+	req.Header.Set("Range", "bytes=5000-5999")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %s; want 206", resp.Status)
+	}
+	if want := fmt.Sprintf("bytes 5000-5999/%d", len(content)); resp.Header.Get("Content-Range") != want {
+		t.Errorf("Content-Range = %q; want %q", resp.Header.Get("Content-Range"), want)
+	}
+	if !bytes.Equal(body, content[5000:6000]) {
+		t.Error("range differs from the file")
+	}
+
+	resp, err = http.Get(server.URL + "/files/7/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown file got status %s; want 404", resp.Status)
+	}
+}
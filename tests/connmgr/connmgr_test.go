@@ -0,0 +1,245 @@
+package connmgr_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/connmgr"
+)
+
+func addrs(n, port int) []net.Addr {
+	list := make([]net.Addr, n)
+	for i := range list {
+		list[i] = &net.TCPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: port}
+	}
+	return list
+}
+
+// dialer records dial attempts and holds them until released.
+type dialer struct {
+	mutex    sync.Mutex
+	attempts map[string]int
+	release  chan error
+	started  chan string
+}
+
+func newDialer() *dialer {
+	return &dialer{
+		attempts: make(map[string]int),
+		release:  make(chan error),
+		started:  make(chan string, 1000),
+	}
+}
+
+func (d *dialer) dial(addr net.Addr) error {
+	d.mutex.Lock()
+	d.attempts[addr.String()]++
+	d.mutex.Unlock()
+
+	d.started <- addr.String()
+	return <-d.release
+}
+
+func (d *dialer) waitStarted(t *testing.T, n int) []string {
+	started := []string{}
+	for i := 0; i < n; i++ {
+		select {
+		case addr := <-d.started:
+			started = append(started, addr)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of %d dials started", i, n)
+		}
+	}
+	return started
+}
+
+func (d *dialer) expectNoDial(t *testing.T) {
+	select {
+	case addr := <-d.started:
+		t.Fatalf("unexpected dial to %s", addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHalfOpenLimit(t *testing.T) {
+	d := newDialer()
+	limits := connmgr.NewLimits(50, 4)
+	m := connmgr.New(limits, nil, d.dial)
+	m.Add(addrs(200, 6881))
+
+	m.Fill()
+	d.waitStarted(t, 4)
+	d.expectNoDial(t)
+
+	if limits.HalfOpen() != 4 {
+		t.Errorf("HalfOpen() = %d; want 4", limits.HalfOpen())
+	}
+
+	d.release <- nil
+	waitFor(t, func() bool { return limits.Peers() == 1 })
+
+	m.Fill()
+	d.waitStarted(t, 1)
+	d.expectNoDial(t)
+}
+
+func TestMaxPeers(t *testing.T) {
+	d := newDialer()
+	limits := connmgr.NewLimits(3, 10)
+	m := connmgr.New(limits, nil, d.dial)
+	m.Add(addrs(10, 6881))
+
+	m.Fill()
+	started := d.waitStarted(t, 3)
+	d.expectNoDial(t)
+
+	for i := 0; i < 3; i++ {
+		d.release <- nil
+	}
+	waitFor(t, func() bool { return limits.Peers() == 3 })
+
+	m.Fill()
+	d.expectNoDial(t)
+
+	if m.Accept(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 50000}) {
+		t.Error("Accept() succeeded above the connection limit")
+	}
+
+	// A dead peer is replaced by another candidate.
+	dead, _ := net.ResolveTCPAddr("tcp", started[0])
+	m.Disconnected(dead)
+	m.Fill()
+	d.waitStarted(t, 1)
+}
+
+func TestSetMaxPeers(t *testing.T) {
+	d := newDialer()
+	limits := connmgr.NewLimits(2, 10)
+	m := connmgr.New(limits, nil, d.dial)
+	m.Add(addrs(10, 6881))
+
+	m.Fill()
+	d.waitStarted(t, 2)
+	d.expectNoDial(t)
+
+	// Raising the cap while dials are running lets more start.
+	limits.SetMaxPeers(4)
+	m.Fill()
+	d.waitStarted(t, 2)
+	d.expectNoDial(t)
+
+	for i := 0; i < 4; i++ {
+		d.release <- nil
+	}
+	waitFor(t, func() bool { return limits.Peers() == 4 })
+
+	limits.SetMaxPeers(3)
+	if m.Accept(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 50000}) {
+		t.Error("Accept() succeeded above the lowered connection limit")
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	d := newDialer()
+	global := connmgr.NewLimits(4, 0)
+	first := connmgr.New(connmgr.NewLimits(3, 0), global, d.dial)
+	second := connmgr.New(connmgr.NewLimits(3, 0), global, d.dial)
+	first.Add(addrs(10, 6881))
+	second.Add(addrs(10, 6882))
+
+	first.Fill()
+	d.waitStarted(t, 3)
+	second.Fill()
+	d.waitStarted(t, 1)
+	d.expectNoDial(t)
+
+	if global.HalfOpen() != 4 {
+		t.Errorf("global HalfOpen() = %d; want 4", global.HalfOpen())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var mutex sync.Mutex
+	clock := func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mutex.Lock()
+		now = now.Add(d)
+		mutex.Unlock()
+	}
+
+	d := newDialer()
+	limits := connmgr.NewLimits(10, 10)
+	m := connmgr.New(limits, nil, d.dial)
+	m.Now = clock
+	m.MinBackoff = time.Minute
+	m.MaxBackoff = 3 * time.Minute
+	m.MaxFailures = 4
+	m.Add(addrs(1, 6881))
+
+	delays := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute}
+	for i, delay := range delays {
+		m.Fill()
+		d.waitStarted(t, 1)
+		d.release <- errors.New("connection refused")
+		waitFor(t, func() bool { return limits.HalfOpen() == 0 })
+
+		advance(delay - time.Second)
+		m.Fill()
+		d.expectNoDial(t)
+
+		advance(time.Second)
+		if m.Len() != 1 {
+			t.Fatalf("attempt %d: Len() = %d; want 1", i+1, m.Len())
+		}
+	}
+
+	m.Fill()
+	d.waitStarted(t, 1)
+	d.release <- errors.New("connection refused")
+	waitFor(t, func() bool { return m.Len() == 0 })
+
+	if got := d.attempts[addrs(1, 6881)[0].String()]; got != 4 {
+		t.Errorf("got %d attempts; want 4", got)
+	}
+}
+
+func TestAcceptDuplicate(t *testing.T) {
+	d := newDialer()
+	m := connmgr.New(connmgr.NewLimits(10, 10), nil, d.dial)
+	addr := addrs(1, 6881)[0]
+	m.Add([]net.Addr{addr})
+
+	m.Fill()
+	d.waitStarted(t, 1)
+
+	if m.Accept(addr) {
+		t.Error("Accept() succeeded for an address being dialed")
+	}
+	d.release <- nil
+
+	incoming := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 50000}
+	if !m.Accept(incoming) {
+		t.Fatal("Accept() failed below the limit")
+	}
+	m.Disconnected(incoming)
+	waitFor(t, func() bool { return fmt.Sprint(m) == "1 connected, 0 dialing, 0 waiting" })
+}
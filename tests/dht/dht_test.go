@@ -0,0 +1,83 @@
+package dht_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/dht"
+)
+
+func newCluster(t *testing.T, size int) []*dht.DHT {
+	nodes := make([]*dht.DHT, size)
+	for i := range nodes {
+		bootstrap := []string{}
+		if i > 0 {
+			bootstrap = []string{nodes[0].Addr().String()}
+		}
+
+		d, err := dht.New(dht.Config{Address: "127.0.0.1:0", BootstrapNodes: bootstrap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Start()
+		t.Cleanup(func() { d.Close() })
+		nodes[i] = d
+	}
+
+	for _, d := range nodes[1:] {
+		if err := d.Bootstrap(); err != nil {
+			t.Fatalf("Bootstrap() got error: %v", err)
+		}
+	}
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := newCluster(t, 16)
+
+	for i, d := range nodes[1:] {
+		if d.Table.Len() < 2 {
+			t.Errorf("node %d knows %d nodes; want at least 2", i+1, d.Table.Len())
+		}
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newCluster(t, 16)
+
+	var info_hash [20]byte
+	copy(info_hash[:], "p-torrent-dht-test-1")
+
+	if _, err := nodes[3].Announce(info_hash, 6881); err != nil {
+		t.Fatalf("Announce() got error: %v", err)
+	}
+
+	peers, err := nodes[12].Peers(info_hash)
+	if err != nil {
+		t.Fatalf("Peers() got error: %v", err)
+	}
+
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("Peers() = %v; want [127.0.0.1:6881]", peers)
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	nodes := newCluster(t, 4)
+	state_file := filepath.Join(t.TempDir(), "dht.dat")
+
+	if err := nodes[1].SaveState(state_file); err != nil {
+		t.Fatalf("SaveState() got error: %v", err)
+	}
+
+	id, saved_nodes, err := dht.LoadState(state_file)
+	if err != nil {
+		t.Fatalf("LoadState() got error: %v", err)
+	}
+	if id != nodes[1].ID {
+		t.Errorf("LoadState() id = %x; want %x", id, nodes[1].ID)
+	}
+	if len(saved_nodes) != nodes[1].Table.Len() {
+		t.Errorf("LoadState() returned %d nodes; want %d", len(saved_nodes), nodes[1].Table.Len())
+	}
+}
@@ -0,0 +1,163 @@
+package lsd_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/lsd"
+)
+
+type packet struct {
+	data []byte
+	from net.Addr
+}
+
+// bus is an in-memory stand-in for a multicast group: every packet written by
+// one member is delivered to all members, including the sender.
+type bus struct {
+	mutex   sync.Mutex
+	members []*member
+}
+
+type member struct {
+	bus    *bus
+	addr   *net.UDPAddr
+	inbox  chan packet
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (b *bus) join(ip string) *member {
+	m := &member{
+		bus:    b,
+		addr:   &net.UDPAddr{IP: net.ParseIP(ip), Port: 6771},
+		inbox:  make(chan packet, 16),
+		closed: make(chan struct{}),
+	}
+	b.mutex.Lock()
+	b.members = append(b.members, m)
+	b.mutex.Unlock()
+	return m
+}
+
+func (m *member) ReadFrom(buf []byte) (int, net.Addr, error) {
+	select {
+	case p := <-m.inbox:
+		return copy(buf, p.data), p.from, nil
+	case <-m.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (m *member) WriteTo(data []byte, addr net.Addr) (int, error) {
+	m.bus.mutex.Lock()
+	defer m.bus.mutex.Unlock()
+	for _, other := range m.bus.members {
+		other.inbox <- packet{data: append([]byte{}, data...), from: m.addr}
+	}
+	return len(data), nil
+}
+
+func (m *member) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
+
+func TestDiscovery(t *testing.T) {
+	var info_hash [20]byte
+	copy(info_hash[:], "p-torrent-lsd-test-1")
+
+	lan := &bus{}
+	a := lsd.New(6881, nil)
+	a.AddConn(lan.join("192.168.1.10"), lsd.MulticastIPv4)
+	defer a.Close()
+	b := lsd.New(51413, nil)
+	b.AddConn(lan.join("192.168.1.20"), lsd.MulticastIPv4)
+	defer b.Close()
+
+	found := make(chan net.Addr, 4)
+	if err := a.Register(info_hash, false, func(addr net.Addr) { found <- addr }); err != nil {
+		t.Fatalf("Register() got error: %v", err)
+	}
+	if err := b.Register(info_hash, false, func(net.Addr) {}); err != nil {
+		t.Fatalf("Register() got error: %v", err)
+	}
+
+	select {
+	case addr := <-found:
+		if addr.String() != "192.168.1.20:51413" {
+			t.Errorf("found peer %s; want 192.168.1.20:51413", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no LAN peer found")
+	}
+
+	select {
+	case addr := <-found:
+		t.Errorf("found unexpected peer %s", addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDuplicateDelivery(t *testing.T) {
+	var info_hash [20]byte
+	copy(info_hash[:], "p-torrent-lsd-test-2")
+
+	// a listens on two interfaces of the same LAN, so it reads every
+	// announce of b twice.
+	lan := &bus{}
+	a := lsd.New(6881, nil)
+	a.AddConn(lan.join("192.168.1.10"), lsd.MulticastIPv4)
+	a.AddConn(lan.join("192.168.1.11"), lsd.MulticastIPv4)
+	defer a.Close()
+	b := lsd.New(51413, nil)
+	b.AddConn(lan.join("192.168.1.20"), lsd.MulticastIPv4)
+	defer b.Close()
+
+	found := make(chan net.Addr, 4)
+	if err := a.Register(info_hash, false, func(addr net.Addr) { found <- addr }); err != nil {
+		t.Fatalf("Register() got error: %v", err)
+	}
+	if err := b.Register(info_hash, false, func(net.Addr) {}); err != nil {
+		t.Fatalf("Register() got error: %v", err)
+	}
+
+	select {
+	case <-found:
+	case <-time.After(time.Second):
+		t.Fatal("no LAN peer found")
+	}
+
+	select {
+	case addr := <-found:
+		t.Errorf("found peer %s twice", addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRegisterPrivate(t *testing.T) {
+	s := lsd.New(6881, nil)
+	if err := s.Register([20]byte{}, true, func(net.Addr) {}); err == nil {
+		t.Error("Register() of a private torrent got no error")
+	}
+}
+
+func TestParseAnnounce(t *testing.T) {
+	var info_hash [20]byte
+	copy(info_hash[:], "p-torrent-lsd-test-2")
+
+	msg := lsd.Announce{Port: 6881, InfoHashes: [][20]byte{info_hash}, Cookie: "abc"}
+	out, err := lsd.ParseAnnounce(msg.Marshal(lsd.MulticastIPv6))
+	if err != nil {
+		t.Fatalf("ParseAnnounce() got error: %v", err)
+	}
+	if out.Port != 6881 || len(out.InfoHashes) != 1 || out.InfoHashes[0] != info_hash || out.Cookie != "abc" {
+		t.Errorf("ParseAnnounce() = %+v; want %+v", out, msg)
+	}
+
+	if _, err := lsd.ParseAnnounce([]byte("GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Error("ParseAnnounce() of a non BT-SEARCH message got no error")
+	}
+}
@@ -0,0 +1,44 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/metrics"
+)
+
+func TestWriter(t *testing.T) {
+	var counter metrics.Counter
+	counter.Add(3)
+	counter.Inc()
+
+	histogram := metrics.NewHistogram([]float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+
+	var buf bytes.Buffer
+	w := metrics.NewWriter(&buf)
+	w.Family("requests_total", "counter", "Requests.")
+	w.Sample("requests_total", float64(counter.Value()), metrics.Label{Name: "name", Value: "a \"b\"\n"})
+	w.Family("latency_seconds", "histogram", "Latency.")
+	w.Histogram("latency_seconds", histogram, metrics.Label{Name: "op", Value: "write"})
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{name="a \"b\"\n"} 4
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="write",le="0.1"} 1
+latency_seconds_bucket{op="write",le="1"} 2
+latency_seconds_bucket{op="write",le="+Inf"} 3
+latency_seconds_sum{op="write"} 2.55
+latency_seconds_count{op="write"} 3
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,106 @@
+package mse_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/mse"
+)
+
+var info_hash = []byte("p-torrent-mse-test-1")
+
+type acceptResult struct {
+	conn *mse.Conn
+	skey []byte
+	err  error
+}
+
+func handshake(t *testing.T, provide uint32, mode mse.Mode) (*mse.Conn, *mse.Conn, error, error) {
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	accepted := make(chan acceptResult, 1)
+	go func() {
+		conn, skey, err := mse.Accept(b, [][]byte{[]byte("some-other-infohash!"), info_hash}, mode.Select)
+		if err != nil {
+			b.Close()
+		}
+		accepted <- acceptResult{conn, skey, err}
+	}()
+
+	initiated, err := mse.Initiate(a, info_hash, provide)
+	if err != nil {
+		a.Close()
+	}
+	result := <-accepted
+
+	if result.err == nil && !bytes.Equal(result.skey, info_hash) {
+		t.Errorf("Accept() skey = %q; want %q", result.skey, info_hash)
+	}
+	return initiated, result.conn, err, result.err
+}
+
+func exchange(t *testing.T, a, b io.ReadWriter) {
+	msg := []byte("\x13BitTorrent protocol and some payload")
+
+	go a.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(b, got); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("a -> b got %q, %v; want %q", got, err, msg)
+	}
+
+	go b.Write(msg)
+	if _, err := io.ReadFull(a, got); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("b -> a got %q, %v; want %q", got, err, msg)
+	}
+}
+
+func TestHandshakeRC4(t *testing.T) {
+	a, b, err_a, err_b := handshake(t, mse.ModeEnabled.Provide(), mse.ModeEnabled)
+	if err_a != nil || err_b != nil {
+		t.Fatalf("handshake errors: %v, %v", err_a, err_b)
+	}
+	if a.Method != mse.CryptoRC4 || b.Method != mse.CryptoRC4 {
+		t.Errorf("methods = %d, %d; want RC4", a.Method, b.Method)
+	}
+	exchange(t, a, b)
+}
+
+func TestHandshakePlaintext(t *testing.T) {
+	a, b, err_a, err_b := handshake(t, mse.CryptoPlaintext, mse.ModeEnabled)
+	if err_a != nil || err_b != nil {
+		t.Fatalf("handshake errors: %v, %v", err_a, err_b)
+	}
+	if a.Method != mse.CryptoPlaintext || b.Method != mse.CryptoPlaintext {
+		t.Errorf("methods = %d, %d; want plaintext", a.Method, b.Method)
+	}
+	exchange(t, a, b)
+}
+
+func TestForcedRejectsPlaintext(t *testing.T) {
+	_, _, _, err_b := handshake(t, mse.CryptoPlaintext, mse.ModeForced)
+	if err_b == nil {
+		t.Error("Accept() in forced mode accepted a plaintext only peer")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	header := "\x13BitTorrent protocol"
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go a.Write([]byte(header + "rest"))
+
+	conn, plaintext, err := mse.Detect(b, header)
+	if err != nil || !plaintext {
+		t.Fatalf("Detect() = %v, %v; want plaintext", plaintext, err)
+	}
+
+	got := make([]byte, len(header)+4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != header+"rest" {
+		t.Errorf("Detect() conn replayed %q; want %q", got, header+"rest")
+	}
+}
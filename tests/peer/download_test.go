@@ -0,0 +1,128 @@
+package peer_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+)
+
+func writeMessage(t *testing.T, conn net.Conn, id peer.MsgType, payload []byte) {
+	msg := peer.Message{ID: id, Payload: payload}
+	if _, err := conn.Write(msg.Serialise()); err != nil {
+		t.Fatalf("writing message %d: %s", id, err)
+	}
+}
+
+func readMessage(t *testing.T, conn net.Conn) peer.Message {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	msg_len := make([]byte, 4)
+	if _, err := io.ReadFull(conn, msg_len); err != nil {
+		t.Fatalf("reading message len: %s", err)
+	}
+	msg_bytes := make([]byte, binary.BigEndian.Uint32(msg_len))
+	if _, err := io.ReadFull(conn, msg_bytes); err != nil {
+		t.Fatalf("reading message: %s", err)
+	}
+	return peer.DeserialiseMessage(msg_bytes)
+}
+
+func blockPayload(index, begin int, block []byte) []byte {
+	payload := make([]byte, 8, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	return append(payload, block...)
+}
+
+func readRequests(t *testing.T, conn net.Conn, n int) [][]byte {
+	requests := [][]byte{}
+	for len(requests) < n {
+		msg := readMessage(t, conn)
+		if msg.ID == peer.MsgRequest {
+			requests = append(requests, msg.Payload)
+		}
+	}
+	return requests
+}
+
+func TestParsePieceMessageBounds(t *testing.T) {
+	work := piece.NewPiece(3, 16, [20]byte{})
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"short", []byte{0, 0, 0, 3}},
+		{"wrong index", blockPayload(4, 0, make([]byte, 4))},
+		{"past end", blockPayload(3, 12, make([]byte, 8))},
+		{"begin past end", blockPayload(3, 1<<31, nil)},
+	}
+
+	for _, tt := range tests {
+		err := peer.ParsePieceMessage(peer.Message{ID: peer.MsgPiece, Payload: tt.payload}, work)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	err := peer.ParsePieceMessage(peer.Message{ID: peer.MsgPiece, Payload: blockPayload(3, 0, nil)}, nil)
+	if err == nil {
+		t.Error("expected an error without a piece in progress")
+	}
+
+	err = peer.ParsePieceMessage(peer.Message{ID: peer.MsgPiece, Payload: blockPayload(3, 8, []byte("abcdefgh"))}, work)
+	if err != nil || !bytes.Equal(work.Data[8:], []byte("abcdefgh")) {
+		t.Errorf("valid block: err %v, data %q", err, work.Data)
+	}
+}
+
+func TestLatePieceAfterReject(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	data := bytes.Repeat([]byte{0x5a}, 2*peer.BlockReqLength)
+	work := piece.NewQueue(1)
+	work.Push(&piece.Piece{Index: 0, Length: len(data), Hash: sha1.Sum(data)})
+	results := make(chan *piece.Piece, 1)
+
+	p := peer.NewIncomingPeer(local, work, results, 1)
+	defer p.Close()
+	p.Reserved[7] |= peer.ReservedFast
+	p.PeerReserved[7] |= peer.ReservedFast
+	go p.StartDownload()
+
+	writeMessage(t, remote, peer.MsgBitfield, []byte{0x80})
+	writeMessage(t, remote, peer.MsgUnChoke, nil)
+	requests := readRequests(t, remote, 2)
+
+	// Choked with the fast extension the requests stay pending, until the
+	// reject hands the piece back.
+	writeMessage(t, remote, peer.MsgChoke, nil)
+	writeMessage(t, remote, peer.MsgReject, requests[0])
+	writeMessage(t, remote, peer.MsgPiece, blockPayload(0, 0, data[:peer.BlockReqLength]))
+	writeMessage(t, remote, peer.MsgPiece, []byte{0, 0})
+
+	writeMessage(t, remote, peer.MsgUnChoke, nil)
+	for _, request := range readRequests(t, remote, 2) {
+		begin := int(binary.BigEndian.Uint32(request[4:8]))
+		length := int(binary.BigEndian.Uint32(request[8:12]))
+		writeMessage(t, remote, peer.MsgPiece, blockPayload(0, begin, data[begin:begin+length]))
+	}
+
+	select {
+	case done := <-results:
+		if done.Index != 0 || !bytes.Equal(done.Data, data) {
+			t.Errorf("got piece #%d with unexpected data", done.Index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the piece")
+	}
+}
@@ -0,0 +1,94 @@
+package peer_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+)
+
+type echoExtension struct {
+	received chan []byte
+}
+
+func (ext *echoExtension) Name() string {
+	return "p_echo"
+}
+
+func (ext *echoExtension) HandleMessage(p *peer.Peer, payload []byte) error {
+	ext.received <- payload
+	return nil
+}
+
+func (ext *echoExtension) HandleHandshake(p *peer.Peer, hs *peer.ExtendedHandshake) {
+	ext.received <- []byte(hs.Client)
+}
+
+func newPipePeers() (*peer.Peer, *peer.Peer) {
+	a_conn, b_conn := net.Pipe()
+	work := piece.NewQueue(8)
+	results := make(chan *piece.Piece, 1)
+	return peer.NewIncomingPeer(a_conn, work, results, 8), peer.NewIncomingPeer(b_conn, work, results, 8)
+}
+
+func receive(t *testing.T, ch chan []byte) []byte {
+	select {
+	case payload := <-ch:
+		return payload
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for extension message")
+		return nil
+	}
+}
+
+func TestExtendedHandshake(t *testing.T) {
+	a, b := newPipePeers()
+	defer a.Conn.Close()
+	defer b.Conn.Close()
+
+	ext := &echoExtension{received: make(chan []byte, 2)}
+
+	a.Extensions = peer.NewExtensionRegistry()
+	a.Extensions.ListenPort = 6881
+	a.Extensions.MetadataSize = 1234
+	a.Extensions.Register(&echoExtension{received: make(chan []byte, 2)})
+
+	b.Extensions = peer.NewExtensionRegistry()
+	b.Extensions.Register(ext)
+
+	go b.HandleIncoming()
+	go a.HandleIncoming()
+
+	if err := a.SendExtendedHandshake(); err != nil {
+		t.Fatalf("SendExtendedHandshake() got error: %v", err)
+	}
+	if client := string(receive(t, ext.received)); client != peer.ClientVersion {
+		t.Errorf("handshake client = %q; want %q", client, peer.ClientVersion)
+	}
+
+	hs := b.ExtendedHandshake()
+	if hs.Port != 6881 || hs.MetadataSize != 1234 || hs.M["p_echo"] != 1 {
+		t.Errorf("ExtendedHandshake() = %+v", hs)
+	}
+
+	if err := b.SendExtendedHandshake(); err != nil {
+		t.Fatalf("SendExtendedHandshake() got error: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !a.SupportsExtension("p_echo") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := a.SendExtended("p_echo", []byte("hello")); err != nil {
+		t.Fatalf("SendExtended() got error: %v", err)
+	}
+	if payload := string(receive(t, ext.received)); payload != "hello" {
+		t.Errorf("extension received %q; want %q", payload, "hello")
+	}
+
+	if err := a.SendExtended("ut_unknown", nil); err == nil {
+		t.Error("SendExtended() of an unsupported extension got no error")
+	}
+}
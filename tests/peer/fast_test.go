@@ -0,0 +1,30 @@
+package peer_test
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+)
+
+func TestGenerateAllowedFastSet(t *testing.T) {
+	info_hash := bytes.Repeat([]byte{0xaa}, 20)
+	addr := &net.TCPAddr{IP: net.IPv4(80, 4, 4, 200), Port: 6881}
+
+	tests := []struct {
+		k   int
+		out []int
+	}{
+		{7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+
+	for _, tt := range tests {
+		out := peer.GenerateAllowedFastSet(tt.k, 1313, info_hash, addr)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("GenerateAllowedFastSet(%d) = %v; want %v", tt.k, out, tt.out)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package peer_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/peer"
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+)
+
+func requestPayload(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return payload
+}
+
+func TestServeRequests(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	data := bytes.Repeat([]byte("block"), 1000)
+	p := peer.NewIncomingPeer(local, piece.NewQueue(2), make(chan *piece.Piece, 1), 2)
+	defer p.Close()
+	p.Reserved[7] |= peer.ReservedFast
+	p.PeerReserved[7] |= peer.ReservedFast
+	p.ReadPiece = func(index int) ([]byte, error) {
+		if index != 0 {
+			return nil, fmt.Errorf("piece #%d is missing", index)
+		}
+		return data, nil
+	}
+
+	interest := make(chan bool, 1)
+	p.OnInterest = func(p *peer.Peer) {
+		interest <- p.IsInterested()
+	}
+	var uploaded atomic.Int64
+	p.OnUploaded = func(p *peer.Peer, n int) {
+		uploaded.Add(int64(n))
+	}
+	go p.StartDownload()
+
+	// Requests are rejected while the peer is choked.
+	writeMessage(t, remote, peer.MsgRequest, requestPayload(0, 0, 100))
+	if msg := readMessage(t, remote); msg.ID != peer.MsgReject {
+		t.Fatalf("got message %d while choked; want a reject", msg.ID)
+	}
+
+	writeMessage(t, remote, peer.MsgInterested, nil)
+	select {
+	case interested := <-interest:
+		if !interested {
+			t.Fatal("peer is not interested after an interested message")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnInterest was not called")
+	}
+
+	go p.Unchoke()
+	if msg := readMessage(t, remote); msg.ID != peer.MsgUnChoke {
+		t.Fatalf("got message %d; want an unchoke", msg.ID)
+	}
+
+	writeMessage(t, remote, peer.MsgRequest, requestPayload(0, 100, 200))
+	msg := readMessage(t, remote)
+	if msg.ID != peer.MsgPiece || !bytes.Equal(msg.Payload, blockPayload(0, 100, data[100:300])) {
+		t.Fatalf("got message %d with %d bytes; want the requested block", msg.ID, len(msg.Payload))
+	}
+
+	// Blocks of missing pieces and beyond the end of a piece are rejected.
+	writeMessage(t, remote, peer.MsgRequest, requestPayload(1, 0, 100))
+	writeMessage(t, remote, peer.MsgRequest, requestPayload(0, len(data)-10, 100))
+	for i := 0; i < 2; i++ {
+		if msg := readMessage(t, remote); msg.ID != peer.MsgReject {
+			t.Errorf("got message %d for an invalid request; want a reject", msg.ID)
+		}
+	}
+
+	if uploaded.Load() != 200 {
+		t.Errorf("uploaded %d bytes; want 200", uploaded.Load())
+	}
+}
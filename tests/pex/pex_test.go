@@ -0,0 +1,56 @@
+package pex_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/pex"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	msg := &pex.Message{
+		Added: []pex.PeerInfo{
+			{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}, Flags: pex.FlagReachable},
+			{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}, Flags: pex.FlagSeed | pex.FlagUTP},
+		},
+		Dropped: []*net.TCPAddr{
+			{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 6882},
+		},
+	}
+
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() got error: %v", err)
+	}
+
+	out, err := pex.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal() got error: %v", err)
+	}
+
+	if !reflect.DeepEqual(out, msg) {
+		t.Errorf("Unmarshal(Marshal(msg)) = %+v; want %+v", out, msg)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	if _, err := pex.Unmarshal([]byte("d5:added5:abcdee")); err == nil {
+		t.Errorf("Unmarshal() of truncated peers got no error")
+	}
+}
+
+func TestStateDiff(t *testing.T) {
+	a := pex.PeerInfo{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 1}}
+	b := pex.PeerInfo{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 2}}
+
+	state := pex.NewState()
+	msg := state.Diff([]pex.PeerInfo{a, b})
+	if msg == nil || len(msg.Added) != 2 || len(msg.Dropped) != 0 {
+		t.Fatalf("first Diff() = %+v; want 2 added", msg)
+	}
+
+	if msg := state.Diff([]pex.PeerInfo{a}); msg != nil {
+		t.Errorf("Diff() within the interval = %+v; want nil", msg)
+	}
+}
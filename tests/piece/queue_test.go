@@ -0,0 +1,130 @@
+package piece_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+)
+
+func newQueue(n int) *piece.Queue {
+	queue := piece.NewQueue(n)
+	for i := 0; i < n; i++ {
+		queue.Push(&piece.Piece{Index: i, Length: 16})
+	}
+	return queue
+}
+
+func pop(t *testing.T, queue *piece.Queue, accept func(int) bool) int {
+	cancel := make(chan struct{})
+	time.AfterFunc(time.Second, func() { close(cancel) })
+
+	p, ok := queue.Pop(accept, cancel)
+	if !ok {
+		t.Fatal("Pop() timed out")
+	}
+	if len(p.Data) != p.Length {
+		t.Errorf("piece #%d has %d bytes of data; want %d", p.Index, len(p.Data), p.Length)
+	}
+	return p.Index
+}
+
+func TestPriorityOrder(t *testing.T) {
+	queue := newQueue(6)
+	queue.SetSequential(true)
+	queue.SetPriority(0, piece.PrioritySkip)
+	queue.SetPriority(1, piece.PriorityLow)
+	queue.SetPriority(4, piece.PriorityHigh)
+
+	want := []int{4, 2, 3, 5, 1}
+	for _, index := range want {
+		if got := pop(t, queue, nil); got != index {
+			t.Fatalf("Pop() = #%d; want #%d", got, index)
+		}
+	}
+
+	if queue.Len() != 0 {
+		t.Errorf("Len() = %d with only skipped pieces left; want 0", queue.Len())
+	}
+
+	queue.SetPriority(0, piece.PriorityNormal)
+	if got := pop(t, queue, nil); got != 0 {
+		t.Errorf("Pop() = #%d after unskipping; want #0", got)
+	}
+}
+
+func TestRandomOrder(t *testing.T) {
+	queue := newQueue(64)
+	queue.SetPriority(40, piece.PriorityNow)
+	queue.SetPriority(41, piece.PriorityNow)
+	queue.SetPriority(7, piece.PriorityNow)
+
+	// Pieces a reader waits for come first and in order.
+	for _, index := range []int{7, 40, 41} {
+		if got := pop(t, queue, nil); got != index {
+			t.Fatalf("Pop() = #%d; want #%d", got, index)
+		}
+	}
+
+	in_order := true
+	for i := 0; i < 61; i++ {
+		got := pop(t, queue, nil)
+		want := i
+		if i >= 7 {
+			want++
+		}
+		if i >= 39 {
+			want += 2
+		}
+		if got != want {
+			in_order = false
+		}
+	}
+	if in_order {
+		t.Error("random mode handed out all pieces in order")
+	}
+}
+
+func TestPopAccept(t *testing.T) {
+	queue := newQueue(4)
+	queue.SetSequential(true)
+	odd := func(index int) bool { return index%2 == 1 }
+
+	if got := pop(t, queue, odd); got != 1 {
+		t.Errorf("Pop(odd) = #%d; want #1", got)
+	}
+	if got := pop(t, queue, odd); got != 3 {
+		t.Errorf("Pop(odd) = #%d; want #3", got)
+	}
+}
+
+func TestPopWaitsForPush(t *testing.T) {
+	queue := piece.NewQueue(2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		queue.Push(&piece.Piece{Index: 1, Length: 16})
+	}()
+
+	if got := pop(t, queue, nil); got != 1 {
+		t.Errorf("Pop() = #%d; want #1", got)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, ok := queue.Pop(nil, cancel); ok {
+		t.Error("Pop() on an empty queue succeeded after cancel")
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, priority := range []piece.Priority{piece.PrioritySkip, piece.PriorityLow, piece.PriorityNormal, piece.PriorityHigh} {
+		parsed, err := piece.ParsePriority(priority.String())
+		if err != nil || parsed != priority {
+			t.Errorf("ParsePriority(%q) = %v, %v", priority.String(), parsed, err)
+		}
+	}
+
+	if _, err := piece.ParsePriority("urgent"); err == nil {
+		t.Error("ParsePriority(\"urgent\") succeeded")
+	}
+}
@@ -0,0 +1,177 @@
+package ratelimit_test
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/ratelimit"
+)
+
+// fakeClock advances time whenever a limiter sleeps.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Sleep(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func (clock *fakeClock) elapsed(start time.Time) time.Duration {
+	return clock.Now().Sub(start)
+}
+
+func newLimiter(clock *fakeClock, rate int) *ratelimit.Limiter {
+	limiter := ratelimit.New(rate)
+	limiter.Now = clock.Now
+	limiter.Sleep = clock.Sleep
+	return limiter
+}
+
+func near(got, want time.Duration) bool {
+	diff := got - want
+	return diff > -50*time.Millisecond && diff < 150*time.Millisecond
+}
+
+func TestRate(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	limiter := newLimiter(clock, 32*1024)
+
+	start := clock.Now()
+	for i := 0; i < 16; i++ {
+		limiter.WaitN(8 * 1024)
+	}
+
+	// The first 32 KiB pass as a burst, the remaining 96 KiB take 3 seconds.
+	if got := clock.elapsed(start); !near(got, 3*time.Second) {
+		t.Errorf("128 KiB at 32 KiB/s took %s; want 3s", got)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	limiter := newLimiter(clock, 0)
+
+	start := clock.Now()
+	limiter.WaitN(100 << 20)
+	if got := clock.elapsed(start); got != 0 {
+		t.Errorf("unlimited WaitN slept %s", got)
+	}
+
+	var nil_limiter *ratelimit.Limiter
+	nil_limiter.WaitN(100)
+	nil_limiter.SetRate(5)
+}
+
+func TestSetRate(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	limiter := newLimiter(clock, 16*1024)
+
+	limiter.WaitN(16 * 1024)
+	start := clock.Now()
+	limiter.WaitN(16 * 1024)
+	if got := clock.elapsed(start); !near(got, time.Second) {
+		t.Errorf("16 KiB at 16 KiB/s took %s; want 1s", got)
+	}
+
+	limiter.SetRate(64 * 1024)
+	if limiter.Rate() != 64*1024 {
+		t.Errorf("Rate() = %d; want %d", limiter.Rate(), 64*1024)
+	}
+
+	start = clock.Now()
+	limiter.WaitN(128 * 1024)
+	if got := clock.elapsed(start); !near(got, 2*time.Second) {
+		t.Errorf("128 KiB at 64 KiB/s took %s; want 2s", got)
+	}
+
+	limiter.SetRate(0)
+	start = clock.Now()
+	limiter.WaitN(1 << 20)
+	if got := clock.elapsed(start); got != 0 {
+		t.Errorf("WaitN after removing the limit slept %s", got)
+	}
+}
+
+func TestConnLimitsEveryLevel(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	peer := &ratelimit.Pair{Download: newLimiter(clock, 0), Upload: newLimiter(clock, 0)}
+	torrent := &ratelimit.Pair{Download: newLimiter(clock, 0), Upload: newLimiter(clock, 32*1024)}
+	global := &ratelimit.Pair{Download: newLimiter(clock, 16*1024), Upload: newLimiter(clock, 0)}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	limited := ratelimit.NewConn(a, peer, torrent, nil, global)
+	data := make([]byte, 96*1024)
+
+	start := clock.Now()
+	go io.ReadFull(b, make([]byte, len(data)))
+	if _, err := limited.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// The torrent upload limit applies: 32 KiB burst, then 2 seconds.
+	if got := clock.elapsed(start); !near(got, 2*time.Second) {
+		t.Errorf("write of 96 KiB took %s; want 2s", got)
+	}
+
+	start = clock.Now()
+	go b.Write(data[:48*1024])
+	if _, err := io.ReadFull(limited, make([]byte, 48*1024)); err != nil {
+		t.Fatal(err)
+	}
+	// The global download limit applies: 16 KiB burst, then 2 seconds.
+	if got := clock.elapsed(start); !near(got, 2*time.Second) {
+		t.Errorf("read of 48 KiB took %s; want 2s", got)
+	}
+}
+
+func TestMeter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	meter := ratelimit.NewMeter()
+	meter.Now = clock.Now
+
+	if rate := meter.Rate(); rate != 0 {
+		t.Errorf("Rate() before any bytes = %v; want 0", rate)
+	}
+
+	// 10 kB every second for 10 seconds.
+	for i := 0; i < 10; i++ {
+		meter.Add(10_000)
+		clock.Sleep(time.Second)
+	}
+	if rate := meter.Rate(); rate < 9_000 || rate > 11_000 {
+		t.Errorf("Rate() = %v; want about 10000", rate)
+	}
+	if total := meter.Total(); total != 100_000 {
+		t.Errorf("Total() = %d; want 100000", total)
+	}
+
+	// The rate drops to zero once nothing passes for the whole window.
+	clock.Sleep((ratelimit.MeterWindow + 1) * time.Second)
+	if rate := meter.Rate(); rate != 0 {
+		t.Errorf("Rate() after a pause = %v; want 0", rate)
+	}
+}
+
+func TestLimiterMeter(t *testing.T) {
+	limiter := ratelimit.New(0)
+	limiter.WaitN(1000)
+	limiter.WaitN(500)
+
+	if total := limiter.Meter.Total(); total != 1500 {
+		t.Errorf("Meter.Total() = %d; want 1500", total)
+	}
+}
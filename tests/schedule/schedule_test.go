@@ -0,0 +1,116 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/schedule"
+)
+
+var (
+	office = schedule.RuleConfig{
+		Days:         []string{"weekdays"},
+		Start:        "09:00",
+		End:          "18:00",
+		DownloadRate: 1 << 20,
+		UploadRate:   256 << 10,
+		UploadSlots:  2,
+	}
+	night = schedule.RuleConfig{
+		Days:           []string{"fri", "sat"},
+		Start:          "23:00",
+		End:            "02:00",
+		ActiveTorrents: 10,
+	}
+	defaults = schedule.Limits{UploadSlots: 4, ActiveTorrents: 3}
+)
+
+// at returns a time in October 2026. The 19th is a Monday.
+func at(day, hour, minute int) time.Time {
+	return time.Date(2026, time.October, day, hour, minute, 0, 0, time.Local)
+}
+
+func parse(t *testing.T, configs ...schedule.RuleConfig) []schedule.Rule {
+	rules, err := schedule.ParseRules(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestActive(t *testing.T) {
+	rules := parse(t, office, night)
+	office_limits := schedule.Limits{DownloadRate: 1 << 20, UploadRate: 256 << 10, UploadSlots: 2}
+	night_limits := schedule.Limits{ActiveTorrents: 10}
+
+	tests := []struct {
+		now  time.Time
+		want schedule.Limits
+	}{
+		{at(19, 8, 59), defaults},
+		{at(19, 9, 0), office_limits},
+		{at(21, 17, 59), office_limits},
+		{at(21, 18, 0), defaults},
+		{at(23, 12, 0), office_limits},
+		{at(23, 23, 30), night_limits},
+		{at(24, 1, 59), night_limits},
+		{at(24, 12, 0), defaults},
+		{at(25, 0, 30), night_limits},
+		{at(25, 23, 30), defaults},
+		{at(26, 1, 0), defaults},
+	}
+
+	for _, test := range tests {
+		s := schedule.New(defaults, rules, func(schedule.Limits) {})
+		s.Now = func() time.Time { return test.now }
+
+		if got := s.Active(); got != test.want {
+			t.Errorf("Active() at %s = %+v; want %+v", test.now.Format("Mon 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestUpdateAppliesChanges(t *testing.T) {
+	now := at(19, 8, 0)
+	applied := []schedule.Limits{}
+
+	s := schedule.New(defaults, parse(t, office), func(limits schedule.Limits) {
+		applied = append(applied, limits)
+	})
+	s.Now = func() time.Time { return now }
+
+	s.Update()
+	s.Update()
+	now = at(19, 10, 0)
+	s.Update()
+	now = at(19, 19, 0)
+	s.Update()
+
+	if len(applied) != 3 || applied[0] != defaults || applied[1].DownloadRate != 1<<20 || applied[2] != defaults {
+		t.Fatalf("applied %+v", applied)
+	}
+
+	// Changing the rules takes effect without waiting for the next check.
+	evening := office
+	evening.Start, evening.End = "18:30", "20:00"
+	s.SetRules(defaults, parse(t, evening))
+
+	if len(applied) != 4 || applied[3].DownloadRate != 1<<20 {
+		t.Fatalf("applied %+v after SetRules", applied)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []schedule.RuleConfig{
+		{Days: []string{"someday"}, Start: "09:00", End: "10:00"},
+		{Start: "9am", End: "10:00"},
+		{Start: "09:00", End: "24:30"},
+		{Start: "09:00", End: "09:00"},
+	}
+
+	for _, config := range bad {
+		if _, err := schedule.ParseRule(config); err == nil {
+			t.Errorf("ParseRule(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/storage"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+)
+
+const pieceLength = 100
+
+// newTorrent returns a torrent with files of the given lengths and random
+// content. Piece hashes are left out since storage does not check them.
+func newTorrent(lengths ...int) (*torrent.Torrent, []byte) {
+	tor := &torrent.Torrent{Info: torrent.Info{Name: "album", PieceLength: pieceLength}}
+
+	total := 0
+	for i, length := range lengths {
+		name := string(rune('a'+i)) + ".flac"
+		tor.Info.Files = append(tor.Info.Files, torrent.File{Length: length, Path: []string{"disc", name}})
+		total += length
+	}
+	tor.Info.Pieces = make([][20]byte, (total+pieceLength-1)/pieceLength)
+
+	content := make([]byte, total)
+	rand.Read(content)
+	return tor, content
+}
+
+func writeAll(t *testing.T, s *storage.Storage, tor *torrent.Torrent, content []byte) {
+	for i := range tor.Info.Pieces {
+		start := i * pieceLength
+		err := s.WritePiece(i, content[start:start+tor.PieceSize(i)])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkFile(t *testing.T, s *storage.Storage, tor *torrent.Torrent, index int, content []byte) {
+	offset := tor.FileOffset(index)
+	want := content[offset : offset+tor.Files()[index].Length]
+
+	got, err := os.ReadFile(s.FilePath(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("file %d differs from the torrent content", index)
+	}
+}
+
+func TestWriteAllFiles(t *testing.T) {
+	tor, content := newTorrent(150, 30, 220)
+	s := storage.New(tor, t.TempDir())
+	writeAll(t, s, tor, content)
+
+	for i := range tor.Files() {
+		checkFile(t, s, tor, i, content)
+	}
+	if filepath.Base(s.FilePath(1)) != "b.flac" || filepath.Base(filepath.Dir(filepath.Dir(s.FilePath(1)))) != "album" {
+		t.Errorf("FilePath(1) = %s", s.FilePath(1))
+	}
+
+	s.Close()
+	if _, err := os.Stat(s.PartsPath()); !os.IsNotExist(err) {
+		t.Error("parts file exists although every file was wanted")
+	}
+}
+
+func TestSkippedFile(t *testing.T) {
+	tor, content := newTorrent(150, 30, 220)
+	s := storage.New(tor, t.TempDir())
+	s.SetWanted(1, false)
+	writeAll(t, s, tor, content)
+
+	if _, err := os.Stat(s.FilePath(1)); !os.IsNotExist(err) {
+		t.Fatal("skipped file was created")
+	}
+	checkFile(t, s, tor, 0, content)
+	checkFile(t, s, tor, 2, content)
+
+	// Piece #1 covers the end of a, all of b and the start of c.
+	data, err := s.ReadPiece(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content[pieceLength:2*pieceLength]) {
+		t.Error("ReadPiece(1) differs from the torrent content")
+	}
+
+	s.Close()
+	if _, err := os.Stat(s.PartsPath()); err != nil {
+		t.Fatalf("parts file missing: %s", err)
+	}
+
+	// Wanting the file later moves its data out of the parts file.
+	if err := s.SetWanted(1, true); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, s, tor, 1, content)
+}
+
+func TestUnsafePaths(t *testing.T) {
+	tor, _ := newTorrent(10)
+	tor.Info.Files[0].Path = []string{"..", "..", "etc", "passwd"}
+	dir := t.TempDir()
+	s := storage.New(tor, dir)
+
+	rel, err := filepath.Rel(dir, s.FilePath(0))
+	if err != nil || rel != filepath.Join("album", "_", "_", "etc", "passwd") {
+		t.Errorf("FilePath(0) = %s", s.FilePath(0))
+	}
+}
@@ -0,0 +1,40 @@
+package torrent_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+)
+
+func TestMalformedAnnounceList(t *testing.T) {
+	data, err := bencode.Marshal(map[string]any{
+		"announce": "http://a.example/announce",
+		"announce-list": []any{
+			[]any{"http://a.example/announce", 42, ""},
+			"http://not-a-tier.example/announce",
+			[]any{},
+			[]any{"udp://b.example:80"},
+		},
+		"info": map[string]any{
+			"name":         "file",
+			"length":       16,
+			"piece length": 16,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err := torrent.NewTorrentFromBencode(data)
+	if err != nil {
+		t.Fatalf("NewTorrentFromBencode() got error: %v", err)
+	}
+	want := [][]string{{"http://a.example/announce"}, {"udp://b.example:80"}}
+	if !reflect.DeepEqual(tor.AnnounceList, want) {
+		t.Errorf("AnnounceList = %v; want %v", tor.AnnounceList, want)
+	}
+}
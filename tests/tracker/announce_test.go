@@ -0,0 +1,50 @@
+package tracker_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+	"github.com/DarkPhoenix42/p-torrent/pkg/tracker"
+)
+
+func TestAnnounceDualStack(t *testing.T) {
+	var ipv6_param string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ipv6_param = r.URL.Query().Get("ipv6")
+		body, _ := bencode.Marshal(map[string]any{
+			"interval":   900,
+			"complete":   12,
+			"incomplete": 3,
+			"peers":      "\x0a\x00\x00\x01\x1a\xe1",
+			"peers6":     "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2",
+		})
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	resp, err := tracker.Announce(server.URL+"/announce", tracker.AnnounceRequest{IPv6: net.ParseIP("2001:db8::2")})
+	if err != nil {
+		t.Fatalf("Announce() got error: %v", err)
+	}
+
+	if ipv6_param != "2001:db8::2" {
+		t.Errorf("ipv6 param = %q; want %q", ipv6_param, "2001:db8::2")
+	}
+
+	if resp.Seeders != 12 || resp.Leechers != 3 {
+		t.Errorf("swarm = %d seeders, %d leechers; want 12, 3", resp.Seeders, resp.Leechers)
+	}
+
+	want := []string{"10.0.0.1:6881", "[2001:db8::1]:6882"}
+	if len(resp.Peers) != len(want) {
+		t.Fatalf("Announce() returned %d peers; want %d", len(resp.Peers), len(want))
+	}
+	for i, addr := range resp.Peers {
+		if addr.String() != want[i] {
+			t.Errorf("peer %d = %s; want %s", i, addr, want[i])
+		}
+	}
+}
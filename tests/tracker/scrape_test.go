@@ -0,0 +1,70 @@
+package tracker_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+	"github.com/DarkPhoenix42/p-torrent/pkg/tracker"
+)
+
+var scrapeURLTests = []struct {
+	in  string
+	out string
+	ok  bool
+}{
+	{"http://example.com/announce", "http://example.com/scrape", true},
+	{"http://example.com/x/announce", "http://example.com/x/scrape", true},
+	{"http://example.com/announce.php", "http://example.com/scrape.php", true},
+	{"http://example.com/announce?passkey=abc", "http://example.com/scrape?passkey=abc", true},
+	{"http://example.com/a", "", false},
+	{"http://example.com/announce/x", "", false},
+}
+
+func TestScrapeURL(t *testing.T) {
+	for _, tt := range scrapeURLTests {
+		t.Run(tt.in, func(t *testing.T) {
+			out, err := tracker.ScrapeURL(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ScrapeURL(%s) error = %v; want ok = %v", tt.in, err, tt.ok)
+			}
+			if out != tt.out {
+				t.Errorf("ScrapeURL(%s) = %s; want %s", tt.in, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	var a, b [20]byte
+	copy(a[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(b[:], "bbbbbbbbbbbbbbbbbbbb")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+
+		files := map[string]any{}
+		for _, info_hash := range r.URL.Query()["info_hash"] {
+			files[info_hash] = map[string]any{"complete": 5, "incomplete": 3, "downloaded": 10}
+		}
+		body, _ := bencode.Marshal(map[string]any{"files": files})
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	results, err := tracker.Scrape(server.URL+"/announce", [][20]byte{a, b})
+	if err != nil {
+		t.Fatalf("Scrape() got error: %v", err)
+	}
+
+	want := tracker.ScrapeResult{Seeders: 5, Leechers: 3, Completed: 10}
+	for _, info_hash := range [][20]byte{a, b} {
+		if results[info_hash] != want {
+			t.Errorf("Scrape()[%x] = %+v; want %+v", info_hash, results[info_hash], want)
+		}
+	}
+}
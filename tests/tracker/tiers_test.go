@@ -0,0 +1,78 @@
+package tracker_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/bencode"
+	"github.com/DarkPhoenix42/p-torrent/pkg/tracker"
+)
+
+func newTrackerServer(t *testing.T, peers string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := bencode.Marshal(map[string]any{"interval": 1800, "peers": peers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(body)
+	}))
+}
+
+func newFailingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+}
+
+func TestTierListFailover(t *testing.T) {
+	down := newFailingServer()
+	defer down.Close()
+	up := newTrackerServer(t, "\x7f\x00\x00\x01\x1a\xe1")
+	defer up.Close()
+
+	tiers := tracker.NewTierList("", [][]string{{down.URL + "/announce"}, {up.URL + "/announce"}})
+	resp, announce_url, err := tiers.Announce(tracker.AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("Announce() got error: %v", err)
+	}
+	if announce_url != up.URL+"/announce" {
+		t.Errorf("Announce() used %s; want %s", announce_url, up.URL+"/announce")
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("Announce() peers = %v; want [127.0.0.1:6881]", resp.Peers)
+	}
+}
+
+func TestTierListPromote(t *testing.T) {
+	down := newFailingServer()
+	defer down.Close()
+	up := newTrackerServer(t, "")
+	defer up.Close()
+
+	tiers := tracker.NewTierList("", [][]string{{down.URL, up.URL}})
+	if _, _, err := tiers.Announce(tracker.AnnounceRequest{}); err != nil {
+		t.Fatalf("Announce() got error: %v", err)
+	}
+	if first := tiers.Tiers()[0][0]; first != up.URL {
+		t.Errorf("first tracker in tier = %s; want %s", first, up.URL)
+	}
+}
+
+func TestTierListAnnounceAll(t *testing.T) {
+	a := newTrackerServer(t, "\x7f\x00\x00\x01\x1a\xe1\x7f\x00\x00\x02\x1a\xe1")
+	defer a.Close()
+	b := newTrackerServer(t, "\x7f\x00\x00\x02\x1a\xe1\x7f\x00\x00\x03\x1a\xe1")
+	defer b.Close()
+	down := newFailingServer()
+	defer down.Close()
+
+	tiers := tracker.NewTierList("", [][]string{{a.URL}, {b.URL}, {down.URL}})
+	resp, err := tiers.AnnounceAll(tracker.AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("AnnounceAll() got error: %v", err)
+	}
+	if len(resp.Peers) != 3 {
+		t.Errorf("AnnounceAll() returned %d peers; want 3", len(resp.Peers))
+	}
+}
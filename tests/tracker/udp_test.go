@@ -0,0 +1,108 @@
+package tracker_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/tracker"
+)
+
+const fakeConnectionID = 0x1122334455667788
+
+// newUDPTracker starts a BEP 15 tracker that returns one peer for announces
+// and fixed counts for scrapes. It fails the test on malformed requests.
+func newUDPTracker(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			if n < 16 {
+				t.Errorf("request of %d bytes; want at least 16", n)
+				continue
+			}
+
+			connection_id := binary.BigEndian.Uint64(req[0:8])
+			action := binary.BigEndian.Uint32(req[8:12])
+			transaction_id := req[12:16]
+
+			var resp bytes.Buffer
+			binary.Write(&resp, binary.BigEndian, action)
+			resp.Write(transaction_id)
+
+			switch action {
+			case 0:
+				if connection_id != 0x41727101980 || n != 16 {
+					t.Errorf("connect request = %x", req)
+				}
+				binary.Write(&resp, binary.BigEndian, uint64(fakeConnectionID))
+			case 1:
+				if connection_id != fakeConnectionID || n != 98 {
+					t.Errorf("announce request = %x", req)
+				}
+				binary.Write(&resp, binary.BigEndian, uint32(900))
+				binary.Write(&resp, binary.BigEndian, uint32(3))
+				binary.Write(&resp, binary.BigEndian, uint32(12))
+				resp.WriteString("\x0a\x00\x00\x01\x1a\xe1")
+			case 2:
+				if connection_id != fakeConnectionID || (n-16)%20 != 0 {
+					t.Errorf("scrape request = %x", req)
+				}
+				for i := 16; i < n; i += 20 {
+					binary.Write(&resp, binary.BigEndian, uint32(5))
+					binary.Write(&resp, binary.BigEndian, uint32(10))
+					binary.Write(&resp, binary.BigEndian, uint32(3))
+				}
+			}
+			conn.WriteToUDP(resp.Bytes(), addr)
+		}
+	}()
+
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	resp, err := tracker.Announce(newUDPTracker(t), tracker.AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatalf("Announce() got error: %v", err)
+	}
+
+	if resp.Interval.Seconds() != 900 {
+		t.Errorf("interval = %v; want 900s", resp.Interval)
+	}
+	if resp.Seeders != 12 || resp.Leechers != 3 {
+		t.Errorf("swarm = %d seeders, %d leechers; want 12, 3", resp.Seeders, resp.Leechers)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("peers = %v; want [10.0.0.1:6881]", resp.Peers)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	var a, b [20]byte
+	copy(a[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(b[:], "bbbbbbbbbbbbbbbbbbbb")
+
+	results, err := tracker.Scrape(newUDPTracker(t), [][20]byte{a, b})
+	if err != nil {
+		t.Fatalf("Scrape() got error: %v", err)
+	}
+
+	want := tracker.ScrapeResult{Seeders: 5, Leechers: 3, Completed: 10}
+	for _, info_hash := range [][20]byte{a, b} {
+		if results[info_hash] != want {
+			t.Errorf("result of %x = %+v; want %+v", info_hash, results[info_hash], want)
+		}
+	}
+}
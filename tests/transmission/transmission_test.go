@@ -0,0 +1,238 @@
+package transmission_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/client"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/DarkPhoenix42/p-torrent/pkg/transmission"
+	"github.com/rs/zerolog"
+)
+
+// seededTorrent returns the .torrent file of a two-file torrent that a web
+// seed serves.
+func seededTorrent(t *testing.T) []byte {
+	content := make([]byte, 4*1024)
+	rand.Read(content)
+
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		offset := 0
+		if req.URL.Path == "/album/b.flac" {
+			offset = 1024
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content[offset:][:3*1024]))
+	}))
+	t.Cleanup(seed.Close)
+
+	tor := &torrent.Torrent{
+		Info: torrent.Info{Name: "album", PieceLength: 1024, Files: []torrent.File{
+			{Length: 1024, Path: []string{"a.flac"}},
+			{Length: 3 * 1024, Path: []string{"b.flac"}},
+		}},
+		URLList: []string{seed.URL + "/"},
+	}
+	for i := 0; i < len(content); i += 1024 {
+		tor.Info.Pieces = append(tor.Info.Pieces, sha1.Sum(content[i:i+1024]))
+	}
+
+	data, err := tor.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+type rpcClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func newServer(t *testing.T) (*client.Session, *transmission.Server, *rpcClient) {
+	logger := zerolog.Nop()
+	session := client.NewSession(&logger)
+	session.Port = 0
+	session.DownloadDir = t.TempDir()
+	t.Cleanup(session.Close)
+
+	server := transmission.NewServer(session, &logger)
+	http_server := httptest.NewServer(server.Handler())
+	t.Cleanup(http_server.Close)
+	return session, server, &rpcClient{t: t, url: http_server.URL + transmission.RPCPath}
+}
+
+func (c *rpcClient) post(body any) *http.Response {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", c.url, bytes.NewReader(data))
+	req.Header.Set(transmission.SessionIDHeader, c.sessionID)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// call does the session ID handshake when needed, like Transmission clients.
+func (c *rpcClient) call(method string, args map[string]any) (string, map[string]any) {
+	request := map[string]any{"method": method, "arguments": args, "tag": 7}
+
+	resp := c.post(request)
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		c.sessionID = resp.Header.Get(transmission.SessionIDHeader)
+		resp = c.post(request)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Result    string         `json:"result"`
+		Arguments map[string]any `json:"arguments"`
+		Tag       float64        `json:"tag"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		c.t.Fatalf("%s: %s", method, err)
+	}
+	if result.Tag != 7 {
+		c.t.Errorf("%s: tag = %v; want 7", method, result.Tag)
+	}
+	return result.Result, result.Arguments
+}
+
+func (c *rpcClient) torrent(id float64, fields ...string) map[string]any {
+	result, args := c.call("torrent-get", map[string]any{"ids": []any{id}, "fields": fields})
+	torrents, _ := args["torrents"].([]any)
+	if result != "success" || len(torrents) != 1 {
+		c.t.Fatalf("torrent-get: %s, %v", result, args)
+	}
+	return torrents[0].(map[string]any)
+}
+
+func TestSessionIDHandshake(t *testing.T) {
+	_, _, c := newServer(t)
+
+	resp := c.post(map[string]any{"method": "session-get"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get(transmission.SessionIDHeader) == "" {
+		t.Fatalf("request without session ID got %s", resp.Status)
+	}
+
+	result, args := c.call("session-get", nil)
+	if result != "success" || args["rpc-version"] != float64(transmission.RPCVersion) {
+		t.Errorf("session-get = %s, %v", result, args)
+	}
+
+	if result, _ := c.call("torrent-reannounce-everything", nil); result == "success" {
+		t.Error("unknown method succeeded")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	_, server, c := newServer(t)
+	server.Username, server.Password = "user", "pass"
+
+	resp := c.post(map[string]any{"method": "session-get"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without credentials got %s", resp.Status)
+	}
+}
+
+func TestTorrents(t *testing.T) {
+	session, _, c := newServer(t)
+	data := seededTorrent(t)
+	metainfo := base64.StdEncoding.EncodeToString(data)
+
+	result, args := c.call("torrent-add", map[string]any{
+		"metainfo":       metainfo,
+		"paused":         true,
+		"files-unwanted": []int{0},
+	})
+	added, _ := args["torrent-added"].(map[string]any)
+	if result != "success" || added == nil || added["name"] != "album" {
+		t.Fatalf("torrent-add = %s, %v", result, args)
+	}
+	id := added["id"].(float64)
+
+	_, args = c.call("torrent-add", map[string]any{"metainfo": metainfo})
+	if args["torrent-duplicate"] == nil {
+		t.Errorf("adding a torrent twice = %v; want torrent-duplicate", args)
+	}
+
+	got := c.torrent(id, "id", "status", "wanted")
+	if len(got) != 3 || got["status"] != float64(transmission.StatusStopped) {
+		t.Errorf("paused torrent = %v", got)
+	}
+	if wanted := got["wanted"].([]any); wanted[0] != float64(0) || wanted[1] != float64(1) {
+		t.Errorf("wanted = %v; want [0 1]", wanted)
+	}
+
+	// Hashes work as ids too.
+	if result, _ := c.call("torrent-start", map[string]any{"ids": added["hashString"]}); result != "success" {
+		t.Fatal(result)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.torrent(id, "status")["status"] != float64(transmission.StatusSeed) {
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent did not finish: %v", c.torrent(id))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	got = c.torrent(id)
+	if got["percentDone"] != float64(1) || got["leftUntilDone"] != float64(0) || got["sizeWhenDone"] != float64(3*1024) {
+		t.Errorf("finished torrent = %v", got)
+	}
+
+	if result, _ := c.call("torrent-stop", map[string]any{"ids": id}); result != "success" {
+		t.Fatal(result)
+	}
+	if state, _ := session.State(session.Torrents()[0].Torrent.InfoHash); state != client.StatePaused {
+		t.Errorf("stopped torrent is %s", state)
+	}
+
+	if result, _ := c.call("torrent-remove", map[string]any{"ids": []any{id}, "delete-local-data": true}); result != "success" {
+		t.Fatal(result)
+	}
+	_, args = c.call("torrent-get", map[string]any{"fields": []string{"id"}})
+	if torrents := args["torrents"].([]any); len(torrents) != 0 || len(session.Torrents()) != 0 {
+		t.Errorf("torrents after torrent-remove = %v", torrents)
+	}
+}
+
+func TestSessionSet(t *testing.T) {
+	session, _, c := newServer(t)
+	dir := t.TempDir()
+
+	result, _ := c.call("session-set", map[string]any{
+		"download-dir":             dir,
+		"speed-limit-down":         100,
+		"speed-limit-down-enabled": true,
+		"speed-limit-up":           50,
+		"download-queue-size":      2,
+	})
+	if result != "success" {
+		t.Fatal(result)
+	}
+
+	if session.GlobalRates.Download.Rate() != 100*1000 || session.GlobalRates.Upload.Rate() != 0 {
+		t.Errorf("rates = %d, %d; want 100000, 0", session.GlobalRates.Download.Rate(), session.GlobalRates.Upload.Rate())
+	}
+	if downloads, _ := session.ActiveLimits(); downloads != 2 {
+		t.Errorf("active downloads = %d; want 2", downloads)
+	}
+
+	_, args := c.call("session-get", nil)
+	if args["download-dir"] != dir || args["speed-limit-up"] != float64(50) || args["speed-limit-up-enabled"] != false {
+		t.Errorf("session-get after session-set = %v", args)
+	}
+}
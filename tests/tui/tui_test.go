@@ -0,0 +1,62 @@
+package tui_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/tui"
+)
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		got, want string
+	}{
+		{tui.FormatBytes(999), "999 B"},
+		{tui.FormatBytes(1500), "1.5 kB"},
+		{tui.FormatBytes(2_340_000_000), "2.3 GB"},
+		{tui.FormatRate(0), "unlimited"},
+		{tui.FormatRate(50_000), "50.0 kB/s"},
+		{tui.FormatETA(0, 0), "done"},
+		{tui.FormatETA(1000, 0), "-"},
+		{tui.FormatETA(90_000, 1000), "1m30s"},
+		{tui.Bar(0.5, 10), "#####-----"},
+		{tui.Bar(2, 4), "####"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got %q, want %q", tc.got, tc.want)
+		}
+	}
+}
+
+func TestPieceBar(t *testing.T) {
+	have := []bool{true, true, true, false, false, false, false, false}
+	availability := []int{0, 0, 0, 1, 2, 1, 0, 0}
+
+	got := tui.PieceBar(have, availability, 4)
+	if want := "█▓▒ "; got != want {
+		t.Errorf("PieceBar = %q, want %q", got, want)
+	}
+
+	// Every piece gets a character at most.
+	got = tui.PieceBar(have[:2], availability, 10)
+	if want := "██"; got != want {
+		t.Errorf("PieceBar = %q, want %q", got, want)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	buffer := tui.NewLogBuffer(3)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(buffer, "line %d\n", i)
+	}
+	fmt.Fprint(buffer, "partial")
+
+	want := []string{"line 3", "line 4"}
+	if got := buffer.Lines(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines(2) = %q, want %q", got, want)
+	}
+	if got := buffer.Lines(10); len(got) != 3 {
+		t.Errorf("Lines(10) = %q, want the last 3 lines", got)
+	}
+}
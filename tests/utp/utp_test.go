@@ -0,0 +1,139 @@
+package utp_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/utp"
+)
+
+// lossyConn drops every nth outgoing packet.
+type lossyConn struct {
+	net.PacketConn
+	n     int64
+	count atomic.Int64
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.count.Add(1)%c.n == 0 {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listen(t *testing.T, drop int64) *utp.Socket {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packet_conn net.PacketConn = conn
+	if drop > 0 {
+		packet_conn = &lossyConn{PacketConn: conn, n: drop}
+	}
+
+	socket := utp.NewSocket(packet_conn)
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+func connect(t *testing.T, server, client *utp.Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	dialed, err := client.DialTimeout(server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout() error = %v", err)
+	}
+	return dialed, <-accepted
+}
+
+func transfer(t *testing.T, from, to net.Conn, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	go func() {
+		if _, err := from.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	to.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got := make([]byte, size)
+	if _, err := io.ReadFull(to, got); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received data does not match")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	server, client := listen(t, 0), listen(t, 0)
+	dialed, accepted := connect(t, server, client)
+
+	transfer(t, dialed, accepted, 1<<20)
+	transfer(t, accepted, dialed, 1<<20)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	server, client := listen(t, 13), listen(t, 17)
+	dialed, accepted := connect(t, server, client)
+
+	transfer(t, dialed, accepted, 256*1024)
+	transfer(t, accepted, dialed, 256*1024)
+}
+
+func TestClose(t *testing.T) {
+	server, client := listen(t, 0), listen(t, 0)
+	dialed, accepted := connect(t, server, client)
+
+	msg := []byte("last words")
+	dialed.Write(msg)
+	dialed.Close()
+
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("ReadAll() = %q; want %q", got, msg)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	client := listen(t, 0)
+	_, err = client.DialTimeout(silent.LocalAddr().String(), 300*time.Millisecond)
+	if err == nil {
+		t.Error("DialTimeout() to a silent address succeeded")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	server, client := listen(t, 0), listen(t, 0)
+	dialed, _ := connect(t, server, client)
+
+	dialed.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := dialed.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read() error = %v; want timeout", err)
+	}
+}
@@ -0,0 +1,166 @@
+package webseed_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/piece"
+	"github.com/DarkPhoenix42/p-torrent/pkg/torrent"
+	"github.com/DarkPhoenix42/p-torrent/pkg/webseed"
+)
+
+const pieceLength = 1024
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+// newTorrent lays out the files below root the way a mirror would serve them
+// and returns a torrent describing them together with the concatenated data.
+func newTorrent(t *testing.T, root string, files map[string][]byte, order []string) (*torrent.Torrent, []byte) {
+	tor := &torrent.Torrent{Info: torrent.Info{Name: "release", PieceLength: pieceLength}}
+
+	var content []byte
+	for _, name := range order {
+		path := filepath.Join(root, "release", name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, files[name], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tor.Info.Files = append(tor.Info.Files, torrent.File{Length: len(files[name]), Path: []string{name}})
+		content = append(content, files[name]...)
+	}
+
+	for i := 0; i < len(content); i += pieceLength {
+		tor.Info.Pieces = append(tor.Info.Pieces, sha1.Sum(content[i:min(i+pieceLength, len(content))]))
+	}
+	return tor, content
+}
+
+func download(t *testing.T, ws *webseed.WebSeed, tor *torrent.Torrent) []byte {
+	for i := range tor.Info.Pieces {
+		ws.Work.Push(piece.NewPiece(i, tor.PieceSize(i), tor.Info.Pieces[i]))
+	}
+
+	ws.Start()
+	defer ws.Stop()
+
+	data := make([]byte, tor.GetLength())
+	timeout := time.After(10 * time.Second)
+	for range tor.Info.Pieces {
+		select {
+		case p := <-ws.Results:
+			copy(data[p.Index*pieceLength:], p.Data)
+		case <-timeout:
+			t.Fatal("timed out waiting for pieces")
+		}
+	}
+	return data
+}
+
+func TestMultiFileDownload(t *testing.T) {
+	root := t.TempDir()
+	files := map[string][]byte{
+		"a.iso":         randomBytes(2500),
+		"b with spaces": randomBytes(10),
+		"c.txt":         randomBytes(3000),
+	}
+	tor, content := newTorrent(t, root, files, []string{"a.iso", "b with spaces", "c.txt"})
+
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer server.Close()
+
+	work := piece.NewQueue(len(tor.Info.Pieces))
+	results := make(chan *piece.Piece, len(tor.Info.Pieces))
+	ws, err := webseed.New(server.URL, tor, work, results, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := download(t, ws, tor); !bytes.Equal(got, content) {
+		t.Error("downloaded data does not match")
+	}
+}
+
+func TestSingleFileDownload(t *testing.T) {
+	content := randomBytes(5000)
+	tor := &torrent.Torrent{Info: torrent.Info{Name: "image.img", PieceLength: pieceLength, Length: len(content)}}
+	for i := 0; i < len(content); i += pieceLength {
+		tor.Info.Pieces = append(tor.Info.Pieces, sha1.Sum(content[i:min(i+pieceLength, len(content))]))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mirror/image.img" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "image.img", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	work := piece.NewQueue(len(tor.Info.Pieces))
+	results := make(chan *piece.Piece, len(tor.Info.Pieces))
+	ws, err := webseed.New(server.URL+"/mirror/", tor, work, results, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := download(t, ws, tor); !bytes.Equal(got, content) {
+		t.Error("downloaded data does not match")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	root := t.TempDir()
+	tor, content := newTorrent(t, root, map[string][]byte{"data": randomBytes(4096)}, []string{"data"})
+
+	var requests atomic.Int32
+	files := http.FileServer(http.Dir(root))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			// Serve a corrupted piece, which must fail validation.
+			w.Header().Set("Content-Range", "bytes 0-1023/4096")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(make([]byte, pieceLength))
+		default:
+			files.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	work := piece.NewQueue(len(tor.Info.Pieces))
+	results := make(chan *piece.Piece, len(tor.Info.Pieces))
+	ws, err := webseed.New(server.URL, tor, work, results, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.MinBackoff = 10 * time.Millisecond
+
+	if got := download(t, ws, tor); !bytes.Equal(got, content) {
+		t.Error("downloaded data does not match")
+	}
+	if requests.Load() != int32(len(tor.Info.Pieces))+2 {
+		t.Errorf("got %d requests; want %d", requests.Load(), len(tor.Info.Pieces)+2)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	_, err := webseed.New("ftp://mirror.example.org/pub/", &torrent.Torrent{}, nil, nil, nil)
+	if err == nil {
+		t.Error("New() accepted an ftp web seed")
+	}
+}
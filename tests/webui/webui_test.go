@@ -0,0 +1,33 @@
+package webui_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DarkPhoenix42/p-torrent/pkg/webui"
+)
+
+func TestAssets(t *testing.T) {
+	server := httptest.NewServer(webui.Handler())
+	defer server.Close()
+
+	for path, want := range map[string]string{
+		"/":          `<script src="app.js">`,
+		"/app.js":    "function refresh",
+		"/style.css": ".bar",
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+			t.Errorf("GET %s = %s, missing %q", path, resp.Status, want)
+		}
+	}
+}